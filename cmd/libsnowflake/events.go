@@ -0,0 +1,69 @@
+package main
+
+import "sync"
+
+// The names of the events passed to the event callback.
+const (
+	eventRendezvousStarted = "rendezvous-started"
+	eventPeerConnected     = "peer-connected"
+	eventPeerLost          = "peer-lost"
+	eventBootstrapped      = "bootstrapped"
+	eventError             = "error"
+)
+
+// eventState is the snowflakeclient.EventSink of the client. It keeps what
+// snowflake_status reports, and passes the events on to the callback.
+type eventState struct {
+	lock         sync.Mutex
+	bootstrapped bool
+	snowflakes   int
+	// Called with each event; notify, unless testing.
+	notify func(event, detail string)
+}
+
+func (s *eventState) emit(event, detail string) {
+	if s.notify != nil {
+		s.notify(event, detail)
+	} else {
+		notify(event, detail)
+	}
+}
+
+func (s *eventState) OnRendezvousStarted(id string) {
+	s.emit(eventRendezvousStarted, id)
+}
+
+func (s *eventState) OnPeerConnected(id string) {
+	s.lock.Lock()
+	s.snowflakes++
+	s.lock.Unlock()
+	s.emit(eventPeerConnected, id)
+}
+
+func (s *eventState) OnPeerLost(id string) {
+	s.lock.Lock()
+	if s.snowflakes > 0 {
+		s.snowflakes--
+	}
+	s.lock.Unlock()
+	s.emit(eventPeerLost, id)
+}
+
+func (s *eventState) OnBootstrapped() {
+	s.lock.Lock()
+	s.bootstrapped = true
+	s.lock.Unlock()
+	s.emit(eventBootstrapped, "")
+}
+
+func (s *eventState) OnError(err error) {
+	s.emit(eventError, err.Error())
+}
+
+// status returns whether the client bootstrapped, and how many snowflakes
+// are connected.
+func (s *eventState) status() (bool, int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.bootstrapped, s.snowflakes
+}
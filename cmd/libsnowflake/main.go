@@ -0,0 +1,218 @@
+// A C library running the snowflake client, for frontends that are not
+// written in Go, such as the Qt desktop client. Build it with
+//
+//	go build -buildmode=c-shared -o libsnowflake.so ./cmd/libsnowflake
+//
+// which also writes libsnowflake.h. The functions are:
+//
+//	int snowflake_api_version(void);
+//	int snowflake_start(char *config);
+//	void snowflake_stop(void);
+//	char *snowflake_status(void);
+//	char *snowflake_last_error(void);
+//	void snowflake_free(char *s);
+//	void snowflake_set_event_callback(snowflake_event_cb cb, void *data);
+//
+// A process runs a single client. snowflake_start takes a JSON object with
+// the settings of Config and returns 0, or -1 after which
+// snowflake_last_error tells why. snowflake_status returns a JSON object
+// describing the client. The strings the library returns must be freed
+// with snowflake_free. The event callback is called from the threads of the
+// library, with the name of an event and its detail, a snowflake ID or an
+// error message, which are only valid during the call. It may still be
+// called shortly after it is replaced. It must not call snowflake_stop,
+// which waits for the threads calling it.
+//
+// Functions are only added to this surface, and their behavior only
+// extended, unless snowflake_api_version changes.
+package main
+
+/*
+#include <stdlib.h>
+
+typedef void (*snowflake_event_cb)(const char *event, const char *detail, void *data);
+
+static inline void snowflake_call_event(snowflake_event_cb cb, const char *event,
+		const char *detail, void *data) {
+	cb(event, detail, data);
+}
+*/
+import "C"
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"unsafe"
+
+	sf "0xacab.org/leap/bitmask-vpn/pkg/snowflake/lib"
+	"0xacab.org/leap/bitmask-vpn/pkg/snowflakeclient"
+)
+
+// apiVersion changes when the C functions change in an incompatible way.
+const apiVersion = 1
+
+// Config is the JSON object snowflake_start takes. Lists are
+// comma-separated, as for the flags of snowflake-client.
+type Config struct {
+	BrokerURL  string `json:"broker_url"`
+	Fronts     string `json:"fronts"`
+	ICEServers string `json:"ice_servers"`
+	AMPCache   string `json:"ampcache"`
+	Max        int    `json:"max"`
+	SocksAddr  string `json:"socks_addr"`
+	Min        int    `json:"min"`
+	Multiplex  bool   `json:"multiplex"`
+}
+
+// Status is the JSON object snowflake_status returns.
+type Status struct {
+	Running      bool   `json:"running"`
+	SocksAddr    string `json:"socks_addr,omitempty"`
+	NATType      string `json:"nat_type,omitempty"`
+	NATMapping   string `json:"nat_mapping,omitempty"`
+	NATFiltering string `json:"nat_filtering,omitempty"`
+	Network      string `json:"network,omitempty"`
+	Bootstrapped bool   `json:"bootstrapped"`
+	Snowflakes   int    `json:"snowflakes"`
+	LastError    string `json:"last_error,omitempty"`
+}
+
+var state struct {
+	sync.Mutex
+	client    *snowflakeclient.Client
+	events    *eventState
+	lastError string
+}
+
+// parseConfig reads the JSON config of snowflake_start.
+func parseConfig(s string) (snowflakeclient.Config, error) {
+	config := Config{Max: 1}
+	if err := json.Unmarshal([]byte(s), &config); err != nil {
+		return snowflakeclient.Config{}, err
+	}
+	return snowflakeclient.Config{
+		Dialer: snowflakeclient.DialerConfig{
+			BrokerURL:     config.BrokerURL,
+			Fronts:        config.Fronts,
+			ICEServers:    config.ICEServers,
+			AMPCache:      config.AMPCache,
+			Max:           config.Max,
+			ParallelDials: 1,
+			IdleTimeout:   sf.SnowflakeTimeout,
+			Retry:         sf.RetryPolicy{Backoff: sf.DefaultBackoff},
+		},
+		SocksAddr: config.SocksAddr,
+		Min:       config.Min,
+		Multiplex: config.Multiplex,
+	}, nil
+}
+
+//export snowflake_api_version
+func snowflake_api_version() C.int {
+	return apiVersion
+}
+
+//export snowflake_start
+func snowflake_start(config *C.char) C.int {
+	state.Lock()
+	defer state.Unlock()
+	err := start(C.GoString(config))
+	if err != nil {
+		state.lastError = err.Error()
+		return -1
+	}
+	state.lastError = ""
+	return 0
+}
+
+// start starts the client with the JSON config. state must be locked.
+func start(config string) error {
+	if state.client != nil {
+		return errors.New("snowflake is already running")
+	}
+	cfg, err := parseConfig(config)
+	if err != nil {
+		return err
+	}
+	events := &eventState{}
+	cfg.Events = events
+	client, err := snowflakeclient.Start(cfg)
+	if err != nil {
+		return err
+	}
+	state.client, state.events = client, events
+	return nil
+}
+
+//export snowflake_stop
+func snowflake_stop() {
+	state.Lock()
+	client := state.client
+	state.client, state.events = nil, nil
+	state.Unlock()
+	if client != nil {
+		client.Stop()
+	}
+}
+
+//export snowflake_status
+func snowflake_status() *C.char {
+	state.Lock()
+	status := Status{LastError: state.lastError}
+	if state.client != nil {
+		status.Running = true
+		status.SocksAddr = state.client.SocksAddr().String()
+		status.NATType = state.client.NATType()
+		behavior := state.client.NATBehavior()
+		status.NATMapping = behavior.Mapping.String()
+		status.NATFiltering = behavior.Filtering.String()
+		status.Network = string(state.client.Diagnosis())
+		status.Bootstrapped, status.Snowflakes = state.events.status()
+	}
+	state.Unlock()
+	b, _ := json.Marshal(status)
+	return C.CString(string(b))
+}
+
+//export snowflake_last_error
+func snowflake_last_error() *C.char {
+	state.Lock()
+	defer state.Unlock()
+	return C.CString(state.lastError)
+}
+
+//export snowflake_free
+func snowflake_free(s *C.char) {
+	C.free(unsafe.Pointer(s))
+}
+
+var callback struct {
+	sync.Mutex
+	cb   C.snowflake_event_cb
+	data unsafe.Pointer
+}
+
+//export snowflake_set_event_callback
+func snowflake_set_event_callback(cb C.snowflake_event_cb, data unsafe.Pointer) {
+	callback.Lock()
+	defer callback.Unlock()
+	callback.cb, callback.data = cb, data
+}
+
+// notify calls the event callback, if one is set. The callback is called
+// without holding the lock, so that it may set another one.
+func notify(event, detail string) {
+	callback.Lock()
+	cb, data := callback.cb, callback.data
+	callback.Unlock()
+	if cb == nil {
+		return
+	}
+	cEvent, cDetail := C.CString(event), C.CString(detail)
+	defer C.free(unsafe.Pointer(cEvent))
+	defer C.free(unsafe.Pointer(cDetail))
+	C.snowflake_call_event(cb, cEvent, cDetail, data)
+}
+
+func main() {}
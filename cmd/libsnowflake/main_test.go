@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := parseConfig(`{"broker_url": "https://broker.example/", "min": 2}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Dialer.BrokerURL != "https://broker.example/" || cfg.Min != 2 {
+		t.Errorf("settings not read: %+v", cfg)
+	}
+	if cfg.Dialer.Max != 1 {
+		t.Errorf("max defaults to %d", cfg.Dialer.Max)
+	}
+	if _, err := parseConfig(`{"max": "many"}`); err == nil {
+		t.Error("expected an error for a wrong type")
+	}
+}
+
+func TestEventState(t *testing.T) {
+	var events []string
+	s := &eventState{notify: func(event, detail string) {
+		events = append(events, event+" "+detail)
+	}}
+	s.OnRendezvousStarted("a")
+	s.OnPeerConnected("a")
+	s.OnBootstrapped()
+	s.OnPeerConnected("b")
+	s.OnPeerLost("a")
+	s.OnError(errors.New("no proxies"))
+
+	expected := []string{
+		"rendezvous-started a",
+		"peer-connected a",
+		"bootstrapped ",
+		"peer-connected b",
+		"peer-lost a",
+		"error no proxies",
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("got events %q, expected %q", events, expected)
+	}
+	if bootstrapped, snowflakes := s.status(); !bootstrapped || snowflakes != 1 {
+		t.Errorf("status %v %d", bootstrapped, snowflakes)
+	}
+}
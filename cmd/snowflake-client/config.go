@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// fileConfig holds the settings loaded with -config. Keys are the names of
+// command-line flags other than -config and values are in the form the flag
+// would accept; lists, such as the ICE servers, are joined with commas.
+type fileConfig map[string]string
+
+// loadConfigFile reads a TOML or JSON config file. The format is chosen by
+// the file extension; anything that is not .json is parsed as TOML.
+func loadConfigFile(path string) (fileConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := make(fileConfig)
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		err = parseJSON(data, cfg)
+	} else {
+		err = parseTOML(string(data), cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// parseJSON reads a JSON object whose members are strings, numbers,
+// booleans or arrays of strings.
+func parseJSON(data []byte, cfg fileConfig) error {
+	var obj map[string]interface{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return err
+	}
+	for key, value := range obj {
+		switch v := value.(type) {
+		case string:
+			cfg[key] = v
+		case bool, float64:
+			cfg[key] = fmt.Sprint(v)
+		case []interface{}:
+			list := make([]string, len(v))
+			for i, elem := range v {
+				s, ok := elem.(string)
+				if !ok {
+					return fmt.Errorf("%s: arrays may only contain strings", key)
+				}
+				list[i] = s
+			}
+			cfg[key] = strings.Join(list, ",")
+		default:
+			return fmt.Errorf("%s: unsupported value %v", key, value)
+		}
+	}
+	return nil
+}
+
+// parseTOML understands the flat subset of TOML needed for the client
+// config: comments, and key = value pairs where value is a string, number,
+// boolean or an array of strings. Arrays may span several lines.
+func parseTOML(data string, cfg fileConfig) error {
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return fmt.Errorf("line %d: expected key = value", lineno)
+		}
+		key := strings.Trim(strings.TrimSpace(line[:eq]), `"`)
+		value := strings.TrimSpace(line[eq+1:])
+		// Gather the remaining lines of a multi-line array.
+		for strings.HasPrefix(value, "[") && !strings.HasSuffix(value, "]") {
+			if !scanner.Scan() {
+				return fmt.Errorf("line %d: unterminated array", lineno)
+			}
+			lineno++
+			value += " " + strings.TrimSpace(stripComment(scanner.Text()))
+		}
+		v, err := tomlValue(value)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", lineno, err)
+		}
+		cfg[key] = v
+	}
+	return scanner.Err()
+}
+
+// stripComment removes a trailing # comment that is not inside a string.
+func stripComment(line string) string {
+	inString := false
+	for i, c := range line {
+		switch c {
+		case '"':
+			inString = !inString
+		case '#':
+			if !inString {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+func tomlValue(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, `"`):
+		return tomlString(value)
+	case strings.HasPrefix(value, "["):
+		list, err := tomlStringArray(value)
+		return strings.Join(list, ","), err
+	case value == "true" || value == "false":
+		return value, nil
+	default:
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return "", fmt.Errorf("invalid value %s", value)
+		}
+		return value, nil
+	}
+}
+
+func tomlString(value string) (string, error) {
+	s, err := strconv.Unquote(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid string %s", value)
+	}
+	return s, nil
+}
+
+func tomlStringArray(value string) ([]string, error) {
+	if !strings.HasPrefix(value, "[") || !strings.HasSuffix(value, "]") {
+		return nil, fmt.Errorf("invalid array %s", value)
+	}
+	var list []string
+	for _, elem := range strings.Split(value[1:len(value)-1], ",") {
+		elem = strings.TrimSpace(elem)
+		if elem == "" {
+			continue
+		}
+		s, err := tomlString(elem)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, nil
+}
+
+// explicitFlags returns the names of the flags that were given on the
+// command line. It must be called before any config file is applied.
+func explicitFlags(fs *flag.FlagSet) map[string]bool {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	return explicit
+}
+
+// envName returns the environment variable that corresponds to a flag,
+// e.g. SNOWFLAKE_KEEP_LOCAL_ADDRESSES for -keep-local-addresses.
+func envName(flagName string) string {
+	return "SNOWFLAKE_" + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// applyEnv sets every flag in fs that was not given on the command line
+// from its SNOWFLAKE_* environment variable, if present. Flags set this way
+// are added to explicit so that a config file does not override them.
+func applyEnv(fs *flag.FlagSet, explicit map[string]bool) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if e := fs.Set(f.Name, value); e != nil {
+			err = fmt.Errorf("%s: %v", envName(f.Name), e)
+			return
+		}
+		explicit[f.Name] = true
+	})
+	return err
+}
+
+// apply sets the flags in fs from the values in the config file, skipping
+// any flag in explicit. Keys that previous, the file as loaded before, set
+// but cfg does not are reset to their defaults, so that reloading a file
+// with a key removed has the expected effect.
+func (cfg fileConfig) apply(fs *flag.FlagSet, explicit map[string]bool, previous fileConfig) error {
+	for name := range cfg {
+		if name == "config" || fs.Lookup(name) == nil {
+			return fmt.Errorf("config: unknown key %q", name)
+		}
+	}
+	for name := range previous {
+		if _, ok := cfg[name]; !ok && !explicit[name] {
+			if err := fs.Set(name, fs.Lookup(name).DefValue); err != nil {
+				return fmt.Errorf("config %s: %v", name, err)
+			}
+		}
+	}
+	for name, value := range cfg {
+		if explicit[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("config %s: %v", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"reflect"
+	"testing"
+)
+
+const exampleTOML = `
+# Calyx defaults
+url = "https://snowflake-broker.example/"
+front = "cdn.example.net" # fronting domain
+ice = [
+	"stun:stun.example.com:3478",
+	"stun:stun.example.org:3478",
+]
+keep-local-addresses = true
+max = 3
+`
+
+func TestParseTOML(t *testing.T) {
+	cfg := make(fileConfig)
+	if err := parseTOML(exampleTOML, cfg); err != nil {
+		t.Fatalf("error parsing toml: %v", err)
+	}
+	expected := fileConfig{
+		"url":                  "https://snowflake-broker.example/",
+		"front":                "cdn.example.net",
+		"ice":                  "stun:stun.example.com:3478,stun:stun.example.org:3478",
+		"keep-local-addresses": "true",
+		"max":                  "3",
+	}
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("unexpected config: %v", cfg)
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	cfg := make(fileConfig)
+	err := parseJSON([]byte(`{"url": "https://snowflake-broker.example/", "ice": ["stun:a", "stun:b"], "max": 3}`), cfg)
+	if err != nil {
+		t.Fatalf("error parsing json: %v", err)
+	}
+	if cfg["ice"] != "stun:a,stun:b" || cfg["max"] != "3" {
+		t.Errorf("unexpected config: %v", cfg)
+	}
+}
+
+func TestConfigUnknownKey(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("url", "", "")
+	cfg := make(fileConfig)
+	if err := parseTOML(`brocker = "typo"`, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.apply(fs, explicitFlags(fs), nil); err == nil {
+		t.Errorf("unknown key was accepted")
+	}
+}
+
+func TestFlagsOverrideConfig(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	url := fs.String("url", "", "")
+	front := fs.String("front", "", "")
+	fs.String("ice", "", "")
+	fs.Bool("keep-local-addresses", false, "")
+	max := fs.Int("max", 1, "")
+	if err := fs.Parse([]string{"-url", "https://flag.example/"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := make(fileConfig)
+	if err := parseTOML(exampleTOML, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.apply(fs, explicitFlags(fs), nil); err != nil {
+		t.Fatal(err)
+	}
+	if *url != "https://flag.example/" {
+		t.Errorf("config file overrode flag: %s", *url)
+	}
+	if *front != "cdn.example.net" || *max != 3 {
+		t.Errorf("config file values not applied: %s %d", *front, *max)
+	}
+}
+
+func TestEnvPrecedence(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	url := fs.String("url", "", "")
+	front := fs.String("front", "", "")
+	fs.String("ice", "", "")
+	keep := fs.Bool("keep-local-addresses", false, "")
+	max := fs.Int("max", 1, "")
+	if err := fs.Parse([]string{"-url", "https://flag.example/"}); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("SNOWFLAKE_URL", "https://env.example/")
+	os.Setenv("SNOWFLAKE_FRONT", "env.example.net")
+	os.Setenv("SNOWFLAKE_KEEP_LOCAL_ADDRESSES", "true")
+	defer os.Unsetenv("SNOWFLAKE_URL")
+	defer os.Unsetenv("SNOWFLAKE_FRONT")
+	defer os.Unsetenv("SNOWFLAKE_KEEP_LOCAL_ADDRESSES")
+
+	explicit := explicitFlags(fs)
+	if err := applyEnv(fs, explicit); err != nil {
+		t.Fatal(err)
+	}
+	cfg := make(fileConfig)
+	if err := parseTOML(exampleTOML, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.apply(fs, explicit, nil); err != nil {
+		t.Fatal(err)
+	}
+	if *url != "https://flag.example/" {
+		t.Errorf("environment overrode flag: %s", *url)
+	}
+	if *front != "env.example.net" || !*keep {
+		t.Errorf("environment not applied: %s %v", *front, *keep)
+	}
+	if *max != 3 {
+		t.Errorf("config file not applied: %d", *max)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	front := fs.String("front", "", "")
+	max := fs.Int("max", 1, "")
+	lastGood := fs.String("last-good-file", "", "")
+	explicit := explicitFlags(fs)
+	first := fileConfig{"front": "cdn.example.net", "max": "3"}
+	if err := first.apply(fs, explicit, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Set after the config file is loaded, as the state dir defaults are.
+	*lastGood = "/state/last-good.json"
+
+	second := fileConfig{"max": "2"}
+	if err := second.apply(fs, explicit, first); err != nil {
+		t.Fatal(err)
+	}
+	if *front != "" || *max != 2 {
+		t.Errorf("reload not applied: front %q, max %d", *front, *max)
+	}
+	if *lastGood != "/state/last-good.json" {
+		t.Errorf("reload reset a flag the file never set: %q", *lastGood)
+	}
+	if err := (fileConfig{"config": "other.toml"}).apply(fs, explicit, second); err == nil {
+		t.Errorf("a config file was allowed to name another")
+	}
+}
+
+func TestConfigAnyFlag(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	socksAddr := fs.String("socks-addr", "127.0.0.1:0", "")
+	logFormat := fs.String("log-format", "text", "")
+	cfg := make(fileConfig)
+	if err := parseTOML("socks-addr = \"127.0.0.1:9999\"\nlog-format = \"json\"\n", cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.apply(fs, explicitFlags(fs), nil); err != nil {
+		t.Fatal(err)
+	}
+	if *socksAddr != "127.0.0.1:9999" || *logFormat != "json" {
+		t.Errorf("config file values not applied: %s %s", *socksAddr, *logFormat)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+
+	sf "0xacab.org/leap/bitmask-vpn/pkg/snowflake/lib"
+	"0xacab.org/leap/bitmask-vpn/pkg/snowflakeclient"
+)
+
+// The control socket lets a frontend, such as the one of bitmask-vpn, manage
+// the client while it runs. It speaks JSON-RPC 2.0 over a Unix socket, with
+// one request or response per line.
+
+type controlRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"` // Missing for notifications
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type controlResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *controlError   `json:"error,omitempty"`
+}
+
+type controlError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *controlError) Error() string {
+	return e.Message
+}
+
+// JSON-RPC error codes.
+const (
+	controlParseError     = -32700
+	controlInvalidRequest = -32600
+	controlMethodNotFound = -32601
+	controlInvalidParams  = -32602
+	controlServerError    = -32000
+)
+
+// A controlMethod runs a request with its raw params. Methods that have
+// nothing to return return a nil result, which is sent as true.
+type controlMethod func(params json.RawMessage) (interface{}, error)
+
+// controlParams decodes the params of a request into v.
+func controlParams(params json.RawMessage, v interface{}) error {
+	if err := json.Unmarshal(params, v); err != nil {
+		return &controlError{controlInvalidParams, err.Error()}
+	}
+	return nil
+}
+
+// controlStatus is the result of the status method.
+type controlStatus struct {
+	Broker      string                           `json:"broker"`
+	ICE         []string                         `json:"ice"`
+	NATType     string                           `json:"nat_type"`
+	NATBehavior sf.NATBehavior                   `json:"nat_behavior"`
+	Network     snowflakeclient.NetworkDiagnosis `json:"network"`
+	Connections []sf.Traffic                     `json:"connections"`
+	Snowflakes  []sf.PeerStats                   `json:"snowflakes"`
+	Sent        sf.PaddingStats                  `json:"sent"` // to tell the overhead of -padding
+}
+
+// newControlMethods returns the methods of the control socket. setFlag sets
+// a flag and rebuilds the dialer, reload reads the config file again and
+// rebuilds the dialer, and stop shuts the client down.
+func newControlMethods(client *snowflakeclient.Client, setFlag func(name, value string) error,
+	reload func() error, stop func()) map[string]controlMethod {
+	set := func(name string) controlMethod {
+		return func(params json.RawMessage) (interface{}, error) {
+			var p map[string]string
+			if err := controlParams(params, &p); err != nil {
+				return nil, err
+			}
+			value, ok := p[name]
+			if !ok {
+				return nil, &controlError{controlInvalidParams, fmt.Sprintf("missing %q", name)}
+			}
+			return nil, setFlag(name, value)
+		}
+	}
+	return map[string]controlMethod{
+		"status": func(json.RawMessage) (interface{}, error) {
+			config := client.DialerConfig()
+			status := controlStatus{
+				Broker:      config.BrokerURL,
+				ICE:         []string{},
+				NATType:     client.NATType(),
+				NATBehavior: client.NATBehavior(),
+				Network:     client.Diagnosis(),
+				Connections: sf.ConnTraffic(),
+				Snowflakes:  sf.SnowflakeStats(),
+				Sent:        sf.GetPaddingStats(),
+			}
+			// Leave out the credentials of TURN servers.
+			for _, server := range snowflakeclient.ParseICEServers(config.ICEServers) {
+				status.ICE = append(status.ICE, strings.Join(server.URLs, " "))
+			}
+			return status, nil
+		},
+		"reload": func(json.RawMessage) (interface{}, error) {
+			return nil, reload()
+		},
+		"drop-peers": func(json.RawMessage) (interface{}, error) {
+			client.ClosePeers()
+			return nil, nil
+		},
+		"rotate-token": func(json.RawMessage) (interface{}, error) {
+			return nil, client.RotateClientToken()
+		},
+		"set-ice":    set("ice"),
+		"set-broker": set("url"),
+		"shutdown": func(json.RawMessage) (interface{}, error) {
+			stop()
+			return nil, nil
+		},
+	}
+}
+
+// listenControl serves methods on a Unix socket at path, which only the
+// user may connect to. A socket left at path by an earlier run is removed.
+func listenControl(path string, methods map[string]controlMethod) (net.Listener, error) {
+	ln, err := snowflakeclient.ListenUnix(path)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Control socket listening at %s", path)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveControl(conn, methods)
+		}
+	}()
+	return ln, nil
+}
+
+// serveControl answers the requests on conn until it is closed.
+func serveControl(conn net.Conn, methods map[string]controlMethod) {
+	defer conn.Close()
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+	for {
+		var req controlRequest
+		if err := dec.Decode(&req); err != nil {
+			if err != io.EOF {
+				enc.Encode(controlResponse{
+					JSONRPC: "2.0",
+					ID:      json.RawMessage("null"),
+					Error:   &controlError{controlParseError, err.Error()},
+				})
+			}
+			return
+		}
+		resp := callControl(methods, req)
+		if req.ID == nil {
+			continue
+		}
+		if err := enc.Encode(resp); err != nil {
+			return
+		}
+	}
+}
+
+func callControl(methods map[string]controlMethod, req controlRequest) controlResponse {
+	resp := controlResponse{JSONRPC: "2.0", ID: req.ID}
+	method, ok := methods[req.Method]
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		resp.Error = &controlError{controlInvalidRequest, "not a JSON-RPC 2.0 request"}
+		return resp
+	} else if !ok {
+		resp.Error = &controlError{controlMethodNotFound, fmt.Sprintf("no method %q", req.Method)}
+		return resp
+	}
+	log.Printf("Control: %s", req.Method)
+	result, err := method(req.Params)
+	if e, ok := err.(*controlError); ok {
+		resp.Error = e
+	} else if err != nil {
+		resp.Error = &controlError{controlServerError, err.Error()}
+	} else if result == nil {
+		resp.Result = true
+	} else {
+		resp.Result = result
+	}
+	return resp
+}
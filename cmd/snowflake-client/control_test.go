@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"0xacab.org/leap/bitmask-vpn/pkg/snowflakeclient"
+)
+
+func TestControlSocket(t *testing.T) {
+	client, err := snowflakeclient.Start(snowflakeclient.Config{
+		Dialer: snowflakeclient.DialerConfig{
+			BrokerURL:  "https://broker.example/",
+			ICEServers: "turn:alice:secret@turn.example.net:3478",
+			ICEPolicy:  "all",
+			Max:        1,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	var set [2]string
+	stopped := false
+	methods := newControlMethods(client, func(name, value string) error {
+		set = [2]string{name, value}
+		return nil
+	}, func() error {
+		return errors.New("no config file")
+	}, func() {
+		stopped = true
+	})
+
+	dir, err := ioutil.TempDir("", "control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "control.sock")
+	ln, err := listenControl(path, methods)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("socket mode %v, %v", fi.Mode(), err)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	responses := bufio.NewScanner(conn)
+	call := func(request string) map[string]interface{} {
+		if _, err := conn.Write([]byte(request + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		if !responses.Scan() {
+			t.Fatalf("no response to %s", request)
+		}
+		var resp map[string]interface{}
+		if err := json.Unmarshal(responses.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	errorCode := func(resp map[string]interface{}) float64 {
+		e, _ := resp["error"].(map[string]interface{})
+		code, _ := e["code"].(float64)
+		return code
+	}
+
+	resp := call(`{"jsonrpc": "2.0", "id": 1, "method": "status"}`)
+	status, _ := resp["result"].(map[string]interface{})
+	if resp["id"] != 1.0 || status["broker"] != "https://broker.example/" {
+		t.Errorf("unexpected status response %v", resp)
+	}
+	if ice, _ := status["ice"].([]interface{}); len(ice) != 1 || ice[0] != "turn:turn.example.net:3478" {
+		t.Errorf("unexpected ICE servers %v", status["ice"])
+	}
+	if sent, _ := status["sent"].(map[string]interface{}); sent == nil || sent["padding"] == nil {
+		t.Errorf("unexpected sent bytes %v", status["sent"])
+	}
+
+	resp = call(`{"jsonrpc": "2.0", "id": 2, "method": "set-ice", "params": {"ice": "stun:stun.example.net:3478"}}`)
+	if resp["result"] != true || set != [2]string{"ice", "stun:stun.example.net:3478"} {
+		t.Errorf("unexpected set-ice response %v, set %v", resp, set)
+	}
+	if resp = call(`{"jsonrpc": "2.0", "id": 3, "method": "set-broker", "params": {}}`); errorCode(resp) != controlInvalidParams {
+		t.Errorf("unexpected set-broker response %v", resp)
+	}
+	if resp = call(`{"jsonrpc": "2.0", "id": 4, "method": "reload"}`); errorCode(resp) != controlServerError {
+		t.Errorf("unexpected reload response %v", resp)
+	}
+	if resp = call(`{"jsonrpc": "2.0", "id": 4, "method": "rotate-token"}`); errorCode(resp) != controlServerError {
+		t.Errorf("unexpected rotate-token response without a client token %v", resp)
+	}
+	if resp = call(`{"jsonrpc": "2.0", "id": 5, "method": "restart"}`); errorCode(resp) != controlMethodNotFound {
+		t.Errorf("unexpected restart response %v", resp)
+	}
+	if resp = call(`{"id": 6, "method": "status"}`); errorCode(resp) != controlInvalidRequest {
+		t.Errorf("unexpected response to a request without version %v", resp)
+	}
+
+	// Notifications get no response.
+	if _, err := conn.Write([]byte(`{"jsonrpc": "2.0", "method": "drop-peers"}` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	resp = call(`{"jsonrpc": "2.0", "id": "last", "method": "shutdown"}`)
+	if resp["id"] != "last" || resp["result"] != true || !stopped {
+		t.Errorf("unexpected shutdown response %v", resp)
+	}
+
+	if resp = call(`{not json`); errorCode(resp) != controlParseError {
+		t.Errorf("unexpected response to invalid JSON %v", resp)
+	}
+}
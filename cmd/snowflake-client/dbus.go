@@ -0,0 +1,582 @@
+package main
+
+// A minimal D-Bus client, enough to own a name on the session or system bus,
+// export one object and emit its signals. It speaks the wire protocol
+// directly, and authenticates with the EXTERNAL mechanism, so it only works
+// on Unix systems.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message types.
+const (
+	dbusMethodCall   = 1
+	dbusMethodReturn = 2
+	dbusError        = 3
+	dbusSignal       = 4
+)
+
+// Header fields.
+const (
+	dbusFieldPath        = 1
+	dbusFieldInterface   = 2
+	dbusFieldMember      = 3
+	dbusFieldErrorName   = 4
+	dbusFieldReplySerial = 5
+	dbusFieldDestination = 6
+	dbusFieldSender      = 7
+	dbusFieldSignature   = 8
+)
+
+// dbusNoReplyExpected is the message flag of calls that want no reply.
+const dbusNoReplyExpected = 0x1
+
+// Largest message we accept. The bus allows more, but nothing we are sent
+// comes close.
+const dbusMaxMessageSize = 1 << 20
+
+// How long to wait for the bus to answer a call.
+const dbusCallTimeout = 25 * time.Second
+
+// Values of these types are marshaled as an object path, a signature and a
+// variant instead of a string or their own type.
+type (
+	dbusObjectPath string
+	dbusSignature  string
+	dbusVariant    struct{ value interface{} }
+)
+
+// dbusMessage is a D-Bus message. The body may hold values of type byte,
+// bool, uint32, string, dbusObjectPath, dbusSignature, dbusVariant,
+// []string and map[string]interface{}, which is marshaled as a{sv}.
+type dbusMessage struct {
+	Type   byte
+	Flags  byte
+	Serial uint32
+	Fields map[byte]interface{}
+	Body   []interface{}
+}
+
+func (m *dbusMessage) field(code byte) string {
+	switch v := m.Fields[code].(type) {
+	case string:
+		return v
+	case dbusObjectPath:
+		return string(v)
+	case dbusSignature:
+		return string(v)
+	}
+	return ""
+}
+
+// dbusSignatureOf returns the D-Bus type signature of v.
+func dbusSignatureOf(v interface{}) string {
+	switch v.(type) {
+	case byte:
+		return "y"
+	case bool:
+		return "b"
+	case uint32:
+		return "u"
+	case string:
+		return "s"
+	case dbusObjectPath:
+		return "o"
+	case dbusSignature:
+		return "g"
+	case dbusVariant:
+		return "v"
+	case []string:
+		return "as"
+	case map[string]interface{}:
+		return "a{sv}"
+	}
+	panic(fmt.Sprintf("no D-Bus type for %T", v))
+}
+
+// dbusEncoder marshals values in little-endian order. Alignment is relative
+// to the start of buf, which must be that of the message or of its body.
+type dbusEncoder struct {
+	buf []byte
+}
+
+func (e *dbusEncoder) align(n int) {
+	for len(e.buf)%n != 0 {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *dbusEncoder) uint32(v uint32) {
+	e.align(4)
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	e.buf = append(e.buf, b[:]...)
+}
+
+// array marshals an array whose elements, marshaled by elems, are aligned
+// to elemAlign.
+func (e *dbusEncoder) array(elemAlign int, elems func()) {
+	e.uint32(0)
+	lenPos := len(e.buf) - 4
+	e.align(elemAlign)
+	start := len(e.buf)
+	elems()
+	binary.LittleEndian.PutUint32(e.buf[lenPos:], uint32(len(e.buf)-start))
+}
+
+func (e *dbusEncoder) value(v interface{}) {
+	switch v := v.(type) {
+	case byte:
+		e.buf = append(e.buf, v)
+	case bool:
+		if v {
+			e.uint32(1)
+		} else {
+			e.uint32(0)
+		}
+	case uint32:
+		e.uint32(v)
+	case string:
+		e.uint32(uint32(len(v)))
+		e.buf = append(append(e.buf, v...), 0)
+	case dbusObjectPath:
+		e.value(string(v))
+	case dbusSignature:
+		e.buf = append(append(append(e.buf, byte(len(v))), v...), 0)
+	case dbusVariant:
+		e.value(dbusSignature(dbusSignatureOf(v.value)))
+		e.value(v.value)
+	case []string:
+		e.array(4, func() {
+			for _, s := range v {
+				e.value(s)
+			}
+		})
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		e.array(8, func() {
+			for _, k := range keys {
+				e.align(8)
+				e.value(k)
+				e.value(dbusVariant{v[k]})
+			}
+		})
+	default:
+		panic(fmt.Sprintf("no D-Bus type for %T", v))
+	}
+}
+
+// marshal returns the wire form of m.
+func (m *dbusMessage) marshal() []byte {
+	var body dbusEncoder
+	var sig string
+	for _, v := range m.Body {
+		sig += dbusSignatureOf(v)
+		body.value(v)
+	}
+	fields := make(map[byte]interface{}, len(m.Fields)+1)
+	for code, v := range m.Fields {
+		fields[code] = v
+	}
+	if sig != "" {
+		fields[dbusFieldSignature] = dbusSignature(sig)
+	}
+	codes := make([]int, 0, len(fields))
+	for code := range fields {
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+
+	e := dbusEncoder{buf: []byte{'l', m.Type, m.Flags, 1}}
+	e.uint32(uint32(len(body.buf)))
+	e.uint32(m.Serial)
+	e.array(8, func() {
+		for _, code := range codes {
+			e.align(8)
+			e.value(byte(code))
+			e.value(dbusVariant{fields[byte(code)]})
+		}
+	})
+	e.align(8)
+	return append(e.buf, body.buf...)
+}
+
+var errDBusMalformed = errors.New("malformed D-Bus message")
+
+// dbusDecoder unmarshals the basic types and variants, which is all the
+// header and the calls we answer are made of.
+type dbusDecoder struct {
+	buf   []byte
+	pos   int
+	order binary.ByteOrder
+	err   error
+}
+
+func (d *dbusDecoder) align(n int) {
+	d.pos = (d.pos + n - 1) / n * n
+}
+
+func (d *dbusDecoder) next(n int) []byte {
+	if d.err != nil || d.pos+n > len(d.buf) || n < 0 {
+		d.err = errDBusMalformed
+		return make([]byte, n)
+	}
+	b := d.buf[d.pos : d.pos+n]
+	d.pos += n
+	return b
+}
+
+func (d *dbusDecoder) uint32() uint32 {
+	d.align(4)
+	return d.order.Uint32(d.next(4))
+}
+
+func (d *dbusDecoder) string() string {
+	n := d.uint32()
+	if n >= dbusMaxMessageSize {
+		d.err = errDBusMalformed
+		return ""
+	}
+	s := string(d.next(int(n)))
+	d.next(1)
+	return s
+}
+
+func (d *dbusDecoder) signature() string {
+	n := d.next(1)[0]
+	s := string(d.next(int(n)))
+	d.next(1)
+	return s
+}
+
+// value unmarshals a value of the single complete type sig.
+func (d *dbusDecoder) value(sig string) interface{} {
+	switch sig {
+	case "y":
+		return d.next(1)[0]
+	case "b":
+		return d.uint32() != 0
+	case "u":
+		return d.uint32()
+	case "s":
+		return d.string()
+	case "o":
+		return dbusObjectPath(d.string())
+	case "g":
+		return dbusSignature(d.signature())
+	case "v":
+		return dbusVariant{d.value(d.signature())}
+	}
+	if d.err == nil {
+		d.err = fmt.Errorf("unsupported D-Bus type %q", sig)
+	}
+	return nil
+}
+
+// readDBusMessage reads a message from r.
+func readDBusMessage(r io.Reader) (*dbusMessage, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder
+	switch fixed[0] {
+	case 'l':
+		order = binary.LittleEndian
+	case 'B':
+		order = binary.BigEndian
+	default:
+		return nil, errDBusMalformed
+	}
+	bodyLen := order.Uint32(fixed[4:])
+	fieldsLen := order.Uint32(fixed[12:])
+	if bodyLen > dbusMaxMessageSize || fieldsLen > dbusMaxMessageSize {
+		return nil, errors.New("D-Bus message too large")
+	}
+	headerLen := (16 + int(fieldsLen) + 7) / 8 * 8
+	data := make([]byte, headerLen+int(bodyLen))
+	copy(data, fixed)
+	if _, err := io.ReadFull(r, data[16:]); err != nil {
+		return nil, err
+	}
+
+	m := &dbusMessage{
+		Type:   fixed[1],
+		Flags:  fixed[2],
+		Serial: order.Uint32(fixed[8:]),
+		Fields: make(map[byte]interface{}),
+	}
+	d := &dbusDecoder{buf: data[:16+fieldsLen], pos: 16, order: order}
+	for d.err == nil && d.pos < len(d.buf) {
+		d.align(8)
+		code := d.next(1)[0]
+		v, _ := d.value("v").(dbusVariant)
+		m.Fields[code] = v.value
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	// Bodies of types we do not know are left out; the calls we answer
+	// only take strings.
+	d = &dbusDecoder{buf: data[headerLen:], order: order}
+	for _, t := range m.field(dbusFieldSignature) {
+		v := d.value(string(t))
+		if d.err != nil {
+			m.Body = nil
+			break
+		}
+		m.Body = append(m.Body, v)
+	}
+	return m, nil
+}
+
+// dbusHandler answers the method calls of a dbusConn. It returns the body
+// of the reply, or the name of an error and its message.
+type dbusHandler func(call *dbusMessage) (body []interface{}, errName, errMsg string)
+
+// dbusConn is a connection to a message bus.
+type dbusConn struct {
+	conn    net.Conn
+	handler dbusHandler
+
+	lock   sync.Mutex // Guards writes, serial and calls
+	serial uint32
+	calls  map[uint32]chan *dbusMessage
+}
+
+// dbusBusAddress returns the address of the session or system bus.
+func dbusBusAddress(bus string) (string, error) {
+	switch bus {
+	case "session":
+		if address := os.Getenv("DBUS_SESSION_BUS_ADDRESS"); address != "" {
+			return address, nil
+		}
+		return "", errors.New("DBUS_SESSION_BUS_ADDRESS is not set")
+	case "system":
+		if address := os.Getenv("DBUS_SYSTEM_BUS_ADDRESS"); address != "" {
+			return address, nil
+		}
+		return "unix:path=/var/run/dbus/system_bus_socket", nil
+	}
+	return "", fmt.Errorf("unknown bus %q, expected session or system", bus)
+}
+
+// dialDBus connects to the first Unix socket among the ';'-separated
+// addresses, and authenticates.
+func dialDBus(addresses string, handler dbusHandler) (*dbusConn, error) {
+	uid := os.Getuid()
+	if uid < 0 {
+		return nil, errors.New("D-Bus is only supported on Unix systems")
+	}
+	for _, address := range strings.Split(addresses, ";") {
+		if !strings.HasPrefix(address, "unix:") {
+			continue
+		}
+		var path string
+		for _, kv := range strings.Split(address[len("unix:"):], ",") {
+			if strings.HasPrefix(kv, "path=") {
+				path = kv[len("path="):]
+			} else if strings.HasPrefix(kv, "abstract=") {
+				path = "@" + kv[len("abstract="):]
+			}
+		}
+		if path == "" {
+			continue
+		}
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		r := bufio.NewReader(conn)
+		if err := dbusAuth(conn, r, uid); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return newDBusConn(conn, r, handler), nil
+	}
+	return nil, fmt.Errorf("no usable address in %q", addresses)
+}
+
+// dbusAuth authenticates as uid with the EXTERNAL mechanism.
+func dbusAuth(w io.Writer, r *bufio.Reader, uid int) error {
+	id := hex.EncodeToString([]byte(strconv.Itoa(uid)))
+	if _, err := io.WriteString(w, "\x00AUTH EXTERNAL "+id+"\r\n"); err != nil {
+		return err
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		return fmt.Errorf("D-Bus authentication failed: %s", strings.TrimSpace(line))
+	}
+	_, err = io.WriteString(w, "BEGIN\r\n")
+	return err
+}
+
+// newDBusConn starts reading messages from r, the authenticated conn.
+func newDBusConn(conn net.Conn, r io.Reader, handler dbusHandler) *dbusConn {
+	c := &dbusConn{
+		conn:    conn,
+		handler: handler,
+		calls:   make(map[uint32]chan *dbusMessage),
+	}
+	go c.readLoop(r)
+	return c
+}
+
+func (c *dbusConn) readLoop(r io.Reader) {
+	defer c.Close()
+	for {
+		m, err := readDBusMessage(r)
+		if err != nil {
+			return
+		}
+		switch m.Type {
+		case dbusMethodReturn, dbusError:
+			serial, _ := m.Fields[dbusFieldReplySerial].(uint32)
+			c.lock.Lock()
+			ch := c.calls[serial]
+			delete(c.calls, serial)
+			c.lock.Unlock()
+			if ch != nil {
+				ch <- m
+			}
+		case dbusMethodCall:
+			c.answer(m)
+		}
+	}
+}
+
+// answer replies to a method call with what the handler returns.
+func (c *dbusConn) answer(call *dbusMessage) {
+	body, errName, errMsg := c.handler(call)
+	if call.Flags&dbusNoReplyExpected != 0 {
+		return
+	}
+	reply := &dbusMessage{
+		Type:   dbusMethodReturn,
+		Fields: map[byte]interface{}{dbusFieldReplySerial: call.Serial},
+		Body:   body,
+	}
+	if sender := call.field(dbusFieldSender); sender != "" {
+		reply.Fields[dbusFieldDestination] = sender
+	}
+	if errName != "" {
+		reply.Type = dbusError
+		reply.Fields[dbusFieldErrorName] = errName
+		reply.Body = []interface{}{errMsg}
+	}
+	c.send(reply, nil)
+}
+
+// send gives m the next serial and writes it. If reply is not nil, the
+// reply to m is delivered to it.
+func (c *dbusConn) send(m *dbusMessage, reply chan *dbusMessage) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.serial++
+	m.Serial = c.serial
+	if reply != nil {
+		c.calls[m.Serial] = reply
+	}
+	_, err := c.conn.Write(m.marshal())
+	return err
+}
+
+// call calls a method and returns the body of the reply.
+func (c *dbusConn) call(dest string, path dbusObjectPath, iface, member string, body ...interface{}) ([]interface{}, error) {
+	m := &dbusMessage{
+		Type: dbusMethodCall,
+		Fields: map[byte]interface{}{
+			dbusFieldDestination: dest,
+			dbusFieldPath:        path,
+			dbusFieldInterface:   iface,
+			dbusFieldMember:      member,
+		},
+		Body: body,
+	}
+	reply := make(chan *dbusMessage, 1)
+	if err := c.send(m, reply); err != nil {
+		return nil, err
+	}
+	select {
+	case r := <-reply:
+		if r.Type == dbusError {
+			msg, _ := firstString(r.Body)
+			return nil, fmt.Errorf("%s: %s", r.field(dbusFieldErrorName), msg)
+		}
+		return r.Body, nil
+	case <-time.After(dbusCallTimeout):
+		c.lock.Lock()
+		delete(c.calls, m.Serial)
+		c.lock.Unlock()
+		return nil, fmt.Errorf("timeout calling %s.%s", iface, member)
+	}
+}
+
+// signal emits a signal from the object at path.
+func (c *dbusConn) signal(path dbusObjectPath, iface, member string, body ...interface{}) error {
+	return c.send(&dbusMessage{
+		Type: dbusSignal,
+		Fields: map[byte]interface{}{
+			dbusFieldPath:      path,
+			dbusFieldInterface: iface,
+			dbusFieldMember:    member,
+		},
+		Body: body,
+	}, nil)
+}
+
+// requestName says hello to the bus and takes name, failing if another
+// connection owns it.
+func (c *dbusConn) requestName(name string) error {
+	const (
+		doNotQueue   = 0x4
+		primaryOwner = 1
+		alreadyOwner = 4
+	)
+	if _, err := c.call("org.freedesktop.DBus", "/org/freedesktop/DBus",
+		"org.freedesktop.DBus", "Hello"); err != nil {
+		return err
+	}
+	body, err := c.call("org.freedesktop.DBus", "/org/freedesktop/DBus",
+		"org.freedesktop.DBus", "RequestName", name, uint32(doNotQueue))
+	if err != nil {
+		return err
+	}
+	if len(body) != 1 || (body[0] != uint32(primaryOwner) && body[0] != uint32(alreadyOwner)) {
+		return fmt.Errorf("%s is owned by another connection", name)
+	}
+	return nil
+}
+
+func (c *dbusConn) Close() error {
+	return c.conn.Close()
+}
+
+// firstString returns the first value of body if it is a string.
+func firstString(body []interface{}) (string, bool) {
+	if len(body) == 0 {
+		return "", false
+	}
+	s, ok := body[0].(string)
+	return s, ok
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	sf "0xacab.org/leap/bitmask-vpn/pkg/snowflake/lib"
+)
+
+func TestDBusMessage(t *testing.T) {
+	m := &dbusMessage{
+		Type:   dbusMethodCall,
+		Serial: 7,
+		Fields: map[byte]interface{}{
+			dbusFieldPath:        dbusServicePath,
+			dbusFieldInterface:   "org.freedesktop.DBus.Properties",
+			dbusFieldMember:      "Get",
+			dbusFieldDestination: dbusServiceName,
+		},
+		Body: []interface{}{"org.leap.SnowflakeClient", "State", uint32(3), true, dbusVariant{"x"}},
+	}
+	got, err := readDBusMessage(bytes.NewReader(m.marshal()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Fields[dbusFieldSignature] = dbusSignature("ssubv")
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("got %+v, expected %+v", got, m)
+	}
+
+	// Types we do not unmarshal are left out of the body.
+	m.Body = []interface{}{map[string]interface{}{"Peers": uint32(1)}}
+	delete(m.Fields, dbusFieldSignature)
+	got, err = readDBusMessage(bytes.NewReader(m.marshal()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.field(dbusFieldSignature) != "a{sv}" || got.Body != nil {
+		t.Errorf("unexpected message %+v", got)
+	}
+
+	if _, err := readDBusMessage(strings.NewReader("x234567890123456")); err == nil {
+		t.Error("expected an error for a bad endianness")
+	}
+}
+
+func TestDBusAuth(t *testing.T) {
+	var w bytes.Buffer
+	err := dbusAuth(&w, bufio.NewReader(strings.NewReader("OK 1234deadbeef\r\n")), 1000)
+	if err != nil || w.String() != "\x00AUTH EXTERNAL 31303030\r\nBEGIN\r\n" {
+		t.Errorf("unexpected auth %q %v", w.String(), err)
+	}
+	err = dbusAuth(&w, bufio.NewReader(strings.NewReader("REJECTED EXTERNAL\r\n")), 1000)
+	if err == nil {
+		t.Error("expected an error when rejected")
+	}
+}
+
+// fakeBus answers Hello and RequestName on conn, and then passes the other
+// messages on to the returned channel.
+func fakeBus(conn net.Conn) <-chan *dbusMessage {
+	messages := make(chan *dbusMessage)
+	go func() {
+		defer close(messages)
+		for {
+			m, err := readDBusMessage(conn)
+			if err != nil {
+				return
+			}
+			var body []interface{}
+			switch m.field(dbusFieldMember) {
+			case "Hello":
+				body = []interface{}{":1.42"}
+			case "RequestName":
+				body = []interface{}{uint32(1)}
+			default:
+				messages <- m
+				continue
+			}
+			reply := &dbusMessage{
+				Type:   dbusMethodReturn,
+				Fields: map[byte]interface{}{dbusFieldReplySerial: m.Serial},
+				Body:   body,
+			}
+			conn.Write(reply.marshal())
+		}
+	}()
+	return messages
+}
+
+func TestDBusService(t *testing.T) {
+	client, bus := net.Pipe()
+	defer bus.Close()
+	messages := fakeBus(bus)
+	s := &dbusService{peers: 1}
+	s.conn = newDBusConn(client, client, s.handle)
+	defer s.conn.Close()
+	if err := s.conn.requestName(dbusServiceName); err != nil {
+		t.Fatal(err)
+	}
+
+	call := func(iface, member string, body ...interface{}) *dbusMessage {
+		m := &dbusMessage{
+			Type:   dbusMethodCall,
+			Serial: 1,
+			Fields: map[byte]interface{}{
+				dbusFieldPath:      dbusServicePath,
+				dbusFieldInterface: iface,
+				dbusFieldMember:    member,
+				dbusFieldSender:    ":1.7",
+			},
+			Body: body,
+		}
+		go io.Copy(bus, bytes.NewReader(m.marshal()))
+		return <-messages
+	}
+	reply := call("org.freedesktop.DBus.Properties", "Get", dbusServiceInterface, "State")
+	if reply.Type != dbusMethodReturn || reply.field(dbusFieldDestination) != ":1.7" ||
+		!reflect.DeepEqual(reply.Body, []interface{}{dbusVariant{"connected"}}) {
+		t.Errorf("unexpected reply to Get %+v", reply)
+	}
+	reply = call("org.freedesktop.DBus.Properties", "Get", dbusServiceInterface, "Color")
+	if reply.Type != dbusError || reply.field(dbusFieldErrorName) != "org.freedesktop.DBus.Error.InvalidArgs" {
+		t.Errorf("unexpected reply to Get of an unknown property %+v", reply)
+	}
+	reply = call("org.freedesktop.DBus.Introspectable", "Introspect")
+	if xml, _ := firstString(reply.Body); !strings.Contains(xml, `<signal name="PeerConnected">`) {
+		t.Errorf("unexpected introspection %+v", reply)
+	}
+	reply = call("org.leap.SnowflakeClient", "Explode")
+	if reply.Type != dbusError || reply.field(dbusFieldErrorName) != "org.freedesktop.DBus.Error.UnknownMethod" {
+		t.Errorf("unexpected reply to an unknown method %+v", reply)
+	}
+
+	events := make(chan sf.Event, 1)
+	events <- sf.Event{Type: sf.EventPeerDisconnected, ID: "1a2b"}
+	close(events)
+	go s.watch(events)
+	signal := <-messages
+	if signal.Type != dbusSignal || signal.field(dbusFieldMember) != "PeerDisconnected" ||
+		!reflect.DeepEqual(signal.Body, []interface{}{"1a2b"}) {
+		t.Errorf("unexpected signal %+v", signal)
+	}
+	signal = <-messages
+	if signal.field(dbusFieldMember) != "PropertiesChanged" || signal.field(dbusFieldSignature) != "sa{sv}as" {
+		t.Errorf("unexpected signal %+v", signal)
+	}
+	if state := s.properties()["State"]; state != "disconnected" {
+		t.Errorf("unexpected state %v", state)
+	}
+}
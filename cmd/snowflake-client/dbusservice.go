@@ -0,0 +1,163 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	sf "0xacab.org/leap/bitmask-vpn/pkg/snowflake/lib"
+)
+
+// The D-Bus service lets desktop applications, such as the Calyx GUI or a
+// network indicator, show whether the client is connected through
+// snowflakes.
+const (
+	dbusServiceName      = "org.leap.SnowflakeClient"
+	dbusServicePath      = dbusObjectPath("/org/leap/SnowflakeClient")
+	dbusServiceInterface = "org.leap.SnowflakeClient"
+)
+
+const dbusIntrospection = `<!DOCTYPE node PUBLIC "-//freedesktop//DTD D-BUS Object Introspection 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/introspect.dtd">
+<node>
+  <interface name="org.leap.SnowflakeClient">
+    <property name="State" type="s" access="read"/>
+    <property name="Peers" type="u" access="read"/>
+    <signal name="PeerConnected"><arg name="id" type="s"/></signal>
+    <signal name="PeerDisconnected"><arg name="id" type="s"/></signal>
+  </interface>
+  <interface name="org.freedesktop.DBus.Properties">
+    <method name="Get">
+      <arg name="interface" type="s" direction="in"/>
+      <arg name="property" type="s" direction="in"/>
+      <arg name="value" type="v" direction="out"/>
+    </method>
+    <method name="GetAll">
+      <arg name="interface" type="s" direction="in"/>
+      <arg name="properties" type="a{sv}" direction="out"/>
+    </method>
+    <signal name="PropertiesChanged">
+      <arg name="interface" type="s"/>
+      <arg name="changed_properties" type="a{sv}"/>
+      <arg name="invalidated_properties" type="as"/>
+    </signal>
+  </interface>
+  <interface name="org.freedesktop.DBus.Introspectable">
+    <method name="Introspect"><arg name="xml" type="s" direction="out"/></method>
+  </interface>
+  <interface name="org.freedesktop.DBus.Peer">
+    <method name="Ping"/>
+  </interface>
+</node>
+`
+
+// dbusService exports the org.leap.SnowflakeClient object. Its State is
+// "connected" while at least one snowflake is, and "disconnected"
+// otherwise; Peers is how many snowflakes are connected.
+type dbusService struct {
+	conn *dbusConn
+
+	lock  sync.Mutex
+	peers uint32
+
+	cancel func()
+}
+
+// startDBusService exports the client state on the session or system bus.
+func startDBusService(bus string) (*dbusService, error) {
+	address, err := dbusBusAddress(bus)
+	if err != nil {
+		return nil, err
+	}
+	s := &dbusService{peers: uint32(len(sf.PeerTraffic()))}
+	s.conn, err = dialDBus(address, s.handle)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.conn.requestName(dbusServiceName); err != nil {
+		s.conn.Close()
+		return nil, err
+	}
+	log.Printf("D-Bus: exporting %s on the %s bus", dbusServiceName, bus)
+	events, cancel := sf.SubscribeEvents()
+	s.cancel = cancel
+	go s.watch(events)
+	return s, nil
+}
+
+// properties returns the properties of the object.
+func (s *dbusService) properties() map[string]interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	state := "disconnected"
+	if s.peers > 0 {
+		state = "connected"
+	}
+	return map[string]interface{}{
+		"State": state,
+		"Peers": s.peers,
+	}
+}
+
+// watch emits signals for the events until they end.
+func (s *dbusService) watch(events <-chan sf.Event) {
+	for e := range events {
+		var member string
+		s.lock.Lock()
+		switch e.Type {
+		case sf.EventPeerConnected:
+			member = "PeerConnected"
+			s.peers++
+		case sf.EventPeerDisconnected:
+			member = "PeerDisconnected"
+			if s.peers > 0 {
+				s.peers--
+			}
+		}
+		s.lock.Unlock()
+		if member == "" {
+			continue
+		}
+		s.conn.signal(dbusServicePath, dbusServiceInterface, member, e.ID)
+		s.conn.signal(dbusServicePath, "org.freedesktop.DBus.Properties", "PropertiesChanged",
+			dbusServiceInterface, s.properties(), []string{})
+	}
+}
+
+// handle answers the method calls to the object.
+func (s *dbusService) handle(call *dbusMessage) ([]interface{}, string, string) {
+	iface, member := call.field(dbusFieldInterface), call.field(dbusFieldMember)
+	if iface == "org.freedesktop.DBus.Peer" && member == "Ping" {
+		return nil, "", ""
+	}
+	if dbusObjectPath(call.field(dbusFieldPath)) != dbusServicePath {
+		return nil, "org.freedesktop.DBus.Error.UnknownObject", "no object at " + call.field(dbusFieldPath)
+	}
+	switch iface + "." + member {
+	case "org.freedesktop.DBus.Introspectable.Introspect":
+		return []interface{}{dbusIntrospection}, "", ""
+	case "org.freedesktop.DBus.Properties.GetAll":
+		if name, _ := firstString(call.Body); name != dbusServiceInterface && name != "" {
+			return []interface{}{map[string]interface{}{}}, "", ""
+		}
+		return []interface{}{s.properties()}, "", ""
+	case "org.freedesktop.DBus.Properties.Get":
+		var property string
+		if len(call.Body) == 2 {
+			property, _ = call.Body[1].(string)
+		}
+		value, ok := s.properties()[property]
+		if !ok {
+			return nil, "org.freedesktop.DBus.Error.InvalidArgs", "no property " + property
+		}
+		return []interface{}{dbusVariant{value}}, "", ""
+	case "org.freedesktop.DBus.Properties.Set":
+		return nil, "org.freedesktop.DBus.Error.PropertyReadOnly", "the properties are read-only"
+	}
+	return nil, "org.freedesktop.DBus.Error.UnknownMethod", "no method " + iface + "." + member
+}
+
+// Close stops exporting the client state.
+func (s *dbusService) Close() error {
+	s.cancel()
+	return s.conn.Close()
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+func newEventLogWriter() (io.WriteCloser, error) {
+	return nil, errors.New("the event log is only supported on Windows")
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io"
+
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// ID of the events logged; EventCreate.exe, the message file of the source,
+// accepts 1 to 1000.
+const eventID = 1
+
+// eventLogWriter sends each message to the Windows Event Log, as an error, a
+// warning or information depending on logLevel.
+type eventLogWriter struct {
+	*eventlog.Log
+}
+
+// newEventLogWriter registers logIdentifier as an event source, if it is not
+// yet and the client runs as an administrator, and opens it. Without the
+// registration, the Event Viewer still shows the messages, with a warning
+// that their description was not found.
+func newEventLogWriter() (io.WriteCloser, error) {
+	// Fails if the source is already registered, which is fine.
+	eventlog.InstallAsEventCreate(logIdentifier, eventlog.Error|eventlog.Warning|eventlog.Info)
+	l, err := eventlog.Open(logIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	return eventLogWriter{l}, nil
+}
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	msg := logMessage(p)
+	var err error
+	switch logLevel(msg) {
+	case "error":
+		err = w.Error(eventID, msg)
+	case "warn":
+		err = w.Warning(eventID, msg)
+	default:
+		err = w.Info(eventID, msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+)
+
+// Where journald takes messages in its native protocol.
+const journaldSocket = "/run/systemd/journal/socket"
+
+// journaldWriter sends each message to journald, with a priority following
+// logLevel.
+type journaldWriter struct {
+	conn *net.UnixConn
+}
+
+func newJournaldWriter() (io.WriteCloser, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journaldWriter{conn: conn}, nil
+}
+
+func (w *journaldWriter) Write(p []byte) (int, error) {
+	if _, err := w.conn.Write(journaldEntry(logMessage(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *journaldWriter) Close() error {
+	return w.conn.Close()
+}
+
+// journaldEntry encodes msg in the journald native protocol.
+func journaldEntry(msg string) []byte {
+	priority := map[string]string{
+		"error": "3",
+		"warn":  "4",
+		"info":  "6",
+		"debug": "7",
+		"trace": "7",
+	}[logLevel(msg)]
+	var b bytes.Buffer
+	journaldField(&b, "PRIORITY", priority)
+	journaldField(&b, "SYSLOG_IDENTIFIER", logIdentifier)
+	journaldField(&b, "MESSAGE", msg)
+	return b.Bytes()
+}
+
+// journaldField appends a field to an entry. Values with newlines are
+// prefixed with their length instead of being ended by a newline.
+func journaldField(b *bytes.Buffer, key, value string) {
+	b.WriteString(key)
+	if !strings.Contains(value, "\n") {
+		b.WriteByte('=')
+		b.WriteString(value)
+		b.WriteByte('\n')
+		return
+	}
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestJournaldEntry(t *testing.T) {
+	entry := string(journaldEntry("handler error: no snowflakes"))
+	expected := "PRIORITY=3\nSYSLOG_IDENTIFIER=snowflake-client\nMESSAGE=handler error: no snowflakes\n"
+	if entry != expected {
+		t.Errorf("unexpected entry %q", entry)
+	}
+
+	entry = string(journaldEntry("Negotiating\nTarget URL"))
+	expected = "PRIORITY=6\nSYSLOG_IDENTIFIER=snowflake-client\nMESSAGE\n\x16\x00\x00\x00\x00\x00\x00\x00Negotiating\nTarget URL\n"
+	if entry != expected {
+		t.Errorf("unexpected entry %q", entry)
+	}
+
+	entry = string(journaldEntry("(debug) WebRTC: DataChannel.OnOpen"))
+	expected = "PRIORITY=7\nSYSLOG_IDENTIFIER=snowflake-client\nMESSAGE=(debug) WebRTC: DataChannel.OnOpen\n"
+	if entry != expected {
+		t.Errorf("unexpected entry %q", entry)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+func newJournaldWriter() (io.WriteCloser, error) {
+	return nil, errors.New("journald is only supported on Linux")
+}
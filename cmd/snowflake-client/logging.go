@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logComponents maps the beginnings of log messages to the part of the
+// client logging them. The first match wins.
+var logComponents = []struct {
+	prefix    string
+	component string
+}{
+	{"WebRTC: ICE", "ice"},
+	{"WebRTC: selected candidate", "ice"},
+	{"WebRTC: IPv6", "ice"},
+	{"NAT", "ice"},
+	{"Using ICE", "ice"},
+	{"WebRTC:", "webrtc"},
+	{"BrokerChannel", "broker"},
+	{"Negotiating", "broker"},
+	{"Received answer", "broker"},
+	{"Received Answer", "broker"},
+	{"Rendezvous", "broker"},
+	{"Racing rendezvous", "broker"},
+	{"Domain fronting", "broker"},
+	{"All front domains", "broker"},
+	{"Through", "broker"},
+	{"SQS", "broker"},
+	{"Using ECH", "broker"},
+	{"SOCKS", "socks"},
+	{"HTTP CONNECT", "socks"},
+	{"Started HTTP CONNECT", "socks"},
+	{"Transparent", "socks"},
+	{"Started transparent", "socks"},
+	{"Started SOCKS", "socks"},
+	{"Restarted SOCKS", "socks"},
+	{"handler error", "socks"},
+	{"Handler ended", "socks"},
+	{"---- Handler", "turbotunnel"},
+	{"---- SharedSession", "turbotunnel"},
+	{"redialing", "turbotunnel"},
+	{"copy", "turbotunnel"},
+	{"ConnectLoop", "turbotunnel"},
+	{"Traffic Bytes", "turbotunnel"},
+	{"0 length message", "turbotunnel"},
+	{"AMP cache", "broker"},
+	{"Dropping front", "broker"},
+}
+
+// logComponent returns the component that logged msg, or "client".
+func logComponent(msg string) string {
+	for _, c := range logComponents {
+		if strings.HasPrefix(msg, c.prefix) {
+			return c.component
+		}
+	}
+	return "client"
+}
+
+// Log levels, from the most to the least important.
+var logLevels = []string{"error", "warn", "info", "debug", "trace"}
+
+// logLevelRank returns the position of level in logLevels, or -1.
+func logLevelRank(level string) int {
+	for i, l := range logLevels {
+		if l == level {
+			return i
+		}
+	}
+	return -1
+}
+
+// Log messages may start with their level in parentheses, then with the ID
+// of the connection they are about in brackets, and carry key=value fields.
+var (
+	logLevelPattern  = regexp.MustCompile(`^\((warn|debug|trace)\) `)
+	logConnIDPattern = regexp.MustCompile(`^\[([0-9a-zA-Z]+)\] `)
+	logFieldPattern  = regexp.MustCompile(`\b([a-z_]+)=([^\s,;]+)`)
+	logErrorPattern  = regexp.MustCompile(`(?i)\b(error|fail(ed|ure)?|unable)\b`)
+)
+
+// parseLogMessage splits msg into its level, connection ID, component and
+// the rest of the message. Messages without a level are taken for errors
+// if they say so, and for information otherwise.
+func parseLogMessage(msg string) (level, connID, component, event string) {
+	event = strings.TrimSpace(msg)
+	level = "info"
+	if m := logLevelPattern.FindStringSubmatch(event); m != nil {
+		level = m[1]
+		event = event[len(m[0]):]
+	} else if logErrorPattern.MatchString(event) {
+		level = "error"
+	}
+	if m := logConnIDPattern.FindStringSubmatch(event); m != nil {
+		connID = m[1]
+		event = event[len(m[0]):]
+	}
+	return level, connID, logComponent(event), event
+}
+
+// logLevel returns the level of msg.
+func logLevel(msg string) string {
+	level, _, _, _ := parseLogMessage(msg)
+	return level
+}
+
+// logRecord is a log message in the JSON format.
+type logRecord struct {
+	Time      string            `json:"time"`
+	Level     string            `json:"level"`
+	Component string            `json:"component"`
+	ConnID    string            `json:"conn_id,omitempty"`
+	Event     string            `json:"event"`
+	Fields    map[string]string `json:"fields,omitempty"`
+}
+
+func newLogRecord(t time.Time, msg string) logRecord {
+	r := logRecord{Time: t.UTC().Format(time.RFC3339Nano)}
+	r.Level, r.ConnID, r.Component, r.Event = parseLogMessage(msg)
+	for _, m := range logFieldPattern.FindAllStringSubmatch(r.Event, -1) {
+		if r.Fields == nil {
+			r.Fields = make(map[string]string)
+		}
+		r.Fields[m[1]] = m[2]
+	}
+	return r
+}
+
+// logFilter passes on to Output the messages of level or more important,
+// and, unless components is empty, only those of the given components.
+type logFilter struct {
+	Output     io.Writer
+	level      int
+	components map[string]bool
+}
+
+// newLogFilter returns a logFilter for the -v level and the comma-separated
+// -components.
+func newLogFilter(output io.Writer, level, components string) (*logFilter, error) {
+	f := &logFilter{Output: output, level: logLevelRank(level)}
+	if f.level < 0 {
+		return nil, fmt.Errorf("unknown log level %q, expected one of %s", level, strings.Join(logLevels, ", "))
+	}
+	for _, c := range strings.Split(components, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			if f.components == nil {
+				f.components = make(map[string]bool)
+			}
+			f.components[c] = true
+		}
+	}
+	return f, nil
+}
+
+func (f *logFilter) Write(p []byte) (int, error) {
+	level, _, component, _ := parseLogMessage(string(p))
+	if logLevelRank(level) > f.level || (f.components != nil && !f.components[component]) {
+		return len(p), nil
+	}
+	return f.Output.Write(p)
+}
+
+// jsonLogWriter writes each log message it is given as a line of JSON to
+// Output. The logger should not add a timestamp of its own.
+type jsonLogWriter struct {
+	Output io.Writer
+
+	lock sync.Mutex
+	now  func() time.Time
+}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	now := time.Now
+	if w.now != nil {
+		now = w.now
+	}
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(newLogRecord(now(), string(p))); err != nil {
+		return 0, err
+	}
+	if _, err := w.Output.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
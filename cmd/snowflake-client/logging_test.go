@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLogRecord(t *testing.T) {
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		msg      string
+		expected logRecord
+	}{
+		{
+			"WebRTC: ICE connection state: connected\n",
+			logRecord{Level: "info", Component: "ice", Event: "WebRTC: ICE connection state: connected"},
+		},
+		{
+			"BrokerChannel: timeout waiting for the broker, retrying in 5s (1/3)",
+			logRecord{Level: "info", Component: "broker", Event: "BrokerChannel: timeout waiting for the broker, retrying in 5s (1/3)"},
+		},
+		{
+			"[1a2b] SOCKS accepted: map[]",
+			logRecord{Level: "info", Component: "socks", ConnID: "1a2b", Event: "SOCKS accepted: map[]"},
+		},
+		{
+			"handler error: no snowflakes",
+			logRecord{Level: "error", Component: "socks", Event: "handler error: no snowflakes"},
+		},
+		{
+			"Network changed nat=restricted",
+			logRecord{Level: "info", Component: "client", Event: "Network changed nat=restricted",
+				Fields: map[string]string{"nat": "restricted"}},
+		},
+		{
+			"(debug) [1a2b] WebRTC: DataChannel.OnOpen",
+			logRecord{Level: "debug", Component: "webrtc", ConnID: "1a2b", Event: "WebRTC: DataChannel.OnOpen"},
+		},
+		{
+			"(warn) BrokerChannel: failed to reach the broker, retrying",
+			logRecord{Level: "warn", Component: "broker", Event: "BrokerChannel: failed to reach the broker, retrying"},
+		},
+	} {
+		test.expected.Time = "2021-05-01T12:00:00Z"
+		if r := newLogRecord(now, test.msg); !reflect.DeepEqual(r, test.expected) {
+			t.Errorf("newLogRecord(%q) = %+v, expected %+v", test.msg, r, test.expected)
+		}
+	}
+}
+
+func TestJSONLogWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := &jsonLogWriter{Output: &out, now: time.Now}
+	logger := log.New(w, "", 0)
+	logger.Println("WebRTC: Collecting a new Snowflake.")
+	logger.Println("Negotiating via BrokerChannel...\nTarget URL: broker.example")
+
+	dec := json.NewDecoder(&out)
+	var records []logRecord
+	for dec.More() {
+		var r logRecord
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	if records[1].Component != "broker" || records[1].Event != "Negotiating via BrokerChannel...\nTarget URL: broker.example" {
+		t.Errorf("unexpected record %+v", records[1])
+	}
+}
+
+func TestLogFilter(t *testing.T) {
+	messages := []string{
+		"handler error: no snowflakes\n",
+		"(warn) WebRTC: ICE connection state: disconnected\n",
+		"WebRTC: ICE connection state: connected\n",
+		"(debug) BrokerChannel Response:\n200 OK\n",
+		"(trace) Traffic Bytes (in|out): 10 | 20 -- (1 OnMessages, 1 Sends)\n",
+	}
+	for _, test := range []struct {
+		level, components string
+		expected          []int
+	}{
+		{"info", "", []int{0, 1, 2}},
+		{"error", "", []int{0}},
+		{"trace", "", []int{0, 1, 2, 3, 4}},
+		{"debug", "ice", []int{1, 2}},
+		{"trace", "broker, turbotunnel", []int{3, 4}},
+	} {
+		var out bytes.Buffer
+		f, err := newLogFilter(&out, test.level, test.components)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expected string
+		for _, i := range test.expected {
+			expected += messages[i]
+		}
+		for _, msg := range messages {
+			f.Write([]byte(msg))
+		}
+		if out.String() != expected {
+			t.Errorf("-v %s -components %q: got %q, expected %q", test.level, test.components, out.String(), expected)
+		}
+	}
+
+	if _, err := newLogFilter(nil, "verbose", ""); err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+}
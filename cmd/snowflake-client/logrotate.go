@@ -0,0 +1,176 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Layout of the timestamp appended to the name of rotated log files.
+const backupTimeLayout = "20060102T150405.000"
+
+// rotatingFile is a log file that is moved aside, to a backup named after
+// the time, once it reaches maxSize bytes. Backups beyond the maxBackups
+// most recent ones, or older than maxAge, are removed. Zero values mean no
+// limit. With compress, backups are gzipped.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	compress   bool
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+
+	// Serializes compressing and removing backups, which happen in the
+	// background.
+	cleanupLock sync.Mutex
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int, compress bool) (*rotatingFile, error) {
+	r := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+		compress:   compress,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	go r.cleanup()
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file, r.size = file, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file to a backup and opens a new one. r.lock
+// must be held.
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	backup := r.path + "." + time.Now().UTC().Format(backupTimeLayout)
+	if err := os.Rename(r.path, backup); err != nil {
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	go r.cleanup()
+	return nil
+}
+
+// backups returns the paths of the backups, most recent first.
+func (r *rotatingFile) backups() ([]string, error) {
+	backups, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	// The timestamps sort like the times they stand for.
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	return backups, nil
+}
+
+// backupTime returns when backup was rotated.
+func (r *rotatingFile) backupTime(backup string) (time.Time, error) {
+	stamp := strings.TrimSuffix(strings.TrimPrefix(backup, r.path+"."), ".gz")
+	return time.Parse(backupTimeLayout, stamp)
+}
+
+// cleanup removes the backups that are too many or too old, and compresses
+// the others.
+func (r *rotatingFile) cleanup() {
+	r.cleanupLock.Lock()
+	defer r.cleanupLock.Unlock()
+	backups, err := r.backups()
+	if err != nil {
+		log.Printf("log rotation: %v", err)
+		return
+	}
+	kept := 0
+	for _, backup := range backups {
+		t, err := r.backupTime(backup)
+		if err != nil {
+			// Not one of ours.
+			continue
+		}
+		if (r.maxBackups > 0 && kept >= r.maxBackups) || (r.maxAge > 0 && time.Since(t) > r.maxAge) {
+			if err := os.Remove(backup); err != nil {
+				log.Printf("log rotation: %v", err)
+			}
+			continue
+		}
+		kept++
+		if r.compress && !strings.HasSuffix(backup, ".gz") {
+			if err := compressFile(backup); err != nil {
+				log.Printf("log rotation: %v", err)
+			}
+		}
+	}
+}
+
+// compressFile replaces path with a gzipped copy named path.gz.
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (r *rotatingFile) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.file.Close()
+}
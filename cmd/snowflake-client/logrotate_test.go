@@ -0,0 +1,90 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snowflake-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snowflake.log")
+
+	r, err := openRotatingFile(path, 10, 0, 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		// Keep the backup names apart.
+		time.Sleep(5 * time.Millisecond)
+	}
+	r.cleanup()
+
+	current, err := ioutil.ReadFile(path)
+	if err != nil || string(current) != "fourth\n" {
+		t.Errorf("current log is %q, %v", current, err)
+	}
+	backups, err := r.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("expected 2 backups, got %v", backups)
+	}
+	if !strings.HasSuffix(backups[0], ".gz") {
+		t.Fatalf("backup %s is not compressed", backups[0])
+	}
+	f, err := os.Open(backups[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, err := ioutil.ReadAll(zr); err != nil || string(content) != "third\n" {
+		t.Errorf("latest backup is %q, %v", content, err)
+	}
+}
+
+func TestRotatingFileMaxAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snowflake-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snowflake.log")
+	old := path + "." + time.Now().Add(-48*time.Hour).UTC().Format(backupTimeLayout)
+	recent := path + "." + time.Now().Add(-time.Hour).UTC().Format(backupTimeLayout)
+	other := path + ".orig"
+	for _, name := range []string{old, recent, other} {
+		if err := ioutil.WriteFile(name, []byte("log\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := openRotatingFile(path, 0, 24*time.Hour, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	r.cleanup()
+	for name, kept := range map[string]bool{old: false, recent: true, other: true} {
+		if _, err := os.Stat(name); (err == nil) != kept {
+			t.Errorf("%s kept: %v, expected %v", name, err == nil, kept)
+		}
+	}
+}
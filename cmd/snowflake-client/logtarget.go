@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Name under which the client logs to the system log.
+const logIdentifier = "snowflake-client"
+
+// openLogTarget returns a writer to the system log called target, other than
+// a file. Each Write is one message.
+func openLogTarget(target string) (io.WriteCloser, error) {
+	switch target {
+	case "syslog":
+		return newSyslogWriter()
+	case "journald":
+		return newJournaldWriter()
+	case "eventlog":
+		return newEventLogWriter()
+	default:
+		return nil, fmt.Errorf("unknown -log-target %q", target)
+	}
+}
+
+// logMessage removes the trailing newline the logger adds to msg.
+func logMessage(msg []byte) string {
+	return strings.TrimRight(string(msg), "\n")
+}
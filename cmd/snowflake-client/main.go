@@ -1,16 +1,26 @@
 // Client transport plugin for the Snowflake pluggable transport.
+//
+// Every flag can also be given as an environment variable named after it,
+// e.g. SNOWFLAKE_URL for -url or SNOWFLAKE_KEEP_LOCAL_ADDRESSES for
+// -keep-local-addresses. A flag on the command line takes precedence over the
+// environment, which takes precedence over the -config file, which takes
+// precedence over the built-in default.
 package main
 
 import (
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -19,94 +29,226 @@ import (
 	pt "git.torproject.org/pluggable-transports/goptlib.git"
 	//sf "git.torproject.org/pluggable-transports/snowflake.git/client/lib"
 	sf "0xacab.org/leap/bitmask-vpn/pkg/snowflake/lib"
-	"git.torproject.org/pluggable-transports/snowflake.git/common/nat"
+	"0xacab.org/leap/bitmask-vpn/pkg/snowflakeclient"
 	"git.torproject.org/pluggable-transports/snowflake.git/common/safelog"
-	"github.com/pion/webrtc/v3"
 )
 
 const (
 	DefaultSnowflakeCapacity = 1
 )
 
-// Accept local SOCKS connections and pass them to the handler.
-func socksAcceptLoop(ln *pt.SocksListener, tongue sf.Tongue, shutdown chan struct{}, wg *sync.WaitGroup) {
-	defer ln.Close()
-	for {
-		conn, err := ln.AcceptSocks()
-		if err != nil {
-			if err, ok := err.(net.Error); ok && err.Temporary() {
-				continue
-			}
-			log.Printf("SOCKS accept error: %s", err)
-			break
-		}
-		log.Printf("SOCKS accepted: %v", conn.Req)
-		go func() {
-			wg.Add(1)
-			defer wg.Done()
-			defer conn.Close()
-
-			err := conn.Grant(&net.TCPAddr{IP: net.IPv4zero, Port: 0})
-			if err != nil {
-				log.Printf("conn.Grant error: %s", err)
-				return
-			}
-
-			handler := make(chan struct{})
-			go func() {
-				err = sf.Handler(conn, tongue)
-				if err != nil {
-					log.Printf("handler error: %s", err)
-				}
-				close(handler)
-				return
+// dataChannelReliability converts the -dc-* flags.
+func dataChannelReliability(unordered bool, maxRetransmits int, maxPacketLifeTime time.Duration) (sf.DataChannelReliability, error) {
+	r := sf.DataChannelReliability{Unordered: unordered}
+	if maxRetransmits > 65535 || maxRetransmits < -1 {
+		return r, fmt.Errorf("invalid -dc-max-retransmits %d", maxRetransmits)
+	}
+	if maxRetransmits >= 0 {
+		n := uint16(maxRetransmits)
+		r.MaxRetransmits = &n
+	}
+	ms := maxPacketLifeTime / time.Millisecond
+	if ms > 65535 || ms < 0 {
+		return r, fmt.Errorf("invalid -dc-max-packet-lifetime %v", maxPacketLifeTime)
+	}
+	if ms > 0 {
+		n := uint16(ms)
+		r.MaxPacketLifeTime = &n
+	}
+	return r, nil
+}
 
-			}()
-			select {
-			case <-shutdown:
-				log.Println("Received shutdown signal")
-			case <-handler:
-				log.Println("Handler ended")
-			}
-			return
-		}()
+// serveHTTP serves handler on addr in the background, for what.
+func serveHTTP(what, addr string, handler http.Handler) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
 	}
+	// The scrubber hides the address, but not the port, which may have been
+	// chosen by the system.
+	log.Printf("Serving %s at %v, port %d", what, ln.Addr(), ln.Addr().(*net.TCPAddr).Port)
+	go func() {
+		log.Printf("serving %s: %v", what, http.Serve(ln, handler))
+	}()
+	return nil
 }
 
-// s is a comma-separated list of ICE server URLs.
-func parseIceServers(s string) []webrtc.ICEServer {
-	var servers []webrtc.ICEServer
-	s = strings.TrimSpace(s)
-	if len(s) == 0 {
-		return nil
-	}
-	urls := strings.Split(s, ",")
-	for _, url := range urls {
-		url = strings.TrimSpace(url)
-		servers = append(servers, webrtc.ICEServer{
-			URLs: []string{url},
-		})
+// pprofHandler serves the net/http/pprof profiles under /debug/pprof/.
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// parseRateLimit parses a -rate-limit of the form UP[/DOWN] in bytes per
+// second. Without DOWN, UP applies both ways.
+func parseRateLimit(s string) (up, down int64, err error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	upStr, downStr := s, s
+	if i := strings.Index(s, "/"); i >= 0 {
+		upStr, downStr = s[:i], s[i+1:]
+	}
+	up, err = strconv.ParseInt(strings.TrimSpace(upStr), 10, 64)
+	if err == nil {
+		down, err = strconv.ParseInt(strings.TrimSpace(downStr), 10, 64)
+	}
+	if err != nil || up < 0 || down < 0 {
+		return 0, 0, fmt.Errorf("invalid -rate-limit %q", s)
 	}
-	return servers
+	return up, down, nil
 }
 
 func main() {
-	iceServersCommas := flag.String("ice", "", "comma-separated list of ICE servers")
+	configFile := flag.String("config", "", "TOML or JSON file with default values for the other flags")
+	iceServersCommas := flag.String("ice", "", "comma-separated list of ICE servers, TURN servers as turn:user:password@host:port")
+	iceListURL := flag.String("ice-list-url", "", "URL of a signed list of ICE servers to use instead of -ice, which remains the fallback")
+	iceListKey := flag.String("ice-list-key", "", "base64 Ed25519 public key the -ice-list-url list must be signed with")
+	iceListCache := flag.String("ice-list-cache", "", "file to keep the -ice-list-url list in until it expires")
+	clientToken := flag.Bool("client-token", false, "send the broker a random client token, which it can match clients fairly by; rotate it through the control socket")
+	clientTokenFile := flag.String("client-token-file", "", "file to keep the -client-token in across restarts; defaults to one in tor's pt state dir, if there is one")
+	lastGoodFile := flag.String("last-good-file", "", "file to keep the broker, front, ICE servers and NAT type of the last snowflake to connect in, to try them first on the next start; defaults to one in tor's pt state dir, if there is one")
+	preset := flag.String("settings", "", "settings preset for a censorship environment (ir, ru or cn), setting the broker, fronts, ICE servers and ICE policy known to work there, overriding the flags")
+	presetsFile := flag.String("settings-file", "", "file to read the -settings presets from instead of the built-in ones, one per line: name key=value...")
+	settingsURL := flag.String("settings-url", "", "circumvention settings API, such as https://bridges.torproject.org/moat/circumvention/settings, to get the broker, fronts and ICE servers that work in the country from, overriding the flags")
+	settingsFront := flag.String("settings-front", "", "front domain for -settings-url")
+	settingsCountry := flag.String("settings-country", "", "two-letter country code to ask -settings-url for; empty for the API to tell from our address")
+	settingsCache := flag.String("settings-cache", "", "file to keep the -settings-url settings in; defaults to one in tor's pt state dir, if there is one")
+	iceSelection := flag.String("ice-selection", snowflakeclient.ICESelectionRandomHalf, "which ICE servers to offer each snowflake: all, random-half, first-n (the first -ice-count) or weighted (-ice-count random ones, favoring STUN servers that answer; half if 0)")
+	iceCount := flag.Int("ice-count", 0, "how many ICE servers the first-n and weighted -ice-selection offer")
 	brokerURL := flag.String("url", "", "URL of signaling broker")
-	frontDomain := flag.String("front", "", "front domain")
+	fingerprint := flag.String("fingerprint", "", "fingerprint of the bridge to ask the broker for, if it serves several; the fingerprint= of the bridge line takes precedence")
+	webSocketURL := flag.String("websocket-fallback", "", "ws or wss URL of the bridge to connect to directly when WebRTC keeps failing, as on networks that block UDP; the connection is then visibly to the bridge or -websocket-front")
+	webSocketFront := flag.String("websocket-front", "", "front domain to reach the -websocket-fallback URL through")
+	webSocketAfter := flag.Int("websocket-after", snowflakeclient.DefaultWebSocketAfter, "how many snowflakes in a row must fail before using -websocket-fallback")
+	bridges := flag.String("bridges", "", "comma-separated fingerprints of the bridges behind the broker to spread sessions over, failing over from those that are down; overrides -fingerprint")
+	fronts := flag.String("fronts", "", "comma-separated list of front domains, one is chosen at random for each request")
+	frontsFile := flag.String("fronts-file", "", "file with front domains to add to -fronts, one per line")
+	rendezvous := flag.String("rendezvous", "", "comma-separated list of rendezvous methods (http, ampcache, sqs) to race; by default the ones configured")
+	proxyTypes := flag.String("proxy-types", "", "comma-separated proxy types (standalone, webext, badge, iptproxy) to ask the broker for; a hint it may ignore")
+	countries := flag.String("countries", "", "comma-separated country codes to ask the broker for proxies from; a hint it may ignore")
+	excludeCountries := flag.String("exclude-countries", "", "comma-separated country codes, such as your own, to ask the broker to avoid proxies from; a hint it may ignore")
+	ampCacheURL := flag.String("ampcache", "", "URL of AMP cache to use as a proxy for signaling")
+	sqsQueueURL := flag.String("sqsqueue", "", "URL of SQS Queue to use as a proxy for signaling")
+	sqsCreds := flag.String("sqscreds", "", "credentials to access SQS Queue")
 	logFilename := flag.String("log", "", "name of log file")
+	logTarget := flag.String("log-target", "file", "where to log: file (the -log file), syslog, journald or eventlog (Windows)")
+	logMaxSize := flag.Int("log-max-size", 0, "rotate the log file once it reaches this many megabytes, 0 never to")
+	logMaxAge := flag.Duration("log-max-age", 0, "remove rotated log files older than this, 0 never to")
+	logMaxBackups := flag.Int("log-max-backups", 0, "how many rotated log files to keep, 0 for all")
+	logCompress := flag.Bool("log-compress", false, "gzip rotated log files")
+	logFormat := flag.String("log-format", "text", "format of the log: text, or json for one JSON record per line")
+	logVerbosity := flag.String("v", "info", "least important messages to log: error, warn, info, debug or trace")
+	logOnly := flag.String("components", "", "comma-separated components to log (broker, ice, webrtc, socks, turbotunnel, client), all if empty")
 	logToStateDir := flag.Bool("log-to-state-dir", false, "resolve the log file relative to tor's pt state dir")
 	keepLocalAddresses := flag.Bool("keep-local-addresses", false, "keep local LAN address ICE candidates")
+	icePolicy := flag.String("ice-policy", "all", "which ICE candidates to use: all, relay (TURN servers only), no-host (leave host candidates out of the offer) or auto (relay only while the NAT is symmetric and filters by port)")
+	preferIPv6 := flag.Bool("prefer-ipv6", false, "connect to proxies over IPv6 when possible")
+	dcUnordered := flag.Bool("dc-unordered", false, "let the DataChannel deliver messages out of order")
+	dcMaxRetransmits := flag.Int("dc-max-retransmits", -1, "how many times the DataChannel retransmits a lost message, -1 for no limit")
+	dcMaxPacketLifeTime := flag.Duration("dc-max-packet-lifetime", 0, "for how long the DataChannel retransmits a lost message, 0 for no limit")
+	sctpSendBuffer := flag.Int("sctp-send-buffer", 0, "bytes queued on the DataChannel before writes block, 0 for no limit")
+	sctpMaxMessageSize := flag.Int("sctp-max-message-size", 0, "largest DataChannel message to send in bytes, 0 for the default")
+	udpPortMin := flag.Uint("udp-port-min", 0, "lowest local UDP port to use for ICE, 0 for any")
+	udpPortMax := flag.Uint("udp-port-max", 0, "highest local UDP port to use for ICE, 0 for any")
+	portMapping := flag.Bool("port-mapping", false, "ask the router to forward the ICE UDP ports, those of -udp-port-min and -udp-port-max or 32 random ones, through NAT-PMP or UPnP, and offer its external address to proxies")
+	iceTCP := flag.String("ice-tcp", "", "also offer passive ICE-TCP candidates, accepting TCP connections from proxies at this address, e.g. :9443, for networks that filter UDP; only proxies that can reach it connect this way")
+	iface := flag.String("interface", "", "network interface, e.g. wlan0, to reach the broker and gather ICE host candidates on, when the default route must be avoided; Linux and macOS only")
+	statsInterval := flag.Duration("stats-interval", 0, "how often to log WebRTC stats of each snowflake, 0 not to")
+	idleTimeout := flag.Duration("idle-timeout", sf.SnowflakeTimeout, "replace snowflakes that receive nothing for this long")
+	lifetime := flag.Duration("snowflake-lifetime", 0, "catch a replacement for a snowflake connected this long and hand the session over to it, before the proxy is likely to go away; 0 not to")
+	keepAlive := flag.Duration("keepalive", sf.KeepAliveInterval, "how often to send a heartbeat through the current snowflake; keep it well under -idle-timeout")
+	kcpSendWindow := flag.Int("kcp-send-window", sf.KCP.SendWindow, "KCP packets in flight towards the bridge; lower it on slow links to keep latency down")
+	kcpReceiveWindow := flag.Int("kcp-receive-window", sf.KCP.ReceiveWindow, "KCP packets the bridge may have in flight to us")
+	kcpNoDelay := flag.Bool("kcp-nodelay", sf.KCP.NoDelay, "have KCP retransmit sooner, for interactivity at the cost of bandwidth")
+	kcpInterval := flag.Duration("kcp-interval", sf.KCP.Interval, "how often KCP flushes, from 10ms to 5s")
+	kcpFastResend := flag.Int("kcp-fast-resend", sf.KCP.FastResend, "have KCP retransmit a packet once this many later ones are acknowledged, 0 only on timeout")
+	kcpCongestion := flag.Bool("kcp-congestion", sf.KCP.Congestion, "have KCP limit sending with a congestion window too, for fairness on shared high-latency links")
+	proxyCooldown := flag.Duration("proxy-cooldown", sf.ProxyCooldown, "skip proxies that failed to connect or died right away for this long when the broker offers them again, 0 not to")
+	evictRTT := flag.Duration("evict-rtt", 0, "replace snowflakes whose round trip time is above this, 0 not to")
+	evictThroughput := flag.Int("evict-throughput", 0, "replace snowflakes receiving fewer bytes per second than this while sending, 0 not to")
+	evictErrorRate := flag.Float64("evict-error-rate", 0, "replace snowflakes on which more than this fraction of writes fail, 0 not to")
+	evictLoss := flag.Float64("evict-loss", 0, "replace snowflakes through which more than this fraction of packets must be sent again, 0 not to")
 	unsafeLogging := flag.Bool("unsafe-logging", false, "prevent logs from being scrubbed")
+	scrub := flag.String("scrub", "", "regular expression whose matches are scrubbed from the log, in addition to addresses and ICE credentials")
+	rendezvousProxy := flag.String("rendezvous-proxy", "", "SOCKS5 or HTTP proxy to reach the broker through, such as socks5://127.0.0.1:9050 for a tor that already works, so that the local network does not see it contacted; the snowflakes themselves do not go through it")
+	utlsImitate := flag.String("utls-imitate", "", "imitate the TLS ClientHello of a browser when contacting the broker (chrome, firefox, ios, randomized)")
+	echConfig := flag.String("ech-config", "", "base64 ECH config list of the broker, to use Encrypted Client Hello")
+	echResolver := flag.String("ech-resolver", "", "DNS server (host:port) to fetch the broker's ECH config list from, if -ech-config is not given")
+	brokerKey := flag.String("broker-key", "", "base64 Ed25519 public key the broker signs its answers with, so that a compromised front domain or AMP cache cannot pick the proxy; defaults to the key built in, if any")
+	brokerPins := flag.String("broker-pin", "", "comma-separated SHA-256 public key pins (sha256/BASE64, as in HPKP) of the broker, or of its front domain when domain fronted; rendezvous fails unless the certificate chain has one of them, as behind TLS-intercepting middleboxes")
+	brokerCA := flag.String("broker-ca", "", "PEM file of the certificate authorities to trust for the broker instead of the system ones")
+	brokerTimeout := flag.Duration("broker-timeout", 0, "how long to wait for the broker to answer, 0 for no limit")
+	brokerRetries := flag.Int("broker-retries", 0, "how many times to retry a failed rendezvous before giving up on it")
+	backoffBase := flag.Duration("backoff-base", sf.DefaultBackoff.Base, "how long to wait before retrying a failed rendezvous, snowflake or NAT probe; doubled after each further failure")
+	backoffCap := flag.Duration("backoff-cap", sf.DefaultBackoff.Cap, "longest wait between retries, 0 for no limit")
+	backoffJitter := flag.Duration("backoff-jitter", sf.DefaultBackoff.Jitter, "maximum random time added to each wait between retries")
+	parallelDials := flag.Int("parallel-dials", 1, "how many snowflakes to dial at once when one is needed, keeping the first to connect")
+	standalone := flag.Bool("standalone", false, "run without tor as the parent process and TOR_PT_* environment variables, printing the SOCKS listener address as \"SOCKS5 ADDRESS\"")
+	socksAddr := flag.String("socks-addr", "127.0.0.1:0", "address to listen for SOCKS connections at, e.g. 127.0.0.1:9150 (port 0 for any), or unix:PATH for a Unix socket; only loopback addresses without -socks-auth")
+	socksAuthFlag := flag.String("socks-auth", "", "USER:PASSWORD that SOCKS clients must log in with, which then cannot pass SOCKS args; required for a -socks-addr that is not a loopback address")
+	socksAuthFile := flag.String("socks-auth-file", "", "file with the USER:PASSWORD of -socks-auth, to keep the password off the command line")
+	maxSocksConns := flag.Int("max-socks-conns", 0, "refuse SOCKS connections beyond this many open at once, 0 for no limit")
+	socksAcceptRate := flag.Float64("socks-accept-rate", 0, "refuse SOCKS connections beyond this many per second, 0 for no limit")
+	httpConnectAddr := flag.String("listen-http-connect", "", "loopback address or unix:PATH to also accept HTTP CONNECT requests at, tunneling them like SOCKS connections")
+	transparentAddr := flag.String("listen-transparent", "", "address to accept TCP connections redirected by the firewall (REDIRECT or TPROXY) at, tunneling them like SOCKS connections; Linux only")
+	multiplex := flag.Bool("multiplex", false, "carry all SOCKS connections over a single set of snowflakes")
+	watchNetwork := flag.Bool("watch-network", true, "start over with new snowflakes and NAT probing when the network changes")
+	watchSleep := flag.Bool("watch-sleep", true, "start over with new snowflakes and NAT probing when the system resumes from sleep")
+	natProbeTimeout := flag.Duration("nat-probe-timeout", snowflakeclient.DefaultNATProbeTimeout, "how long to wait for the STUN servers to tell the NAT type")
+	natType := flag.String("nat-type", "", "tell the broker this NAT type (unknown, restricted or unrestricted) instead of probing it, e.g. where STUN is blocked")
+	natProbeInterval := flag.Duration("nat-probe-interval", 30*time.Minute, "how often to probe the NAT type again and tell the broker, 0 only when starting over")
+	giveBack := flag.Bool("give-back", false, "while the tunnel is idle and the NAT is unrestricted, also run a snowflake proxy to serve other users")
+	giveBackRelay := flag.String("give-back-relay", snowflakeclient.DefaultGiveBackRelay, "WebSocket URL of the bridge that -give-back relays the users it serves to")
+	giveBackClients := flag.Int("give-back-clients", 1, "how many users -give-back serves at once")
+	giveBackRate := flag.Int64("give-back-rate", 64<<10, "bytes per second that -give-back relays for all users together, 0 for no limit")
+	metricsAddr := flag.String("metrics-addr", "", "address to serve Prometheus metrics at, e.g. 127.0.0.1:9090")
+	controlSocket := flag.String("control-socket", "", "path of a Unix socket to accept JSON-RPC control requests on (status, reload, drop-peers, rotate-token, set-ice, set-broker, shutdown)")
+	dbusBus := flag.String("dbus", "", "export the connection state as org.leap.SnowflakeClient on the session or system D-Bus")
+	pprofAddr := flag.String("pprof-addr", "", "address to serve net/http/pprof profiles at, e.g. 127.0.0.1:0")
+	rateLimit := flag.String("rate-limit", "", "limit the traffic of all SOCKS connections to UP[/DOWN] bytes per second, 0 for no limit")
+	paddingQuantum := flag.Int("padding", 0, "pad the packets sent to the bridge to a multiple of this many bytes, to hide their sizes; 0 not to")
+	paddingIdle := flag.Duration("padding-idle", 0, "send a dummy packet to the bridge when nothing was sent for about this long, to hide idle times; 0 not to")
+	dormantAfter := flag.Duration("dormant-after", 0, "close the snowflakes kept ahead of time after this long without SOCKS connections, 0 never to")
+	min := flag.Int("min", 0, "number of snowflakes to keep connected ahead of time")
 	max := flag.Int("max", DefaultSnowflakeCapacity,
 		"capacity for number of multiplexed WebRTC peers")
+	adaptiveMax := flag.Bool("adaptive-max", true, "treat -max as a ceiling, keeping a single snowflake for light use and more as SOCKS connections open and traffic grows")
+	snowflakeThroughput := flag.Int64("snowflake-throughput", sf.ThroughputPerSnowflake, "with -adaptive-max, bytes per second of traffic that call for one more snowflake, 0 to scale with the SOCKS connections only")
 
 	// Deprecated
 	oldLogToStateDir := flag.Bool("logToStateDir", false, "use -log-to-state-dir instead")
 	oldKeepLocalAddresses := flag.Bool("keepLocalAddresses", false, "use -keep-local-addresses instead")
+	oldFrontDomain := flag.String("front", "", "use -fronts instead")
+	oldBrokerRetryInterval := flag.Duration("broker-retry-interval", 0, "use -backoff-base instead")
+	oldBrokerRetryJitter := flag.Duration("broker-retry-jitter", 0, "use -backoff-jitter instead")
 
 	flag.Parse()
 
+	// Values from the environment and then from the config file only fill
+	// in flags that were not given on the command line.
+	explicit := explicitFlags(flag.CommandLine)
+	if err := applyEnv(flag.CommandLine, explicit); err != nil {
+		log.Fatal(err)
+	}
+	// What the config file set when it was last loaded.
+	var loaded fileConfig
+	if *configFile != "" {
+		cfg, err := loadConfigFile(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := cfg.apply(flag.CommandLine, explicit, nil); err != nil {
+			log.Fatal(err)
+		}
+		loaded = cfg
+	}
+
 	log.SetFlags(log.LstdFlags | log.LUTC)
 
 	// Don't write to stderr; versions of tor earlier than about 0.3.5.6 do
@@ -115,7 +257,16 @@ func main() {
 	// https://bugs.torproject.org/26360
 	// https://bugs.torproject.org/25600#comment:14
 	var logOutput = ioutil.Discard
-	if *logFilename != "" {
+	if *logTarget != "file" {
+		target, err := openLogTarget(*logTarget)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer target.Close()
+		logOutput = target
+		// The system log timestamps messages itself.
+		log.SetFlags(0)
+	} else if *logFilename != "" {
 		if *logToStateDir || *oldLogToStateDir {
 			stateDir, err := pt.MakeStateDir()
 			if err != nil {
@@ -123,82 +274,278 @@ func main() {
 			}
 			*logFilename = filepath.Join(stateDir, *logFilename)
 		}
-		logFile, err := os.OpenFile(*logFilename,
-			os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		logFile, err := openRotatingFile(*logFilename, int64(*logMaxSize)<<20,
+			*logMaxAge, *logMaxBackups, *logCompress)
 		if err != nil {
 			log.Fatal(err)
 		}
 		defer logFile.Close()
 		logOutput = logFile
 	}
-	if *unsafeLogging {
-		log.SetOutput(logOutput)
-	} else {
+	switch *logFormat {
+	case "text":
+	case "json":
+		// The records carry their own timestamp.
+		log.SetFlags(0)
+		logOutput = &jsonLogWriter{Output: logOutput}
+	default:
+		log.Fatalf("unknown -log-format %q", *logFormat)
+	}
+	if !*unsafeLogging {
 		// We want to send the log output through our scrubber first
-		log.SetOutput(&safelog.LogScrubber{Output: logOutput})
+		patterns, err := newScrubPatterns(*scrub)
+		if err != nil {
+			log.Fatalf("invalid -scrub pattern: %v", err)
+		}
+		logOutput = &logScrubber{
+			Output:   &safelog.LogScrubber{Output: logOutput},
+			patterns: patterns,
+		}
+	}
+	logFilter, err := newLogFilter(logOutput, *logVerbosity, *logOnly)
+	if err != nil {
+		log.Fatal(err)
 	}
+	log.SetOutput(logFilter)
 
 	log.Println("\n\n\n --- Starting Snowflake Client ---")
 
-	iceServers := parseIceServers(*iceServersCommas)
-	// chooses a random subset of servers from inputs
 	rand.Seed(time.Now().UnixNano())
-	rand.Shuffle(len(iceServers), func(i, j int) {
-		iceServers[i], iceServers[j] = iceServers[j], iceServers[i]
-	})
-	if len(iceServers) > 2 {
-		iceServers = iceServers[:(len(iceServers)+1)/2]
+
+	if *oldBrokerRetryInterval != 0 {
+		*backoffBase = *oldBrokerRetryInterval
+	}
+	if *oldBrokerRetryJitter != 0 {
+		*backoffJitter = *oldBrokerRetryJitter
 	}
-	log.Printf("Using ICE servers:")
-	for _, server := range iceServers {
-		log.Printf("url: %v", strings.Join(server.URLs, " "))
+	if *keepAlive <= 0 || *keepAlive > 10*time.Minute {
+		log.Fatalf("invalid -keepalive %v", *keepAlive)
 	}
+	kcp := sf.KCPSettings{
+		SendWindow:    *kcpSendWindow,
+		ReceiveWindow: *kcpReceiveWindow,
+		NoDelay:       *kcpNoDelay,
+		Interval:      *kcpInterval,
+		FastResend:    *kcpFastResend,
+		Congestion:    *kcpCongestion,
+	}
+	if err := kcp.Check(); err != nil {
+		log.Fatal(err)
+	}
+	sf.ThroughputPerSnowflake = *snowflakeThroughput
 
-	// Use potentially domain-fronting broker to rendezvous.
-	broker, err := sf.NewBrokerChannel(
-		*brokerURL, *frontDomain, sf.CreateBrokerTransport(),
-		*keepLocalAddresses || *oldKeepLocalAddresses)
+	upLimit, downLimit, err := parseRateLimit(*rateLimit)
 	if err != nil {
-		log.Fatalf("parsing broker URL: %v", err)
+		log.Fatal(err)
+	}
+	if *paddingQuantum < 0 || *paddingIdle < 0 {
+		log.Fatal("-padding and -padding-idle cannot be negative")
 	}
-	go updateNATType(iceServers, broker)
 
-	// Create a new WebRTCDialer to use as the |Tongue| to catch snowflakes
-	dialer := sf.NewWebRTCDialer(broker, iceServers, *max)
+	backoff := sf.Backoff{Base: *backoffBase, Cap: *backoffCap, Jitter: *backoffJitter}
+	tuning := &sf.Tuning{
+		KCP:               kcp,
+		KeepAliveInterval: *keepAlive,
+		RedialBackoff:     backoff,
+		ProxyCooldown:     *proxyCooldown,
+		Padding:           sf.Padding{Quantum: *paddingQuantum, Idle: *paddingIdle},
+		UpLimit:           upLimit,
+		DownLimit:         downLimit,
+	}
 
-	// Begin goptlib client process.
-	ptInfo, err := pt.ClientSetup(nil)
-	if err != nil {
-		log.Fatal(err)
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", sf.MetricsHandler())
+		if err := serveHTTP("metrics", *metricsAddr, mux); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *pprofAddr != "" {
+		if err := serveHTTP("pprof", *pprofAddr, pprofHandler()); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Begin goptlib client process. Without tor as the parent, there is no
+	// managed proxy environment to read, and only snowflake to offer.
+	ptInfo := pt.ClientInfo{MethodNames: []string{"snowflake"}}
+	if !*standalone {
+		ptInfo, err = pt.ClientSetup(nil)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 	if ptInfo.ProxyURL != nil {
-		pt.ProxyError("proxy is not supported")
-		os.Exit(1)
+		if err := sf.CheckProxyProtocolSupport(ptInfo.ProxyURL); err != nil {
+			pt.ProxyError(err.Error())
+			os.Exit(1)
+		}
+		log.Printf("Using upstream proxy %s://%s", ptInfo.ProxyURL.Scheme, ptInfo.ProxyURL.Host)
+		pt.ProxyDone()
+	}
+
+	// Keep the settings and what last worked in tor's pt state dir, when
+	// there is one, unless the flags say where.
+	stateDir, err := pt.MakeStateDir()
+	if err != nil {
+		stateDir = ""
+	}
+	inStateDir := func(path, name string) string {
+		if path == "" && stateDir != "" {
+			return filepath.Join(stateDir, name)
+		}
+		return path
+	}
+
+	// dialerConfig gathers the dialer settings from the flags, which a
+	// reload or the control socket may have changed since.
+	dialerConfig := func() (snowflakeclient.DialerConfig, error) {
+		reliability, err := dataChannelReliability(*dcUnordered, *dcMaxRetransmits, *dcMaxPacketLifeTime)
+		if err != nil {
+			return snowflakeclient.DialerConfig{}, err
+		}
+		settingsCachePath := *settingsCache
+		if *settingsURL != "" {
+			settingsCachePath = inStateDir(settingsCachePath, "circumvention-settings.json")
+		}
+		clientTokenPath := *clientTokenFile
+		if *clientToken {
+			clientTokenPath = inStateDir(clientTokenPath, "client-token")
+		}
+		return snowflakeclient.DialerConfig{
+			ICEServers:         *iceServersCommas,
+			ICEListURL:         *iceListURL,
+			ICEListKey:         *iceListKey,
+			ICEListCache:       *iceListCache,
+			Preset:             *preset,
+			PresetsFile:        *presetsFile,
+			SettingsURL:        *settingsURL,
+			SettingsFront:      *settingsFront,
+			SettingsCountry:    *settingsCountry,
+			SettingsCache:      settingsCachePath,
+			ClientToken:        *clientToken,
+			ClientTokenFile:    clientTokenPath,
+			LastGoodFile:       inStateDir(*lastGoodFile, "last-good.json"),
+			ICESelection:       *iceSelection,
+			ICECount:           *iceCount,
+			ProxyTypes:         *proxyTypes,
+			Countries:          *countries,
+			ExcludeCountries:   *excludeCountries,
+			BrokerURL:          *brokerURL,
+			Fronts:             strings.Trim(*fronts+","+*oldFrontDomain, ","),
+			FrontsFile:         *frontsFile,
+			Rendezvous:         *rendezvous,
+			AMPCache:           *ampCacheURL,
+			SQSQueue:           *sqsQueueURL,
+			SQSCreds:           *sqsCreds,
+			KeepLocalAddresses: *keepLocalAddresses || *oldKeepLocalAddresses,
+			ICEPolicy:          *icePolicy,
+			PreferIPv6:         *preferIPv6,
+			StatsInterval:      *statsInterval,
+			IdleTimeout:        *idleTimeout,
+			Lifetime:           *lifetime,
+			Reliability:        reliability,
+			UDPPortMin:         *udpPortMin,
+			UDPPortMax:         *udpPortMax,
+			ICETCP:             *iceTCP,
+			PortMapping:        *portMapping,
+			Interface:          *iface,
+			NATProbeTimeout:    *natProbeTimeout,
+			NATType:            *natType,
+			Max:                *max,
+			Fingerprint:        *fingerprint,
+			Bridges:            *bridges,
+			WebSocketURL:       *webSocketURL,
+			WebSocketFront:     *webSocketFront,
+			WebSocketAfter:     *webSocketAfter,
+			AdaptiveMax:        *adaptiveMax,
+			ParallelDials:      *parallelDials,
+			Proxy:              ptInfo.ProxyURL,
+			RendezvousProxy:    *rendezvousProxy,
+			ClientHello:        *utlsImitate,
+			ECHConfig:          *echConfig,
+			ECHResolver:        *echResolver,
+			BrokerKey:          *brokerKey,
+			BrokerPins:         *brokerPins,
+			BrokerCAFile:       *brokerCA,
+			SCTP: sf.SCTPOptions{
+				SendBufferSize: *sctpSendBuffer,
+				MaxMessageSize: *sctpMaxMessageSize,
+			},
+			Quality: sf.QualityThresholds{
+				MaxRTT:        *evictRTT,
+				MinThroughput: *evictThroughput,
+				MaxErrorRate:  *evictErrorRate,
+				MaxLoss:       *evictLoss,
+			},
+			Retry: sf.RetryPolicy{
+				Timeout: *brokerTimeout,
+				Backoff: backoff,
+				Retries: *brokerRetries,
+			},
+		}, nil
+	}
+	config, err := dialerConfig()
+	if err != nil {
+		log.Fatalf("creating dialer: %v", err)
 	}
-	listeners := make([]net.Listener, 0)
-	shutdown := make(chan struct{})
-	var wg sync.WaitGroup
+
+	var client *snowflakeclient.Client
 	for _, methodName := range ptInfo.MethodNames {
 		switch methodName {
 		case "snowflake":
-			// TODO: Be able to recover when SOCKS dies.
-			ln, err := pt.ListenSocks("tcp", "127.0.0.1:0")
-			if err != nil {
+			client, err = snowflakeclient.Start(snowflakeclient.Config{
+				Dialer:           config,
+				Tuning:           tuning,
+				SocksAddr:        *socksAddr,
+				SocksAuth:        *socksAuthFlag,
+				SocksAuthFile:    *socksAuthFile,
+				MaxSocksConns:    *maxSocksConns,
+				SocksAcceptRate:  *socksAcceptRate,
+				HTTPConnectAddr:  *httpConnectAddr,
+				TransparentAddr:  *transparentAddr,
+				Min:              *min,
+				Multiplex:        *multiplex,
+				DormantAfter:     *dormantAfter,
+				WatchNetwork:     *watchNetwork,
+				WatchSleep:       *watchSleep,
+				NATProbeInterval: *natProbeInterval,
+				GiveBack:         *giveBack,
+				GiveBackRelay:    *giveBackRelay,
+				GiveBackClients:  *giveBackClients,
+				GiveBackRate:     *giveBackRate,
+			})
+			if err != nil && *standalone {
+				log.Fatal(err)
+			} else if err != nil {
 				pt.CmethodError(methodName, err.Error())
-				break
+				log.Fatal(err)
+			}
+			if *standalone {
+				fmt.Printf("SOCKS5 %v\n", client.SocksAddr())
+			} else {
+				pt.Cmethod(methodName, "socks5", client.SocksAddr())
 			}
-			log.Printf("Started SOCKS listener at %v.", ln.Addr())
-			go socksAcceptLoop(ln, dialer, shutdown, &wg)
-			pt.Cmethod(methodName, ln.Version(), ln.Addr())
-			listeners = append(listeners, ln)
 		default:
 			pt.CmethodError(methodName, "no such method")
 		}
 	}
-	pt.CmethodsDone()
+	if !*standalone {
+		pt.CmethodsDone()
+	}
+	if client == nil {
+		log.Fatal("snowflake is not among the transport methods to offer")
+	}
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGTERM)
+	if *standalone {
+		signal.Notify(sigChan, os.Interrupt)
+	} else {
+		statusEvents, stopStatus := sf.SubscribeEvents()
+		defer stopStatus()
+		go reportStatus(pt.Stdout, statusEvents)
+	}
 
 	if os.Getenv("TOR_PT_EXIT_ON_STDIN_CLOSE") == "1" {
 		// This environment variable means we should treat EOF on stdin
@@ -212,38 +559,93 @@ func main() {
 		}()
 	}
 
-	// Wait for a signal.
-	<-sigChan
-	log.Println("stopping snowflake")
-
-	// Signal received, shut down.
-	for _, ln := range listeners {
-		ln.Close()
+	// reconfigure applies change, if any, and rebuilds the dialer from the
+	// flags. Existing SOCKS connections keep their sessions, but every
+	// subsequent dial uses the new settings.
+	var reconfiguring sync.Mutex
+	reconfigure := func(change func() error) error {
+		reconfiguring.Lock()
+		defer reconfiguring.Unlock()
+		if change != nil {
+			if err := change(); err != nil {
+				return err
+			}
+		}
+		config, err := dialerConfig()
+		if err != nil {
+			return fmt.Errorf("creating dialer: %v", err)
+		}
+		return client.Reconfigure(config)
+	}
+	reload := func() error {
+		return reconfigure(func() error {
+			if *configFile == "" {
+				return nil
+			}
+			cfg, err := loadConfigFile(*configFile)
+			if err != nil {
+				return err
+			}
+			if err := cfg.apply(flag.CommandLine, explicit, loaded); err != nil {
+				return err
+			}
+			loaded = cfg
+			return nil
+		})
 	}
-	close(shutdown)
-	wg.Wait()
-	log.Println("snowflake is done.")
-}
 
-// loop through all provided STUN servers until we exhaust the list or find
-// one that is compatable with RFC 5780
-func updateNATType(servers []webrtc.ICEServer, broker *sf.BrokerChannel) {
-
-	var restrictedNAT bool
-	var err error
-	for _, server := range servers {
-		addr := strings.TrimPrefix(server.URLs[0], "stun:")
-		restrictedNAT, err = nat.CheckIfRestrictedNAT(addr)
-		if err == nil {
-			if restrictedNAT {
-				broker.SetNATType(nat.NATRestricted)
-			} else {
-				broker.SetNATType(nat.NATUnrestricted)
+	// Reload the config file and rebuild the dialer on SIGHUP.
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			log.Println("SIGHUP received, reloading configuration")
+			if err := reload(); err != nil {
+				log.Printf("reload: %v", err)
 			}
-			break
 		}
+	}()
+
+	if *controlSocket != "" {
+		// Flags set through the control socket take precedence over the
+		// config file, like those given on the command line.
+		setFlag := func(name, value string) error {
+			return reconfigure(func() error {
+				if err := flag.Set(name, value); err != nil {
+					return err
+				}
+				explicit[name] = true
+				return nil
+			})
+		}
+		stop := func() {
+			select {
+			case sigChan <- syscall.SIGTERM:
+			default:
+			}
+		}
+		ln, err := listenControl(*controlSocket, newControlMethods(client, setFlag, reload, stop))
+		if err != nil {
+			log.Fatalf("control socket: %v", err)
+		}
+		defer ln.Close()
 	}
-	if err != nil {
-		broker.SetNATType(nat.NATUnknown)
+
+	if *dbusBus != "" {
+		// The client works without its desktop integration.
+		service, err := startDBusService(*dbusBus)
+		if err != nil {
+			log.Printf("D-Bus: %v", err)
+		} else {
+			defer service.Close()
+		}
 	}
+
+	// Wait for a signal.
+	<-sigChan
+	log.Println("stopping snowflake")
+
+	// Signal received, shut down.
+	client.Stop()
+	log.Println("snowflake is done.")
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDataChannelReliability(t *testing.T) {
+	r, err := dataChannelReliability(false, -1, 0)
+	if err != nil || r.Unordered || r.MaxRetransmits != nil || r.MaxPacketLifeTime != nil {
+		t.Errorf("defaults are not fully reliable: %+v %v", r, err)
+	}
+	r, err = dataChannelReliability(true, 0, 0)
+	if err != nil || !r.Unordered || r.MaxRetransmits == nil || *r.MaxRetransmits != 0 {
+		t.Errorf("zero retransmits not set: %+v %v", r, err)
+	}
+	r, err = dataChannelReliability(false, -1, 250*time.Millisecond)
+	if err != nil || r.MaxPacketLifeTime == nil || *r.MaxPacketLifeTime != 250 {
+		t.Errorf("packet lifetime not set: %+v %v", r, err)
+	}
+	if _, err = dataChannelReliability(false, 70000, 0); err == nil {
+		t.Errorf("out of range retransmits accepted")
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	for _, test := range []struct {
+		s        string
+		up, down int64
+	}{
+		{"", 0, 0},
+		{"1000", 1000, 1000},
+		{"1000/5000", 1000, 5000},
+		{"0/5000", 0, 5000},
+	} {
+		up, down, err := parseRateLimit(test.s)
+		if err != nil || up != test.up || down != test.down {
+			t.Errorf("parseRateLimit(%q) = %d, %d, %v", test.s, up, down, err)
+		}
+	}
+	for _, s := range []string{"fast", "1000/", "-1", "1/2/3"} {
+		if _, _, err := parseRateLimit(s); err == nil {
+			t.Errorf("parseRateLimit(%q) did not fail", s)
+		}
+	}
+}
+
+func TestPprofHandler(t *testing.T) {
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/goroutine?debug=1", "/debug/pprof/cmdline"} {
+		w := httptest.NewRecorder()
+		pprofHandler().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("GET %s: %d", path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	sf "0xacab.org/leap/bitmask-vpn/pkg/snowflake/lib"
+)
+
+// bootstrapProgress is how far along the connection of a snowflake is at
+// each of its phases, in percent.
+var bootstrapProgress = map[sf.EventType]int{
+	sf.EventBrokerContacted: 10,
+	sf.EventOfferSent:       25,
+	sf.EventAnswerReceived:  50,
+	sf.EventICEConnected:    75,
+	sf.EventDataChannelOpen: 90,
+	sf.EventPeerConnected:   100,
+}
+
+// reportStatus writes a pt STATUS message to w for each phase a snowflake
+// goes through, so that tor, and the applications reading its log, can show
+// how far along the connection is instead of waiting without news.
+func reportStatus(w io.Writer, events <-chan sf.Event) {
+	for e := range events {
+		progress, ok := bootstrapProgress[e.Type]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(w, "STATUS TRANSPORT=snowflake ID=%s PHASE=%s PROGRESS=%d\n",
+			e.ID, e.Type, progress)
+	}
+}
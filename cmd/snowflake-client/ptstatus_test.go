@@ -0,0 +1,23 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	sf "0xacab.org/leap/bitmask-vpn/pkg/snowflake/lib"
+)
+
+func TestReportStatus(t *testing.T) {
+	events := make(chan sf.Event, 3)
+	events <- sf.Event{Type: sf.EventAnswerReceived, ID: "1a2b"}
+	events <- sf.Event{Type: sf.EventPeerDisconnected, ID: "1a2b"}
+	events <- sf.Event{Type: sf.EventPeerConnected, ID: "3c4d"}
+	close(events)
+	var out bytes.Buffer
+	reportStatus(&out, events)
+	expected := "STATUS TRANSPORT=snowflake ID=1a2b PHASE=answer-received PROGRESS=50\n" +
+		"STATUS TRANSPORT=snowflake ID=3c4d PHASE=peer-connected PROGRESS=100\n"
+	if out.String() != expected {
+		t.Errorf("got %q, expected %q", out.String(), expected)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io"
+	"regexp"
+)
+
+// scrubPattern is a regular expression whose matches are replaced with repl
+// in the log.
+type scrubPattern struct {
+	re   *regexp.Regexp
+	repl string
+}
+
+// An IPv6 address, with its zone.
+const scrubIPv6 = `(?:(?:[0-9a-fA-F]{1,4}:){7}[0-9a-fA-F]{1,4}|` +
+	`(?:[0-9a-fA-F]{1,4}:){1,6}(?::[0-9a-fA-F]{1,4}){1,6}|` +
+	`(?:[0-9a-fA-F]{1,4}:){1,7}:|` +
+	`::(?:[0-9a-fA-F]{1,4}:){0,6}[0-9a-fA-F]{1,4})(?:%[0-9A-Za-z._-]+)?`
+
+// What safelog.LogScrubber leaves in the log. ICE credentials and DTLS
+// fingerprints come first, so that the hex pairs of a fingerprint are not
+// taken for an IPv6 address.
+var defaultScrubPatterns = []scrubPattern{
+	// ICE credentials in an SDP, which may be JSON-encoded.
+	{regexp.MustCompile(`(a=ice-(?:ufrag|pwd):)[^\s"\\]+`), "${1}[scrubbed]"},
+	{regexp.MustCompile(`(a=fingerprint:\S+ )[0-9A-Fa-f:]+`), "${1}[scrubbed]"},
+	// mDNS host names of ICE candidates.
+	{regexp.MustCompile(`\b[0-9A-Za-z-]+\.local\b`), "[scrubbed]"},
+	// IPv6 addresses with a zone or a port, or next to letters or colons
+	// such as in "addr:2001:db8::1", where safelog misses them.
+	{regexp.MustCompile(`\[` + scrubIPv6 + `\](?::\d{1,5})?`), "[scrubbed]"},
+	{regexp.MustCompile(`(^|[^0-9A-Za-z:]|[0-9A-Za-z]+:)` + scrubIPv6), "${1}[scrubbed]"},
+}
+
+// newScrubPatterns returns the default patterns, followed by extra if it is
+// not empty.
+func newScrubPatterns(extra string) ([]scrubPattern, error) {
+	patterns := defaultScrubPatterns
+	if extra != "" {
+		re, err := regexp.Compile(extra)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns[:len(patterns):len(patterns)], scrubPattern{re, "[scrubbed]"})
+	}
+	return patterns, nil
+}
+
+// logScrubber removes from each message what safelog.LogScrubber misses,
+// before passing it on to Output. The log package writes each message at
+// once, so unlike safelog it does not need to buffer lines.
+type logScrubber struct {
+	Output   io.Writer
+	patterns []scrubPattern
+}
+
+func (s *logScrubber) Write(p []byte) (int, error) {
+	msg := p
+	for _, pattern := range s.patterns {
+		msg = pattern.re.ReplaceAll(msg, []byte(pattern.repl))
+	}
+	if _, err := s.Output.Write(msg); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
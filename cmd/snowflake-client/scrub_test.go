@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"testing"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/common/safelog"
+)
+
+// Log lines as the client writes them, and as they should end up in the log.
+var scrubCorpus = []struct {
+	line, expected string
+}{
+	{
+		"2021/05/01 12:00:00 WebRTC: ICE connection state: connected",
+		"2021/05/01 12:00:00 WebRTC: ICE connection state: connected",
+	},
+	{
+		"2021/05/01 12:00:00 [1a2b] SOCKS accepted: map[]",
+		"2021/05/01 12:00:00 [1a2b] SOCKS accepted: map[]",
+	},
+	{
+		"2021/05/01 12:00:00 Traffic Bytes (in|out): 1024 | 512 -- (3 OnMessages, 2 Sends)",
+		"2021/05/01 12:00:00 Traffic Bytes (in|out): 1024 | 512 -- (3 OnMessages, 2 Sends)",
+	},
+	{
+		"2021/05/01 12:00:00 WebRTC: Closing 1a2b after 1m30s: 1024 B up, 512 B down",
+		"2021/05/01 12:00:00 WebRTC: Closing 1a2b after 1m30s: 1024 B up, 512 B down",
+	},
+	{
+		"2021/05/01 12:00:00 SOCKS listening on 127.0.0.1:1080",
+		"2021/05/01 12:00:00 SOCKS listening on [scrubbed]",
+	},
+	{
+		"2021/05/01 12:00:00 WebRTC: local candidate 2001:db8:85a3::8a2e:370:7334 port 54321",
+		"2021/05/01 12:00:00 WebRTC: local candidate [scrubbed] port 54321",
+	},
+	{
+		"2021/05/01 12:00:00 dial udp [2001:db8::1]:3478: connect: network is unreachable",
+		"2021/05/01 12:00:00 dial udp [scrubbed]: connect: network is unreachable",
+	},
+	{
+		"2021/05/01 12:00:00 remote:2001:db8:0:0:1:0:0:1 unreachable",
+		"2021/05/01 12:00:00 remote:[scrubbed] unreachable",
+	},
+	{
+		"2021/05/01 12:00:00 read udp fe80::1c2f:4ff:fe3a:1b2c%wlan0: i/o timeout",
+		"2021/05/01 12:00:00 read udp [scrubbed]: i/o timeout",
+	},
+	{
+		"2021/05/01 12:00:00 candidate:1 1 udp 2122260223 0c1d3e8f-4b6a-4c2d-9e7f-1a2b3c4d5e6f.local 54321 typ host",
+		"2021/05/01 12:00:00 candidate:1 1 udp 2122260223 [scrubbed] 54321 typ host",
+	},
+	{
+		`2021/05/01 12:00:00 (debug) Received answer: {"type":"answer","sdp":"v=0\r\na=ice-ufrag:KfDpXnLq\r\na=ice-pwd:wGbRcYmSdTfHuJkLoPqAzXeC\r\na=fingerprint:sha-256 4A:AD:B9:B1:3F:82:18:3B:54:02:12:DF:3E:5D:49:6B:19:E5:7C:AB:4A:AD:B9:B1:3F:82:18:3B:54:02:12:DF\r\na=candidate:1 1 udp 2122260223 192.0.2.1 54321 typ host\r\n"}`,
+		`2021/05/01 12:00:00 (debug) Received answer: {"type":"answer","sdp":"v=0\r\na=ice-ufrag:[scrubbed]\r\na=ice-pwd:[scrubbed]\r\na=fingerprint:sha-256 [scrubbed]\r\na=candidate:1 1 udp 2122260223 [scrubbed] 54321 typ host\r\n"}`,
+	},
+}
+
+func TestLogScrubber(t *testing.T) {
+	patterns, err := newScrubPatterns("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range scrubCorpus {
+		var out bytes.Buffer
+		w := &logScrubber{Output: &safelog.LogScrubber{Output: &out}, patterns: patterns}
+		log.New(w, "", 0).Println(test.line)
+		if out.String() != test.expected+"\n" {
+			t.Errorf("scrubbed %q\ninto %q\nexpected %q", test.line, out.String(), test.expected+"\n")
+		}
+	}
+}
+
+func TestLogScrubberPattern(t *testing.T) {
+	patterns, err := newScrubPatterns(`bridge-[0-9]+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	w := &logScrubber{Output: &out, patterns: patterns}
+	log.New(w, "", 0).Println("connected to bridge-42 via fe80::1")
+	if out.String() != "connected to [scrubbed] via [scrubbed]\n" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+	if len(defaultScrubPatterns) != len(patterns)-1 {
+		t.Errorf("the default patterns were modified")
+	}
+
+	if _, err := newScrubPatterns(`(`); err == nil {
+		t.Error("expected an error for an invalid pattern")
+	}
+}
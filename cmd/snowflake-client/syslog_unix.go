@@ -0,0 +1,42 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// syslogWriter sends each message to syslog with a severity following
+// logLevel.
+type syslogWriter struct {
+	*syslog.Writer
+}
+
+func newSyslogWriter() (io.WriteCloser, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, logIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	return syslogWriter{w}, nil
+}
+
+func (w syslogWriter) Write(p []byte) (int, error) {
+	msg := logMessage(p)
+	var err error
+	switch logLevel(msg) {
+	case "error":
+		err = w.Err(msg)
+	case "warn":
+		err = w.Warning(msg)
+	case "info":
+		err = w.Info(msg)
+	default:
+		err = w.Debug(msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
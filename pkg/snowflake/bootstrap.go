@@ -7,35 +7,55 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"time"
 
 	"0xacab.org/leap/bitmask-vpn/pkg/config"
+	sf "0xacab.org/leap/bitmask-vpn/pkg/snowflake/lib"
+	"0xacab.org/leap/bitmask-vpn/pkg/snowflakeclient"
 	"github.com/cretz/bine/tor"
 )
 
+// tor uses the snowflake client running in this process as a SOCKS proxy,
+// listening at the address filled in.
 const torrc = `UseBridges 1
 DataDirectory datadir
 
-ClientTransportPlugin snowflake exec /usr/local/bin/snowflake-client \
--url https://snowflake-broker.torproject.net.global.prod.fastly.net/ -front cdn.sstatic.net \
--ice stun:stun.voip.blackberry.com:3478,stun:stun.altar.com.pl:3478,stun:stun.antisip.com:3478,stun:stun.bluesip.net:3478,stun:stun.dus.net:3478,stun:stun.epygi.com:3478,stun:stun.sonetel.com:3478,stun:stun.sonetel.net:3478,stun:stun.stunprotocol.org:3478,stun:stun.uls.co.za:3478,stun:stun.voipgate.com:3478,stun:stun.voys.nl:3478 \
--max 3
+ClientTransportPlugin snowflake socks5 %s
 
 Bridge snowflake 0.0.3.0:1`
 
-func writeTorrc() string {
+var snowflakeConfig = snowflakeclient.Config{
+	Dialer: snowflakeclient.DialerConfig{
+		BrokerURL:     "https://snowflake-broker.torproject.net.global.prod.fastly.net/",
+		Fronts:        "cdn.sstatic.net",
+		ICEServers:    "stun:stun.voip.blackberry.com:3478,stun:stun.altar.com.pl:3478,stun:stun.antisip.com:3478,stun:stun.bluesip.net:3478,stun:stun.dus.net:3478,stun:stun.epygi.com:3478,stun:stun.sonetel.com:3478,stun:stun.sonetel.net:3478,stun:stun.stunprotocol.org:3478,stun:stun.uls.co.za:3478,stun:stun.voipgate.com:3478,stun:stun.voys.nl:3478",
+		Max:           3,
+		ParallelDials: 1,
+		IdleTimeout:   sf.SnowflakeTimeout,
+		Retry:         sf.RetryPolicy{Backoff: sf.DefaultBackoff},
+	},
+}
+
+func writeTorrc(socksAddr net.Addr) string {
 	f, err := ioutil.TempFile("", "torrc-snowflake-")
 	if err != nil {
 		log.Println(err)
 	}
-	f.Write([]byte(torrc))
+	fmt.Fprintf(f, torrc, socksAddr)
 	return f.Name()
 }
 
 func BootstrapWithSnowflakeProxies() error {
-	rcfile := writeTorrc()
+	client, err := snowflakeclient.Start(snowflakeConfig)
+	if err != nil {
+		return err
+	}
+	defer client.Stop()
+
+	rcfile := writeTorrc(client.SocksAddr())
 	conf := &tor.StartConf{DebugWriter: os.Stdout, TorrcFile: rcfile}
 
 	fmt.Println("Starting Tor and fetching files to bootstrap VPN tunnel...")
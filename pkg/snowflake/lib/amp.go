@@ -0,0 +1,163 @@
+// AMP cache rendezvous.
+//
+// The offer is encoded into the path of a GET request to the broker's
+// /amp/client/ endpoint, and the request is sent through an AMP cache, which
+// fetches the page from the broker and relays it. The broker's response is an
+// AMP HTML document with the answer armored inside <pre> elements.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// ampCacheURL returns the URL under which the AMP cache at cacheURL serves
+// the document at pubURL.
+// https://developers.google.com/amp/cache/overview#amp-cache-url-format
+func ampCacheURL(pubURL, cacheURL *url.URL) (*url.URL, error) {
+	if pubURL.Scheme != "https" {
+		return nil, fmt.Errorf("AMP cache requires an https broker URL, got %s", pubURL.Scheme)
+	}
+	host := strings.ToLower(pubURL.Hostname())
+	prefix := strings.Replace(host, "-", "--", -1)
+	prefix = strings.Replace(prefix, ".", "-", -1)
+
+	result := *cacheURL
+	result.Host = prefix + "." + cacheURL.Hostname()
+	result.Path = strings.TrimSuffix(cacheURL.Path, "/") + "/c/s/" + pubURL.Host + pubURL.Path
+	result.RawPath = ""
+	return &result, nil
+}
+
+// ampEncodePath encodes data for use as the last component of an AMP cache
+// URL. A random prefix prevents the cache from answering from its memory.
+func ampEncodePath(data []byte) string {
+	var cacheBreaker [9]byte
+	if _, err := rand.Read(cacheBreaker[:]); err != nil {
+		panic(err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	return "0" + b64(cacheBreaker[:]) + "/" + b64(data)
+}
+
+var preElement = regexp.MustCompile(`(?s)<pre>(.*?)</pre>`)
+
+// ampArmorDecode extracts the data armored in the <pre> elements of an AMP
+// HTML document.
+func ampArmorDecode(doc []byte) ([]byte, error) {
+	var b64 bytes.Buffer
+	for _, m := range preElement.FindAllSubmatch(doc, -1) {
+		for _, c := range m[1] {
+			if !strings.ContainsRune(" \t\r\n", rune(c)) {
+				b64.WriteByte(c)
+			}
+		}
+	}
+	if b64.Len() == 0 {
+		return nil, errors.New("no armored data in AMP response")
+	}
+	return base64.StdEncoding.DecodeString(b64.String())
+}
+
+// ampCacheRendezvous sends the offer to the broker through an AMP cache,
+// optionally domain fronted.
+// Fronts set with SetFronts take precedence over front.
+type ampCacheRendezvous struct {
+	*BrokerChannel
+	broker *url.URL
+	cache  *url.URL
+	front  string
+}
+
+// newAMPCacheRendezvous reads the cache URL from the "ampcache" option.
+func newAMPCacheRendezvous(bc *BrokerChannel, options map[string]string) (RendezvousMethod, error) {
+	if options["ampcache"] == "" {
+		return nil, errors.New("no AMP cache URL given")
+	}
+	cacheURL, err := url.Parse(options["ampcache"])
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Through AMP cache at:", options["ampcache"])
+	// The front domain given to NewBrokerChannel fronts the cache rather
+	// than the broker. bc is left alone, as other methods may share it.
+	broker := *bc.url
+	r := &ampCacheRendezvous{BrokerChannel: bc, broker: &broker, cache: cacheURL}
+	if bc.Host != "" {
+		r.front = bc.url.Host
+		r.broker.Host = bc.Host
+	}
+	return r, nil
+}
+
+func (r *ampCacheRendezvous) Exchange(offer []byte) ([]byte, error) {
+	return r.ExchangeContext(context.Background(), offer)
+}
+
+func (r *ampCacheRendezvous) ExchangeContext(ctx context.Context, offer []byte) ([]byte, error) {
+	reqBody, err := encodeClientPollRequest(offer, r.GetNATType(), r.proxyPreferences, r.bridgeFor(ctx), r.token())
+	if err != nil {
+		return nil, err
+	}
+
+	pubURL := r.broker.ResolveReference(&url.URL{
+		Path: "amp/client/" + ampEncodePath(reqBody),
+	})
+	cacheURL, err := ampCacheURL(pubURL, r.cache)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, "GET", cacheURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	front := r.front
+	if r.fronts != nil {
+		front = r.fronts.pick()
+	}
+	if front != "" {
+		// Domain front the AMP cache itself.
+		request.Host = cacheURL.Host
+		request.URL.Host = front
+	}
+
+	resp, err := r.transport.RoundTrip(request)
+	if r.fronts != nil && ctx.Err() == nil {
+		r.fronts.report(front, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	debugf("AMP cache Response:\n%s\n\n", resp.Status)
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(BrokerErrorUnexpected)
+	}
+
+	doc, err := limitedRead(resp.Body, readLimit)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ampArmorDecode(doc)
+	if err != nil {
+		return nil, err
+	}
+	answer, bridge, err := decodeClientPollResponse(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.checkBridge(ctx, bridge); err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
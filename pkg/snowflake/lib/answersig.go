@@ -0,0 +1,66 @@
+package lib
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// A broker with a signing key wraps its answers in an envelope, so that a
+// compromised front domain or AMP cache, or anyone on the path, cannot match
+// us with a proxy of their own choosing:
+//
+//	{"payload": "<base64 answer>", "signature": "<base64 Ed25519 signature>"}
+//
+// where the payload is the answer as the broker would send it unsigned, and
+// the signature is of the SHA-256 hash of the offer it answers followed by
+// the payload, so that an answer to another offer cannot be replayed.
+type signedAnswer struct {
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// ErrBadAnswerSignature is returned by Negotiate when the broker has an
+// answer key and the answer is not signed with it.
+var ErrBadAnswerSignature = errors.New("the answer is not signed by the broker")
+
+// SetAnswerKey makes the BrokerChannel accept only answers signed with key,
+// the Ed25519 public key of the broker. With a nil key, the default, answers
+// are not signed.
+func (bc *BrokerChannel) SetAnswerKey(key ed25519.PublicKey) {
+	bc.answerKey = key
+}
+
+// verifyAnswer returns the answer to offer out of its signed envelope,
+// unless bc has no answer key.
+func (bc *BrokerChannel) verifyAnswer(offer, answer []byte) ([]byte, error) {
+	if bc.answerKey == nil {
+		return answer, nil
+	}
+	var signed signedAnswer
+	if err := json.Unmarshal(answer, &signed); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadAnswerSignature, err)
+	}
+	payload, err := base64.StdEncoding.DecodeString(signed.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadAnswerSignature, err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(signed.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadAnswerSignature, err)
+	}
+	if !ed25519.Verify(bc.answerKey, answerSigningMessage(offer, payload), signature) {
+		return nil, ErrBadAnswerSignature
+	}
+	return payload, nil
+}
+
+// answerSigningMessage returns what the broker signs to answer offer with
+// payload.
+func answerSigningMessage(offer, payload []byte) []byte {
+	hash := sha256.Sum256(offer)
+	return append(hash[:], payload...)
+}
@@ -0,0 +1,46 @@
+package lib
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff is an exponential backoff policy. The wait before the nth retry
+// is Base doubled n times, but no more than Cap, plus a random duration of
+// up to Jitter so that many clients failing together do not retry together.
+type Backoff struct {
+	Base time.Duration
+	// Zero means no limit.
+	Cap    time.Duration
+	Jitter time.Duration
+}
+
+// DefaultBackoff is the backoff policy used unless another is set.
+var DefaultBackoff = Backoff{
+	Base:   5 * time.Second,
+	Cap:    5 * time.Minute,
+	Jitter: 2 * time.Second,
+}
+
+// RedialBackoff is how long to wait after failing to catch a snowflake
+// before trying again.
+var RedialBackoff = DefaultBackoff
+
+// Delay returns how long to wait before retry number n, counting from 0.
+func (b Backoff) Delay(n int) time.Duration {
+	d := b.Base
+	for i := 0; i < n && d < math.MaxInt64/2; i++ {
+		if b.Cap > 0 && d >= b.Cap {
+			break
+		}
+		d *= 2
+	}
+	if b.Cap > 0 && d > b.Cap {
+		d = b.Cap
+	}
+	if b.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(b.Jitter)))
+	}
+	return d
+}
@@ -0,0 +1,34 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"syscall"
+)
+
+// interfaceControl returns a net.Dialer Control function that makes its
+// sockets send through the network interface name only, whatever the
+// routing table says.
+func interfaceControl(name string) (func(network, address string, c syscall.RawConn) error, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if !canBindToInterface {
+		return nil, fmt.Errorf("binding to a network interface is not supported on %s", runtime.GOOS)
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var bindErr error
+		err := c.Control(func(fd uintptr) {
+			bindErr = bindToInterface(fd, network, iface)
+		})
+		if err != nil {
+			return err
+		}
+		if bindErr != nil {
+			return fmt.Errorf("binding to %s: %v", iface.Name, bindErr)
+		}
+		return nil
+	}, nil
+}
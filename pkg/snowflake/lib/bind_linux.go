@@ -0,0 +1,15 @@
+package lib
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+const canBindToInterface = true
+
+// bindToInterface sets SO_BINDTODEVICE, which needs CAP_NET_RAW before
+// Linux 5.7.
+func bindToInterface(fd uintptr, network string, iface *net.Interface) error {
+	return unix.BindToDevice(int(fd), iface.Name)
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package lib
+
+import (
+	"net"
+)
+
+const canBindToInterface = false
+
+func bindToInterface(fd uintptr, network string, iface *net.Interface) error {
+	return nil
+}
@@ -0,0 +1,257 @@
+package lib
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrWrongBridge is returned by a rendezvous when the broker says it
+// matched us with a proxy for another bridge than the one asked for with
+// SetBridgeFingerprint.
+var ErrWrongBridge = errors.New("the broker assigned another bridge")
+
+// SetBridgeFingerprint makes the rendezvous ask the broker for a proxy to
+// the bridge with fingerprint, the 40 hex digits of its identity key, for
+// brokers serving several bridges. "" leaves the choice to the broker.
+//
+// A broker that names the bridge it assigned in its answer is checked
+// against fingerprint. Either way, tor checks the identity of the bridge it
+// reaches against the fingerprint of its bridge line.
+func (bc *BrokerChannel) SetBridgeFingerprint(fingerprint string) error {
+	fingerprint, err := normalizeFingerprint(fingerprint)
+	if err != nil {
+		return err
+	}
+	bc.lock.Lock()
+	bc.bridgeFingerprint = fingerprint
+	bc.lock.Unlock()
+	return nil
+}
+
+// GetBridgeFingerprint returns the fingerprint of the bridge asked for, or ""
+// for any.
+func (bc *BrokerChannel) GetBridgeFingerprint() string {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	return bc.bridgeFingerprint
+}
+
+// normalizeFingerprint returns fingerprint in upper case, or an error if it
+// is neither empty nor 20 bytes in hex.
+func normalizeFingerprint(fingerprint string) (string, error) {
+	if fingerprint == "" {
+		return "", nil
+	}
+	if b, err := hex.DecodeString(fingerprint); err != nil || len(b) != 20 {
+		return "", fmt.Errorf("invalid bridge fingerprint %q", fingerprint)
+	}
+	return strings.ToUpper(fingerprint), nil
+}
+
+// bridgeFor returns the fingerprint of the bridge to ask the broker for in
+// a rendezvous under ctx.
+func (bc *BrokerChannel) bridgeFor(ctx context.Context) string {
+	if choice := bridgeFromContext(ctx); choice.fingerprint != "" {
+		return choice.fingerprint
+	}
+	return bc.GetBridgeFingerprint()
+}
+
+// checkBridge fails with ErrWrongBridge if assigned, the fingerprint of the
+// bridge the broker says it matched us for, is not the one asked for in a
+// rendezvous under ctx. A broker that does not say is trusted.
+func (bc *BrokerChannel) checkBridge(ctx context.Context, assigned string) error {
+	wanted := bc.bridgeFor(ctx)
+	if wanted == "" || assigned == "" || strings.EqualFold(wanted, assigned) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s instead of %s", ErrWrongBridge, assigned, wanted)
+}
+
+// After how many failures in a row a bridge counts as down: snowflakes that
+// could not be caught for it, or that the proxy closed right after
+// connecting, as proxies do when they can not reach the bridge.
+const bridgeFailureThreshold = 3
+
+// How long to avoid a bridge that is down before trying it again.
+const bridgeRetryInterval = 5 * time.Minute
+
+// BridgeBalancer spreads sessions over several bridges behind the same
+// broker, and fails over to the others while one is down. A session keeps
+// the bridge it started with once data has come through it, as the bridge
+// holds the state of the session.
+type BridgeBalancer struct {
+	lock    sync.Mutex
+	bridges []*bridgeState
+	// Where to start looking for the least loaded bridge, so that bridges
+	// with as many sessions take turns.
+	next int
+}
+
+type bridgeState struct {
+	fingerprint   string
+	sessions      int
+	failuresInRow int
+	downUntil     time.Time
+}
+
+// NewBridgeBalancer returns a balancer over the bridges with fingerprints.
+func NewBridgeBalancer(fingerprints []string) (*BridgeBalancer, error) {
+	if len(fingerprints) == 0 {
+		return nil, errors.New("no bridges to balance")
+	}
+	b := new(BridgeBalancer)
+	seen := make(map[string]bool)
+	for _, fingerprint := range fingerprints {
+		fingerprint, err := normalizeFingerprint(fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		if fingerprint == "" || seen[fingerprint] {
+			return nil, fmt.Errorf("invalid or duplicate bridge fingerprint %q", fingerprint)
+		}
+		seen[fingerprint] = true
+		b.bridges = append(b.bridges, &bridgeState{fingerprint: fingerprint})
+	}
+	return b, nil
+}
+
+// choose returns the bridge to use next: of those that are up, the one with
+// the fewest sessions, or the one to be tried again first if all are down.
+// b.lock must be held.
+func (b *BridgeBalancer) choose() *bridgeState {
+	now := time.Now()
+	best := b.bridges[b.next]
+	for i := 1; i < len(b.bridges); i++ {
+		s := b.bridges[(b.next+i)%len(b.bridges)]
+		up, bestUp := !now.Before(s.downUntil), !now.Before(best.downUntil)
+		switch {
+		case up != bestUp:
+			if up {
+				best = s
+			}
+		case up:
+			if s.sessions < best.sessions {
+				best = s
+			}
+		default:
+			if s.downUntil.Before(best.downUntil) {
+				best = s
+			}
+		}
+	}
+	b.next = (b.next + 1) % len(b.bridges)
+	return best
+}
+
+// acquire returns the bridge for a new session, counting it there until
+// release.
+func (b *BridgeBalancer) acquire() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	s := b.choose()
+	s.sessions++
+	return s.fingerprint
+}
+
+// rotate returns the bridge to catch a snowflake for ahead of time, for
+// whichever session comes next.
+func (b *BridgeBalancer) rotate() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.choose().fingerprint
+}
+
+func (b *BridgeBalancer) release(fingerprint string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if s := b.find(fingerprint); s != nil && s.sessions > 0 {
+		s.sessions--
+	}
+}
+
+// up tells whether the bridge with fingerprint is not down.
+func (b *BridgeBalancer) up(fingerprint string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	s := b.find(fingerprint)
+	return s == nil || !time.Now().Before(s.downUntil)
+}
+
+// report counts a snowflake for the bridge with fingerprint that failed, or
+// that data came through.
+func (b *BridgeBalancer) report(fingerprint string, ok bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	s := b.find(fingerprint)
+	if s == nil {
+		return
+	}
+	if ok {
+		if s.failuresInRow >= bridgeFailureThreshold {
+			log.Printf("Bridge %s is back up", fingerprint)
+		}
+		s.failuresInRow = 0
+		s.downUntil = time.Time{}
+		return
+	}
+	s.failuresInRow++
+	if s.failuresInRow == bridgeFailureThreshold {
+		warnf("Bridge %s seems down, failing over to the others for %v", fingerprint, bridgeRetryInterval)
+	}
+	if s.failuresInRow >= bridgeFailureThreshold {
+		s.downUntil = time.Now().Add(bridgeRetryInterval)
+	}
+}
+
+// find returns the state of the bridge with fingerprint, or nil. b.lock
+// must be held.
+func (b *BridgeBalancer) find(fingerprint string) *bridgeState {
+	for _, s := range b.bridges {
+		if s.fingerprint == fingerprint {
+			return s
+		}
+	}
+	return nil
+}
+
+// bridgeChoice is the bridge a snowflake is caught for, out of those of
+// balancer. The zero value is the bridge set with SetBridgeFingerprint.
+type bridgeChoice struct {
+	balancer    *BridgeBalancer
+	fingerprint string
+}
+
+type bridgeKey struct{}
+
+// withBridge returns a context under which snowflakes are caught for the
+// bridge with fingerprint.
+func withBridge(ctx context.Context, balancer *BridgeBalancer, fingerprint string) context.Context {
+	return context.WithValue(ctx, bridgeKey{}, bridgeChoice{balancer, fingerprint})
+}
+
+func bridgeFromContext(ctx context.Context) bridgeChoice {
+	choice, _ := ctx.Value(bridgeKey{}).(bridgeChoice)
+	return choice
+}
+
+func (c bridgeChoice) report(ok bool) {
+	if c.balancer != nil {
+		c.balancer.report(c.fingerprint, ok)
+	}
+}
+
+// bridgesOf returns the balancer of tongue, or nil if it catches snowflakes
+// for a single bridge.
+func bridgesOf(tongue Tongue) *BridgeBalancer {
+	if tongue, ok := tongue.(BridgeTongue); ok {
+		return tongue.Bridges()
+	}
+	return nil
+}
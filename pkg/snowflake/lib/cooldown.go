@@ -0,0 +1,94 @@
+package lib
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/common/util"
+)
+
+// How long to skip the proxies that failed to connect or died right after
+// connecting, when the broker matches us with them again. 0 not to skip
+// them.
+var ProxyCooldown = 10 * time.Minute
+
+// A snowflake closed by the proxy or ICE within this long after connecting
+// counts as a failed proxy.
+const deadOnArrival = 10 * time.Second
+
+// How many answers in a row a rendezvous skips before it takes a proxy that
+// is cooling down anyway, so that a broker with few proxies still gets us
+// connected.
+const maxCooldownSkips = 2
+
+// proxyCooldown remembers the addresses of the proxies that failed, for the
+// cooldown of the Tuning of their dialer.
+type proxyCooldown struct {
+	lock  sync.Mutex
+	until map[string]time.Time
+}
+
+var failedProxies = &proxyCooldown{until: make(map[string]time.Time)}
+
+// add skips the proxy with addrs for cooldown.
+func (p *proxyCooldown) add(addrs []string, cooldown time.Duration) {
+	if cooldown == 0 || len(addrs) == 0 {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	for addr, until := range p.until {
+		if now.After(until) {
+			delete(p.until, addr)
+		}
+	}
+	for _, addr := range addrs {
+		p.until[addr] = now.Add(cooldown)
+	}
+}
+
+// cooling tells whether any of addrs belongs to a proxy that failed
+// recently.
+func (p *proxyCooldown) cooling(addrs []string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	for _, addr := range addrs {
+		if until, ok := p.until[addr]; ok && now.Before(until) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyAddresses returns the public IP addresses of the host, server
+// reflexive and peer reflexive candidates in the SDP of a proxy. Relay
+// candidates are left out, as many proxies share the same TURN servers, and
+// so are private addresses, which many proxies have in common too.
+func proxyAddresses(sdp string) []string {
+	var addrs []string
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "a=candidate:") {
+			continue
+		}
+		// a=candidate:foundation component protocol priority address port typ type ...
+		fields := strings.Fields(line)
+		if len(fields) < 8 || fields[6] != "typ" || fields[7] == "relay" {
+			continue
+		}
+		ip := net.ParseIP(fields[4])
+		if ip == nil || !ip.IsGlobalUnicast() || util.IsLocal(ip) {
+			continue
+		}
+		if addr := ip.String(); !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,94 @@
+package lib
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With adaptive capacity, each this many bytes per second of SOCKS traffic,
+// up and down together, call for one more snowflake. 0 to scale with the
+// number of SOCKS connections only.
+var ThroughputPerSnowflake int64 = 256 << 10
+
+// With adaptive capacity, each this many SOCKS connections open beyond the
+// first call for one more snowflake.
+const connsPerSnowflake = 4
+
+// How often the throughput is sampled at most. Samples are smoothed, so that
+// a burst does not bring in snowflakes that are gone again the next moment.
+const demandSampleInterval = time.Second
+
+// demandMeter follows the throughput of all SOCKS connections, for the
+// dialers with adaptive capacity.
+type demandMeter struct {
+	lock  sync.Mutex
+	at    time.Time
+	total int64
+	rate  float64 // bytes per second
+	last  int     // the capacity last asked for, to log changes
+}
+
+var demand = new(demandMeter)
+
+// sample returns the smoothed throughput, once total bytes have been
+// carried by now.
+func (m *demandMeter) sample(now time.Time, total int64) float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.at.IsZero() {
+		m.at, m.total = now, total
+		return 0
+	}
+	elapsed := now.Sub(m.at)
+	if elapsed < demandSampleInterval {
+		return m.rate
+	}
+	rate := float64(total-m.total) / elapsed.Seconds()
+	m.rate = (m.rate + rate) / 2
+	m.at, m.total = now, total
+	return m.rate
+}
+
+// capacity returns how many snowflakes the current demand calls for, up to
+// max, and logs when that changes.
+func (m *demandMeter) capacity(max int) int {
+	total := atomic.LoadInt64(&metrics.bytesUp) + atomic.LoadInt64(&metrics.bytesDown)
+	n := demandCapacity(max, openConnCount(), m.sample(time.Now(), total))
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if n != m.last {
+		log.Printf("WebRTC: Demand calls for %d of at most %d snowflakes", n, max)
+		m.last = n
+	}
+	return n
+}
+
+// demandCapacity returns how many snowflakes conns open SOCKS connections
+// carrying rate bytes per second call for: one, and more as there are more
+// connections or traffic, up to max.
+func demandCapacity(max, conns int, rate float64) int {
+	n := 1
+	if conns > 1 {
+		n += (conns - 1) / connsPerSnowflake
+	}
+	if ThroughputPerSnowflake > 0 {
+		n += int(rate / float64(ThroughputPerSnowflake))
+	}
+	if n > max {
+		n = max
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// ceiling returns the most snowflakes tongue may ask for.
+func ceiling(tongue Tongue) int {
+	if tongue, ok := tongue.(AdaptiveTongue); ok {
+		return tongue.GetCeiling()
+	}
+	return tongue.GetMax()
+}
@@ -0,0 +1,18 @@
+//go:build go1.23
+// +build go1.23
+
+package lib
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+// setECHConfigList enables Encrypted Client Hello on the transport.
+func setECHConfigList(transport *http.Transport, echConfigList []byte) error {
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.EncryptedClientHelloConfigList = echConfigList
+	return nil
+}
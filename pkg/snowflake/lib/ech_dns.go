@@ -0,0 +1,116 @@
+package lib
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsTypeHTTPS = dnsmessage.Type(65)
+	svcParamECH  = 5
+)
+
+// FetchECHConfigList looks up the HTTPS DNS record of host at the DNS server
+// resolver (host:port) and returns the ECH config list it advertises.
+func FetchECHConfigList(host, resolver string) ([]byte, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, err
+	}
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: binary.BigEndian.Uint16(id[:]), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  name,
+			Type:  dnsTypeHTTPS,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout("udp", resolver, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(packed); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var p dnsmessage.Parser
+	header, err := p.Start(buf[:n])
+	if err != nil {
+		return nil, err
+	}
+	if header.ID != query.Header.ID {
+		return nil, errors.New("DNS response ID mismatch")
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+	for {
+		h, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if h.Type != dnsTypeHTTPS {
+			p.SkipAnswer()
+			continue
+		}
+		r, err := p.UnknownResource()
+		if err != nil {
+			return nil, err
+		}
+		if ech := echFromSVCB(r.Data); ech != nil {
+			return ech, nil
+		}
+	}
+	return nil, fmt.Errorf("no ECH config in the HTTPS record of %s", host)
+}
+
+// echFromSVCB extracts the ech SvcParam from the RDATA of an SVCB or HTTPS
+// record (RFC 9460), or returns nil.
+func echFromSVCB(data []byte) []byte {
+	// Skip SvcPriority and the uncompressed TargetName.
+	if len(data) < 3 {
+		return nil
+	}
+	off := 2
+	for off < len(data) && data[off] != 0 {
+		off += int(data[off]) + 1
+	}
+	off++
+	for off+4 <= len(data) {
+		key := binary.BigEndian.Uint16(data[off:])
+		length := int(binary.BigEndian.Uint16(data[off+2:]))
+		off += 4
+		if off+length > len(data) {
+			return nil
+		}
+		if key == svcParamECH {
+			return data[off : off+length]
+		}
+		off += length
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !go1.23
+// +build !go1.23
+
+package lib
+
+import (
+	"errors"
+	"net/http"
+)
+
+// setECHConfigList fails, crypto/tls only supports Encrypted Client Hello
+// since Go 1.23.
+func setECHConfigList(transport *http.Transport, echConfigList []byte) error {
+	return errors.New("Encrypted Client Hello requires building with Go 1.23 or later")
+}
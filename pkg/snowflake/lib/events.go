@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType is a kind of Event.
+type EventType string
+
+// The phases a snowflake goes through to connect, in order, and what
+// happens to it then.
+const (
+	// The rendezvous with the broker started.
+	EventBrokerContacted EventType = "broker-contacted"
+	// The offer was handed to the rendezvous method.
+	EventOfferSent EventType = "offer-sent"
+	// The broker answered with the SDP of a proxy.
+	EventAnswerReceived EventType = "answer-received"
+	// ICE found a working candidate pair to the proxy.
+	EventICEConnected EventType = "ice-connected"
+	// The DataChannel to the proxy is open.
+	EventDataChannelOpen EventType = "datachannel-open"
+	// A snowflake connected, and can carry traffic.
+	EventPeerConnected EventType = "peer-connected"
+	// A connected snowflake was closed.
+	EventPeerDisconnected EventType = "peer-disconnected"
+)
+
+// Event is a change in the state of the client, for the application to
+// show or act upon.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// The trace ID of the snowflake or SOCKS connection concerned, if any.
+	ID string
+}
+
+// How many events a subscriber may fall behind before missing some.
+const eventBuffer = 64
+
+var subscribers = struct {
+	sync.Mutex
+	m map[chan Event]struct{}
+}{m: make(map[chan Event]struct{})}
+
+// SubscribeEvents returns a channel on which the events are delivered from
+// now on, until cancel is called. Events are dropped rather than wait for a
+// subscriber that does not keep up.
+func SubscribeEvents() (events <-chan Event, cancel func()) {
+	ch := make(chan Event, eventBuffer)
+	subscribers.Lock()
+	subscribers.m[ch] = struct{}{}
+	subscribers.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			subscribers.Lock()
+			delete(subscribers.m, ch)
+			subscribers.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// emit delivers an event of type t about id to the subscribers.
+func emit(t EventType, id traceID) {
+	emitTo(nil, t, id)
+}
+
+// emitTo is emit, delivering the event to sink as well if it is not nil.
+func emitTo(sink func(Event), t EventType, id traceID) {
+	e := Event{Type: t, Time: time.Now(), ID: string(id)}
+	if sink != nil {
+		sink(e)
+	}
+	subscribers.Lock()
+	defer subscribers.Unlock()
+	for ch := range subscribers.m {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// emit delivers an event of type t about c to the subscribers, and to the
+// sink of its dialer.
+func (c *WebRTCPeer) emit(t EventType) {
+	emitTo(c.options.events, t, c.trace)
+}
@@ -0,0 +1,158 @@
+package lib
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// How long sessions use the WebSocket fallback before trying WebRTC again.
+const webRTCRetryInterval = 10 * time.Minute
+
+// WebSocketFallback connects sessions to the WebSocket endpoint of the
+// bridge directly once WebRTC keeps failing, as on networks that block UDP.
+// Unlike a snowflake, the connection shows that it goes to the bridge, or
+// to the front domain when domain fronted.
+type WebSocketFallback struct {
+	url       *url.URL
+	front     string
+	transport http.RoundTripper
+	// How many snowflakes in a row must fail to be caught first.
+	after int
+
+	lock        sync.Mutex
+	failures    int
+	lastFailure time.Time
+}
+
+// NewWebSocketFallback returns a fallback to the bridge at bridgeURL, a ws
+// or wss URL, once after snowflakes in a row failed to be caught. With
+// front, the connection is domain fronted. It is made through transport,
+// such as one from NewBrokerTransport, without HTTP/2.
+func NewWebSocketFallback(bridgeURL, front string, transport http.RoundTripper, after int) (*WebSocketFallback, error) {
+	u, err := url.Parse(bridgeURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("not a WebSocket URL: %s", bridgeURL)
+	}
+	if after < 1 {
+		return nil, errors.New("the WebSocket fallback needs at least one failure to start")
+	}
+	if t, ok := transport.(*http.Transport); ok {
+		// WebSocket connections are upgraded HTTP/1.1 requests.
+		t = t.Clone()
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		transport = t
+	}
+	return &WebSocketFallback{url: u, front: front, transport: transport, after: after}, nil
+}
+
+// active tells whether sessions are to use the fallback rather than WebRTC.
+func (f *WebSocketFallback) active() bool {
+	if f == nil {
+		return false
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.failures >= f.after && time.Since(f.lastFailure) < webRTCRetryInterval
+}
+
+// failed counts a snowflake that could not be caught.
+func (f *WebSocketFallback) failed() {
+	if f == nil {
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.failures++
+	f.lastFailure = time.Now()
+	if f.failures == f.after {
+		warnf("WebRTC failed %d times in a row: falling back to connecting to the bridge at %s over WebSocket for %v",
+			f.failures, f.url.Host, webRTCRetryInterval)
+	}
+}
+
+// Activate makes sessions use the fallback at once, as when UDP is known to
+// be blocked, until WebRTC is tried again.
+func (f *WebSocketFallback) Activate() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.failures < f.after {
+		f.failures = f.after
+	}
+	f.lastFailure = time.Now()
+	log.Printf("Falling back to connecting to the bridge at %s over WebSocket for %v",
+		f.url.Host, webRTCRetryInterval)
+}
+
+// succeeded counts a snowflake that was caught, which ends the fallback.
+func (f *WebSocketFallback) succeeded() {
+	if f == nil {
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.failures >= f.after {
+		log.Printf("WebRTC works again: no longer falling back to WebSocket")
+	}
+	f.failures = 0
+}
+
+func (f *WebSocketFallback) dial(ctx context.Context) (*wsConn, error) {
+	return dialWebSocket(ctx, f.transport, f.url, f.front)
+}
+
+// fallbackOf returns the WebSocket fallback of tongue, or nil.
+func fallbackOf(tongue Tongue) *WebSocketFallback {
+	if tongue, ok := tongue.(FallbackTongue); ok {
+		return tongue.WebSocketFallback()
+	}
+	return nil
+}
+
+// collectFallback connects the session to the bridge over WebSocket, unless
+// it already is, and hands the connection to popConn.
+func (p *Peers) collectFallback() error {
+	if p.fallbackConn != nil && !p.fallbackConn.isClosed() {
+		return fmt.Errorf("%w [WebSocket]", errAtCapacity)
+	}
+	conn, err := p.fallback.dial(p.ctx)
+	if err != nil {
+		return fmt.Errorf("WebSocket fallback: %w", err)
+	}
+	p.trace.printf("WebSocket fallback: connected to the bridge at %s directly, not through a snowflake",
+		p.fallback.url.Host)
+	p.fallbackConn = conn
+	p.fallbackConns <- conn
+	return nil
+}
+
+// popConn is Pop, also handing out the WebSocket connections of the
+// fallback.
+func (p *Peers) popConn() io.ReadWriteCloser {
+	for {
+		select {
+		case snowflake, ok := <-p.snowflakeChan:
+			if !ok {
+				return nil
+			}
+			if snowflake.closed {
+				continue
+			}
+			snowflake.BytesLogger = p.BytesLogger
+			return snowflake
+		case conn := <-p.fallbackConns:
+			return conn
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package lib
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+)
+
+// How many requests in a row may fail through a front domain before it is
+// no longer used.
+const frontMaxFailures = 3
+
+// frontPool chooses a front domain at random for each rendezvous request,
+// and stops choosing those that keep failing.
+type frontPool struct {
+	lock      sync.Mutex
+	fronts    []string
+	failures  map[string]int
+	preferred string // picked rather than one at random, if not empty
+	good      string // the last front a request went through
+}
+
+func newFrontPool(fronts []string) *frontPool {
+	return &frontPool{
+		fronts:   fronts,
+		failures: make(map[string]int),
+	}
+}
+
+// pick returns the preferred front, if any, or else a random one among those
+// that have not been dropped. If every front has been dropped, they are all
+// given another chance.
+func (p *frontPool) pick() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.preferred != "" {
+		return p.preferred
+	}
+	var usable []string
+	for _, front := range p.fronts {
+		if p.failures[front] < frontMaxFailures {
+			usable = append(usable, front)
+		}
+	}
+	if len(usable) == 0 {
+		warnf("All front domains failed, trying them again")
+		p.failures = make(map[string]int)
+		usable = p.fronts
+	}
+	return usable[rand.Intn(len(usable))]
+}
+
+// report records whether a request through front reached the other side.
+func (p *frontPool) report(front string, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err == nil {
+		delete(p.failures, front)
+		p.good = front
+		return
+	}
+	if front == p.preferred {
+		p.preferred = ""
+	}
+	p.failures[front]++
+	if p.failures[front] == frontMaxFailures {
+		warnf("Dropping front domain %s after %d failures", front, frontMaxFailures)
+	}
+}
+
+// prefer makes pick return front, if it is one of the fronts, until a request
+// through it fails.
+func (p *frontPool) prefer(front string) {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, f := range p.fronts {
+		if f == front {
+			p.preferred = front
+		}
+	}
+}
+
+// lastGood returns the last front a request went through, if any.
+func (p *frontPool) lastGood() string {
+	if p == nil {
+		return ""
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.good
+}
+
+// SetFronts makes the BrokerChannel domain front its requests with a front
+// domain chosen at random from fronts for each request, replacing any front
+// given to NewBrokerChannel. Fronts that fail repeatedly are dropped.
+func (bc *BrokerChannel) SetFronts(fronts []string) {
+	if bc.Host != "" {
+		bc.url.Host = bc.Host
+		bc.Host = ""
+	}
+	if len(fronts) == 0 {
+		bc.fronts = nil
+		return
+	}
+	log.Println("Domain fronting using one of:", fronts)
+	bc.fronts = newFrontPool(fronts)
+}
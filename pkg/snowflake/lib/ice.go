@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// ICEPolicy controls which ICE candidates a WebRTCPeer gathers and offers.
+type ICEPolicy string
+
+const (
+	// Gather and offer all candidates. This is the default.
+	ICEPolicyAll ICEPolicy = "all"
+	// Only use TURN relays, so that neither the proxy nor the broker learn
+	// the client's address.
+	ICEPolicyRelay ICEPolicy = "relay"
+	// Gather all candidates, but leave host candidates out of the offer,
+	// whether or not their addresses are local.
+	ICEPolicyNoHost ICEPolicy = "no-host"
+	// Like ICEPolicyAll, but only use TURN relays while our NAT maps and
+	// filters by address and port, as few proxies can connect through
+	// such a NAT. That takes a BrokerChannel told the NAT behavior.
+	ICEPolicyAuto ICEPolicy = "auto"
+)
+
+// ParseICEPolicy returns the ICEPolicy called name. An empty name is
+// ICEPolicyAll.
+func ParseICEPolicy(name string) (ICEPolicy, error) {
+	switch policy := ICEPolicy(name); policy {
+	case "":
+		return ICEPolicyAll, nil
+	case ICEPolicyAll, ICEPolicyRelay, ICEPolicyNoHost, ICEPolicyAuto:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown ICE policy %q", name)
+	}
+}
+
+// stripHostCandidates removes the host candidates from an SDP.
+func stripHostCandidates(sdp string) string {
+	lines := strings.SplitAfter(sdp, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if strings.HasPrefix(line, "a=candidate:") &&
+			strings.Contains(line, " typ host") {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return strings.Join(kept, "")
+}
+
+// tcp443Relays returns the TURN servers out of servers that are reached over
+// TCP or TLS on port 443, which networks allowing nothing but HTTPS let
+// through: turns:host:443 ones, and turn:host:443 ones with transport=tcp.
+func tcp443Relays(servers []webrtc.ICEServer) []webrtc.ICEServer {
+	var relays []webrtc.ICEServer
+	for _, server := range servers {
+		for _, u := range server.URLs {
+			if isTCP443Relay(u) {
+				relays = append(relays, server)
+				break
+			}
+		}
+	}
+	return relays
+}
+
+func isTCP443Relay(u string) bool {
+	u = strings.ToLower(u)
+	var rest string
+	switch {
+	case strings.HasPrefix(u, "turns:"):
+		rest = strings.TrimPrefix(u, "turns:")
+	case strings.HasPrefix(u, "turn:"):
+		rest = strings.TrimPrefix(u, "turn:")
+		if !strings.Contains(u, "transport=tcp") {
+			return false
+		}
+	default:
+		return false
+	}
+	if i := strings.Index(rest, "?"); i >= 0 {
+		rest = rest[:i]
+	}
+	_, port, err := net.SplitHostPort(rest)
+	return err == nil && port == "443"
+}
@@ -0,0 +1,57 @@
+package lib
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// iceTCPMux is the ice.TCPMux that webrtc.NewICETCPMux returns: it hands the
+// TCP connections accepted on a listener to the ICE agents they are for.
+type iceTCPMux interface {
+	io.Closer
+	GetConnByUfrag(ufrag string) (net.PacketConn, error)
+	RemoveConnByUfrag(ufrag string)
+}
+
+// The ICE-TCP listeners by address. They are shared by all the dialers, as
+// a dialer is rebuilt with the same settings on reload, and live as long as
+// the process.
+var iceTCPMuxes = struct {
+	sync.Mutex
+	m map[string]iceTCPMux
+}{m: make(map[string]iceTCPMux)}
+
+// SetICETCP makes the peers of this dialer also gather passive ICE-TCP
+// candidates, accepting the TCP connections of proxies on addr, such as
+// ":9443". That lets proxies reach us on networks that filter UDP but let
+// TCP through, as long as they can connect to addr: pion gathers no active
+// candidates, and ignores those of proxies. An empty addr turns ICE-TCP
+// off.
+func (w *WebRTCDialer) SetICETCP(addr string) error {
+	if addr == "" {
+		w.options.tcpMux = nil
+		return nil
+	}
+	iceTCPMuxes.Lock()
+	defer iceTCPMuxes.Unlock()
+	mux, ok := iceTCPMuxes.m[addr]
+	if !ok {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		log.Printf("WebRTC: Accepting ICE-TCP connections on %v", ln.Addr())
+		mux = webrtc.NewICETCPMux(nil, ln, iceTCPReadBufferSize)
+		iceTCPMuxes.m[addr] = mux
+	}
+	w.options.tcpMux = mux
+	return nil
+}
+
+// How many packets received on each ICE-TCP connection are queued for its
+// ICE agent, as in the examples of pion.
+const iceTCPReadBufferSize = 8
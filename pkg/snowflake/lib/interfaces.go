@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"context"
 	"net"
 )
 
@@ -12,6 +13,37 @@ type Tongue interface {
 	GetMax() int
 }
 
+// Interface for catching Snowflakes that can be given up on. Cancelling the
+// context stops the rendezvous and ICE gathering in progress. Tongues that do
+// not implement it are left to finish catching in the background, and the
+// snowflake they catch is closed.
+type ContextTongue interface {
+	Tongue
+	CatchContext(ctx context.Context) (*WebRTCPeer, error)
+}
+
+// Interface for catching a number of Snowflakes that changes with demand.
+// GetMax is how many to keep at the moment, and GetCeiling the most GetMax
+// may return.
+type AdaptiveTongue interface {
+	Tongue
+	GetCeiling() int
+}
+
+// Interface for catching Snowflakes for several bridges. Each session
+// catches its snowflakes for one of the bridges of the balancer.
+type BridgeTongue interface {
+	Tongue
+	Bridges() *BridgeBalancer
+}
+
+// Interface for catching Snowflakes that falls back to connecting to the
+// bridge over WebSocket when WebRTC keeps failing.
+type FallbackTongue interface {
+	Tongue
+	WebSocketFallback() *WebSocketFallback
+}
+
 // Interface for collecting some number of Snowflakes, for passing along
 // ultimately to the SOCKS handler.
 type SnowflakeCollector interface {
@@ -30,5 +62,6 @@ type SnowflakeCollector interface {
 type SocksConnector interface {
 	Grant(*net.TCPAddr) error
 	Reject() error
+	RejectReason(reason byte) error
 	net.Conn
 }
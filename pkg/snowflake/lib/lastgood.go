@@ -0,0 +1,50 @@
+package lib
+
+import "github.com/pion/webrtc/v3"
+
+// LastGood is what the last snowflake to connect rendezvoused and connected
+// through, for the next start to try first.
+type LastGood struct {
+	BrokerURL string `json:"broker_url"`
+	// The front domain that last got an answer from the broker, if fronted.
+	Front string `json:"front,omitempty"`
+	// The URLs of the ICE servers offered to the snowflake, without their
+	// credentials.
+	ICEServers []string `json:"ice_servers,omitempty"`
+	NATType    string   `json:"nat_type,omitempty"`
+}
+
+// recordGood notes that a snowflake offered servers connected.
+func (bc *BrokerChannel) recordGood(servers []webrtc.ICEServer) {
+	good := &LastGood{Front: bc.fronts.lastGood()}
+	u := *bc.url
+	if bc.Host != "" {
+		u.Host = bc.Host
+	}
+	good.BrokerURL = u.String()
+	for _, server := range servers {
+		good.ICEServers = append(good.ICEServers, server.URLs...)
+	}
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	good.NATType = bc.NATType
+	bc.lastGood = good
+}
+
+// LastGood returns what the last snowflake to connect went through, or nil
+// if none has yet.
+func (bc *BrokerChannel) LastGood() *LastGood {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	if bc.lastGood == nil {
+		return nil
+	}
+	good := *bc.lastGood
+	return &good
+}
+
+// PreferFront makes the BrokerChannel use front, one of those given to
+// SetFronts, rather than one at random, until a request through it fails.
+func (bc *BrokerChannel) PreferFront(front string) {
+	bc.fronts.prefer(front)
+}
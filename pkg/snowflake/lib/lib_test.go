@@ -1,15 +1,41 @@
 package lib
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"git.torproject.org/pluggable-transports/snowflake.git/common/encapsulation"
+	"git.torproject.org/pluggable-transports/snowflake.git/common/nat"
+	"git.torproject.org/pluggable-transports/snowflake.git/common/turbotunnel"
 	"git.torproject.org/pluggable-transports/snowflake.git/common/util"
+	"github.com/pion/stun"
+	"github.com/pion/webrtc/v3"
 	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xtaci/kcp-go/v5"
+	"github.com/xtaci/smux"
+	"golang.org/x/net/proxy"
 )
 
 type MockTransport struct {
@@ -27,6 +53,89 @@ func (m *MockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	return r, nil
 }
 
+// SQSMockTransport plays the broker's part of the SQS rendezvous.
+type SQSMockTransport struct {
+	sentOffer bool
+}
+
+func (m *SQSMockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.ParseForm()
+	var status int
+	var body string
+	switch req.PostForm.Get("Action") {
+	case "SendMessage":
+		m.sentOffer = req.Header.Get("Authorization") != ""
+		status, body = http.StatusOK, "<SendMessageResponse/>"
+	case "GetQueueUrl":
+		status = http.StatusOK
+		body = "<GetQueueUrlResponse><GetQueueUrlResult><QueueUrl>" +
+			"https://sqs.us-east-1.amazonaws.com/1/" + req.PostForm.Get("QueueName") +
+			"</QueueUrl></GetQueueUrlResult></GetQueueUrlResponse>"
+	case "ReceiveMessage":
+		status = http.StatusOK
+		body = "<ReceiveMessageResponse><ReceiveMessageResult><Message><Body>" +
+			`{"answer":"{\"type\":\"answer\",\"sdp\":\"fake\"}"}` +
+			"</Body></Message></ReceiveMessageResult></ReceiveMessageResponse>"
+	default:
+		status = http.StatusBadRequest
+	}
+	return &http.Response{
+		StatusCode: status,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(body))),
+	}, nil
+}
+
+// EchoRendezvous is a custom RendezvousMethod answering with the offer.
+type EchoRendezvous struct{}
+
+func (r EchoRendezvous) Exchange(offer []byte) ([]byte, error) {
+	return offer, nil
+}
+
+// BlockingRendezvous does not answer until released is closed.
+type BlockingRendezvous struct {
+	released chan struct{}
+}
+
+func (r *BlockingRendezvous) Exchange(offer []byte) ([]byte, error) {
+	<-r.released
+	return nil, errors.New("released")
+}
+
+// CancellableRendezvous waits for its exchange to be cancelled.
+type CancellableRendezvous struct {
+	cancelled chan struct{}
+}
+
+func (r CancellableRendezvous) Exchange(offer []byte) ([]byte, error) {
+	return r.ExchangeContext(context.Background(), offer)
+}
+
+func (r CancellableRendezvous) ExchangeContext(ctx context.Context, offer []byte) ([]byte, error) {
+	<-ctx.Done()
+	close(r.cancelled)
+	return nil, ctx.Err()
+}
+
+// AnsweringRendezvous answers every offer with answer, and keeps the
+// offers.
+type AnsweringRendezvous struct {
+	answer string
+	offers []string
+}
+
+func (r *AnsweringRendezvous) Exchange(offer []byte) ([]byte, error) {
+	r.offers = append(r.offers, string(offer))
+	return []byte(r.answer), nil
+}
+
+// FailingRendezvous always fails as if no proxies were available.
+type FailingRendezvous struct{}
+
+func (r FailingRendezvous) Exchange(offer []byte) ([]byte, error) {
+	return nil, errors.New(BrokerError503)
+}
+
 type FakeDialer struct {
 	max int
 }
@@ -40,16 +149,158 @@ func (w FakeDialer) GetMax() int {
 	return w.max
 }
 
+// BlockingDialer catches nothing until released.
+type BlockingDialer struct {
+	catching chan struct{}
+	released chan struct{}
+}
+
+func (w *BlockingDialer) Catch() (*WebRTCPeer, error) {
+	close(w.catching)
+	<-w.released
+	return &WebRTCPeer{}, nil
+}
+
+func (w *BlockingDialer) GetMax() int {
+	return 1
+}
+
+// FakeBridge plays the server side of a turbotunnel session and echoes its
+// streams, whichever snowflake the packets come through.
+type FakeBridge struct {
+	pconn *turbotunnel.QueuePacketConn
+	ln    *kcp.Listener
+}
+
+func NewFakeBridge() (*FakeBridge, error) {
+	pconn := turbotunnel.NewQueuePacketConn(dummyAddr{}, time.Minute)
+	ln, err := kcp.ServeConn(nil, 0, 0, pconn)
+	if err != nil {
+		return nil, err
+	}
+	b := &FakeBridge{pconn: pconn, ln: ln}
+	go b.acceptLoop()
+	return b, nil
+}
+
+func (b *FakeBridge) acceptLoop() {
+	for {
+		conn, err := b.ln.AcceptKCP()
+		if err != nil {
+			return
+		}
+		conn.SetStreamMode(true)
+		conn.SetWindowSize(65535, 65535)
+		conn.SetNoDelay(0, 0, 0, 1)
+		smuxConfig := smux.DefaultConfig()
+		smuxConfig.Version = 2
+		sess, err := smux.Server(conn, smuxConfig)
+		if err != nil {
+			return
+		}
+		go func() {
+			for {
+				stream, err := sess.AcceptStream()
+				if err != nil {
+					return
+				}
+				go io.Copy(stream, stream)
+			}
+		}()
+	}
+}
+
+// Snowflake returns a connection to the bridge standing in for a proxy.
+func (b *FakeBridge) Snowflake() net.Conn {
+	client, proxy := net.Pipe()
+	go b.serve(proxy)
+	return client
+}
+
+func (b *FakeBridge) serve(conn net.Conn) {
+	defer conn.Close()
+	var token [8]byte
+	var id turbotunnel.ClientID
+	if _, err := io.ReadFull(conn, token[:]); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, id[:]); err != nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			p, err := encapsulation.ReadData(conn)
+			if err != nil {
+				return
+			}
+			b.pconn.QueueIncoming(p, id)
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		case p := <-b.pconn.OutgoingQueue(id):
+			if _, err := encapsulation.WriteData(conn, p); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (b *FakeBridge) Close() {
+	b.ln.Close()
+	b.pconn.Close()
+}
+
+// CountingConn counts the bytes read from a snowflake.
+type CountingConn struct {
+	net.Conn
+	received int64
+}
+
+func (c *CountingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.received, int64(n))
+	return n, err
+}
+
+// DyingConn is a snowflake whose proxy goes away after limit bytes.
+type DyingConn struct {
+	net.Conn
+	limit int64
+	sent  int64
+}
+
+func (c *DyingConn) Write(p []byte) (int, error) {
+	if atomic.AddInt64(&c.sent, int64(len(p))) > c.limit {
+		c.Conn.Close()
+		return 0, io.ErrClosedPipe
+	}
+	return c.Conn.Write(p)
+}
+
 type FakeSocksConn struct {
 	net.Conn
 	rejected bool
+	reason   byte
+	granted  bool
 }
 
-func (f FakeSocksConn) Reject() error {
+func (f *FakeSocksConn) Reject() error {
+	return f.RejectReason(0x01)
+}
+func (f *FakeSocksConn) RejectReason(reason byte) error {
 	f.rejected = true
+	f.reason = reason
+	return nil
+}
+func (f *FakeSocksConn) Grant(addr *net.TCPAddr) error {
+	f.granted = true
 	return nil
 }
-func (f FakeSocksConn) Grant(addr *net.TCPAddr) error { return nil }
 
 type FakePeers struct{ toRelease *WebRTCPeer }
 
@@ -57,6 +308,101 @@ func (f FakePeers) Collect() (*WebRTCPeer, error) { return &WebRTCPeer{}, nil }
 func (f FakePeers) Pop() *WebRTCPeer              { return nil }
 func (f FakePeers) Melted() <-chan struct{}       { return nil }
 
+// newWebSocketEchoServer returns a server that accepts WebSocket
+// connections, pings them, and echoes their data back in unmasked frames.
+func newWebSocketEchoServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			http.Error(w, "not a WebSocket", http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: %s\r\n\r\n", wsAccept(r.Header.Get("Sec-WebSocket-Key")))
+		rw.Write([]byte{0x80 | wsPing, 2, 'h', 'i'})
+		rw.Flush()
+		ws := newWSConn(conn)
+		ws.r = rw.Reader
+		buf := make([]byte, 4096)
+		for {
+			n, err := ws.Read(buf)
+			if err != nil {
+				return
+			}
+			conn.Write(append([]byte{0x80 | wsBinary, byte(n)}, buf[:n]...))
+		}
+	}))
+}
+
+// newNATPMPTestGateway returns a NAT-PMP gateway on 127.0.0.1 at the
+// external address 203.0.113.9, forwarding each port requested from the port
+// offset above.
+func newNATPMPTestGateway(offset uint16) *net.UDPConn {
+	conn, _ := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			resp := make([]byte, 16)
+			resp[1] = buf[1] | 0x80
+			switch {
+			case n == 2 && buf[1] == 0:
+				copy(resp[8:], net.IPv4(203, 0, 113, 9).To4())
+				conn.WriteToUDP(resp[:12], addr)
+			case n == 12 && buf[1] == 1:
+				copy(resp[8:10], buf[4:6])
+				binary.BigEndian.PutUint16(resp[10:], binary.BigEndian.Uint16(buf[6:])+offset)
+				copy(resp[12:], buf[8:12])
+				conn.WriteToUDP(resp, addr)
+			}
+		}
+	}()
+	return conn
+}
+
+// newUPnPTestGateway returns a UPnP Internet gateway device at the external
+// address 203.0.113.10, whose WAN connection service is nested in another
+// device, as routers describe it. The port mappings asked for are sent to
+// mappings.
+func newUPnPTestGateway(mappings chan<- string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/description.xml":
+			fmt.Fprint(w, `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0"><device>
+<serviceList><service><serviceType>urn:schemas-upnp-org:service:Layer3Forwarding:1</serviceType>
+<controlURL>/l3f</controlURL></service></serviceList>
+<deviceList><device><serviceList><service>
+<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+<controlURL>/ctl/ipconn</controlURL></service></serviceList></device></deviceList>
+</device></root>`)
+		case "/ctl/ipconn":
+			body, _ := ioutil.ReadAll(r.Body)
+			switch r.Header.Get("SOAPAction") {
+			case `"urn:schemas-upnp-org:service:WANIPConnection:1#GetExternalIPAddress"`:
+				fmt.Fprint(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>
+<u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">
+<NewExternalIPAddress>203.0.113.10</NewExternalIPAddress>
+</u:GetExternalIPAddressResponse></s:Body></s:Envelope>`)
+			case `"urn:schemas-upnp-org:service:WANIPConnection:1#AddPortMapping"`:
+				mappings <- string(body)
+			default:
+				http.Error(w, "unknown action", http.StatusInternalServerError)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
 func TestSnowflakeClient(t *testing.T) {
 
 	Convey("Peers", t, func() {
@@ -81,6 +427,21 @@ func TestSnowflakeClient(t *testing.T) {
 			_, err = p.Collect()
 		})
 
+		Convey("End gives up on the snowflake being caught", func() {
+			d := &BlockingDialer{catching: make(chan struct{}), released: make(chan struct{})}
+			defer close(d.released)
+			p, _ := NewPeers(d)
+			collected := make(chan error)
+			go func() {
+				_, err := p.Collect()
+				collected <- err
+			}()
+			<-d.catching
+			p.cancel()
+			So(<-collected, ShouldEqual, context.Canceled)
+			p.End()
+		})
+
 		Convey("Collection continues until capacity.", func() {
 			c := 5
 			p, _ := NewPeers(FakeDialer{max: c})
@@ -108,6 +469,42 @@ func TestSnowflakeClient(t *testing.T) {
 			So(p.Count(), ShouldEqual, c)
 		})
 
+		Convey("A snowflake to be replaced is handed over to its replacement.", func() {
+			p, _ := NewPeers(FakeDialer{max: 1})
+			_, err := p.Collect()
+			So(err, ShouldBeNil)
+			old := p.Pop()
+			_, err = p.Collect()
+			So(errors.Is(err, errAtCapacity), ShouldBeTrue)
+
+			old.retire("test")
+			So(old.isRetiring(), ShouldBeTrue)
+			_, err = p.Collect()
+			So(err, ShouldBeNil)
+			So(old.closed, ShouldBeTrue)
+			So(p.Count(), ShouldEqual, 1)
+			next := p.Pop()
+			So(next, ShouldNotEqual, old)
+			So(next.isRetiring(), ShouldBeFalse)
+		})
+
+		Convey("A snowflake to be replaced is not popped.", func() {
+			p, _ := NewPeers(FakeDialer{max: 2})
+			first, _ := p.Collect()
+			second, _ := p.Collect()
+			first.retire("test")
+			So(p.Pop(), ShouldEqual, second)
+			So(first.closed, ShouldBeTrue)
+		})
+
+		Convey("A snowflake is replaced after its lifetime.", func() {
+			c := &WebRTCPeer{}
+			c.retireAfter(10 * time.Millisecond)
+			<-time.After(100 * time.Millisecond)
+			So(c.isRetiring(), ShouldBeTrue)
+			c.Close()
+		})
+
 		Convey("Count correctly purges peers marked for deletion.", func() {
 			p, _ := NewPeers(FakeDialer{max: 5})
 			p.Collect()
@@ -161,25 +558,399 @@ func TestSnowflakeClient(t *testing.T) {
 		SkipConvey("Handler Grants correctly", func() {
 			socks := &FakeSocksConn{}
 			broker := &BrokerChannel{Host: "test"}
-			d := NewWebRTCDialer(broker, nil, 1)
+			d := NewWebRTCDialer(broker)
 
 			So(socks.rejected, ShouldEqual, false)
 			Handler(socks, d)
 			So(socks.rejected, ShouldEqual, true)
 		})
+
+		Convey("Replies to SOCKS after the first catch", func() {
+			socks := &FakeSocksConn{}
+			traced := TraceConn(socks, "1a2b")
+			connector, ok := socksConnector(traced)
+			So(ok, ShouldBeTrue)
+
+			first := newFirstCatch()
+			first.set(nil)
+			So(replySocks(context.Background(), "1a2b", connector, first), ShouldBeNil)
+			So(socks.granted, ShouldBeTrue)
+
+			first = newFirstCatch()
+			first.set(errBrokerTimeout)
+			So(replySocks(context.Background(), "1a2b", connector, first), ShouldEqual, errBrokerTimeout)
+			So(socks.rejected, ShouldBeTrue)
+			So(socks.reason, ShouldEqual, 0x06)
+		})
+
+		Convey("Stops waiting for the first catch when cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			So(replySocks(ctx, "1a2b", &FakeSocksConn{}, newFirstCatch()), ShouldEqual, context.Canceled)
+		})
+
+		Convey("Tells tor why no snowflake was caught", func() {
+			dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("no route to host")}
+			So(socksReply(errBrokerTimeout), ShouldEqual, 0x06)
+			So(socksReply(errDataChannelTimeout), ShouldEqual, 0x06)
+			So(socksReply(fmt.Errorf("rendezvous: %w", context.DeadlineExceeded)), ShouldEqual, 0x06)
+			So(socksReply(&url.Error{Op: "Post", URL: "https://broker.example/", Err: dialErr}), ShouldEqual, 0x03)
+			So(socksReply(errors.New(BrokerError503)), ShouldEqual, 0x04)
+			So(socksReply(errors.New(BrokerError400)), ShouldEqual, 0x01)
+		})
+	})
+
+	Convey("Peer pool", t, func() {
+		Convey("Keeps snowflakes warm and hands them out", func() {
+			p := NewPeerPool(FakeDialer{max: 1}, 2)
+			defer p.Close()
+			for p.refresh() < 2 {
+				time.Sleep(10 * time.Millisecond)
+			}
+			peer, err := p.Catch()
+			So(err, ShouldBeNil)
+			So(peer, ShouldNotBeNil)
+			So(p.refresh(), ShouldBeLessThan, 2)
+			So(p.GetMax(), ShouldEqual, 1)
+		})
+
+		Convey("Stops refilling while dormant", func() {
+			p := NewPeerPool(FakeDialer{max: 1}, 1)
+			defer p.Close()
+			for p.refresh() < 1 {
+				time.Sleep(10 * time.Millisecond)
+			}
+			p.Sleep()
+			So(p.take(""), ShouldBeNil)
+			time.Sleep(2 * poolCheckInterval)
+			So(p.take(""), ShouldBeNil)
+			p.Wake()
+			for p.refresh() < 1 {
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(p.take(""), ShouldNotBeNil)
+		})
+
+		Convey("Skips closed snowflakes", func() {
+			p := &PeerPool{Tongue: FakeDialer{max: 1}}
+			closed := &WebRTCPeer{closed: true}
+			p.warm = []*WebRTCPeer{closed}
+			So(p.take(""), ShouldBeNil)
+		})
+	})
+
+	Convey("Backoff", t, func() {
+		Convey("Doubles the wait up to the cap", func() {
+			b := Backoff{Base: time.Second, Cap: 5 * time.Second}
+			So(b.Delay(0), ShouldEqual, time.Second)
+			So(b.Delay(1), ShouldEqual, 2*time.Second)
+			So(b.Delay(2), ShouldEqual, 4*time.Second)
+			So(b.Delay(3), ShouldEqual, 5*time.Second)
+			So(b.Delay(100), ShouldEqual, 5*time.Second)
+		})
+
+		Convey("Does not overflow without a cap", func() {
+			b := Backoff{Base: time.Second}
+			So(b.Delay(100), ShouldBeGreaterThan, 0)
+		})
+
+		Convey("Adds jitter", func() {
+			b := Backoff{Base: time.Second, Jitter: time.Second}
+			for i := 0; i < 100; i++ {
+				d := b.Delay(0)
+				So(d, ShouldBeGreaterThanOrEqualTo, time.Second)
+				So(d, ShouldBeLessThan, 2*time.Second)
+			}
+		})
+
+		Convey("Collecting at capacity is not a failure", func() {
+			p, _ := NewPeers(FakeDialer{max: 1})
+			p.Collect()
+			_, err := p.Collect()
+			So(errors.Is(err, errAtCapacity), ShouldBeTrue)
+		})
+	})
+
+	Convey("Idle timeout", t, func() {
+		Convey("Closes snowflakes that receive nothing", func() {
+			c := &WebRTCPeer{options: peerOptions{idleTimeout: time.Second}}
+			start := time.Now()
+			c.checkForStaleness()
+			So(c.closed, ShouldBeTrue)
+			So(time.Since(start), ShouldBeLessThan, SnowflakeTimeout)
+		})
+	})
+
+	Convey("Events", t, func() {
+		events, cancel := SubscribeEvents()
+		c := &WebRTCPeer{trace: "1a2b"}
+		addLivePeer(c)
+		c.Close()
+		c.Close()
+		cancel()
+		var got []EventType
+		for e := range events {
+			So(e.ID, ShouldEqual, "1a2b")
+			got = append(got, e.Type)
+		}
+		So(got, ShouldResemble, []EventType{EventPeerConnected, EventPeerDisconnected})
+	})
+
+	Convey("Traffic accounting", t, func() {
+		Convey("Counts the bytes copied each way", func() {
+			socks, client := net.Pipe()
+			stream, bridge := net.Pipe()
+			go func() {
+				client.Write([]byte("hello"))
+				io.ReadFull(client, make([]byte, 3))
+			}()
+			open := make(chan []Traffic, 1)
+			go func() {
+				io.ReadFull(bridge, make([]byte, 5))
+				open <- ConnTraffic()
+				bridge.Write([]byte("hi!"))
+				bridge.Close()
+			}()
+			traffic := copyLoop(connTraceID(TraceConn(socks, "1a2b")), socks, stream, nil)
+			during := <-open
+			So(during, ShouldHaveLength, 1)
+			So(during[0].ID, ShouldEqual, "1a2b")
+			So(traffic.Up, ShouldEqual, 5)
+			So(traffic.Down, ShouldEqual, 3)
+			So(ConnTraffic(), ShouldBeEmpty)
+		})
+
+		Convey("Reports the traffic of connected snowflakes", func() {
+			c := &WebRTCPeer{id: "snowflake-1a2b", trace: "1a2b"}
+			c.counters.bytesOut = 10
+			c.counters.bytesIn = 20
+			addLivePeer(c)
+			defer c.Close()
+			So(PeerTraffic(), ShouldContain, Traffic{ID: "1a2b", Up: 10, Down: 20})
+		})
+
+		Convey("Reports the RTT and loss of connected snowflakes", func() {
+			c := &WebRTCPeer{id: "snowflake-3c4d", trace: "3c4d"}
+			c.path.rtt = int64(120 * time.Millisecond)
+			c.path.loss = math.Float64bits(0.05)
+			addLivePeer(c)
+			defer c.Close()
+			So(SnowflakeStats(), ShouldContain, PeerStats{Traffic: Traffic{ID: "3c4d"}, RTT: 120 * time.Millisecond, Loss: 0.05})
+			So(c.rtt(nil), ShouldEqual, 120*time.Millisecond)
+		})
+	})
+
+	Convey("Rate limit", t, func() {
+		Convey("No rate means no limit", func() {
+			var b bytes.Buffer
+			So(newTokenBucket(0), ShouldBeNil)
+			So(limitWriter(&b, nil), ShouldEqual, &b)
+		})
+
+		Convey("Holds writes to the rate after the first second's worth", func() {
+			var b bytes.Buffer
+			w := limitWriter(&b, newTokenBucket(10000))
+			start := time.Now()
+			n, err := w.Write(make([]byte, 20000))
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 20000)
+			So(b.Len(), ShouldEqual, 20000)
+			So(time.Since(start), ShouldBeBetween, 800*time.Millisecond, 3*time.Second)
+		})
+	})
+
+	Convey("Metrics", t, func() {
+		Convey("Are served in the Prometheus text format", func() {
+			metrics.observeRendezvous(300*time.Millisecond, nil)
+			metrics.observeRendezvous(time.Second, errors.New("failed"))
+			metrics.setNATType("restricted")
+
+			w := httptest.NewRecorder()
+			MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+			body := w.Body.String()
+			So(w.Header().Get("Content-Type"), ShouldStartWith, "text/plain")
+			So(body, ShouldContainSubstring, "# TYPE snowflake_rendezvous_attempts_total counter\n")
+			So(body, ShouldContainSubstring, `snowflake_nat_type{type="restricted"} 1`)
+			So(body, ShouldContainSubstring, `snowflake_broker_latency_seconds_bucket{le="0.25"} `)
+			So(body, ShouldContainSubstring, "snowflake_broker_latency_seconds_count ")
+			So(body, ShouldContainSubstring, `snowflake_bytes_total{direction="up"} `)
+			So(body, ShouldContainSubstring, `snowflake_encapsulated_bytes_total{kind="padding"} `)
+		})
+
+		Convey("Broker latency buckets are cumulative", func() {
+			m := &clientMetrics{latencyCounts: make([]uint64, len(brokerLatencyBuckets)+1)}
+			m.observeRendezvous(300*time.Millisecond, nil)
+			m.observeRendezvous(2*time.Minute, nil)
+			m.observeRendezvous(time.Second, errors.New("failed"))
+			var b bytes.Buffer
+			m.write(&b)
+			So(b.String(), ShouldContainSubstring, "snowflake_rendezvous_attempts_total 3\n")
+			So(b.String(), ShouldContainSubstring, "snowflake_rendezvous_successes_total 2\n")
+			So(b.String(), ShouldContainSubstring, `snowflake_broker_latency_seconds_bucket{le="0.25"} 0`+"\n")
+			So(b.String(), ShouldContainSubstring, `snowflake_broker_latency_seconds_bucket{le="0.5"} 1`+"\n")
+			So(b.String(), ShouldContainSubstring, `snowflake_broker_latency_seconds_bucket{le="+Inf"} 2`+"\n")
+		})
+	})
+
+	Convey("Network changes", t, func() {
+		Convey("The fingerprint is stable", func() {
+			So(networkFingerprint(), ShouldEqual, networkFingerprint())
+		})
+
+		Convey("ClosePeers closes the connected snowflakes", func() {
+			c := &WebRTCPeer{}
+			addLivePeer(c)
+			ClosePeers()
+			So(c.closed, ShouldBeTrue)
+			livePeers.Lock()
+			_, ok := livePeers.m[c]
+			livePeers.Unlock()
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("A PeerGroup closes only its own snowflakes", func() {
+			group := NewPeerGroup()
+			c := &WebRTCPeer{options: peerOptions{group: group}}
+			other := &WebRTCPeer{}
+			addLivePeer(c)
+			addLivePeer(other)
+			group.Close()
+			So(c.closed, ShouldBeTrue)
+			So(other.closed, ShouldBeFalse)
+			other.Close()
+			So(group.peers, ShouldBeEmpty)
+		})
+
+		Convey("Stops watching when told to", func() {
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				WatchNetwork(stop, func() {})
+				close(done)
+			}()
+			close(stop)
+			stopped := false
+			select {
+			case <-done:
+				stopped = true
+			case <-time.After(5 * time.Second):
+			}
+			So(stopped, ShouldBeTrue)
+		})
+	})
+
+	Convey("Sleep", t, func() {
+		Convey("Time missed by the monotonic clock was spent asleep", func() {
+			So(timeAsleep(5*time.Second, 5*time.Second), ShouldEqual, 0)
+			So(timeAsleep(time.Hour, 5*time.Second), ShouldEqual, time.Hour-5*time.Second)
+		})
+
+		Convey("The wall clock going back is not sleep", func() {
+			So(timeAsleep(-time.Hour, 5*time.Second), ShouldEqual, 0)
+		})
+	})
+
+	Convey("Migration", t, func() {
+		bridge, err := NewFakeBridge()
+		So(err, ShouldBeNil)
+		defer bridge.Close()
+		snowflakes := make(chan io.ReadWriteCloser, 3)
+		pop := func() io.ReadWriteCloser {
+			return <-snowflakes
+		}
+		// echo sends data through a new stream of the session and reads
+		// it back.
+		echo := func(sess *smux.Session, data []byte) ([]byte, error) {
+			stream, err := sess.OpenStream()
+			if err != nil {
+				return nil, err
+			}
+			defer stream.Close()
+			go stream.Write(data)
+			stream.SetReadDeadline(time.Now().Add(30 * time.Second))
+			got := make([]byte, len(data))
+			_, err = io.ReadFull(stream, got)
+			return got, err
+		}
+		data := make([]byte, 1<<20)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+
+		Convey("Moves the session to a new snowflake when a proxy dies mid-transfer", func() {
+			snowflakes <- &DyingConn{Conn: bridge.Snowflake(), limit: 256 << 10}
+			snowflakes <- bridge.Snowflake()
+			pconn, sess, err := newSessionOver(pop, nil)
+			So(err, ShouldBeNil)
+			defer pconn.Close()
+			defer sess.Close()
+
+			got, err := echo(sess, data)
+			So(err, ShouldBeNil)
+			So(bytes.Equal(got, data), ShouldBeTrue)
+			So(sess.IsClosed(), ShouldBeFalse)
+		})
+
+		Convey("Skips snowflakes that die before the session moves to them", func() {
+			dead := bridge.Snowflake()
+			dead.Close()
+			snowflakes <- dead
+			snowflakes <- bridge.Snowflake()
+			pconn, sess, err := newSessionOver(pop, nil)
+			So(err, ShouldBeNil)
+			defer pconn.Close()
+			defer sess.Close()
+
+			got, err := echo(sess, data[:1000])
+			So(err, ShouldBeNil)
+			So(got, ShouldResemble, data[:1000])
+		})
+
+		Convey("An idle session still receives through its snowflake", func() {
+			defer func(interval time.Duration) { KeepAliveInterval = interval }(KeepAliveInterval)
+			KeepAliveInterval = 100 * time.Millisecond
+			conn := &CountingConn{Conn: bridge.Snowflake()}
+			snowflakes <- conn
+			pconn, sess, err := newSessionOver(pop, nil)
+			So(err, ShouldBeNil)
+			defer pconn.Close()
+			defer sess.Close()
+
+			time.Sleep(time.Second)
+			So(atomic.LoadInt64(&conn.received), ShouldBeGreaterThan, 0)
+		})
+
+		Convey("Ends when there are no snowflakes left", func() {
+			close(snowflakes)
+			pconn, sess, err := newSessionOver(pop, nil)
+			So(err, ShouldBeNil)
+			defer pconn.Close()
+			defer sess.Close()
+
+			_, _, err = pconn.ReadFrom(make([]byte, 1500))
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Shared session", t, func() {
+		Convey("Refuses streams once closed", func() {
+			s := NewSharedSession(FakeDialer{max: 1})
+			So(s.Close(), ShouldBeNil)
+			So(s.Handler(nil), ShouldNotBeNil)
+		})
 	})
 
 	Convey("Dialers", t, func() {
 		Convey("Can construct WebRTCDialer.", func() {
 			broker := &BrokerChannel{Host: "test"}
-			d := NewWebRTCDialer(broker, nil, 1)
+			d := NewWebRTCDialer(broker)
 			So(d, ShouldNotBeNil)
 			So(d.BrokerChannel, ShouldNotBeNil)
 			So(d.BrokerChannel.Host, ShouldEqual, "test")
 		})
 		SkipConvey("WebRTCDialer can Catch a snowflake.", func() {
 			broker := &BrokerChannel{Host: "test"}
-			d := NewWebRTCDialer(broker, nil, 1)
+			d := NewWebRTCDialer(broker)
 			conn, err := d.Catch()
 			So(conn, ShouldBeNil)
 			So(err, ShouldNotBeNil)
@@ -264,6 +1035,1402 @@ func TestSnowflakeClient(t *testing.T) {
 			So(answer, ShouldBeNil)
 			So(err.Error(), ShouldResemble, BrokerErrorUnexpected)
 		})
+
+		Convey("BrokerChannel.Negotiate verifies signed answers", func() {
+			public, private, _ := ed25519.GenerateKey(nil)
+			_, otherKey, _ := ed25519.GenerateKey(nil)
+			key := private
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				offer, _ := ioutil.ReadAll(r.Body)
+				payload := []byte(`{"type":"answer","sdp":"signed"}`)
+				signature := ed25519.Sign(key, answerSigningMessage(offer, payload))
+				json.NewEncoder(w).Encode(signedAnswer{
+					Payload:   base64.StdEncoding.EncodeToString(payload),
+					Signature: base64.StdEncoding.EncodeToString(signature),
+				})
+			}))
+			defer server.Close()
+			b, err := NewBrokerChannel(server.URL, "", CreateBrokerTransport(), false)
+			So(err, ShouldBeNil)
+			b.SetAnswerKey(public)
+			answer, err := b.Negotiate(fakeOffer)
+			So(err, ShouldBeNil)
+			So(answer.SDP, ShouldEqual, "signed")
+
+			key = otherKey
+			_, err = b.Negotiate(fakeOffer)
+			So(errors.Is(err, ErrBadAnswerSignature), ShouldBeTrue)
+
+			unsigned, _ := NewBrokerChannel("test.broker", "", transport, false)
+			unsigned.SetAnswerKey(public)
+			_, err = unsigned.Negotiate(fakeOffer)
+			So(errors.Is(err, ErrBadAnswerSignature), ShouldBeTrue)
+		})
+
+		Convey("BrokerChannel tells the broker the proxy preferences", func() {
+			var header http.Header
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				header = r.Header
+				w.Write([]byte(`{"type":"answer","sdp":"fake"}`))
+			}))
+			defer server.Close()
+			b, err := NewBrokerChannel(server.URL, "", CreateBrokerTransport(), false)
+			So(err, ShouldBeNil)
+			b.SetProxyPreferences(ProxyPreferences{Types: []string{"standalone"}, ExcludeCountries: []string{"DE", "AT"}})
+			_, err = b.Negotiate(fakeOffer)
+			So(err, ShouldBeNil)
+			So(header.Get("Snowflake-Proxy-Types"), ShouldEqual, "standalone")
+			So(header.Get("Snowflake-Exclude-Countries"), ShouldEqual, "DE,AT")
+			So(header.Get("Snowflake-Countries"), ShouldEqual, "")
+
+			body, err := encodeClientPollRequest([]byte("offer"), "unknown",
+				ProxyPreferences{Types: []string{"standalone"}, ExcludeCountries: []string{"DE"}}, "", "")
+			So(err, ShouldBeNil)
+			So(string(body), ShouldEqual, clientVersion+"\n"+
+				`{"offer":"offer","nat":"unknown","proxy_types":["standalone"],"exclude_countries":["DE"]}`)
+			body, _ = encodeClientPollRequest([]byte("offer"), "unknown", ProxyPreferences{}, "", "")
+			So(string(body), ShouldEqual, clientVersion+"\n"+`{"offer":"offer","nat":"unknown"}`)
+		})
+
+		Convey("BrokerChannel sends the client token", func() {
+			var header http.Header
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				header = r.Header
+				w.Write([]byte(`{"type":"answer","sdp":"fake"}`))
+			}))
+			defer server.Close()
+			b, err := NewBrokerChannel(server.URL, "", CreateBrokerTransport(), false)
+			So(err, ShouldBeNil)
+			_, err = b.Negotiate(fakeOffer)
+			So(err, ShouldBeNil)
+			So(header.Get("Snowflake-Client-Token"), ShouldEqual, "")
+			token := "0123456789abcdef"
+			b.SetClientToken(func() string { return token })
+			_, err = b.Negotiate(fakeOffer)
+			So(err, ShouldBeNil)
+			So(header.Get("Snowflake-Client-Token"), ShouldEqual, "0123456789abcdef")
+
+			body, _ := encodeClientPollRequest([]byte("offer"), "unknown", ProxyPreferences{}, "", b.token())
+			So(string(body), ShouldEqual, clientVersion+"\n"+`{"offer":"offer","nat":"unknown","token":"0123456789abcdef"}`)
+		})
+
+		Convey("BrokerChannel asks for the bridge and checks the one assigned", func() {
+			const fingerprint = "2B280B23E1107BB62ABFC40DDCC8824814F80A72"
+			var header http.Header
+			assigned := fingerprint
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				header = r.Header
+				w.Header().Set("Snowflake-Bridge-Fingerprint", assigned)
+				w.Write([]byte(`{"type":"answer","sdp":"fake"}`))
+			}))
+			defer server.Close()
+			b, err := NewBrokerChannel(server.URL, "", CreateBrokerTransport(), false)
+			So(err, ShouldBeNil)
+			So(b.SetBridgeFingerprint("not a fingerprint"), ShouldNotBeNil)
+			So(b.SetBridgeFingerprint(strings.ToLower(fingerprint)), ShouldBeNil)
+			So(b.GetBridgeFingerprint(), ShouldEqual, fingerprint)
+			_, err = b.Negotiate(fakeOffer)
+			So(err, ShouldBeNil)
+			So(header.Get("Snowflake-Bridge-Fingerprint"), ShouldEqual, fingerprint)
+
+			assigned = "8838024498816A039FCBBAB14E6F40A0843051FA"
+			_, err = b.Negotiate(fakeOffer)
+			So(errors.Is(err, ErrWrongBridge), ShouldBeTrue)
+			assigned = ""
+			_, err = b.Negotiate(fakeOffer)
+			So(err, ShouldBeNil)
+
+			body, _ := encodeClientPollRequest([]byte("offer"), "unknown", ProxyPreferences{}, fingerprint, "")
+			So(string(body), ShouldEqual, clientVersion+"\n"+
+				`{"offer":"offer","nat":"unknown","fingerprint":"`+fingerprint+`"}`)
+			answer, bridge, err := decodeClientPollResponse([]byte(`{"answer":"fake","fingerprint":"` + fingerprint + `"}`))
+			So(err, ShouldBeNil)
+			So(string(answer), ShouldEqual, "fake")
+			So(bridge, ShouldEqual, fingerprint)
+		})
+
+		Convey("Proxy preferences are checked", func() {
+			So(ProxyPreferences{Types: []string{"webext"}, Countries: []string{"BR"}}.Check(), ShouldBeNil)
+			So(ProxyPreferences{Types: []string{"browser"}}.Check(), ShouldNotBeNil)
+			So(ProxyPreferences{Countries: []string{"de"}}.Check(), ShouldNotBeNil)
+			So(ProxyPreferences{ExcludeCountries: []string{"DEU"}}.Check(), ShouldNotBeNil)
+		})
 	})
 
+	Convey("Bridge balancer", t, func() {
+		const a = "2B280B23E1107BB62ABFC40DDCC8824814F80A72"
+		const b = "8838024498816A039FCBBAB14E6F40A0843051FA"
+		balancer, err := NewBridgeBalancer([]string{a, strings.ToLower(b)})
+		So(err, ShouldBeNil)
+		_, err = NewBridgeBalancer([]string{a, a})
+		So(err, ShouldNotBeNil)
+		_, err = NewBridgeBalancer(nil)
+		So(err, ShouldNotBeNil)
+
+		Convey("Spreads sessions over the bridges", func() {
+			So(balancer.acquire(), ShouldEqual, a)
+			So(balancer.acquire(), ShouldEqual, b)
+			balancer.release(a)
+			So(balancer.acquire(), ShouldEqual, a)
+		})
+
+		Convey("Fails over from a bridge that is down until data comes through it", func() {
+			for i := 0; i < bridgeFailureThreshold; i++ {
+				So(balancer.up(a), ShouldBeTrue)
+				balancer.report(a, false)
+			}
+			So(balancer.up(a), ShouldBeFalse)
+			So(balancer.acquire(), ShouldEqual, b)
+			So(balancer.acquire(), ShouldEqual, b)
+			balancer.report(a, true)
+			So(balancer.up(a), ShouldBeTrue)
+			So(balancer.acquire(), ShouldEqual, a)
+		})
+
+		Convey("Takes the bridge to be retried first when all are down", func() {
+			for i := 0; i < bridgeFailureThreshold; i++ {
+				balancer.report(b, false)
+			}
+			for i := 0; i < bridgeFailureThreshold; i++ {
+				balancer.report(a, false)
+			}
+			So(balancer.acquire(), ShouldEqual, b)
+		})
+
+		Convey("A session catches for its bridge and moves on while no data came", func() {
+			d := NewWebRTCDialer(nil)
+			d.SetBridges(balancer)
+			So(bridgesOf(d), ShouldEqual, balancer)
+			p, err := NewPeers(d)
+			So(err, ShouldBeNil)
+			So(p.bridge, ShouldEqual, a)
+			for i := 0; i < bridgeFailureThreshold; i++ {
+				balancer.report(a, false)
+			}
+			p.failOver()
+			So(p.bridge, ShouldEqual, b)
+
+			p.activePeers.PushBack(&WebRTCPeer{counters: peerCounters{bytesIn: 1}})
+			for i := 0; i < bridgeFailureThreshold; i++ {
+				balancer.report(b, false)
+			}
+			p.failOver()
+			So(p.bound, ShouldBeTrue)
+			So(p.bridge, ShouldEqual, b)
+		})
+
+		Convey("Rendezvous ask for the bridge of the session", func() {
+			broker, err := NewBrokerChannel("https://broker.example/", "", CreateBrokerTransport(), false)
+			So(err, ShouldBeNil)
+			So(broker.SetBridgeFingerprint(a), ShouldBeNil)
+			ctx := withBridge(context.Background(), balancer, b)
+			So(broker.bridgeFor(context.Background()), ShouldEqual, a)
+			So(broker.bridgeFor(ctx), ShouldEqual, b)
+			So(broker.checkBridge(ctx, a), ShouldNotBeNil)
+			So(broker.checkBridge(ctx, b), ShouldBeNil)
+		})
+
+		Convey("A pool hands out snowflakes for the bridge asked for", func() {
+			pool := &PeerPool{Tongue: FakeDialer{max: 1}}
+			forB := &WebRTCPeer{bridge: bridgeChoice{balancer, b}}
+			pool.warm = []*WebRTCPeer{{bridge: bridgeChoice{balancer, a}}, forB}
+			So(pool.take(b), ShouldEqual, forB)
+			So(pool.warm, ShouldHaveLength, 1)
+			So(pool.take(b), ShouldBeNil)
+			So(pool.take(a), ShouldNotBeNil)
+		})
+	})
+
+	Convey("WebSocket fallback", t, func() {
+		server := newWebSocketEchoServer()
+		defer server.Close()
+		wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+		Convey("Carries a stream over WebSocket", func() {
+			u, _ := url.Parse(wsURL)
+			conn, err := dialWebSocket(context.Background(), http.DefaultTransport, u, "")
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			_, err = conn.Write([]byte("hello"))
+			So(err, ShouldBeNil)
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(conn, buf)
+			So(err, ShouldBeNil)
+			So(string(buf), ShouldEqual, "hello")
+			conn.Close()
+			So(conn.isClosed(), ShouldBeTrue)
+		})
+
+		Convey("Starts after enough failures in a row", func() {
+			_, err := NewWebSocketFallback("https://bridge.example/", "", CreateBrokerTransport(), 2)
+			So(err, ShouldNotBeNil)
+			f, err := NewWebSocketFallback(wsURL, "", CreateBrokerTransport(), 2)
+			So(err, ShouldBeNil)
+			So(f.active(), ShouldBeFalse)
+			f.failed()
+			So(f.active(), ShouldBeFalse)
+			f.failed()
+			So(f.active(), ShouldBeTrue)
+			f.succeeded()
+			So(f.active(), ShouldBeFalse)
+			var none *WebSocketFallback
+			So(none.active(), ShouldBeFalse)
+		})
+
+		Convey("Starts at once when activated", func() {
+			f, err := NewWebSocketFallback(wsURL, "", CreateBrokerTransport(), 3)
+			So(err, ShouldBeNil)
+			f.Activate()
+			So(f.active(), ShouldBeTrue)
+			f.succeeded()
+			So(f.active(), ShouldBeFalse)
+		})
+
+		Convey("Hands a session a connection to the bridge", func() {
+			f, err := NewWebSocketFallback(wsURL, "", CreateBrokerTransport(), 1)
+			So(err, ShouldBeNil)
+			f.failed()
+			p, _ := NewPeers(FakeDialer{max: 1})
+			p.fallback = f
+			peer, err := p.Collect()
+			So(err, ShouldBeNil)
+			So(peer, ShouldBeNil)
+			_, err = p.Collect()
+			So(errors.Is(err, errAtCapacity), ShouldBeTrue)
+			conn := p.popConn()
+			So(conn, ShouldEqual, p.fallbackConn)
+			p.End()
+			So(p.fallbackConn.isClosed(), ShouldBeTrue)
+		})
+	})
+
+	Convey("Tuning", t, func() {
+		Convey("Defaults to the process-wide settings", func() {
+			var none *Tuning
+			So(none.kcp(), ShouldResemble, KCP)
+			So(none.redialBackoff(), ShouldResemble, RedialBackoff)
+			So(tuningOf(NewWebRTCDialer(nil)), ShouldBeNil)
+			So(DefaultTuning().KeepAliveInterval, ShouldEqual, KeepAliveInterval)
+		})
+
+		Convey("Is that of the dialer, through a pool", func() {
+			tuning := &Tuning{ProxyCooldown: time.Minute, UpLimit: 1000}
+			pool := &PeerPool{Tongue: NewWebRTCDialer(nil, WithTuning(tuning))}
+			So(tuningOf(pool), ShouldEqual, tuning)
+
+			up, down := tuning.limits()
+			So(up.limit(), ShouldEqual, 1000)
+			So(down, ShouldBeNil)
+			again, _ := tuning.limits()
+			So(again, ShouldEqual, up)
+		})
+	})
+
+	Convey("Proxy cooldown", t, func() {
+		Convey("Takes the public addresses of a proxy from its answer", func() {
+			sdp := "v=0\r\n" +
+				"a=candidate:1 1 udp 2130706431 192.168.1.5 5000 typ host\r\n" +
+				"a=candidate:2 1 udp 2130706431 2001:db8::5 5000 typ host\r\n" +
+				"a=candidate:3 1 udp 1694498815 203.0.113.7 5000 typ srflx raddr 192.168.1.5 rport 5000\r\n" +
+				"a=candidate:4 1 udp 1694498815 203.0.113.7 5001 typ srflx raddr 192.168.1.5 rport 5001\r\n" +
+				"a=candidate:5 1 udp 16777215 198.51.100.3 3478 typ relay raddr 203.0.113.7 rport 5000\r\n" +
+				"a=candidate:6 1 udp 2130706431 abcd.local 5000 typ host\r\n"
+			So(proxyAddresses(sdp), ShouldResemble, []string{"2001:db8::5", "203.0.113.7"})
+		})
+
+		Convey("Skips proxies for a while after they failed", func() {
+			p := &proxyCooldown{until: make(map[string]time.Time)}
+			p.add([]string{"203.0.113.7"}, time.Minute)
+			So(p.cooling([]string{"198.51.100.1", "203.0.113.7"}), ShouldBeTrue)
+			So(p.cooling([]string{"198.51.100.1"}), ShouldBeFalse)
+			So(p.cooling(nil), ShouldBeFalse)
+
+			p.add([]string{"198.51.100.1"}, time.Millisecond)
+			time.Sleep(2 * time.Millisecond)
+			So(p.cooling([]string{"198.51.100.1"}), ShouldBeFalse)
+
+			p.add([]string{"198.51.100.2"}, 0)
+			So(p.cooling([]string{"198.51.100.2"}), ShouldBeFalse)
+		})
+
+		Convey("Sends each proxy it skips a fresh offer", func() {
+			failedProxies.add([]string{"203.0.113.9"}, time.Minute)
+			defer func() {
+				failedProxies.lock.Lock()
+				delete(failedProxies.until, "203.0.113.9")
+				failedProxies.lock.Unlock()
+			}()
+			answer, err := util.SerializeSessionDescription(&webrtc.SessionDescription{
+				Type: webrtc.SDPTypeAnswer,
+				SDP:  "v=0\r\na=candidate:1 1 udp 1694498815 203.0.113.9 5000 typ srflx raddr 0.0.0.0 rport 0\r\n",
+			})
+			So(err, ShouldBeNil)
+			rendezvous := &AnsweringRendezvous{answer: answer}
+			b, _ := NewBrokerChannel("test.broker", "", &MockTransport{}, false)
+			b.SetRendezvousMethod(rendezvous)
+
+			// The answer is no real one, so the last proxy fails too.
+			_, err = newWebRTCPeer(context.Background(), &webrtc.Configuration{}, b, peerOptions{})
+			So(err, ShouldNotBeNil)
+			So(rendezvous.offers, ShouldHaveLength, maxCooldownSkips+1)
+			ufrags := make(map[string]bool)
+			for _, offer := range rendezvous.offers {
+				sdp, err := util.DeserializeSessionDescription(offer)
+				So(err, ShouldBeNil)
+				for _, line := range strings.Split(sdp.SDP, "\r\n") {
+					if strings.HasPrefix(line, "a=ice-ufrag:") {
+						ufrags[line] = true
+					}
+				}
+			}
+			So(ufrags, ShouldHaveLength, maxCooldownSkips+1)
+		})
+	})
+
+	Convey("Upstream proxy", t, func() {
+		Convey("Only socks5 and http proxies are supported", func() {
+			u, _ := url.Parse("socks5://127.0.0.1:1080")
+			So(CheckProxyProtocolSupport(u), ShouldBeNil)
+			u, _ = url.Parse("http://127.0.0.1:8080")
+			So(CheckProxyProtocolSupport(u), ShouldBeNil)
+			u, _ = url.Parse("socks4a://127.0.0.1:1080")
+			So(CheckProxyProtocolSupport(u), ShouldNotBeNil)
+		})
+
+		Convey("HTTP CONNECT dialer tunnels through the proxy", func() {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			defer ln.Close()
+			target := make(chan string, 1)
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				target <- req.Method + " " + req.Host
+				conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+			}()
+
+			u, _ := url.Parse("http://" + ln.Addr().String())
+			dialer, err := proxy.FromURL(u, proxy.Direct)
+			So(err, ShouldBeNil)
+			conn, err := dialer.Dial("tcp", "turn.example:443")
+			So(err, ShouldBeNil)
+			conn.Close()
+			So(<-target, ShouldEqual, "CONNECT turn.example:443")
+		})
+	})
+
+	Convey("AMP cache", t, func() {
+		Convey("Builds AMP cache URLs", func() {
+			pub, _ := url.Parse("https://snowflake-broker.example.com/amp/client/xyz")
+			cache, _ := url.Parse("https://cdn.ampproject.org/")
+			u, err := ampCacheURL(pub, cache)
+			So(err, ShouldBeNil)
+			So(u.String(), ShouldEqual,
+				"https://snowflake--broker-example-com.cdn.ampproject.org/c/s/snowflake-broker.example.com/amp/client/xyz")
+		})
+
+		Convey("BrokerChannel.Negotiate decodes an armored answer", func() {
+			answer := base64.StdEncoding.EncodeToString(
+				[]byte(`{"answer":"{\"type\":\"answer\",\"sdp\":\"fake\"}"}`))
+			doc := "<!doctype html>\n<html amp><body>\n<pre>\n" +
+				answer[:10] + "\n</pre>\n<pre>\n" + answer[10:] + "\n</pre>\n</body></html>"
+			transport := &MockTransport{http.StatusOK, []byte(doc)}
+			b, err := NewBrokerChannel("https://broker.example/", "front.example", transport, false)
+			So(err, ShouldBeNil)
+			So(b.SetAMPCache("https://cdn.ampproject.org/"), ShouldBeNil)
+			So(b.rendezvous.(*ampCacheRendezvous).front, ShouldEqual, "front.example")
+			So(b.rendezvous.(*ampCacheRendezvous).broker.Host, ShouldEqual, "broker.example")
+
+			fakeOffer, err := util.DeserializeSessionDescription(`{"type":"offer","sdp":"test"}`)
+			So(err, ShouldBeNil)
+			sdp, err := b.Negotiate(fakeOffer)
+			So(err, ShouldBeNil)
+			So(sdp.SDP, ShouldEqual, "fake")
+		})
+	})
+
+	Convey("SQS", t, func() {
+		creds := base64.StdEncoding.EncodeToString(
+			[]byte(`{"aws-access-key-id":"id","aws-secret-key":"secret"}`))
+
+		Convey("Rejects bad queue URLs and credentials", func() {
+			b, _ := NewBrokerChannel("https://broker.example/", "", &SQSMockTransport{}, false)
+			So(b.SetSQSQueue("https://example.com/1/queue", creds), ShouldNotBeNil)
+			So(b.SetSQSQueue("https://sqs.us-east-1.amazonaws.com/1/queue", "garbage"), ShouldNotBeNil)
+		})
+
+		Convey("BrokerChannel.Negotiate exchanges through the queues", func() {
+			transport := &SQSMockTransport{}
+			b, _ := NewBrokerChannel("https://broker.example/", "", transport, false)
+			So(b.SetSQSQueue("https://sqs.us-east-1.amazonaws.com/1/queue", creds), ShouldBeNil)
+			fakeOffer, err := util.DeserializeSessionDescription(`{"type":"offer","sdp":"test"}`)
+			So(err, ShouldBeNil)
+			answer, err := b.Negotiate(fakeOffer)
+			So(err, ShouldBeNil)
+			So(answer.SDP, ShouldEqual, "fake")
+			So(transport.sentOffer, ShouldBeTrue)
+		})
+	})
+
+	Convey("Broker reachability", t, func() {
+		Convey("Any answer shows the broker is reachable", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.NotFound(w, r)
+			}))
+			defer server.Close()
+			b, _ := NewBrokerChannel(server.URL, "", CreateBrokerTransport(), false)
+			So(b.CheckReachable(context.Background()), ShouldBeNil)
+		})
+
+		Convey("Fails without an answer", func() {
+			ln, _ := net.Listen("tcp", "127.0.0.1:0")
+			addr := ln.Addr().String()
+			ln.Close()
+			b, _ := NewBrokerChannel("http://"+addr+"/", "", CreateBrokerTransport(), false)
+			So(b.CheckReachable(context.Background()), ShouldNotBeNil)
+		})
+	})
+
+	Convey("Rendezvous methods", t, func() {
+		fakeOffer, err := util.DeserializeSessionDescription(`{"type":"offer","sdp":"test"}`)
+		So(err, ShouldBeNil)
+
+		Convey("Unknown methods are rejected", func() {
+			b, _ := NewBrokerChannel("test.broker", "", &MockTransport{}, false)
+			So(b.UseRendezvousMethod("carrier-pigeon", nil), ShouldNotBeNil)
+		})
+
+		Convey("Registered methods can be selected", func() {
+			RegisterRendezvousMethod("echo", func(bc *BrokerChannel, options map[string]string) (RendezvousMethod, error) {
+				return EchoRendezvous{}, nil
+			})
+			b, _ := NewBrokerChannel("test.broker", "", &MockTransport{}, true)
+			So(b.UseRendezvousMethod("echo", nil), ShouldBeNil)
+			answer, err := b.Negotiate(fakeOffer)
+			So(err, ShouldBeNil)
+			So(answer.SDP, ShouldEqual, "test")
+		})
+	})
+
+	Convey("Racing rendezvous methods", t, func() {
+		fakeOffer, err := util.DeserializeSessionDescription(`{"type":"offer","sdp":"test"}`)
+		So(err, ShouldBeNil)
+		b, _ := NewBrokerChannel("test.broker", "", &MockTransport{}, true)
+
+		Convey("The first answer wins", func() {
+			blocked := &BlockingRendezvous{released: make(chan struct{})}
+			defer close(blocked.released)
+			b.SetRendezvousMethod(RaceRendezvousMethods(blocked, EchoRendezvous{}))
+			answer, err := b.Negotiate(fakeOffer)
+			So(err, ShouldBeNil)
+			So(answer.SDP, ShouldEqual, "test")
+		})
+
+		Convey("Losing exchanges are cancelled", func() {
+			cancelled := make(chan struct{})
+			b.SetRendezvousMethod(RaceRendezvousMethods(
+				CancellableRendezvous{cancelled}, EchoRendezvous{}))
+			_, err := b.Negotiate(fakeOffer)
+			So(err, ShouldBeNil)
+			<-cancelled
+		})
+
+		Convey("Fails when every method fails", func() {
+			b.SetRendezvousMethod(RaceRendezvousMethods(
+				FailingRendezvous{}, FailingRendezvous{}))
+			_, err := b.Negotiate(fakeOffer)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, BrokerError503)
+		})
+
+		Convey("A cancelled negotiation cancels the exchange", func() {
+			cancelled := make(chan struct{})
+			b.SetRendezvousMethod(CancellableRendezvous{cancelled})
+			ctx, cancel := context.WithCancel(context.Background())
+			go cancel()
+			_, err := b.NegotiateContext(ctx, fakeOffer)
+			So(err, ShouldEqual, context.Canceled)
+			<-cancelled
+		})
+
+		Convey("A cancelled negotiation stops waiting to retry", func() {
+			b.SetRendezvousMethod(FailingRendezvous{})
+			b.SetRetryPolicy(RetryPolicy{Backoff: Backoff{Base: time.Hour}, Retries: 1})
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			_, err := b.NegotiateContext(ctx, fakeOffer)
+			So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+		})
+
+		Convey("Methods can be raced by name", func() {
+			b, _ := NewBrokerChannel("https://broker.example/", "", &MockTransport{}, true)
+			So(b.UseRendezvousMethods([]string{"http", "ampcache"},
+				map[string]string{"ampcache": "https://cdn.ampproject.org/"}), ShouldBeNil)
+			So(b.rendezvous, ShouldHaveSameTypeAs, raceRendezvous{})
+			So(b.UseRendezvousMethods([]string{"http", "ampcache"}, nil), ShouldNotBeNil)
+		})
+	})
+
+	Convey("ICE policy", t, func() {
+		Convey("Parses policy names", func() {
+			policy, err := ParseICEPolicy("")
+			So(err, ShouldBeNil)
+			So(policy, ShouldEqual, ICEPolicyAll)
+			policy, err = ParseICEPolicy("no-host")
+			So(err, ShouldBeNil)
+			So(policy, ShouldEqual, ICEPolicyNoHost)
+			_, err = ParseICEPolicy("srflx")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Relay policy is set on the WebRTC configuration", func() {
+			d := NewWebRTCDialer(nil)
+			d.SetICEPolicy(ICEPolicyRelay)
+			So(d.webrtcConfig.ICETransportPolicy, ShouldEqual, webrtc.ICETransportPolicyRelay)
+		})
+
+		Convey("Strips host candidates", func() {
+			sdp := "v=0\r\n" +
+				"a=candidate:1 1 udp 2130706431 192.168.1.5 5000 typ host\r\n" +
+				"a=candidate:2 1 udp 1694498815 203.0.113.7 5000 typ srflx raddr 192.168.1.5 rport 5000\r\n" +
+				"a=end-of-candidates\r\n"
+			So(stripHostCandidates(sdp), ShouldEqual, "v=0\r\n"+
+				"a=candidate:2 1 udp 1694498815 203.0.113.7 5000 typ srflx raddr 192.168.1.5 rport 5000\r\n"+
+				"a=end-of-candidates\r\n")
+		})
+	})
+
+	Convey("Dialer options", t, func() {
+		Convey("Default to a single snowflake without ICE servers", func() {
+			d := NewWebRTCDialer(nil)
+			So(d.GetMax(), ShouldEqual, 1)
+			So(d.webrtcConfig.ICEServers, ShouldBeEmpty)
+		})
+
+		Convey("Are applied in order", func() {
+			servers := []webrtc.ICEServer{{URLs: []string{"stun:stun.example.net:3478"}}}
+			proxyURL, _ := url.Parse("socks5://127.0.0.1:1080")
+			d := NewWebRTCDialer(nil, WithICEServers(servers), WithCapacity(3),
+				WithCapacity(2), WithProxy(proxyURL), WithSettingEngine(webrtc.SettingEngine{}))
+			So(d.GetMax(), ShouldEqual, 2)
+			So(d.webrtcConfig.ICEServers, ShouldResemble, servers)
+			So(d.options.proxy, ShouldEqual, proxyURL)
+			So(d.options.settingEngine, ShouldNotBeNil)
+		})
+
+		Convey("The event sink receives the events of the peers", func() {
+			var got []Event
+			d := NewWebRTCDialer(nil, WithEventSink(func(e Event) { got = append(got, e) }))
+			peer := &WebRTCPeer{options: d.options, trace: "1a2b"}
+			peer.emit(EventICEConnected)
+			So(got, ShouldHaveLength, 1)
+			So(got[0].Type, ShouldEqual, EventICEConnected)
+			So(got[0].ID, ShouldEqual, "1a2b")
+		})
+	})
+
+	Convey("Adaptive capacity", t, func() {
+		Convey("Keeps a single snowflake for light use", func() {
+			So(demandCapacity(4, 0, 0), ShouldEqual, 1)
+			So(demandCapacity(4, 1, 1000), ShouldEqual, 1)
+		})
+
+		Convey("Grows with connections and traffic up to the ceiling", func() {
+			So(demandCapacity(4, 5, 0), ShouldEqual, 2)
+			So(demandCapacity(4, 1, float64(2*ThroughputPerSnowflake)), ShouldEqual, 3)
+			So(demandCapacity(4, 9, float64(2*ThroughputPerSnowflake)), ShouldEqual, 4)
+			So(demandCapacity(2, 100, 0), ShouldEqual, 2)
+		})
+
+		Convey("Smooths the throughput", func() {
+			m := new(demandMeter)
+			now := time.Now()
+			So(m.sample(now, 0), ShouldEqual, 0)
+			So(m.sample(now.Add(time.Second), 1000), ShouldEqual, 500)
+			So(m.sample(now.Add(1500*time.Millisecond), 5000), ShouldEqual, 500)
+			So(m.sample(now.Add(2*time.Second), 1000), ShouldEqual, 250)
+		})
+
+		Convey("Bounds the peers by the ceiling of the dialer", func() {
+			d := NewWebRTCDialer(nil, WithCapacity(3))
+			d.SetAdaptiveCapacity(true)
+			So(d.GetMax(), ShouldBeBetweenOrEqual, 1, 3)
+			So(d.GetCeiling(), ShouldEqual, 3)
+			p, err := NewPeers(d)
+			So(err, ShouldBeNil)
+			So(cap(p.snowflakeChan), ShouldEqual, 3)
+			pool := NewPeerPool(d, 0)
+			defer pool.Close()
+			So(pool.GetCeiling(), ShouldEqual, 3)
+		})
+	})
+
+	Convey("UDP port range", t, func() {
+		d := NewWebRTCDialer(nil)
+		So(d.SetUDPPortRange(50000, 50100), ShouldBeNil)
+		So(d.options.portMin, ShouldEqual, 50000)
+		So(d.options.portMax, ShouldEqual, 50100)
+		So(d.SetUDPPortRange(50100, 50000), ShouldNotBeNil)
+	})
+
+	Convey("Interface", t, func() {
+		d := NewWebRTCDialer(nil)
+		So(d.SetInterface("no-such-interface0"), ShouldNotBeNil)
+		So(d.options.iface, ShouldEqual, "")
+		So(d.SetInterface(""), ShouldBeNil)
+	})
+
+	Convey("IPv6", t, func() {
+		Convey("Tells IPv4 and IPv6 addresses apart", func() {
+			So(ipVersion("203.0.113.7"), ShouldEqual, "IPv4")
+			So(ipVersion("2001:db8::1"), ShouldEqual, "IPv6")
+		})
+
+		Convey("IPv6 is not preferred for a while after failing", func() {
+			d := NewWebRTCDialer(nil)
+			So(d.ipv6.usable(), ShouldBeFalse)
+			d.SetPreferIPv6(true)
+			So(d.ipv6.usable(), ShouldBeTrue)
+			d.ipv6.failed()
+			So(d.ipv6.usable(), ShouldBeFalse)
+		})
+	})
+
+	Convey("DataChannel reliability", t, func() {
+		d := NewWebRTCDialer(nil)
+		n := uint16(3)
+		So(d.SetDataChannelReliability(DataChannelReliability{
+			Unordered: true, MaxRetransmits: &n}), ShouldBeNil)
+		So(d.options.reliability.Unordered, ShouldBeTrue)
+		So(d.SetDataChannelReliability(DataChannelReliability{
+			MaxRetransmits: &n, MaxPacketLifeTime: &n}), ShouldNotBeNil)
+	})
+
+	Convey("SCTP options", t, func() {
+		d := NewWebRTCDialer(nil)
+		So(d.SetSCTPOptions(SCTPOptions{SendBufferSize: 1 << 20, MaxMessageSize: 16384}), ShouldBeNil)
+		So(d.options.sctp.SendBufferSize, ShouldEqual, 1<<20)
+		So(d.SetSCTPOptions(SCTPOptions{SendBufferSize: -1}), ShouldNotBeNil)
+	})
+
+	Convey("WebRTC stats", t, func() {
+		Convey("Summarizes the nominated candidate pair", func() {
+			report := webrtc.StatsReport{
+				"dc": webrtc.DataChannelStats{ID: "dc", BytesSent: 1200, BytesReceived: 34000},
+				"pair": webrtc.ICECandidatePairStats{ID: "pair", Nominated: true,
+					LocalCandidateID: "local", RemoteCandidateID: "remote",
+					CurrentRoundTripTime: 0.085, RetransmissionsSent: 2},
+				"local": webrtc.ICECandidateStats{ID: "local", IP: "192.168.1.5",
+					NetworkType: webrtc.NetworkTypeUDP4, CandidateType: webrtc.ICECandidateTypeSrflx},
+				"remote": webrtc.ICECandidateStats{ID: "remote", IP: "203.0.113.7",
+					CandidateType: webrtc.ICECandidateTypeHost},
+			}
+			summary := summarizeStats(report)
+			So(summary, ShouldEqual, "sent 1200 B, received 34000 B, RTT 85 ms, "+
+				"pair udp4 srflx <-> host, STUN retransmissions 2")
+		})
+
+		Convey("Copes with no selected pair", func() {
+			So(summarizeStats(webrtc.StatsReport{}), ShouldEqual,
+				"sent 0 B, received 0 B, no candidate pair selected")
+		})
+	})
+
+	Convey("Peer quality", t, func() {
+		prev := peerCounters{bytesIn: 1000, bytesOut: 1000, writes: 10}
+		cur := peerCounters{bytesIn: 11000, bytesOut: 5000, writes: 30, writeErrors: 2}
+		q := measureQuality(prev, cur, 10*time.Second, 150*time.Millisecond)
+
+		Convey("Measures throughput and error rate", func() {
+			So(q.throughput, ShouldEqual, 1000)
+			So(q.errorRate, ShouldEqual, 0.1)
+			So(q.sending, ShouldBeTrue)
+			So(q.String(), ShouldEqual, "RTT 150ms, throughput 1000 B/s, error rate 0.10, loss 0.00")
+		})
+
+		Convey("Checks the thresholds", func() {
+			So(QualityThresholds{}.check(q), ShouldEqual, "")
+			So(QualityThresholds{MaxRTT: 100 * time.Millisecond}.check(q), ShouldNotEqual, "")
+			So(QualityThresholds{MinThroughput: 2000}.check(q), ShouldNotEqual, "")
+			So(QualityThresholds{MaxErrorRate: 0.05}.check(q), ShouldNotEqual, "")
+			lossy := q
+			lossy.loss = 0.3
+			So(QualityThresholds{MaxLoss: 0.2}.check(q), ShouldEqual, "")
+			So(QualityThresholds{MaxLoss: 0.2}.check(lossy), ShouldNotEqual, "")
+			So(QualityThresholds{MaxRTT: time.Second, MinThroughput: 500, MaxErrorRate: 0.2}.check(q), ShouldEqual, "")
+		})
+
+		Convey("Idle snowflakes are not judged on throughput", func() {
+			idle := measureQuality(prev, prev, 10*time.Second, 0)
+			So(QualityThresholds{MinThroughput: 2000}.check(idle), ShouldEqual, "")
+		})
+	})
+
+	Convey("Parallel dials", t, func() {
+		Convey("The first snowflake to connect wins", func() {
+			slow := &WebRTCPeer{}
+			fast := &WebRTCPeer{}
+			release := make(chan struct{})
+			var calls int32
+			catch := func(context.Context) (*WebRTCPeer, error) {
+				if atomic.AddInt32(&calls, 1) == 1 {
+					<-release
+					return slow, nil
+				}
+				return fast, nil
+			}
+			// Returns while the slow dial is still blocked.
+			peer, err := catchFirst(context.Background(), 2, catch)
+			close(release)
+			So(err, ShouldBeNil)
+			So(peer, ShouldEqual, fast)
+		})
+
+		Convey("The dials that lost the race are cancelled", func() {
+			cancelled := make(chan error, 1)
+			var calls int32
+			catch := func(ctx context.Context) (*WebRTCPeer, error) {
+				if atomic.AddInt32(&calls, 1) == 1 {
+					<-ctx.Done()
+					cancelled <- ctx.Err()
+					return nil, ctx.Err()
+				}
+				return &WebRTCPeer{}, nil
+			}
+			_, err := catchFirst(context.Background(), 2, catch)
+			So(err, ShouldBeNil)
+			So(<-cancelled, ShouldEqual, context.Canceled)
+		})
+
+		Convey("Fails when every dial fails", func() {
+			peer, err := catchFirst(context.Background(), 3, func(context.Context) (*WebRTCPeer, error) {
+				return nil, errors.New(BrokerError503)
+			})
+			So(peer, ShouldBeNil)
+			So(err.Error(), ShouldEqual, BrokerError503)
+		})
+	})
+
+	Convey("Front domains", t, func() {
+		Convey("SetFronts replaces the front given to NewBrokerChannel", func() {
+			b, _ := NewBrokerChannel("https://broker.example/", "front", &MockTransport{}, false)
+			b.SetFronts([]string{"a.example", "b.example"})
+			So(b.Host, ShouldEqual, "")
+			So(b.url.Host, ShouldEqual, "broker.example")
+		})
+
+		Convey("Failing fronts are dropped", func() {
+			p := newFrontPool([]string{"good.example", "bad.example"})
+			for i := 0; i < frontMaxFailures; i++ {
+				p.report("bad.example", errors.New("connection reset"))
+			}
+			for i := 0; i < 10; i++ {
+				So(p.pick(), ShouldEqual, "good.example")
+			}
+		})
+
+		Convey("A success forgives earlier failures", func() {
+			p := newFrontPool([]string{"flaky.example"})
+			p.report("flaky.example", errors.New("timeout"))
+			p.report("flaky.example", nil)
+			So(p.failures["flaky.example"], ShouldEqual, 0)
+		})
+
+		Convey("All fronts are retried once all have failed", func() {
+			p := newFrontPool([]string{"bad.example"})
+			for i := 0; i < frontMaxFailures; i++ {
+				p.report("bad.example", errors.New("timeout"))
+			}
+			So(p.pick(), ShouldEqual, "bad.example")
+		})
+
+		Convey("The preferred front is picked until it fails", func() {
+			p := newFrontPool([]string{"a.example", "b.example"})
+			p.prefer("c.example")
+			So(p.preferred, ShouldEqual, "")
+			p.prefer("b.example")
+			for i := 0; i < 10; i++ {
+				So(p.pick(), ShouldEqual, "b.example")
+			}
+			p.report("b.example", errors.New("timeout"))
+			So(p.preferred, ShouldEqual, "")
+			p.report("a.example", nil)
+			So(p.lastGood(), ShouldEqual, "a.example")
+		})
+
+		Convey("The last good rendezvous is recorded", func() {
+			b, _ := NewBrokerChannel("https://broker.example/", "", &MockTransport{}, false)
+			So(b.LastGood(), ShouldBeNil)
+			b.SetFronts([]string{"a.example"})
+			b.fronts.report("a.example", nil)
+			b.SetNATType(nat.NATRestricted)
+			b.recordGood([]webrtc.ICEServer{
+				{URLs: []string{"stun:stun.example.net:3478"}},
+				{URLs: []string{"turn:turn.example.net:3478"}, Username: "user", Credential: "secret"},
+			})
+			So(b.LastGood(), ShouldResemble, &LastGood{
+				BrokerURL:  "https://broker.example/",
+				Front:      "a.example",
+				ICEServers: []string{"stun:stun.example.net:3478", "turn:turn.example.net:3478"},
+				NATType:    nat.NATRestricted,
+			})
+		})
+	})
+
+	Convey("Broker transport", t, func() {
+		Convey("Unknown ClientHello imitations are rejected", func() {
+			_, err := NewBrokerTransport(BrokerTransportConfig{ClientHello: "netscape"})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Registered ClientHello imitations do the handshake", func() {
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			defer server.Close()
+			roots := x509.NewCertPool()
+			roots.AddCert(server.Certificate())
+			handshakes := 0
+			RegisterClientHelloImitation("test", func(conn net.Conn, config *tls.Config) (net.Conn, error) {
+				handshakes++
+				config.RootCAs = roots
+				tlsConn := tls.Client(conn, config)
+				return tlsConn, tlsConn.Handshake()
+			})
+
+			transport, err := NewBrokerTransport(BrokerTransportConfig{ClientHello: "test"})
+			So(err, ShouldBeNil)
+			req, _ := http.NewRequest("GET", server.URL, nil)
+			resp, err := transport.RoundTrip(req)
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(handshakes, ShouldEqual, 1)
+		})
+
+		Convey("Is shared by the same settings", func() {
+			a, err := NewBrokerTransport(BrokerTransportConfig{Proxy: &url.URL{Scheme: "socks5", Host: "127.0.0.1:9050"}})
+			So(err, ShouldBeNil)
+			b, _ := NewBrokerTransport(BrokerTransportConfig{Proxy: &url.URL{Scheme: "socks5", Host: "127.0.0.1:9050"}})
+			So(b, ShouldEqual, a)
+			So(CreateBrokerTransport(), ShouldNotEqual, a)
+			So(a.(*http.Transport).TLSClientConfig.ClientSessionCache, ShouldEqual, brokerSessionCache)
+		})
+
+		Convey("Resumes TLS sessions", func() {
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			defer server.Close()
+			roots := x509.NewCertPool()
+			roots.AddCert(server.Certificate())
+			var resumed []bool
+			RegisterClientHelloImitation("resuming", func(conn net.Conn, config *tls.Config) (net.Conn, error) {
+				config.RootCAs = roots
+				tlsConn := tls.Client(conn, config)
+				err := tlsConn.Handshake()
+				resumed = append(resumed, tlsConn.ConnectionState().DidResume)
+				return tlsConn, err
+			})
+
+			transport, err := NewBrokerTransport(BrokerTransportConfig{ClientHello: "resuming"})
+			So(err, ShouldBeNil)
+			for i := 0; i < 2; i++ {
+				req, _ := http.NewRequest("GET", server.URL, nil)
+				resp, err := transport.RoundTrip(req)
+				So(err, ShouldBeNil)
+				ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				CloseIdleBrokerConnections()
+			}
+			So(resumed, ShouldResemble, []bool{false, true})
+
+			ForgetBrokerSessions()
+			req, _ := http.NewRequest("GET", server.URL, nil)
+			resp, err := transport.RoundTrip(req)
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resumed, ShouldResemble, []bool{false, true, false})
+		})
+
+		Convey("Trusts the CA bundle and checks the pins", func() {
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			defer server.Close()
+			rootCAs := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+			hash := sha256.Sum256(server.Certificate().RawSubjectPublicKeyInfo)
+			pin := "sha256/" + base64.StdEncoding.EncodeToString(hash[:])
+			wrongPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+			get := func(config BrokerTransportConfig) error {
+				transport, err := NewBrokerTransport(config)
+				So(err, ShouldBeNil)
+				req, _ := http.NewRequest("GET", server.URL, nil)
+				resp, err := transport.RoundTrip(req)
+				if err == nil {
+					resp.Body.Close()
+				}
+				return err
+			}
+
+			So(get(BrokerTransportConfig{}), ShouldNotBeNil)
+			So(get(BrokerTransportConfig{RootCAs: rootCAs}), ShouldBeNil)
+			So(get(BrokerTransportConfig{RootCAs: rootCAs, Pins: []string{wrongPin, pin}}), ShouldBeNil)
+			err := get(BrokerTransportConfig{RootCAs: rootCAs, Pins: []string{wrongPin}})
+			So(errors.Is(err, ErrPinMismatch), ShouldBeTrue)
+
+			_, err = NewBrokerTransport(BrokerTransportConfig{Pins: []string{"sha256/short"}})
+			So(err, ShouldNotBeNil)
+			_, err = NewBrokerTransport(BrokerTransportConfig{RootCAs: []byte("no PEM")})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Unknown interfaces are rejected", func() {
+			_, err := NewBrokerTransport(BrokerTransportConfig{Interface: "no-such-interface0"})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Connects from the interface", func() {
+			if !canBindToInterface {
+				return
+			}
+			var loopback string
+			ifaces, _ := net.Interfaces()
+			for _, iface := range ifaces {
+				if iface.Flags&net.FlagLoopback != 0 && iface.Flags&net.FlagUp != 0 {
+					loopback = iface.Name
+				}
+			}
+			if loopback == "" {
+				return
+			}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			defer server.Close()
+
+			transport, err := NewBrokerTransport(BrokerTransportConfig{Interface: loopback})
+			So(err, ShouldBeNil)
+			req, _ := http.NewRequest("GET", server.URL, nil)
+			resp, err := transport.RoundTrip(req)
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+		})
+	})
+
+	Convey("ECH", t, func() {
+		Convey("Extracts the ECH config list from an HTTPS record", func() {
+			rdata := []byte{
+				0, 1, // SvcPriority
+				0,          // TargetName "."
+				0, 1, 0, 3, // alpn
+				2, 'h', '2',
+				0, 5, 0, 4, // ech
+				0xfe, 0x0d, 0, 0,
+			}
+			So(echFromSVCB(rdata), ShouldResemble, []byte{0xfe, 0x0d, 0, 0})
+			So(echFromSVCB(rdata[:9]), ShouldBeNil)
+		})
+	})
+
+	Convey("NAT behavior", t, func() {
+		defer func(timeout time.Duration) { natTestTimeout = timeout }(natTestTimeout)
+		natTestTimeout = 200 * time.Millisecond
+
+		Convey("Is endpoint independent without a NAT", func() {
+			server := newNATTestServer(t, false, false)
+			defer server.close()
+			b, err := DiscoverNATBehavior(context.Background(), server.addr())
+			So(err, ShouldBeNil)
+			So(b, ShouldResemble, NATBehavior{MappingEndpointIndependent, FilteringEndpointIndependent})
+			So(b.NATType(), ShouldEqual, "unrestricted")
+			So(b.needsRelay(), ShouldBeFalse)
+		})
+
+		Convey("Tells symmetric NATs filtering by port", func() {
+			server := newNATTestServer(t, true, true)
+			defer server.close()
+			b, err := DiscoverNATBehavior(context.Background(), server.addr())
+			So(err, ShouldBeNil)
+			So(b, ShouldResemble, NATBehavior{MappingAddressPortDependent, FilteringAddressPortDependent})
+			So(b.NATType(), ShouldEqual, "restricted")
+			So(b.needsRelay(), ShouldBeTrue)
+		})
+
+		Convey("Fails without an answer", func() {
+			conn, _ := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			defer conn.Close()
+			_, err := DiscoverNATBehavior(context.Background(), conn.LocalAddr().String())
+			So(errors.Is(err, ErrNoSTUNAnswer), ShouldBeTrue)
+			So(err.Error(), ShouldContainSubstring, errSTUNTimeout.Error())
+		})
+
+		Convey("Is shown as JSON", func() {
+			b, _ := json.Marshal(NATBehavior{MappingAddressDependent, FilteringUnknown})
+			So(string(b), ShouldEqual, `{"mapping":"address-dependent","filtering":"unknown"}`)
+		})
+
+		Convey("Makes the auto ICE policy use relays", func() {
+			broker, _ := NewBrokerChannel("http://127.0.0.1:1", "", CreateBrokerTransport(), false)
+			d := NewWebRTCDialer(broker, WithICEServers([]webrtc.ICEServer{
+				{URLs: []string{"turn:turn.example.net:3478"}},
+			}))
+			d.SetICEPolicy(ICEPolicyAuto)
+			So(d.peerConfig().ICETransportPolicy, ShouldEqual, webrtc.ICETransportPolicyAll)
+			broker.SetNATBehavior(NATBehavior{MappingAddressPortDependent, FilteringAddressPortDependent})
+			So(d.peerConfig().ICETransportPolicy, ShouldEqual, webrtc.ICETransportPolicyRelay)
+			So(d.webrtcConfig.ICETransportPolicy, ShouldEqual, webrtc.ICETransportPolicyAll)
+			broker.SetNATType("restricted")
+			So(d.peerConfig().ICETransportPolicy, ShouldEqual, webrtc.ICETransportPolicyAll)
+		})
+
+		Convey("Offers each peer the ICE servers the selector picks", func() {
+			servers := []webrtc.ICEServer{
+				{URLs: []string{"stun:stun.example.net:3478"}},
+				{URLs: []string{"turn:turn.example.net:3478"}},
+			}
+			broker, _ := NewBrokerChannel("http://127.0.0.1:1", "", CreateBrokerTransport(), false)
+			d := NewWebRTCDialer(broker, WithICEServers(servers))
+			d.SetICEPolicy(ICEPolicyAuto)
+			broker.SetNATBehavior(NATBehavior{MappingAddressPortDependent, FilteringAddressPortDependent})
+			d.SetICEServerSelector(func(s []webrtc.ICEServer) []webrtc.ICEServer { return s[:1] })
+			config := d.peerConfig()
+			So(config.ICEServers, ShouldResemble, servers[:1])
+			So(config.ICETransportPolicy, ShouldEqual, webrtc.ICETransportPolicyAll)
+			So(d.webrtcConfig.ICEServers, ShouldResemble, servers)
+		})
+
+		Convey("Gathers passive ICE-TCP candidates", func() {
+			broker, _ := NewBrokerChannel("http://127.0.0.1:1", "", CreateBrokerTransport(), false)
+			d := NewWebRTCDialer(broker)
+			So(d.SetICETCP("127.0.0.1:0"), ShouldBeNil)
+			So(d.options.tcpMux, ShouldNotBeNil)
+			other := NewWebRTCDialer(broker)
+			So(other.SetICETCP("127.0.0.1:0"), ShouldBeNil)
+			So(other.options.tcpMux, ShouldEqual, d.options.tcpMux)
+			So(other.SetICETCP(""), ShouldBeNil)
+			So(other.options.tcpMux, ShouldBeNil)
+			So(other.SetICETCP("256.0.0.1:0"), ShouldNotBeNil)
+
+			peer := &WebRTCPeer{options: d.options}
+			pc, err := peer.newPeerConnection(&webrtc.Configuration{})
+			So(err, ShouldBeNil)
+			defer pc.Close()
+			_, err = pc.CreateDataChannel("test", nil)
+			So(err, ShouldBeNil)
+			offer, err := pc.CreateOffer(nil)
+			So(err, ShouldBeNil)
+			gathered := webrtc.GatheringCompletePromise(pc)
+			So(pc.SetLocalDescription(offer), ShouldBeNil)
+			<-gathered
+			So(pc.LocalDescription().SDP, ShouldContainSubstring, "tcptype passive")
+			So(withTCP([]webrtc.NetworkType{webrtc.NetworkTypeUDP6}), ShouldResemble,
+				[]webrtc.NetworkType{webrtc.NetworkTypeUDP6, webrtc.NetworkTypeTCP6})
+		})
+
+		Convey("Maps ports with NAT-PMP", func() {
+			gateway := newNATPMPTestGateway(0)
+			defer gateway.Close()
+			router := natPMP{gateway.LocalAddr().(*net.UDPAddr)}
+			ip, err := router.externalIP()
+			So(err, ShouldBeNil)
+			So(ip.String(), ShouldEqual, "203.0.113.9")
+			So(router.mapPort(50000, time.Hour), ShouldBeNil)
+
+			other := newNATPMPTestGateway(1)
+			defer other.Close()
+			router = natPMP{other.LocalAddr().(*net.UDPAddr)}
+			So(router.mapPort(50000, time.Hour), ShouldNotBeNil)
+		})
+
+		Convey("Maps ports with UPnP", func() {
+			mappings := make(chan string, 1)
+			server := newUPnPTestGateway(mappings)
+			defer server.Close()
+			igd, err := newUPnPIGD(server.URL + "/description.xml")
+			So(err, ShouldBeNil)
+			So(igd.controlURL, ShouldEqual, server.URL+"/ctl/ipconn")
+			ip, err := igd.externalIP()
+			So(err, ShouldBeNil)
+			So(ip.String(), ShouldEqual, "203.0.113.10")
+			So(igd.mapPort(50000, time.Hour), ShouldBeNil)
+			mapping := <-mappings
+			So(mapping, ShouldContainSubstring, "<NewExternalPort>50000</NewExternalPort>")
+			So(mapping, ShouldContainSubstring, "<NewInternalClient>127.0.0.1</NewInternalClient>")
+			So(mapping, ShouldContainSubstring, "<NewLeaseDuration>3600</NewLeaseDuration>")
+		})
+
+		Convey("Offers the mapped address as a server reflexive candidate", func() {
+			broker, _ := NewBrokerChannel("http://127.0.0.1:1", "", CreateBrokerTransport(), false)
+			d := NewWebRTCDialer(broker)
+			So(d.SetUDPPortRange(40000, 40511), ShouldBeNil)
+			So(d.SetPortMapping(true), ShouldNotBeNil)
+			So(d.SetUDPPortRange(0, 0), ShouldBeNil)
+			m := &portMapper{min: 40000, max: 40031}
+			var s webrtc.SettingEngine
+			So(m.apply(&s), ShouldBeNil)
+			m.external = net.IPv4(203, 0, 113, 9)
+			d.options.portMapper = m
+
+			peer := &WebRTCPeer{options: d.options}
+			pc, err := peer.newPeerConnection(&webrtc.Configuration{})
+			So(err, ShouldBeNil)
+			defer pc.Close()
+			_, err = pc.CreateDataChannel("test", nil)
+			So(err, ShouldBeNil)
+			offer, err := pc.CreateOffer(nil)
+			So(err, ShouldBeNil)
+			gathered := webrtc.GatheringCompletePromise(pc)
+			So(pc.SetLocalDescription(offer), ShouldBeNil)
+			<-gathered
+			So(pc.LocalDescription().SDP, ShouldContainSubstring, " 203.0.113.9 400")
+			So(pc.LocalDescription().SDP, ShouldContainSubstring, "typ srflx")
+		})
+
+		Convey("Falls back to TURN over TCP on port 443", func() {
+			servers := []webrtc.ICEServer{
+				{URLs: []string{"stun:stun.example.net:3478"}},
+				{URLs: []string{"turn:turn.example.net:443"}},
+				{URLs: []string{"turn:turn.example.net:443?transport=tcp"}},
+				{URLs: []string{"turns:turn.example.net:443"}},
+				{URLs: []string{"turns:turn.example.net:5349"}},
+			}
+			So(tcp443Relays(servers), ShouldResemble, servers[2:4])
+			broker, _ := NewBrokerChannel("http://127.0.0.1:1", "", CreateBrokerTransport(), false)
+			d := NewWebRTCDialer(broker, WithICEServers(servers))
+			config := d.tcpRelayConfig()
+			So(config.ICEServers, ShouldResemble, servers[2:4])
+			So(config.ICETransportPolicy, ShouldEqual, webrtc.ICETransportPolicyRelay)
+			So(NewWebRTCDialer(broker, WithICEServers(servers[:2])).tcpRelayConfig(), ShouldBeNil)
+
+			So(d.udp.usable(), ShouldBeTrue)
+			d.udp.failed()
+			So(d.udp.usable(), ShouldBeFalse)
+			var none *udpPreference
+			So(none.usable(), ShouldBeTrue)
+		})
+	})
+
+	Convey("Volunteer proxy", t, func() {
+		Convey("Relays a client to the bridge", func() {
+			relay := newWebSocketEchoServer()
+			defer relay.Close()
+			client, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+			So(err, ShouldBeNil)
+			defer client.Close()
+			dc, err := client.CreateDataChannel("snowflake", nil)
+			So(err, ShouldBeNil)
+			echoed := make(chan string, 1)
+			dc.OnOpen(func() { dc.SendText("hello") })
+			dc.OnMessage(func(msg webrtc.DataChannelMessage) { echoed <- string(msg.Data) })
+			offer, _ := client.CreateOffer(nil)
+			gathered := webrtc.GatheringCompletePromise(client)
+			So(client.SetLocalDescription(offer), ShouldBeNil)
+			<-gathered
+			offerSDP, _ := util.SerializeSessionDescription(client.LocalDescription())
+
+			var polls int32
+			var poll proxyPollRequest
+			broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/proxy":
+					json.NewDecoder(r.Body).Decode(&poll)
+					if atomic.AddInt32(&polls, 1) > 1 {
+						json.NewEncoder(w).Encode(proxyPollResponse{Status: "no match"})
+						return
+					}
+					json.NewEncoder(w).Encode(proxyPollResponse{Status: proxyClientMatch, Offer: offerSDP})
+				case "/answer":
+					var req proxyAnswerRequest
+					json.NewDecoder(r.Body).Decode(&req)
+					answer, err := util.DeserializeSessionDescription(req.Answer)
+					if err == nil && req.Sid == poll.Sid {
+						client.SetRemoteDescription(*answer)
+					}
+					json.NewEncoder(w).Encode(proxyAnswerResponse{Status: proxyAnswerOK})
+				}
+			}))
+			defer broker.Close()
+
+			bc, _ := NewBrokerChannel(broker.URL, "", CreateBrokerTransport(), false)
+			bc.SetNATType(nat.NATUnrestricted)
+			_, err = NewVolunteerProxy(NewWebRTCDialer(bc), VolunteerProxyConfig{RelayURL: "https://bridge.example/", Capacity: 1})
+			So(err, ShouldNotBeNil)
+			_, err = NewVolunteerProxy(NewWebRTCDialer(bc), VolunteerProxyConfig{RelayURL: "ws://bridge.example/"})
+			So(err, ShouldNotBeNil)
+			proxy, err := NewVolunteerProxy(NewWebRTCDialer(bc), VolunteerProxyConfig{
+				RelayURL:  "ws" + strings.TrimPrefix(relay.URL, "http"),
+				Transport: CreateBrokerTransport(),
+				Capacity:  1,
+				Rate:      1 << 20,
+			})
+			So(err, ShouldBeNil)
+			ctx, cancel := context.WithCancel(context.Background())
+			stopped := make(chan struct{})
+			go func() {
+				proxy.Run(ctx)
+				close(stopped)
+			}()
+
+			select {
+			case msg := <-echoed:
+				So(msg, ShouldEqual, "hello")
+			case <-time.After(20 * time.Second):
+				So("no echo", ShouldBeEmpty)
+			}
+			So(poll.NAT, ShouldEqual, nat.NATUnrestricted)
+			So(poll.Version, ShouldEqual, proxyPollVersion)
+			So(proxy.Clients(), ShouldEqual, 1)
+			cancel()
+			<-stopped
+			So(proxy.Clients(), ShouldEqual, 0)
+		})
+	})
+
+	Convey("Padding", t, func() {
+		defer SetPadding(Padding{})
+		local, remote := net.Pipe()
+		defer remote.Close()
+
+		Convey("Pads packets to the quantum", func() {
+			SetPadding(Padding{Quantum: 64})
+			before := GetPaddingStats()
+			conn := NewEncapsulationPacketConn(dummyAddr{}, dummyAddr{}, local)
+			defer conn.Close()
+			go conn.WriteTo([]byte("hello"), dummyAddr{})
+			packet := make([]byte, 64)
+			_, err := io.ReadFull(remote, packet)
+			So(err, ShouldBeNil)
+			r := bytes.NewReader(packet)
+			data, err := encapsulation.ReadData(r)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldEqual, "hello")
+			_, err = encapsulation.ReadData(r)
+			So(err, ShouldEqual, io.EOF)
+
+			after := GetPaddingStats()
+			So(after.Data-before.Data, ShouldEqual, 6)
+			So(after.Padding-before.Padding, ShouldEqual, 58)
+			So(PaddingStats{Data: 100, Padding: 25}.Overhead(), ShouldEqual, 0.25)
+			So(PaddingStats{}.Overhead(), ShouldEqual, 0)
+		})
+
+		Convey("Sends dummy packets when idle", func() {
+			SetPadding(Padding{Quantum: 128, Idle: 10 * time.Millisecond})
+			conn := NewEncapsulationPacketConn(dummyAddr{}, dummyAddr{}, local)
+			defer conn.Close()
+			remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+			packet := make([]byte, 128)
+			_, err := io.ReadFull(remote, packet)
+			So(err, ShouldBeNil)
+			_, err = encapsulation.ReadData(bytes.NewReader(packet))
+			So(err, ShouldEqual, io.EOF)
+		})
+
+		Convey("Leaves packets alone by default", func() {
+			conn := NewEncapsulationPacketConn(dummyAddr{}, dummyAddr{}, local)
+			defer conn.Close()
+			go conn.WriteTo([]byte("hello"), dummyAddr{})
+			packet := make([]byte, 16)
+			n, err := remote.Read(packet)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 6)
+		})
+	})
+
+	Convey("KCP settings", t, func() {
+		So(KCP.Check(), ShouldBeNil)
+		s := KCP
+		s.NoDelay, s.Congestion, s.FastResend = true, true, 2
+		So(s.Check(), ShouldBeNil)
+		s.Interval = time.Millisecond
+		So(s.Check(), ShouldNotBeNil)
+		s.Interval = 10 * time.Second
+		So(s.Check(), ShouldNotBeNil)
+		s = KCP
+		s.ReceiveWindow = 0
+		So(s.Check(), ShouldNotBeNil)
+		s = KCP
+		s.FastResend = -1
+		So(s.Check(), ShouldNotBeNil)
+	})
+}
+
+// natTestServer is a STUN server supporting RFC 5780 on 127.0.0.1 and
+// 127.0.0.2, which can pretend that the client is behind a NAT mapping
+// by address and port, or filtering by port.
+type natTestServer struct {
+	// conns[ip][port] listens at the first or second address and port.
+	conns         [2][2]*net.UDPConn
+	symmetric     bool
+	filterChanged bool
+}
+
+func newNATTestServer(t *testing.T, symmetric, filterChanged bool) *natTestServer {
+	s := &natTestServer{symmetric: symmetric, filterChanged: filterChanged}
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2)}
+	ports := []int{0, 0}
+	for i := range ports {
+		for j, ip := range ips {
+			conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip, Port: ports[i]})
+			if err != nil {
+				s.close()
+				t.Skipf("can not listen for STUN: %v", err)
+			}
+			ports[i] = conn.LocalAddr().(*net.UDPAddr).Port
+			s.conns[j][i] = conn
+		}
+	}
+	for i := range s.conns {
+		for j := range s.conns[i] {
+			go s.serve(i, j)
+		}
+	}
+	return s
+}
+
+func (s *natTestServer) addr() string {
+	return s.conns[0][0].LocalAddr().String()
+}
+
+func (s *natTestServer) close() {
+	for i := range s.conns {
+		for _, conn := range s.conns[i] {
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+}
+
+func (s *natTestServer) serve(ip, port int) {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := s.conns[ip][port].ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req := &stun.Message{Raw: append([]byte{}, buf[:n]...)}
+		if req.Decode() != nil {
+			continue
+		}
+		replyIP, replyPort := ip, port
+		if change, err := req.Get(stun.AttrChangeRequest); err == nil && len(change) == 4 {
+			if s.filterChanged {
+				continue
+			}
+			if change[3]&changeIP != 0 {
+				replyIP = 1 - ip
+			}
+			if change[3]&changePort != 0 {
+				replyPort = 1 - port
+			}
+		}
+		mapped := &stun.XORMappedAddress{IP: from.IP, Port: from.Port}
+		if s.symmetric {
+			mapped.Port += 2*ip + port + 1
+		}
+		other := s.conns[1][1].LocalAddr().(*net.UDPAddr)
+		resp := stun.MustBuild(stun.NewTransactionIDSetter(req.TransactionID), stun.BindingSuccess,
+			mapped, &stun.OtherAddress{IP: other.IP, Port: other.Port})
+		s.conns[replyIP][replyPort].WriteToUDP(resp.Raw, from)
+	}
 }
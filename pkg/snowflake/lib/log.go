@@ -0,0 +1,87 @@
+package lib
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net"
+)
+
+// Log messages other than information and errors start with their level in
+// parentheses, such as "(debug) ", so that the application can filter them
+// out or route them.
+func warnf(format string, v ...interface{}) {
+	log.Printf("(warn) "+format, v...)
+}
+
+func debugf(format string, v ...interface{}) {
+	log.Printf("(debug) "+format, v...)
+}
+
+func tracef(format string, v ...interface{}) {
+	log.Printf("(trace) "+format, v...)
+}
+
+// traceID is a short random ID of a SOCKS connection or a snowflake. The
+// messages about it carry the ID in brackets after their level, as in
+// "(debug) [1a2b3c4d] ", so that the messages about one connection can be
+// picked out of the log when many are open at once. The zero traceID adds
+// nothing to the messages.
+type traceID string
+
+func newTraceID() traceID {
+	var buf [4]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(err)
+	}
+	return traceID(hex.EncodeToString(buf[:]))
+}
+
+func (id traceID) prefix() string {
+	if id == "" {
+		return ""
+	}
+	return "[" + string(id) + "] "
+}
+
+func (id traceID) printf(format string, v ...interface{}) {
+	log.Printf(id.prefix()+format, v...)
+}
+
+func (id traceID) warnf(format string, v ...interface{}) {
+	warnf(id.prefix()+format, v...)
+}
+
+func (id traceID) debugf(format string, v ...interface{}) {
+	debugf(id.prefix()+format, v...)
+}
+
+func (id traceID) tracef(format string, v ...interface{}) {
+	tracef(id.prefix()+format, v...)
+}
+
+// NewTraceID returns a new random ID for a SOCKS connection, to pass to
+// TraceConn and to start the application's own messages about it with.
+func NewTraceID() string {
+	return string(newTraceID())
+}
+
+// TraceConn returns conn tagged with the trace ID id, which Handler and
+// SharedSession.Handler then put in their messages about it. Connections
+// that are not tagged get a random ID.
+func TraceConn(conn net.Conn, id string) net.Conn {
+	return tracedConn{conn, traceID(id)}
+}
+
+type tracedConn struct {
+	net.Conn
+	id traceID
+}
+
+// connTraceID returns the trace ID conn was tagged with, or a new one.
+func connTraceID(conn net.Conn) traceID {
+	if c, ok := conn.(tracedConn); ok {
+		return c.id
+	}
+	return newTraceID()
+}
@@ -0,0 +1,97 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// clientVersion prefixes the client poll requests understood by the
+// broker's AMP and SQS endpoints, which unlike the plain HTTP endpoint carry
+// the NAT type inside the message.
+const clientVersion = "1.0"
+
+type clientPollRequest struct {
+	Offer string `json:"offer"`
+	NAT   string `json:"nat"`
+
+	ProxyTypes       []string `json:"proxy_types,omitempty"`
+	Countries        []string `json:"countries,omitempty"`
+	ExcludeCountries []string `json:"exclude_countries,omitempty"`
+
+	// The bridge to reach, for brokers serving several.
+	Fingerprint string `json:"fingerprint,omitempty"`
+
+	// The client token, if any.
+	Token string `json:"token,omitempty"`
+}
+
+type clientPollResponse struct {
+	Answer string `json:"answer,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// The bridge the proxy connects to, if the broker tells.
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+func encodeClientPollRequest(offer []byte, natType string, prefs ProxyPreferences, fingerprint, token string) ([]byte, error) {
+	body, err := json.Marshal(clientPollRequest{
+		Offer:            string(offer),
+		NAT:              natType,
+		ProxyTypes:       prefs.Types,
+		Countries:        prefs.Countries,
+		ExcludeCountries: prefs.ExcludeCountries,
+		Fingerprint:      fingerprint,
+		Token:            token,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(clientVersion+"\n"), body...), nil
+}
+
+// decodeClientPollResponse returns the answer in a broker response and the
+// fingerprint of the bridge it names, if any, or the error the broker
+// reported instead.
+func decodeClientPollResponse(data []byte) ([]byte, string, error) {
+	var resp clientPollResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, "", err
+	}
+	if resp.Error != "" {
+		return nil, "", errors.New(resp.Error)
+	}
+	return []byte(resp.Answer), resp.Fingerprint, nil
+}
+
+// The messages of the proxy side of the broker protocol, which the volunteer
+// proxy speaks: it polls for a client offer and sends back the answer.
+const (
+	proxyPollVersion   = "1.2"
+	proxyAnswerVersion = "1.0"
+
+	proxyClientMatch = "client match"
+	proxyAnswerOK    = "success"
+)
+
+type proxyPollRequest struct {
+	Sid     string
+	Version string
+	Type    string
+	NAT     string
+	Clients int
+}
+
+type proxyPollResponse struct {
+	Status string
+	Offer  string
+	NAT    string
+}
+
+type proxyAnswerRequest struct {
+	Version string
+	Sid     string
+	Answer  string
+}
+
+type proxyAnswerResponse struct {
+	Status string
+}
@@ -0,0 +1,127 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds of the broker latency histogram buckets, in seconds.
+var brokerLatencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// clientMetrics are the counters served by MetricsHandler. Those not kept
+// here, like the number of connected snowflakes, are read when serving.
+type clientMetrics struct {
+	// Accessed atomically, keep first for alignment.
+	rendezvousAttempts  int64
+	rendezvousSuccesses int64
+	bytesUp, bytesDown  int64
+	socksConnections    int64
+	// Sent to the bridge by EncapsulationPacketConn.
+	encapsulatedData, encapsulatedPadding int64
+
+	natType atomic.Value // string
+
+	lock           sync.Mutex
+	latencyCounts  []uint64 // per bucket, and +Inf last
+	latencySum     float64
+	latencyObserve uint64
+}
+
+var metrics = &clientMetrics{
+	latencyCounts: make([]uint64, len(brokerLatencyBuckets)+1),
+}
+
+// observeRendezvous records a broker exchange that took d. Only successful
+// exchanges go into the latency histogram.
+func (m *clientMetrics) observeRendezvous(d time.Duration, err error) {
+	atomic.AddInt64(&m.rendezvousAttempts, 1)
+	if err != nil {
+		return
+	}
+	atomic.AddInt64(&m.rendezvousSuccesses, 1)
+	s := d.Seconds()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	i := 0
+	for i < len(brokerLatencyBuckets) && s > brokerLatencyBuckets[i] {
+		i++
+	}
+	m.latencyCounts[i]++
+	m.latencySum += s
+	m.latencyObserve++
+}
+
+func (m *clientMetrics) setNATType(natType string) {
+	m.natType.Store(natType)
+}
+
+// write writes the metrics in the Prometheus text exposition format.
+func (m *clientMetrics) write(w io.Writer) {
+	counter := func(name, help string, value int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+	gauge := func(name, help string, value int) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, value)
+	}
+
+	counter("snowflake_rendezvous_attempts_total", "Offers sent to the broker.",
+		atomic.LoadInt64(&m.rendezvousAttempts))
+	counter("snowflake_rendezvous_successes_total", "Offers the broker answered.",
+		atomic.LoadInt64(&m.rendezvousSuccesses))
+
+	livePeers.Lock()
+	peers := len(livePeers.m)
+	livePeers.Unlock()
+	gauge("snowflake_peers", "Connected snowflakes.", peers)
+
+	fmt.Fprintf(w, "# HELP snowflake_bytes_total Bytes carried for SOCKS connections.\n"+
+		"# TYPE snowflake_bytes_total counter\n"+
+		"snowflake_bytes_total{direction=\"up\"} %d\n"+
+		"snowflake_bytes_total{direction=\"down\"} %d\n",
+		atomic.LoadInt64(&m.bytesUp), atomic.LoadInt64(&m.bytesDown))
+
+	fmt.Fprintf(w, "# HELP snowflake_encapsulated_bytes_total Bytes sent to the bridge, data and padding.\n"+
+		"# TYPE snowflake_encapsulated_bytes_total counter\n"+
+		"snowflake_encapsulated_bytes_total{kind=\"data\"} %d\n"+
+		"snowflake_encapsulated_bytes_total{kind=\"padding\"} %d\n",
+		atomic.LoadInt64(&m.encapsulatedData), atomic.LoadInt64(&m.encapsulatedPadding))
+
+	openConns.Lock()
+	conns := len(openConns.m)
+	openConns.Unlock()
+	gauge("snowflake_socks_connections", "Open SOCKS connections.", conns)
+	counter("snowflake_socks_connections_total", "SOCKS connections handled.",
+		atomic.LoadInt64(&m.socksConnections))
+
+	if natType, ok := m.natType.Load().(string); ok {
+		fmt.Fprintf(w, "# HELP snowflake_nat_type NAT type found by probing.\n"+
+			"# TYPE snowflake_nat_type gauge\n"+
+			"snowflake_nat_type{type=%q} 1\n", natType)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	fmt.Fprintf(w, "# HELP snowflake_broker_latency_seconds Time for the broker to answer an offer.\n"+
+		"# TYPE snowflake_broker_latency_seconds histogram\n")
+	var cumulative uint64
+	for i, le := range brokerLatencyBuckets {
+		cumulative += m.latencyCounts[i]
+		fmt.Fprintf(w, "snowflake_broker_latency_seconds_bucket{le=\"%g\"} %d\n", le, cumulative)
+	}
+	cumulative += m.latencyCounts[len(brokerLatencyBuckets)]
+	fmt.Fprintf(w, "snowflake_broker_latency_seconds_bucket{le=\"+Inf\"} %d\n", cumulative)
+	fmt.Fprintf(w, "snowflake_broker_latency_seconds_sum %g\n", m.latencySum)
+	fmt.Fprintf(w, "snowflake_broker_latency_seconds_count %d\n", m.latencyObserve)
+}
+
+// MetricsHandler serves the metrics of the client for Prometheus.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.write(w)
+	})
+}
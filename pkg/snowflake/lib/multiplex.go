@@ -0,0 +1,132 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/xtaci/smux"
+)
+
+// SharedSession carries many SOCKS connections as streams of a single smux
+// session, instead of giving each its own session and set of snowflakes as
+// Handler does. This uses fewer proxies and broker requests when many
+// connections are open at once. The session is created on first use and
+// again whenever it dies.
+type SharedSession struct {
+	tongue Tongue
+	// Cancelled by Close, to give up on the snowflakes being caught.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lock       sync.Mutex
+	snowflakes *Peers
+	first      *firstCatch
+	pconn      net.PacketConn
+	sess       *smux.Session
+	closed     bool
+}
+
+// NewSharedSession returns a SharedSession collecting snowflakes with tongue.
+func NewSharedSession(tongue Tongue) *SharedSession {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &SharedSession{tongue: tongue, ctx: ctx, cancel: cancel}
+}
+
+// Handler exchanges traffic between socks and a new stream of the shared
+// session.
+func (s *SharedSession) Handler(socks net.Conn) error {
+	return s.HandlerContext(context.Background(), socks)
+}
+
+// HandlerContext is Handler until ctx is done. Then it closes socks and its
+// stream, leaving the session to the other streams.
+func (s *SharedSession) HandlerContext(ctx context.Context, socks net.Conn) error {
+	id := connTraceID(socks)
+	stream, first, err := s.openStream()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	if socks, ok := socksConnector(socks); ok {
+		if err := replySocks(ctx, id, socks, first); err != nil {
+			// Start over with the next stream rather than keep
+			// rejecting them with this error.
+			s.lock.Lock()
+			if s.first == first && ctx.Err() == nil {
+				s.discard()
+			}
+			s.lock.Unlock()
+			return err
+		}
+	}
+	stop := closeOnDone(ctx, socks)
+	defer stop()
+
+	id.printf("---- SharedSession: begin stream %v ---", stream.ID())
+	traffic := copyLoop(id, socks, stream, tuningOf(s.tongue))
+	id.printf("---- SharedSession: closed stream %v: %v ---", stream.ID(), traffic)
+	return nil
+}
+
+func (s *SharedSession) openStream() (*smux.Stream, *firstCatch, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil, nil, errors.New("shared session is closed")
+	}
+	if s.sess == nil || s.sess.IsClosed() {
+		s.discard()
+		snowflakes, err := NewPeersContext(s.ctx, s.tongue)
+		if err != nil {
+			return nil, nil, err
+		}
+		snowflakes.BytesLogger = NewBytesSyncLogger()
+		log.Printf("---- SharedSession: begin collecting snowflakes ---")
+		first := newFirstCatch()
+		go connectLoop(snowflakes, first, tuningOf(s.tongue).redialBackoff())
+
+		log.Printf("---- SharedSession: starting a new session ---")
+		pconn, sess, err := newSession(snowflakes)
+		if err != nil {
+			snowflakes.End()
+			return nil, nil, err
+		}
+		s.snowflakes, s.first, s.pconn, s.sess = snowflakes, first, pconn, sess
+	}
+	stream, err := s.sess.OpenStream()
+	return stream, s.first, err
+}
+
+// discard tears down the current session, if any. s.lock must be held.
+func (s *SharedSession) discard() {
+	if s.sess == nil {
+		return
+	}
+	s.snowflakes.End()
+	log.Printf("---- SharedSession: end collecting snowflakes ---")
+	s.pconn.Close()
+	s.sess.Close()
+	s.snowflakes, s.first, s.pconn, s.sess = nil, nil, nil, nil
+}
+
+// Sleep ends the current session, if any, and stops collecting snowflakes
+// for it. The next stream starts a new session.
+func (s *SharedSession) Sleep() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.discard()
+}
+
+// Close ends the shared session and its streams.
+func (s *SharedSession) Close() error {
+	s.cancel()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	s.discard()
+	return nil
+}
@@ -0,0 +1,301 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/common/nat"
+	"github.com/pion/stun"
+)
+
+// NATMapping is how a NAT picks the public address of a UDP socket, as
+// RFC 5780 classifies it.
+type NATMapping int
+
+const (
+	MappingUnknown NATMapping = iota
+	// The socket keeps its public address whatever it sends to. This is
+	// also the case without a NAT.
+	MappingEndpointIndependent
+	// The socket gets a new public address for every host it sends to.
+	MappingAddressDependent
+	// The socket gets a new public address for every host and port it
+	// sends to: a symmetric NAT.
+	MappingAddressPortDependent
+)
+
+var mappingNames = map[NATMapping]string{
+	MappingUnknown:              "unknown",
+	MappingEndpointIndependent:  "endpoint-independent",
+	MappingAddressDependent:     "address-dependent",
+	MappingAddressPortDependent: "address-and-port-dependent",
+}
+
+func (m NATMapping) String() string {
+	return mappingNames[m]
+}
+
+func (m NATMapping) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// NATFiltering is which hosts a NAT lets send to the public address of a
+// UDP socket, as RFC 5780 classifies it.
+type NATFiltering int
+
+const (
+	FilteringUnknown NATFiltering = iota
+	// Any host may send to the socket once it has sent something.
+	FilteringEndpointIndependent
+	// Only the hosts the socket sent to may send to it, from any port.
+	FilteringAddressDependent
+	// Only the hosts and ports the socket sent to may send to it.
+	FilteringAddressPortDependent
+)
+
+var filteringNames = map[NATFiltering]string{
+	FilteringUnknown:              "unknown",
+	FilteringEndpointIndependent:  "endpoint-independent",
+	FilteringAddressDependent:     "address-dependent",
+	FilteringAddressPortDependent: "address-and-port-dependent",
+}
+
+func (f NATFiltering) String() string {
+	return filteringNames[f]
+}
+
+func (f NATFiltering) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
+// NATBehavior is how the NAT in front of us maps and filters UDP.
+type NATBehavior struct {
+	Mapping   NATMapping   `json:"mapping"`
+	Filtering NATFiltering `json:"filtering"`
+}
+
+func (b NATBehavior) String() string {
+	return fmt.Sprintf("mapping %v, filtering %v", b.Mapping, b.Filtering)
+}
+
+// NATType returns the NAT type the broker matches proxies by. Only the
+// mapping counts, as for the snowflake proxies: with an address dependent
+// mapping, we need a proxy behind an unrestricted NAT.
+func (b NATBehavior) NATType() string {
+	switch b.Mapping {
+	case MappingEndpointIndependent:
+		return nat.NATUnrestricted
+	case MappingAddressDependent, MappingAddressPortDependent:
+		return nat.NATRestricted
+	default:
+		return nat.NATUnknown
+	}
+}
+
+// needsRelay tells whether the NAT is symmetric and filters by port, so
+// that only few proxies, those without a NAT, can connect to us directly.
+func (b NATBehavior) needsRelay() bool {
+	return b.Mapping == MappingAddressPortDependent &&
+		b.Filtering == FilteringAddressPortDependent
+}
+
+// How long to wait for the answer to each STUN request of the NAT
+// behavior tests. The filtering tests wait for answers that may never
+// come, so this is also how long they take.
+var natTestTimeout = 5 * time.Second
+
+var errSTUNTimeout = errors.New("timed out waiting for STUN response")
+
+// ErrNATDiscoveryUnsupported is returned by DiscoverNATBehavior for a STUN
+// server that answers, but does not tell its other address.
+var ErrNATDiscoveryUnsupported = errors.New("the STUN server does not support NAT discovery")
+
+// ErrNoSTUNAnswer is returned by DiscoverNATBehavior when the STUN server
+// does not answer at all, as when UDP is blocked.
+var ErrNoSTUNAnswer = errors.New("no answer from the STUN server")
+
+// DiscoverNATBehavior runs the mapping and filtering tests of RFC 5780
+// against the STUN server at addr, which must support them. If only the
+// filtering tests fail, the filtering is left unknown.
+func DiscoverNATBehavior(ctx context.Context, addr string) (NATBehavior, error) {
+	server, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return NATBehavior{}, err
+	}
+	var b NATBehavior
+	b.Mapping, err = discoverMapping(ctx, server)
+	if err != nil {
+		return NATBehavior{}, err
+	}
+	b.Filtering, err = discoverFiltering(ctx, server)
+	if err != nil {
+		warnf("NAT: filtering tests with %v failed: %v", addr, err)
+	}
+	return b, nil
+}
+
+// discoverMapping compares the public addresses a socket gets when sending
+// to the primary and other addresses of server.
+func discoverMapping(ctx context.Context, server *net.UDPAddr) (NATMapping, error) {
+	conn, err := newSTUNConn(ctx)
+	if err != nil {
+		return MappingUnknown, err
+	}
+	defer conn.Close()
+
+	// Test I: a plain binding request, which tells the other address.
+	resp, err := conn.roundTrip(ctx, server)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return MappingUnknown, err
+		}
+		return MappingUnknown, fmt.Errorf("%w: %v", ErrNoSTUNAnswer, err)
+	}
+	mapped1, err := mappedAddress(resp)
+	if err != nil {
+		return MappingUnknown, err
+	}
+	var other stun.OtherAddress
+	if err := other.GetFrom(resp); err != nil {
+		return MappingUnknown, ErrNATDiscoveryUnsupported
+	}
+
+	// Test II: the other IP address, at the primary port.
+	resp, err = conn.roundTrip(ctx, &net.UDPAddr{IP: other.IP, Port: server.Port})
+	if err != nil {
+		return MappingUnknown, err
+	}
+	mapped2, err := mappedAddress(resp)
+	if err != nil {
+		return MappingUnknown, err
+	}
+	if mapped2 == mapped1 {
+		return MappingEndpointIndependent, nil
+	}
+
+	// Test III: the other IP address and port.
+	resp, err = conn.roundTrip(ctx, &net.UDPAddr{IP: other.IP, Port: other.Port})
+	if err != nil {
+		return MappingUnknown, err
+	}
+	mapped3, err := mappedAddress(resp)
+	if err != nil {
+		return MappingUnknown, err
+	}
+	if mapped3 == mapped2 {
+		return MappingAddressDependent, nil
+	}
+	return MappingAddressPortDependent, nil
+}
+
+// discoverFiltering asks server to answer from other addresses and ports,
+// and sees which answers get through. It uses a socket of its own, which
+// has not sent anything to the other address of server yet.
+func discoverFiltering(ctx context.Context, server *net.UDPAddr) (NATFiltering, error) {
+	conn, err := newSTUNConn(ctx)
+	if err != nil {
+		return FilteringUnknown, err
+	}
+	defer conn.Close()
+
+	// Test I: make sure the server answers at all.
+	if _, err := conn.roundTrip(ctx, server); err != nil {
+		return FilteringUnknown, err
+	}
+
+	// Test II: ask for the answer from the other IP address and port.
+	_, err = conn.roundTrip(ctx, server, changeRequest(changeIP|changePort))
+	if err == nil {
+		return FilteringEndpointIndependent, nil
+	} else if err != errSTUNTimeout {
+		return FilteringUnknown, err
+	}
+
+	// Test III: ask for the answer from the other port only.
+	_, err = conn.roundTrip(ctx, server, changeRequest(changePort))
+	if err == nil {
+		return FilteringAddressDependent, nil
+	} else if err != errSTUNTimeout {
+		return FilteringUnknown, err
+	}
+	return FilteringAddressPortDependent, nil
+}
+
+// The flags of a CHANGE-REQUEST attribute.
+const (
+	changeIP   = 0x04
+	changePort = 0x02
+)
+
+// changeRequest is a CHANGE-REQUEST attribute, asking the server to answer
+// from another address.
+type changeRequest byte
+
+func (c changeRequest) AddTo(m *stun.Message) error {
+	m.Add(stun.AttrChangeRequest, []byte{0, 0, 0, byte(c)})
+	return nil
+}
+
+func mappedAddress(m *stun.Message) (string, error) {
+	var addr stun.XORMappedAddress
+	if err := addr.GetFrom(m); err != nil {
+		return "", err
+	}
+	return addr.String(), nil
+}
+
+// stunConn sends STUN requests from one UDP socket and reads their
+// answers, from whatever address they come.
+type stunConn struct {
+	*net.UDPConn
+	stop func()
+}
+
+// newSTUNConn opens a socket that is closed when ctx is done.
+func newSTUNConn(ctx context.Context) (*stunConn, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	return &stunConn{UDPConn: conn, stop: closeOnDone(ctx, conn)}, nil
+}
+
+func (c *stunConn) Close() error {
+	c.stop()
+	return c.UDPConn.Close()
+}
+
+// roundTrip sends a binding request with attrs to addr, and returns the
+// answer to it. Answers to earlier requests are skipped.
+func (c *stunConn) roundTrip(ctx context.Context, addr *net.UDPAddr, attrs ...stun.Setter) (*stun.Message, error) {
+	req, err := stun.Build(append([]stun.Setter{stun.TransactionID, stun.BindingRequest}, attrs...)...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.WriteToUDP(req.Raw, addr); err != nil {
+		return nil, err
+	}
+	c.SetReadDeadline(time.Now().Add(natTestTimeout))
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := c.ReadFromUDP(buf)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			return nil, errSTUNTimeout
+		}
+		if err != nil {
+			return nil, err
+		}
+		resp := new(stun.Message)
+		resp.Raw = append([]byte{}, buf[:n]...)
+		if err := resp.Decode(); err != nil || resp.TransactionID != req.TransactionID {
+			continue
+		}
+		return resp, nil
+	}
+}
@@ -0,0 +1,181 @@
+package lib
+
+import (
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How long to let a network change settle before acting on it.
+	networkSettleTime = 2 * time.Second
+	// How often to look for network changes where the system does not
+	// notify them.
+	networkPollInterval = 5 * time.Second
+)
+
+// WatchNetwork calls onChange whenever the addresses of the network
+// interfaces change, for instance when switching from Wi-Fi to LTE, until
+// stop is closed. Snowflakes connected before such a change are usually
+// dead, but it can take a long time to notice.
+func WatchNetwork(stop <-chan struct{}, onChange func()) {
+	prev := networkFingerprint()
+	events := networkEvents(stop)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-events:
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(networkSettleTime):
+		}
+		select {
+		case <-events:
+		default:
+		}
+		cur := networkFingerprint()
+		if cur == prev {
+			continue
+		}
+		prev = cur
+		log.Println("Network changed")
+		onChange()
+	}
+}
+
+// pollNetwork signals events every networkPollInterval until stop is closed.
+func pollNetwork(stop <-chan struct{}, events chan<- struct{}) {
+	ticker := time.NewTicker(networkPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// networkFingerprint describes the addresses of the network interfaces that
+// are up, leaving out loopback.
+func networkFingerprint() string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	var addrs []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range ifaceAddrs {
+			addrs = append(addrs, iface.Name+" "+addr.String())
+		}
+	}
+	sort.Strings(addrs)
+	return strings.Join(addrs, ",")
+}
+
+// livePeers are the connected snowflakes, so that ClosePeers can find them.
+var livePeers = struct {
+	sync.Mutex
+	m map[*WebRTCPeer]struct{}
+}{m: make(map[*WebRTCPeer]struct{})}
+
+func addLivePeer(c *WebRTCPeer) {
+	livePeers.Lock()
+	livePeers.m[c] = struct{}{}
+	livePeers.Unlock()
+	c.options.group.add(c)
+	c.emit(EventPeerConnected)
+}
+
+func removeLivePeer(c *WebRTCPeer) {
+	livePeers.Lock()
+	_, live := livePeers.m[c]
+	delete(livePeers.m, c)
+	livePeers.Unlock()
+	c.options.group.remove(c)
+	if live {
+		c.emit(EventPeerDisconnected)
+	}
+}
+
+// ClosePeers closes every connected snowflake of the process. Sessions then
+// redial through new snowflakes, as they do when one dies.
+func ClosePeers() {
+	livePeers.Lock()
+	peers := make([]*WebRTCPeer, 0, len(livePeers.m))
+	for c := range livePeers.m {
+		peers = append(peers, c)
+	}
+	livePeers.Unlock()
+	closePeers(peers)
+}
+
+func closePeers(peers []*WebRTCPeer) {
+	log.Printf("WebRTC: closing %d snowflakes", len(peers))
+	for _, c := range peers {
+		c.Close()
+	}
+}
+
+// PeerGroup is the connected snowflakes of the dialers given it with
+// WithPeerGroup, such as those of one client, for them to be closed without
+// the snowflakes of the rest of the process. A nil *PeerGroup keeps none.
+type PeerGroup struct {
+	lock  sync.Mutex
+	peers map[*WebRTCPeer]struct{}
+}
+
+// NewPeerGroup returns an empty PeerGroup.
+func NewPeerGroup() *PeerGroup {
+	return &PeerGroup{peers: make(map[*WebRTCPeer]struct{})}
+}
+
+func (g *PeerGroup) add(c *WebRTCPeer) {
+	if g == nil {
+		return
+	}
+	g.lock.Lock()
+	g.peers[c] = struct{}{}
+	g.lock.Unlock()
+}
+
+func (g *PeerGroup) remove(c *WebRTCPeer) {
+	if g == nil {
+		return
+	}
+	g.lock.Lock()
+	delete(g.peers, c)
+	g.lock.Unlock()
+}
+
+// Close closes the connected snowflakes of g. Sessions then redial through
+// new snowflakes, as they do when one dies.
+func (g *PeerGroup) Close() {
+	if g == nil {
+		return
+	}
+	g.lock.Lock()
+	peers := make([]*WebRTCPeer, 0, len(g.peers))
+	for c := range g.peers {
+		peers = append(peers, c)
+	}
+	g.lock.Unlock()
+	closePeers(peers)
+}
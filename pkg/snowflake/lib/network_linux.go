@@ -0,0 +1,65 @@
+package lib
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// networkEvents signals changes of the links, addresses and routes, as
+// notified by rtnetlink. It falls back to polling if that fails.
+func networkEvents(stop <-chan struct{}) <-chan struct{} {
+	events := make(chan struct{}, 1)
+	fd, err := openRouteSocket()
+	if err != nil {
+		warnf("Network: watching netlink: %v, polling instead", err)
+		go pollNetwork(stop, events)
+		return events
+	}
+	go func() {
+		defer unix.Close(fd)
+		buf := make([]byte, 1<<16)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_, _, err := unix.Recvfrom(fd, buf, 0)
+			if err == unix.EAGAIN || err == unix.EINTR {
+				continue
+			} else if err != nil {
+				warnf("Network: reading netlink: %v, polling instead", err)
+				pollNetwork(stop, events)
+				return
+			}
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return events
+}
+
+// openRouteSocket returns a netlink socket subscribed to link, address and
+// route changes. Reads time out every second so that stop is noticed.
+func openRouteSocket() (int, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return -1, err
+	}
+	addr := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR |
+			unix.RTMGRP_IPV4_ROUTE | unix.RTMGRP_IPV6_ROUTE,
+	}
+	if err := unix.Bind(fd, addr); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	timeout := unix.Timeval{Sec: 1}
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package lib
+
+// networkEvents polls for changes, as there is no portable way to be
+// notified of them.
+func networkEvents(stop <-chan struct{}) <-chan struct{} {
+	events := make(chan struct{}, 1)
+	go pollNetwork(stop, events)
+	return events
+}
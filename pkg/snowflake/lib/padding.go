@@ -0,0 +1,108 @@
+package lib
+
+import (
+	mrand "math/rand"
+	"sync/atomic"
+	"time"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/common/encapsulation"
+)
+
+// Padding shapes the packets sent to the bridge so that their sizes and
+// timing tell less about the traffic they carry. It uses the padding chunks
+// of the encapsulation format, which the bridge skips, so it needs nothing
+// of the bridge. Only what we send is shaped: what the bridge sends back is
+// up to it.
+type Padding struct {
+	// Pad each packet to a multiple of this many bytes; 0 not to.
+	Quantum int
+	// Send a dummy packet, of Quantum bytes or 512 if 0, when nothing has
+	// been sent for about this long; 0 not to. The time is drawn from
+	// between half and one and a half of it each time.
+	Idle time.Duration
+}
+
+// The size of dummy packets without Padding.Quantum.
+const defaultDummySize = 512
+
+// padding is the Padding of all the snowflakes. Set by SetPadding.
+var padding Padding
+
+// SetPadding shapes the packets of all the snowflakes as p says. It must be
+// called before any connection is handled.
+func SetPadding(p Padding) {
+	padding = p
+}
+
+// PaddingStats is how many bytes were sent to the bridge, data and padding
+// with their length prefixes, since the process started.
+type PaddingStats struct {
+	Data    int64 `json:"data"`
+	Padding int64 `json:"padding"`
+}
+
+// Overhead returns the padding sent per byte of data.
+func (s PaddingStats) Overhead() float64 {
+	if s.Data == 0 {
+		return 0
+	}
+	return float64(s.Padding) / float64(s.Data)
+}
+
+// GetPaddingStats returns the bytes sent to the bridge so far.
+func GetPaddingStats() PaddingStats {
+	return PaddingStats{
+		Data:    atomic.LoadInt64(&metrics.encapsulatedData),
+		Padding: atomic.LoadInt64(&metrics.encapsulatedPadding),
+	}
+}
+
+// paddingFor returns how many bytes of padding to send after a data chunk
+// of encoded size n.
+func (p Padding) paddingFor(n int) int {
+	if p.Quantum <= 0 || n%p.Quantum == 0 {
+		return 0
+	}
+	return p.Quantum - n%p.Quantum
+}
+
+// dummySize returns the size of a dummy packet.
+func (p Padding) dummySize() int {
+	if p.Quantum > 0 {
+		return p.Quantum
+	}
+	return defaultDummySize
+}
+
+// nextIdle returns how long to wait for traffic before sending a dummy
+// packet.
+func (p Padding) nextIdle() time.Duration {
+	return p.Idle/2 + time.Duration(mrand.Int63n(int64(p.Idle)+1))
+}
+
+// sendDummies writes a dummy packet whenever c has sent nothing for a while,
+// until c is closed.
+func (c *EncapsulationPacketConn) sendDummies(p Padding) {
+	timer := time.NewTimer(p.nextIdle())
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-c.closed:
+			return
+		}
+		if atomic.SwapInt32(&c.sent, 0) == 0 {
+			c.lock.Lock()
+			n, err := encapsulation.WritePadding(c.bw, p.dummySize())
+			if err == nil {
+				err = c.bw.Flush()
+			}
+			c.lock.Unlock()
+			atomic.AddInt64(&metrics.encapsulatedPadding, int64(n))
+			if err != nil {
+				return
+			}
+		}
+		timer.Reset(p.nextIdle())
+	}
+}
@@ -2,12 +2,18 @@ package lib
 
 import (
 	"container/list"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"sync"
+	"sync/atomic"
 )
 
+// Collect fails with errAtCapacity when there are enough snowflakes.
+var errAtCapacity = errors.New("At capacity")
+
 // Container which keeps track of multiple WebRTC remote peers.
 // Implements |SnowflakeCollector|.
 //
@@ -23,26 +29,56 @@ type Peers struct {
 	Tongue
 	BytesLogger BytesLogger
 
+	// The SOCKS connection the snowflakes are collected for, if only one.
+	trace traceID
+
 	snowflakeChan chan *WebRTCPeer
 	activePeers   *list.List
 
 	melt   chan struct{}
 	melted bool
+	// Cancelled by End, to give up on the snowflakes being caught.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// With several bridges, the one the snowflakes are caught for, and
+	// whether data has come through it, which binds the session to it.
+	bridges *BridgeBalancer
+	bridge  string
+	bound   bool
+
+	// With a WebSocket fallback, the connection to the bridge it made
+	// last, and the channel popConn takes it from.
+	fallback      *WebSocketFallback
+	fallbackConn  *wsConn
+	fallbackConns chan io.ReadWriteCloser
 
 	collection sync.WaitGroup
 }
 
 // Construct a fresh container of remote peers.
 func NewPeers(tongue Tongue) (*Peers, error) {
+	return NewPeersContext(context.Background(), tongue)
+}
+
+// NewPeersContext is NewPeers, giving up on catching snowflakes once ctx is
+// done or End is called.
+func NewPeersContext(ctx context.Context, tongue Tongue) (*Peers, error) {
 	p := &Peers{}
 	// Use buffered go channel to pass snowflakes onwards to the SOCKS handler.
 	if tongue == nil {
 		return nil, errors.New("missing Tongue to catch Snowflakes with")
 	}
-	p.snowflakeChan = make(chan *WebRTCPeer, tongue.GetMax())
+	p.snowflakeChan = make(chan *WebRTCPeer, ceiling(tongue))
 	p.activePeers = list.New()
+	p.fallback = fallbackOf(tongue)
+	p.fallbackConns = make(chan io.ReadWriteCloser, 1)
 	p.melt = make(chan struct{})
 	p.Tongue = tongue
+	p.ctx, p.cancel = context.WithCancel(ctx)
+	if p.bridges = bridgesOf(tongue); p.bridges != nil {
+		p.bridge = p.bridges.acquire()
+	}
 	return p, nil
 }
 
@@ -57,21 +93,40 @@ func (p *Peers) Collect() (*WebRTCPeer, error) {
 	if nil == p.Tongue {
 		return nil, errors.New("missing Tongue to catch Snowflakes with")
 	}
+	p.failOver()
 	cnt := p.Count()
+	if cnt == 0 && p.fallback.active() {
+		return nil, p.collectFallback()
+	}
+	// Snowflakes to be replaced make room for a replacement, one at a time,
+	// as long as it can be passed on without waiting.
 	capacity := p.Tongue.GetMax()
+	if p.retiring() && len(p.snowflakeChan) < cap(p.snowflakeChan) {
+		capacity++
+	}
 	s := fmt.Sprintf("Currently at [%d/%d]", cnt, capacity)
 	if cnt >= capacity {
-		return nil, fmt.Errorf("At capacity [%d/%d]", cnt, capacity)
+		return nil, fmt.Errorf("%w [%d/%d]", errAtCapacity, cnt, capacity)
 	}
-	log.Println("WebRTC: Collecting a new Snowflake.", s)
+	p.trace.printf("WebRTC: Collecting a new Snowflake. %s", s)
 	// BUG: some broker conflict here.
-	connection, err := p.Tongue.Catch()
+	ctx := p.ctx
+	if p.bridges != nil {
+		ctx = withBridge(ctx, p.bridges, p.bridge)
+	}
+	connection, err := catchContext(ctx, p.Tongue)
 	if nil != err {
+		if p.ctx.Err() == nil {
+			p.fallback.failed()
+		}
 		return nil, err
 	}
+	p.fallback.succeeded()
+	p.trace.printf("WebRTC: Collected snowflake %s", connection.trace)
 	// Track new valid Snowflake in internal collection and pass along.
 	p.activePeers.PushBack(connection)
 	p.snowflakeChan <- connection
+	p.replaceRetiring()
 	return connection, nil
 }
 
@@ -86,6 +141,11 @@ func (p *Peers) Pop() *WebRTCPeer {
 		if snowflake.closed {
 			continue
 		}
+		// One to be replaced is not worth moving a session to.
+		if snowflake.isRetiring() {
+			snowflake.Close()
+			continue
+		}
 		// Set to use the same rate-limited traffic logger to keep consistency.
 		snowflake.BytesLogger = p.BytesLogger
 		return snowflake
@@ -105,6 +165,27 @@ func (p *Peers) Count() int {
 	return p.activePeers.Len()
 }
 
+// failOver moves on to another bridge if the one of the snowflakes is down,
+// as long as data has not come through it and none of its snowflakes are
+// left.
+func (p *Peers) failOver() {
+	if p.bridges == nil || p.bound {
+		return
+	}
+	for e := p.activePeers.Front(); e != nil; e = e.Next() {
+		if atomic.LoadInt64(&e.Value.(*WebRTCPeer).counters.bytesIn) > 0 {
+			p.bound = true
+			return
+		}
+	}
+	if p.Count() > 0 || p.bridges.up(p.bridge) {
+		return
+	}
+	p.bridges.release(p.bridge)
+	p.bridge = p.bridges.acquire()
+	p.trace.printf("WebRTC: Failing over to bridge %s", p.bridge)
+}
+
 func (p *Peers) purgeClosedPeers() {
 	for e := p.activePeers.Front(); e != nil; {
 		next := e.Next()
@@ -119,10 +200,14 @@ func (p *Peers) purgeClosedPeers() {
 
 // Close all Peers contained here.
 func (p *Peers) End() {
+	p.cancel()
 	close(p.melt)
 	p.melted = true
 	p.collection.Wait()
 	close(p.snowflakeChan)
+	if p.fallbackConn != nil {
+		p.fallbackConn.Close()
+	}
 	cnt := p.Count()
 	for e := p.activePeers.Front(); e != nil; {
 		next := e.Next()
@@ -131,5 +216,37 @@ func (p *Peers) End() {
 		p.activePeers.Remove(e)
 		e = next
 	}
+	if p.bridges != nil {
+		p.bridges.release(p.bridge)
+	}
 	log.Printf("WebRTC: melted all %d snowflakes.", cnt)
 }
+
+// catchContext catches a snowflake with tongue, giving up once ctx is done.
+// A Tongue that is not a ContextTongue is left to catch in the background,
+// and the snowflake it catches is closed.
+func catchContext(ctx context.Context, tongue Tongue) (*WebRTCPeer, error) {
+	if tongue, ok := tongue.(ContextTongue); ok {
+		return tongue.CatchContext(ctx)
+	}
+	type result struct {
+		peer *WebRTCPeer
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		peer, err := tongue.Catch()
+		done <- result{peer, err}
+	}()
+	select {
+	case r := <-done:
+		return r.peer, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.peer != nil {
+				r.peer.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
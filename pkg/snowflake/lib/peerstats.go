@@ -0,0 +1,85 @@
+package lib
+
+import (
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// How often the path to the bridge through a snowflake is measured while it
+// carries a session.
+const pathSampleInterval = 5 * time.Second
+
+// pathStats is what KCP tells of the path to the bridge through a snowflake
+// while it carries a session. Accessed atomically, keep 64-bit aligned.
+type pathStats struct {
+	rtt  int64  // smoothed round trip time, in nanoseconds
+	loss uint64 // math.Float64bits of the fraction of segments resent
+}
+
+// PeerStats is how a snowflake is doing: its traffic so far, and the round
+// trip time and loss to the bridge through it lately. RTT and Loss are zero
+// until the snowflake has carried a session for a while.
+type PeerStats struct {
+	Traffic
+	RTT  time.Duration
+	Loss float64 // fraction of the packets sent that had to be sent again
+}
+
+// SnowflakeStats returns the stats of each connected snowflake.
+func SnowflakeStats() []PeerStats {
+	livePeers.Lock()
+	stats := make([]PeerStats, 0, len(livePeers.m))
+	for c := range livePeers.m {
+		stats = append(stats, PeerStats{Traffic: c.traffic(), RTT: c.rtt(nil), Loss: c.loss()})
+	}
+	livePeers.Unlock()
+	sort.Slice(stats, func(i, j int) bool { return stats[i].ID < stats[j].ID })
+	return stats
+}
+
+// rtt returns the round trip time through the snowflake: that of its
+// nominated candidate pair in report, if pion measured it, or else that of
+// the session it carries.
+func (c *WebRTCPeer) rtt(report webrtc.StatsReport) time.Duration {
+	if rtt := currentRTT(report); rtt > 0 {
+		return rtt
+	}
+	return time.Duration(atomic.LoadInt64(&c.path.rtt))
+}
+
+// loss returns the fraction of packets resent by the session the snowflake
+// carries, lately.
+func (c *WebRTCPeer) loss() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&c.path.loss))
+}
+
+// measurePath samples the round trip time of the KCP session that session
+// returns, once it is made, and the loss, until the snowflake is closed.
+// The snowflake carries the session from now on: it is only replaced when it
+// dies. KCP counts resent segments for all the sessions together, so the
+// loss is that of all of them while there are several.
+func (c *WebRTCPeer) measurePath(session func() *kcp.UDPSession) {
+	prev := kcp.DefaultSnmp.Copy()
+	for {
+		<-time.After(pathSampleInterval)
+		if c.closed {
+			return
+		}
+		conn := session()
+		if conn == nil {
+			continue
+		}
+		atomic.StoreInt64(&c.path.rtt, int64(conn.GetSRTT())*int64(time.Millisecond))
+		cur := kcp.DefaultSnmp.Copy()
+		if sent := cur.OutSegs - prev.OutSegs; sent > 0 {
+			loss := float64(cur.RetransSegs-prev.RetransSegs) / float64(sent)
+			atomic.StoreUint64(&c.path.loss, math.Float64bits(loss))
+		}
+		prev = cur
+	}
+}
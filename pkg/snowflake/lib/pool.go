@@ -0,0 +1,186 @@
+package lib
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// How often the pool checks its snowflakes when it is full.
+const poolCheckInterval = time.Second
+
+// PeerPool is a Tongue that keeps a number of snowflakes caught ahead of
+// time, so that a new SOCKS connection does not have to wait for a
+// rendezvous. Catch hands out a warm snowflake when there is one, and
+// otherwise catches a new one with the underlying Tongue. The pool refills
+// itself in the background until Close is called.
+type PeerPool struct {
+	Tongue
+	min int
+
+	lock    sync.Mutex
+	warm    []*WebRTCPeer
+	dormant bool
+
+	stop chan struct{}
+	once sync.Once
+	// Cancelled by Close, to give up on the snowflake being prewarmed.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// GetCeiling returns the most snowflakes the underlying Tongue may ask for.
+func (p *PeerPool) GetCeiling() int {
+	return ceiling(p.Tongue)
+}
+
+// Bridges returns the balancer of the underlying Tongue, if any.
+func (p *PeerPool) Bridges() *BridgeBalancer {
+	return bridgesOf(p.Tongue)
+}
+
+// WebSocketFallback returns the fallback of the underlying Tongue, if any.
+func (p *PeerPool) WebSocketFallback() *WebSocketFallback {
+	return fallbackOf(p.Tongue)
+}
+
+// Tuning returns the Tuning of the underlying Tongue, if any.
+func (p *PeerPool) Tuning() *Tuning {
+	return tuningOf(p.Tongue)
+}
+
+// NewPeerPool returns a PeerPool keeping min snowflakes caught with tongue.
+func NewPeerPool(tongue Tongue, min int) *PeerPool {
+	p := &PeerPool{
+		Tongue: tongue,
+		min:    min,
+		stop:   make(chan struct{}),
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	go p.maintain()
+	return p
+}
+
+func (p *PeerPool) Catch() (*WebRTCPeer, error) {
+	return p.CatchContext(context.Background())
+}
+
+// CatchContext hands out a warm snowflake, or catches a new one until ctx is
+// done. With several bridges, only a snowflake for the bridge of the session
+// will do.
+func (p *PeerPool) CatchContext(ctx context.Context) (*WebRTCPeer, error) {
+	if peer := p.take(bridgeFromContext(ctx).fingerprint); peer != nil {
+		log.Println("WebRTC: Using a prewarmed snowflake.")
+		return peer, nil
+	}
+	return catchContext(ctx, p.Tongue)
+}
+
+// take removes a warm snowflake for the bridge with fingerprint from the
+// pool, or returns nil.
+func (p *PeerPool) take(fingerprint string) *WebRTCPeer {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i, peer := range p.warm {
+		if peer.closed || peer.bridge.fingerprint != fingerprint {
+			continue
+		}
+		p.warm = append(p.warm[:i:i], p.warm[i+1:]...)
+		peer.lastReceive = time.Now()
+		return peer
+	}
+	return nil
+}
+
+// refresh drops the closed snowflakes and returns how many are left. The
+// others have nothing to receive yet, so they are kept from being closed as
+// stale. A dormant pool drops all of them, and reports itself full.
+func (p *PeerPool) refresh() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.dormant {
+		p.closeWarm()
+		return p.min
+	}
+	warm := p.warm[:0]
+	for _, peer := range p.warm {
+		if !peer.closed {
+			peer.lastReceive = time.Now()
+			warm = append(warm, peer)
+		}
+	}
+	p.warm = warm
+	return len(p.warm)
+}
+
+func (p *PeerPool) maintain() {
+	failures := 0
+	for {
+		wait := poolCheckInterval
+		if n := p.refresh(); n < p.min {
+			log.Printf("WebRTC: Prewarming a snowflake. Currently at [%d/%d]", n, p.min)
+			ctx := p.ctx
+			if bridges := bridgesOf(p.Tongue); bridges != nil {
+				ctx = withBridge(ctx, bridges, bridges.rotate())
+			}
+			peer, err := catchContext(ctx, p.Tongue)
+			if err != nil {
+				wait = tuningOf(p.Tongue).redialBackoff().Delay(failures)
+				failures++
+				warnf("WebRTC: prewarming: %v, retrying in %v", err, wait)
+			} else {
+				failures = 0
+				p.lock.Lock()
+				if p.dormant {
+					peer.Close()
+				} else {
+					p.warm = append(p.warm, peer)
+				}
+				p.lock.Unlock()
+				wait = 0
+			}
+		}
+		select {
+		case <-p.stop:
+			p.lock.Lock()
+			p.closeWarm()
+			p.lock.Unlock()
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// closeWarm closes the warm snowflakes. p.lock must be held.
+func (p *PeerPool) closeWarm() {
+	for _, peer := range p.warm {
+		peer.Close()
+	}
+	p.warm = nil
+}
+
+// Sleep closes the warm snowflakes and stops refilling the pool until Wake
+// is called. Catch keeps working, without warm snowflakes.
+func (p *PeerPool) Sleep() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.dormant = true
+	p.closeWarm()
+}
+
+// Wake starts refilling the pool again after Sleep.
+func (p *PeerPool) Wake() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.dormant = false
+}
+
+// Close stops refilling the pool and closes the warm snowflakes.
+func (p *PeerPool) Close() error {
+	p.once.Do(func() {
+		p.cancel()
+		close(p.stop)
+	})
+	return nil
+}
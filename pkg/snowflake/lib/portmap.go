@@ -0,0 +1,446 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// How long the router is asked to keep the port mappings. They are renewed
+// halfway through.
+const portMappingLifetime = time.Hour
+
+// How long to wait before trying again when port mapping failed.
+const portMappingRetryInterval = 10 * time.Minute
+
+// How many ports to map when no UDP port range is set, and how many at most.
+const (
+	defaultMappedPorts = 32
+	maxMappedPorts     = 256
+)
+
+// portMapper asks the router to forward a range of local UDP ports, through
+// NAT-PMP or UPnP IGD, and keeps the mappings alive. Proxies can then reach
+// the peers at the external address of the router, even behind a NAT they
+// could not get through otherwise.
+type portMapper struct {
+	min, max uint16
+
+	lock     sync.Mutex
+	external net.IP // nil until the ports are mapped
+}
+
+// The port mappers by range, shared by all the dialers like the ICE-TCP
+// listeners. 0-0 is the range picked when none is set.
+var portMappers = struct {
+	sync.Mutex
+	m map[[2]uint16]*portMapper
+}{m: make(map[[2]uint16]*portMapper)}
+
+// SetPortMapping makes the peers of this dialer ask the router to forward
+// their UDP ports, and offer its external address as a server reflexive
+// candidate. The ports are those set with SetUDPPortRange, which must be
+// called first, or else a random range of defaultMappedPorts. Pion takes
+// the ports for all candidates out of the range, so it must leave room for
+// several at once per peer.
+//
+// The ports are mapped in the background, and the peers caught meanwhile, or
+// when the router supports neither NAT-PMP nor UPnP, go without.
+func (w *WebRTCDialer) SetPortMapping(enable bool) error {
+	if !enable {
+		w.options.portMapper = nil
+		return nil
+	}
+	key := [2]uint16{w.options.portMin, w.options.portMax}
+	if n := int(key[1]) - int(key[0]) + 1; key != [2]uint16{} && n > maxMappedPorts {
+		return fmt.Errorf("can not map %d ports, at most %d", n, maxMappedPorts)
+	}
+	portMappers.Lock()
+	defer portMappers.Unlock()
+	m, ok := portMappers.m[key]
+	if !ok {
+		m = &portMapper{min: key[0], max: key[1]}
+		if key == [2]uint16{} {
+			m.min = uint16(49152 + rand.Intn(65536-49152-defaultMappedPorts))
+			m.max = m.min + defaultMappedPorts - 1
+		}
+		portMappers.m[key] = m
+		go m.run()
+	}
+	w.options.portMapper = m
+	return nil
+}
+
+// mapped returns the external address and the range of the mapped ports, or
+// a nil address until they are mapped.
+func (m *portMapper) mapped() (external net.IP, min, max uint16) {
+	if m == nil {
+		return nil, 0, 0
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.external, m.min, m.max
+}
+
+// apply makes the peers of s use the mapped ports, if they are.
+func (m *portMapper) apply(s *webrtc.SettingEngine) error {
+	external, min, max := m.mapped()
+	if external == nil {
+		return nil
+	}
+	if err := s.SetEphemeralUDPPortRange(min, max); err != nil {
+		return err
+	}
+	s.SetNAT1To1IPs([]string{external.String()}, webrtc.ICECandidateTypeSrflx)
+	return nil
+}
+
+// run maps the ports, and renews the mappings, for as long as the process
+// runs.
+func (m *portMapper) run() {
+	for {
+		external, err := m.mapPorts()
+		m.lock.Lock()
+		m.external = external
+		m.lock.Unlock()
+		if err != nil {
+			warnf("Port mapping: %v, trying again in %v", err, portMappingRetryInterval)
+			time.Sleep(portMappingRetryInterval)
+			continue
+		}
+		time.Sleep(portMappingLifetime / 2)
+	}
+}
+
+// mapPorts maps all the ports of m through the first of NAT-PMP and UPnP
+// IGD the router supports, and returns the external address they are
+// mapped at.
+func (m *portMapper) mapPorts() (net.IP, error) {
+	var router portMappingClient
+	var external net.IP
+	var errs []string
+	if gateway, err := defaultGateway(); err != nil {
+		errs = append(errs, err.Error())
+	} else {
+		pmp := natPMP{&net.UDPAddr{IP: gateway, Port: natPMPPort}}
+		if external, err = pmp.externalIP(); err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			router = pmp
+		}
+	}
+	if router == nil {
+		igd, err := discoverUPnPIGD()
+		if err == nil {
+			external, err = igd.externalIP()
+		}
+		if err != nil {
+			return nil, errors.New(strings.Join(append(errs, err.Error()), "; "))
+		}
+		router = igd
+	}
+	for port := int(m.min); port <= int(m.max); port++ {
+		if err := router.mapPort(uint16(port), portMappingLifetime); err != nil {
+			return nil, err
+		}
+	}
+	log.Printf("Port mapping: UDP ports %d-%d forwarded from %v through %s", m.min, m.max, external, router)
+	return external, nil
+}
+
+// portMappingClient asks the router to forward ports.
+type portMappingClient interface {
+	externalIP() (net.IP, error)
+	// mapPort forwards UDP port of the router to the same port here, for
+	// lifetime.
+	mapPort(port uint16, lifetime time.Duration) error
+	String() string
+}
+
+// The port NAT-PMP gateways listen on, as in RFC 6886.
+const natPMPPort = 5351
+
+// How many times a NAT-PMP request is sent, the first time waiting 250ms for
+// the answer and twice as long each time after that.
+const natPMPTries = 4
+
+// natPMP is a NAT-PMP gateway.
+type natPMP struct {
+	addr *net.UDPAddr
+}
+
+func (c natPMP) String() string {
+	return "NAT-PMP"
+}
+
+// call sends req to the gateway and returns its successful answer, of at
+// least size bytes.
+func (c natPMP) call(req []byte, size int) ([]byte, error) {
+	conn, err := net.DialUDP("udp4", nil, c.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	timeout := 250 * time.Millisecond
+	buf := make([]byte, 16)
+	for i := 0; i < natPMPTries; i++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, fmt.Errorf("NAT-PMP: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		for {
+			n, err := conn.Read(buf)
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("NAT-PMP: %v", err)
+			}
+			if n < size || buf[0] != 0 || buf[1] != req[1]|0x80 {
+				continue
+			}
+			if result := binary.BigEndian.Uint16(buf[2:]); result != 0 {
+				return nil, fmt.Errorf("NAT-PMP: the gateway refused with result code %d", result)
+			}
+			return buf[:n], nil
+		}
+		timeout *= 2
+	}
+	return nil, errors.New("NAT-PMP: no answer from the gateway")
+}
+
+func (c natPMP) externalIP() (net.IP, error) {
+	resp, err := c.call([]byte{0, 0}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IP(append([]byte(nil), resp[8:12]...)), nil
+}
+
+func (c natPMP) mapPort(port uint16, lifetime time.Duration) error {
+	req := make([]byte, 12)
+	req[1] = 1 // map UDP
+	binary.BigEndian.PutUint16(req[4:], port)
+	binary.BigEndian.PutUint16(req[6:], port)
+	binary.BigEndian.PutUint32(req[8:], uint32(lifetime/time.Second))
+	resp, err := c.call(req, 16)
+	if err != nil {
+		return err
+	}
+	if mapped := binary.BigEndian.Uint16(resp[10:]); mapped != port {
+		return fmt.Errorf("NAT-PMP: the gateway forwards port %d from port %d instead", port, mapped)
+	}
+	return nil
+}
+
+// Where UPnP devices answer SSDP searches, and how long to wait for them.
+const (
+	ssdpAddr    = "239.255.255.250:1900"
+	ssdpTimeout = 3 * time.Second
+)
+
+// upnpHTTPClient talks to the router directly, whatever the proxy settings.
+var upnpHTTPClient = &http.Client{
+	Transport: &http.Transport{},
+	Timeout:   10 * time.Second,
+}
+
+// upnpIGD is the WAN connection service of a UPnP Internet gateway device.
+type upnpIGD struct {
+	controlURL  string
+	serviceType string
+	// Our address on the network of the router, which it forwards to.
+	localIP net.IP
+}
+
+func (c *upnpIGD) String() string {
+	return "UPnP"
+}
+
+// discoverUPnPIGD searches the network for an Internet gateway device with
+// SSDP, and returns the first that has a WAN connection service.
+func discoverUPnPIGD() (*upnpIGD, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	dst, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return nil, err
+	}
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddr + "\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n\r\n"
+	if _, err := conn.WriteTo([]byte(search), dst); err != nil {
+		return nil, fmt.Errorf("UPnP: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(ssdpTimeout))
+	buf := make([]byte, 2048)
+	err = errors.New("UPnP: no Internet gateway device found")
+	for {
+		n, _, readErr := conn.ReadFrom(buf)
+		if readErr != nil {
+			return nil, err
+		}
+		resp, parseErr := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if parseErr != nil {
+			continue
+		}
+		location := resp.Header.Get("Location")
+		if location == "" {
+			continue
+		}
+		igd, igdErr := newUPnPIGD(location)
+		if igdErr == nil {
+			return igd, nil
+		}
+		err = igdErr
+	}
+}
+
+// upnpDevice is the part of a UPnP device description that tells where its
+// services are controlled.
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// newUPnPIGD reads the device description at location, and returns its WAN
+// connection service.
+func newUPnPIGD(location string) (*upnpIGD, error) {
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := upnpHTTPClient.Get(location)
+	if err != nil {
+		return nil, fmt.Errorf("UPnP: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := limitedRead(resp.Body, 1<<20)
+	if err != nil {
+		return nil, fmt.Errorf("UPnP: reading the device description: %v", err)
+	}
+	var description struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := xml.Unmarshal(data, &description); err != nil {
+		return nil, fmt.Errorf("UPnP: parsing the device description: %v", err)
+	}
+	if description.URLBase != "" {
+		if u, err := url.Parse(description.URLBase); err == nil {
+			base = u
+		}
+	}
+	serviceType, controlURL := findWANConnection(description.Device)
+	if controlURL == "" {
+		return nil, errors.New("UPnP: the device has no WAN connection service")
+	}
+	control, err := base.Parse(controlURL)
+	if err != nil {
+		return nil, err
+	}
+	// Find out the local address routed to the router, without sending
+	// anything.
+	probe, err := net.Dial("udp4", net.JoinHostPort(base.Hostname(), "1900"))
+	if err != nil {
+		return nil, err
+	}
+	localIP := probe.LocalAddr().(*net.UDPAddr).IP
+	probe.Close()
+	return &upnpIGD{controlURL: control.String(), serviceType: serviceType, localIP: localIP}, nil
+}
+
+// findWANConnection returns the type and control URL of the first WAN IP or
+// PPP connection service of device or the devices within.
+func findWANConnection(device upnpDevice) (serviceType, controlURL string) {
+	for _, service := range device.Services {
+		if strings.Contains(service.ServiceType, ":WANIPConnection:") ||
+			strings.Contains(service.ServiceType, ":WANPPPConnection:") {
+			return service.ServiceType, service.ControlURL
+		}
+	}
+	for _, d := range device.Devices {
+		if serviceType, controlURL := findWANConnection(d); controlURL != "" {
+			return serviceType, controlURL
+		}
+	}
+	return "", ""
+}
+
+// soap calls action of the service with args, the XML of its arguments, and
+// returns the answer.
+func (c *upnpIGD) soap(action, args string) ([]byte, error) {
+	body := `<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+		`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>` +
+		`<u:` + action + ` xmlns:u="` + c.serviceType + `">` + args + `</u:` + action + `>` +
+		`</s:Body></s:Envelope>`
+	req, err := http.NewRequest("POST", c.controlURL, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+c.serviceType+"#"+action+`"`)
+	resp, err := upnpHTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("UPnP %s: %v", action, err)
+	}
+	defer resp.Body.Close()
+	data, err := limitedRead(resp.Body, 64<<10)
+	if err != nil {
+		return nil, fmt.Errorf("UPnP %s: %v", action, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("UPnP %s: %s", action, resp.Status)
+	}
+	return data, nil
+}
+
+func (c *upnpIGD) externalIP() (net.IP, error) {
+	data, err := c.soap("GetExternalIPAddress", "")
+	if err != nil {
+		return nil, err
+	}
+	var answer struct {
+		IP string `xml:"Body>GetExternalIPAddressResponse>NewExternalIPAddress"`
+	}
+	if err := xml.Unmarshal(data, &answer); err != nil {
+		return nil, fmt.Errorf("UPnP GetExternalIPAddress: %v", err)
+	}
+	ip := net.ParseIP(strings.TrimSpace(answer.IP))
+	if ip == nil {
+		return nil, fmt.Errorf("UPnP GetExternalIPAddress: invalid address %q", answer.IP)
+	}
+	return ip, nil
+}
+
+func (c *upnpIGD) mapPort(port uint16, lifetime time.Duration) error {
+	_, err := c.soap("AddPortMapping", fmt.Sprintf("<NewRemoteHost></NewRemoteHost>"+
+		"<NewExternalPort>%d</NewExternalPort><NewProtocol>UDP</NewProtocol>"+
+		"<NewInternalPort>%d</NewInternalPort><NewInternalClient>%s</NewInternalClient>"+
+		"<NewEnabled>1</NewEnabled><NewPortMappingDescription>snowflake</NewPortMappingDescription>"+
+		"<NewLeaseDuration>%d</NewLeaseDuration>",
+		port, port, c.localIP, int(lifetime/time.Second)))
+	return err
+}
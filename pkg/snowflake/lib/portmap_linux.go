@@ -0,0 +1,36 @@
+package lib
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// defaultGateway returns the gateway of the default IPv4 route, as listed in
+// /proc/net/route.
+func defaultGateway() (net.IP, error) {
+	data, err := ioutil.ReadFile("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(string(data), "\n")
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		gateway, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil || gateway == 0 {
+			continue
+		}
+		// The address is listed in host byte order, little endian on the
+		// architectures we run on.
+		ip := make(net.IP, 4)
+		binary.LittleEndian.PutUint32(ip, uint32(gateway))
+		return ip, nil
+	}
+	return nil, errors.New("no default gateway")
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package lib
+
+import (
+	"errors"
+	"net"
+)
+
+// defaultGateway is only implemented on Linux. Elsewhere, ports are mapped
+// through UPnP only.
+func defaultGateway() (net.IP, error) {
+	return nil, errors.New("finding the default gateway is only supported on Linux")
+}
@@ -0,0 +1,57 @@
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The types of proxies, as the broker knows them.
+var proxyTypes = map[string]bool{
+	"standalone": true,
+	"webext":     true,
+	"badge":      true,
+	"iptproxy":   true,
+}
+
+// ProxyPreferences are the proxies a client would rather be matched with.
+// They are hints: a broker that does not know them ignores them, and one
+// that does may still match us with other proxies when none fit.
+type ProxyPreferences struct {
+	// Types of proxies, such as "standalone" or "webext"; any if empty.
+	Types []string
+	// Upper case ISO 3166 codes of the countries to take proxies from, any
+	// if empty, and of those to avoid.
+	Countries        []string
+	ExcludeCountries []string
+}
+
+// Check returns an error for unknown proxy types and malformed country
+// codes.
+func (p ProxyPreferences) Check() error {
+	for _, t := range p.Types {
+		if !proxyTypes[t] {
+			return fmt.Errorf("unknown proxy type %q", t)
+		}
+	}
+	for _, c := range append(append([]string{}, p.Countries...), p.ExcludeCountries...) {
+		if len(c) != 2 || strings.ToUpper(c) != c || strings.Trim(c, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+			return fmt.Errorf("invalid country code %q", c)
+		}
+	}
+	return nil
+}
+
+// setHeaders puts the preferences in the headers of a request to the HTTP
+// endpoint of the broker, which takes the offer as the whole body.
+func (p ProxyPreferences) setHeaders(h http.Header) {
+	if len(p.Types) > 0 {
+		h.Set("Snowflake-Proxy-Types", strings.Join(p.Types, ","))
+	}
+	if len(p.Countries) > 0 {
+		h.Set("Snowflake-Countries", strings.Join(p.Countries, ","))
+	}
+	if len(p.ExcludeCountries) > 0 {
+		h.Set("Snowflake-Exclude-Countries", strings.Join(p.ExcludeCountries, ","))
+	}
+}
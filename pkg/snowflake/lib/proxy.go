@@ -0,0 +1,76 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+func init() {
+	// golang.org/x/net/proxy only knows about SOCKS5, so teach it about
+	// HTTP CONNECT proxies for the ICE proxy dialer.
+	proxy.RegisterDialerType("http", newHTTPConnectDialer)
+}
+
+// CheckProxyProtocolSupport returns an error if the upstream proxy given in
+// TOR_PT_PROXY can not be used by the client.
+func CheckProxyProtocolSupport(proxyURL *url.URL) error {
+	switch proxyURL.Scheme {
+	case "socks5", "http":
+		return nil
+	default:
+		return fmt.Errorf("proxy scheme %q is not supported", proxyURL.Scheme)
+	}
+}
+
+// httpConnectDialer is a proxy.Dialer tunneling TCP connections through an
+// HTTP proxy with the CONNECT method.
+type httpConnectDialer struct {
+	proxyURL *url.URL
+	forward  proxy.Dialer
+}
+
+func newHTTPConnectDialer(proxyURL *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	return &httpConnectDialer{proxyURL: proxyURL, forward: forward}, nil
+}
+
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.forward.Dial("tcp", d.proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.proxyURL.User != nil {
+		password, _ := d.proxyURL.User.Password()
+		credentials := d.proxyURL.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization",
+			"Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The proxy does not send anything after its response until we do, so
+	// nothing is lost by discarding the bufio.Reader.
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT to %s: %s", addr, resp.Status)
+	}
+	return conn, nil
+}
@@ -0,0 +1,117 @@
+package lib
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// How often a snowflake's quality is checked against the QualityThresholds.
+const qualityCheckInterval = 10 * time.Second
+
+// QualityThresholds are the limits below which a snowflake is closed, so
+// that it is replaced before it fails outright. Zero values are not checked.
+type QualityThresholds struct {
+	// Highest acceptable round trip time to the proxy.
+	MaxRTT time.Duration
+	// Lowest acceptable rate, in bytes per second, at which data is
+	// received while data is being sent.
+	MinThroughput int
+	// Highest acceptable fraction of writes that fail.
+	MaxErrorRate float64
+	// Highest acceptable fraction of packets that the session through the
+	// snowflake has to send again.
+	MaxLoss float64
+}
+
+func (t QualityThresholds) enabled() bool {
+	return t.MaxRTT > 0 || t.MinThroughput > 0 || t.MaxErrorRate > 0 || t.MaxLoss > 0
+}
+
+// peerCounters count the traffic of a snowflake. They are updated
+// atomically, and must stay 64-bit aligned.
+type peerCounters struct {
+	bytesIn     int64
+	bytesOut    int64
+	writes      int64
+	writeErrors int64
+}
+
+func (c *peerCounters) snapshot() peerCounters {
+	return peerCounters{
+		bytesIn:     atomic.LoadInt64(&c.bytesIn),
+		bytesOut:    atomic.LoadInt64(&c.bytesOut),
+		writes:      atomic.LoadInt64(&c.writes),
+		writeErrors: atomic.LoadInt64(&c.writeErrors),
+	}
+}
+
+// peerQuality is the score of a snowflake over an interval.
+type peerQuality struct {
+	rtt        time.Duration
+	throughput float64 // bytes received per second
+	errorRate  float64
+	loss       float64
+	sending    bool // whether anything was sent
+}
+
+func (q peerQuality) String() string {
+	return fmt.Sprintf("RTT %v, throughput %.0f B/s, error rate %.2f, loss %.2f",
+		q.rtt, q.throughput, q.errorRate, q.loss)
+}
+
+// measureQuality scores the traffic between two snapshots of the counters
+// taken interval apart, and the current round trip time.
+func measureQuality(prev, cur peerCounters, interval time.Duration, rtt time.Duration) peerQuality {
+	q := peerQuality{
+		rtt:        rtt,
+		throughput: float64(cur.bytesIn-prev.bytesIn) / interval.Seconds(),
+		sending:    cur.bytesOut > prev.bytesOut,
+	}
+	if writes := cur.writes - prev.writes; writes > 0 {
+		q.errorRate = float64(cur.writeErrors-prev.writeErrors) / float64(writes)
+	}
+	return q
+}
+
+// check returns why q falls below the thresholds, or "" if it does not.
+func (t QualityThresholds) check(q peerQuality) string {
+	switch {
+	case t.MaxRTT > 0 && q.rtt > t.MaxRTT:
+		return fmt.Sprintf("RTT above %v", t.MaxRTT)
+	case t.MinThroughput > 0 && q.sending && q.throughput < float64(t.MinThroughput):
+		return fmt.Sprintf("throughput below %d B/s", t.MinThroughput)
+	case t.MaxErrorRate > 0 && q.errorRate > t.MaxErrorRate:
+		return fmt.Sprintf("error rate above %.2f", t.MaxErrorRate)
+	case t.MaxLoss > 0 && q.loss > t.MaxLoss:
+		return fmt.Sprintf("loss above %.2f", t.MaxLoss)
+	}
+	return ""
+}
+
+// currentRTT returns the round trip time of the nominated candidate pair.
+func currentRTT(report webrtc.StatsReport) time.Duration {
+	pair, _ := nominatedPair(report)
+	return time.Duration(pair.CurrentRoundTripTime * float64(time.Second))
+}
+
+// monitorQuality replaces the peer once its quality falls below t.
+func (c *WebRTCPeer) monitorQuality(t QualityThresholds) {
+	prev := c.counters.snapshot()
+	for {
+		<-time.After(qualityCheckInterval)
+		if c.closed {
+			return
+		}
+		cur := c.counters.snapshot()
+		q := measureQuality(prev, cur, qualityCheckInterval, c.rtt(c.pc.GetStats()))
+		q.loss = c.loss()
+		if reason := t.check(q); reason != "" {
+			c.retire(fmt.Sprintf("%s (%v)", reason, q))
+			return
+		}
+		prev = cur
+	}
+}
@@ -0,0 +1,105 @@
+// Racing rendezvous methods.
+//
+// In a partially censored network it is not known in advance which signaling
+// channel works, and trying them one after the other can take minutes. The
+// race sends each offer through all the configured methods at once, uses the
+// first answer and cancels the other exchanges.
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+)
+
+// ContextRendezvousMethod is a RendezvousMethod whose exchanges can be
+// cancelled. Methods that do not implement it are left to finish in the
+// background when they lose a race, and their answer is discarded.
+type ContextRendezvousMethod interface {
+	RendezvousMethod
+	ExchangeContext(ctx context.Context, offer []byte) ([]byte, error)
+}
+
+// exchangeContext runs r.Exchange, returning early if ctx is done.
+func exchangeContext(ctx context.Context, r RendezvousMethod, offer []byte) ([]byte, error) {
+	if r, ok := r.(ContextRendezvousMethod); ok {
+		return r.ExchangeContext(ctx, offer)
+	}
+	done := make(chan exchangeResult, 1)
+	go func() {
+		answer, err := r.Exchange(offer)
+		done <- exchangeResult{answer, err}
+	}()
+	select {
+	case res := <-done:
+		return res.answer, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type exchangeResult struct {
+	answer []byte
+	err    error
+}
+
+// raceRendezvous exchanges each offer through all of its methods at once.
+type raceRendezvous []RendezvousMethod
+
+// RaceRendezvousMethods returns a RendezvousMethod that sends each offer
+// through all of methods concurrently and returns the first answer. If every
+// method fails, the first error is returned.
+func RaceRendezvousMethods(methods ...RendezvousMethod) RendezvousMethod {
+	return raceRendezvous(methods)
+}
+
+func (r raceRendezvous) Exchange(offer []byte) ([]byte, error) {
+	return r.ExchangeContext(context.Background(), offer)
+}
+
+func (r raceRendezvous) ExchangeContext(ctx context.Context, offer []byte) ([]byte, error) {
+	if len(r) == 0 {
+		return nil, errors.New("no rendezvous methods to race")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan exchangeResult, len(r))
+	for _, method := range r {
+		go func(method RendezvousMethod) {
+			answer, err := exchangeContext(ctx, method, offer)
+			results <- exchangeResult{answer, err}
+		}(method)
+	}
+	var firstErr error
+	for range r {
+		res := <-results
+		if res.err == nil {
+			return res.answer, nil
+		}
+		if firstErr == nil {
+			firstErr = res.err
+		}
+	}
+	return nil, firstErr
+}
+
+// UseRendezvousMethods makes the BrokerChannel race the registered methods
+// called names against each other. The options are shared by all of them.
+func (bc *BrokerChannel) UseRendezvousMethods(names []string, options map[string]string) error {
+	if len(names) == 1 {
+		return bc.UseRendezvousMethod(names[0], options)
+	}
+	methods := make([]RendezvousMethod, len(names))
+	for i, name := range names {
+		m, err := newRendezvousMethod(bc, name, options)
+		if err != nil {
+			return err
+		}
+		methods[i] = m
+	}
+	log.Println("Racing rendezvous methods:", strings.Join(names, ", "))
+	bc.SetRendezvousMethod(RaceRendezvousMethods(methods...))
+	return nil
+}
@@ -0,0 +1,105 @@
+package lib
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// The limits on the traffic of all SOCKS connections, up towards the
+// bridge and down, or nil for no limit. Set by SetRateLimit.
+var upLimit, downLimit *tokenBucket
+
+// SetRateLimit limits the traffic of all SOCKS connections together to up
+// bytes per second towards the bridge and down bytes per second back. Zero
+// means no limit. It must be called before any connection is handled.
+func SetRateLimit(up, down int64) {
+	upLimit, downLimit = newTokenBucket(up), newTokenBucket(down)
+}
+
+// tokenBucket lets through rate bytes per second, in bursts of up to one
+// second's worth.
+type tokenBucket struct {
+	rate float64
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a tokenBucket of rate bytes per second, or nil if
+// rate is not positive.
+func newTokenBucket(rate int64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// limit returns the rate of b, or 0 if b is nil.
+func (b *tokenBucket) limit() int64 {
+	if b == nil {
+		return 0
+	}
+	return int64(b.rate)
+}
+
+// take removes n tokens, going into debt if there are not enough, and
+// returns how long to wait for the debt to be paid off.
+func (b *tokenBucket) take(n int) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// chunk is how much to write at once through the bucket, so that slow rates
+// are met smoothly instead of in long pauses.
+func (b *tokenBucket) chunk() int {
+	n := int(b.rate / 10)
+	if n < 512 {
+		n = 512
+	}
+	return n
+}
+
+// limitedWriter writes through a tokenBucket.
+type limitedWriter struct {
+	io.Writer
+	bucket *tokenBucket
+}
+
+// limitWriter returns w limited by bucket, or w itself if bucket is nil.
+func limitWriter(w io.Writer, bucket *tokenBucket) io.Writer {
+	if bucket == nil {
+		return w
+	}
+	return limitedWriter{w, bucket}
+}
+
+func (w limitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if chunk := w.bucket.chunk(); n > chunk {
+			n = chunk
+		}
+		time.Sleep(w.bucket.take(n))
+		n, err := w.Writer.Write(p[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
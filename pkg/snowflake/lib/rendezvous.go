@@ -1,21 +1,34 @@
 // WebRTC rendezvous requires the exchange of SessionDescriptions between
 // peers in order to establish a PeerConnection.
 //
-// This file contains the one method currently available to Snowflake:
+// This file contains the methods currently available to Snowflake:
 //
 // - Domain-fronted HTTP signaling. The Broker automatically exchange offers
 //   and answers between this client and some remote WebRTC proxy.
+//
+// - AMP cache signaling (see amp.go), which reaches the Broker through an
+//   AMP cache, optionally domain fronted, when the Broker itself is blocked.
+//
+// - SQS signaling (see sqs.go), which passes offers and answers through
+//   Amazon SQS queues the Broker also listens on.
+//
+// Several of them can be raced against each other (see race.go).
 
 package lib
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 
@@ -31,26 +44,129 @@ const (
 	readLimit                    = 100000 //Maximum number of bytes to be read from an HTTP response
 )
 
+var errBrokerTimeout = errors.New("timeout waiting for the broker")
+
 // Signalling Channel to the Broker.
 type BrokerChannel struct {
 	// The Host header to put in the HTTP request (optional and may be
 	// different from the host name in URL).
 	Host               string
 	url                *url.URL
+	fronts             *frontPool        // Set by SetFronts, overrides Host.
 	transport          http.RoundTripper // Used to make all requests.
 	keepLocalAddresses bool
 	NATType            string
+	natBehavior        NATBehavior // what NATType was told from, if known
 	lock               sync.Mutex
+
+	// The signaling channel offers are exchanged over.
+	rendezvous RendezvousMethod
+
+	retry RetryPolicy
+
+	proxyPreferences ProxyPreferences
+	// The bridge to ask the broker for, or "" for any.
+	bridgeFingerprint string
+	// The key answers must be signed with, or nil.
+	answerKey ed25519.PublicKey
+	// What the last snowflake to connect went through, or nil.
+	lastGood *LastGood
+	// Returns the client token to send, or nil.
+	clientToken func() string
+}
+
+// RetryPolicy controls how a BrokerChannel retries a failed exchange
+// before Negotiate gives up and returns the error.
+type RetryPolicy struct {
+	// How long to wait for an answer before counting the exchange as
+	// failed. Zero leaves it to the timeouts of the transport.
+	Timeout time.Duration
+	// How long to wait before each retry.
+	Backoff Backoff
+	// How many times to retry.
+	Retries int
+}
+
+// SetRetryPolicy sets how failed exchanges are retried. By default they
+// are not.
+func (bc *BrokerChannel) SetRetryPolicy(policy RetryPolicy) {
+	bc.retry = policy
+}
+
+// SetClientToken makes the rendezvous send the broker the client token that
+// token returns, a random identifier the broker can tell this client by
+// across rendezvous for fair matching. A nil token, the default, sends none.
+func (bc *BrokerChannel) SetClientToken(token func() string) {
+	bc.clientToken = token
+}
+
+func (bc *BrokerChannel) token() string {
+	if bc.clientToken == nil {
+		return ""
+	}
+	return bc.clientToken()
+}
+
+// SetProxyPreferences makes the rendezvous tell the broker which proxies we
+// would rather be matched with.
+func (bc *BrokerChannel) SetProxyPreferences(prefs ProxyPreferences) {
+	bc.proxyPreferences = prefs
+}
+
+// RendezvousMethod is a signaling channel to the broker. Exchange sends a
+// serialized SDP offer and returns the serialized SDP answer of the proxy
+// the broker matched us with.
+type RendezvousMethod interface {
+	Exchange(offer []byte) ([]byte, error)
+}
+
+// RendezvousFactory builds a RendezvousMethod for bc. The options are the
+// method-specific settings, keyed like the equivalent SOCKS args.
+type RendezvousFactory func(bc *BrokerChannel, options map[string]string) (RendezvousMethod, error)
+
+var (
+	rendezvousLock    sync.Mutex
+	rendezvousMethods = map[string]RendezvousFactory{
+		"http": func(bc *BrokerChannel, options map[string]string) (RendezvousMethod, error) {
+			return httpRendezvous{bc}, nil
+		},
+		"ampcache": newAMPCacheRendezvous,
+		"sqs":      newSQSRendezvous,
+	}
+)
+
+// RegisterRendezvousMethod makes a signaling channel available under name,
+// so it can be selected with UseRendezvousMethod.
+func RegisterRendezvousMethod(name string, factory RendezvousFactory) {
+	rendezvousLock.Lock()
+	defer rendezvousLock.Unlock()
+	rendezvousMethods[name] = factory
 }
 
-// We make a copy of DefaultTransport because we want the default Dial
-// and TLSHandshakeTimeout settings. But we want to disable the default
-// ProxyFromEnvironment setting.
-func CreateBrokerTransport() http.RoundTripper {
-	transport := http.DefaultTransport.(*http.Transport)
-	transport.Proxy = nil
-	transport.ResponseHeaderTimeout = 15 * time.Second
-	return transport
+// UseRendezvousMethod makes the BrokerChannel exchange offers through the
+// registered method called name.
+func (bc *BrokerChannel) UseRendezvousMethod(name string, options map[string]string) error {
+	r, err := newRendezvousMethod(bc, name, options)
+	if err != nil {
+		return err
+	}
+	bc.SetRendezvousMethod(r)
+	return nil
+}
+
+func newRendezvousMethod(bc *BrokerChannel, name string, options map[string]string) (RendezvousMethod, error) {
+	rendezvousLock.Lock()
+	factory, ok := rendezvousMethods[name]
+	rendezvousLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown rendezvous method %q", name)
+	}
+	return factory(bc, options)
+}
+
+// SetRendezvousMethod makes the BrokerChannel exchange offers through r.
+func (bc *BrokerChannel) SetRendezvousMethod(r RendezvousMethod) {
+	bc.rendezvous = r
 }
 
 // Construct a new BrokerChannel, where:
@@ -76,6 +192,13 @@ func NewBrokerChannel(broker string, front string, transport http.RoundTripper,
 	return bc, nil
 }
 
+// SetAMPCache makes the BrokerChannel rendezvous through the AMP cache at
+// ampCache instead of contacting the broker directly. A front domain given to
+// NewBrokerChannel is then used to front the AMP cache.
+func (bc *BrokerChannel) SetAMPCache(ampCache string) error {
+	return bc.UseRendezvousMethod("ampcache", map[string]string{"ampcache": ampCache})
+}
+
 func limitedRead(r io.Reader, limit int64) ([]byte, error) {
 	p, err := ioutil.ReadAll(&io.LimitedReader{R: r, N: limit + 1})
 	if err != nil {
@@ -92,8 +215,23 @@ func limitedRead(r io.Reader, limit int64) ([]byte, error) {
 // with an SDP answer from a designated remote WebRTC peer.
 func (bc *BrokerChannel) Negotiate(offer *webrtc.SessionDescription) (
 	*webrtc.SessionDescription, error) {
-	log.Println("Negotiating via BrokerChannel...\nTarget URL: ",
-		bc.Host, "\nFront URL:  ", bc.url.Host)
+	return bc.negotiate(context.Background(), "", offer, nil)
+}
+
+// NegotiateContext is Negotiate, giving up on the broker, and on waiting to
+// retry it, once ctx is done.
+func (bc *BrokerChannel) NegotiateContext(ctx context.Context, offer *webrtc.SessionDescription) (
+	*webrtc.SessionDescription, error) {
+	return bc.negotiate(ctx, "", offer, nil)
+}
+
+// negotiate is NegotiateContext for the snowflake id, whose events also go
+// to sink if it is not nil.
+func (bc *BrokerChannel) negotiate(ctx context.Context, id traceID, offer *webrtc.SessionDescription,
+	sink func(Event)) (*webrtc.SessionDescription, error) {
+	id.printf("Negotiating via BrokerChannel...\nTarget URL:  %s\nFront URL:  %s",
+		bc.Host, bc.url.Host)
+	emitTo(sink, EventBrokerContacted, id)
 	// Ideally, we could specify an `RTCIceTransportPolicy` that would handle
 	// this for us.  However, "public" was removed from the draft spec.
 	// See https://developer.mozilla.org/en-US/docs/Web/API/RTCConfiguration#RTCIceTransportPolicy_enum
@@ -107,35 +245,103 @@ func (bc *BrokerChannel) Negotiate(offer *webrtc.SessionDescription) (
 	if err != nil {
 		return nil, err
 	}
-	data := bytes.NewReader([]byte(offerSDP))
+	rendezvous := bc.rendezvous
+	if rendezvous == nil {
+		rendezvous = httpRendezvous{bc}
+	}
+	emitTo(sink, EventOfferSent, id)
+	answer, err := bc.exchange(ctx, rendezvous, []byte(offerSDP))
+	for i := 0; err != nil && ctx.Err() == nil && i < bc.retry.Retries; i++ {
+		wait := bc.retry.Backoff.Delay(i)
+		id.warnf("BrokerChannel: %v, retrying in %v (%d/%d)", err, wait, i+1, bc.retry.Retries)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		answer, err = bc.exchange(ctx, rendezvous, []byte(offerSDP))
+	}
+	if err != nil {
+		return nil, err
+	}
+	id.debugf("Received answer: %s", string(answer))
+	emitTo(sink, EventAnswerReceived, id)
+	return util.DeserializeSessionDescription(string(answer))
+}
+
+// exchange runs a single exchange, giving up after the policy timeout or
+// once ctx is done, and verifies the answer.
+func (bc *BrokerChannel) exchange(ctx context.Context, rendezvous RendezvousMethod, offer []byte) (answer []byte, err error) {
+	start := time.Now()
+	defer func() { metrics.observeRendezvous(time.Since(start), err) }()
+	if bc.retry.Timeout == 0 {
+		answer, err = exchangeContext(ctx, rendezvous, offer)
+	} else {
+		exchangeCtx, cancel := context.WithTimeout(ctx, bc.retry.Timeout)
+		defer cancel()
+		answer, err = exchangeContext(exchangeCtx, rendezvous, offer)
+		if err != nil && ctx.Err() == nil && exchangeCtx.Err() == context.DeadlineExceeded {
+			return nil, errBrokerTimeout
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bc.verifyAnswer(offer, answer)
+}
+
+// httpRendezvous POSTs the offer to the broker, which is the default method.
+type httpRendezvous struct {
+	*BrokerChannel
+}
+
+func (r httpRendezvous) Exchange(offer []byte) ([]byte, error) {
+	return r.ExchangeContext(context.Background(), offer)
+}
+
+func (r httpRendezvous) ExchangeContext(ctx context.Context, offer []byte) ([]byte, error) {
+	data := bytes.NewReader(offer)
 	// Suffix with broker's client registration handler.
-	clientURL := bc.url.ResolveReference(&url.URL{Path: "client"})
-	request, err := http.NewRequest("POST", clientURL.String(), data)
+	clientURL := r.url.ResolveReference(&url.URL{Path: "client"})
+	request, err := http.NewRequestWithContext(ctx, "POST", clientURL.String(), data)
 	if nil != err {
 		return nil, err
 	}
-	if "" != bc.Host { // Set true host if necessary.
-		request.Host = bc.Host
+	if "" != r.Host { // Set true host if necessary.
+		request.Host = r.Host
+	}
+	var front string
+	if r.fronts != nil {
+		front = r.fronts.pick()
+		request.Host = request.URL.Host
+		request.URL.Host = front
 	}
 	// include NAT-TYPE
-	bc.lock.Lock()
-	request.Header.Set("Snowflake-NAT-TYPE", bc.NATType)
-	bc.lock.Unlock()
-	resp, err := bc.transport.RoundTrip(request)
+	request.Header.Set("Snowflake-NAT-TYPE", r.GetNATType())
+	r.proxyPreferences.setHeaders(request.Header)
+	fingerprint := r.bridgeFor(ctx)
+	if fingerprint != "" {
+		request.Header.Set("Snowflake-Bridge-Fingerprint", fingerprint)
+	}
+	if token := r.token(); token != "" {
+		request.Header.Set("Snowflake-Client-Token", token)
+	}
+	resp, err := r.transport.RoundTrip(request)
+	if r.fronts != nil && ctx.Err() == nil {
+		r.fronts.report(front, err)
+	}
 	if nil != err {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	log.Printf("BrokerChannel Response:\n%s\n\n", resp.Status)
+	debugf("BrokerChannel Response:\n%s\n\n", resp.Status)
 
 	switch resp.StatusCode {
 	case http.StatusOK:
-		body, err := limitedRead(resp.Body, readLimit)
-		if nil != err {
+		if err := r.checkBridge(ctx, resp.Header.Get("Snowflake-Bridge-Fingerprint")); err != nil {
 			return nil, err
 		}
-		log.Printf("Received answer: %s", string(body))
-		return util.DeserializeSessionDescription(string(body))
+		return limitedRead(resp.Body, readLimit)
 	case http.StatusServiceUnavailable:
 		return nil, errors.New(BrokerError503)
 	case http.StatusBadRequest:
@@ -145,40 +351,487 @@ func (bc *BrokerChannel) Negotiate(offer *webrtc.SessionDescription) (
 	}
 }
 
+// CheckReachable makes a request to the broker the way the HTTP rendezvous
+// does, and fails only if no HTTP response comes back: any answer shows
+// that HTTPS to the broker works.
+func (bc *BrokerChannel) CheckReachable(ctx context.Context) error {
+	request, err := http.NewRequestWithContext(ctx, "GET", bc.url.String(), nil)
+	if err != nil {
+		return err
+	}
+	if bc.Host != "" {
+		request.Host = bc.Host
+	}
+	if bc.fronts != nil {
+		request.Host = request.URL.Host
+		request.URL.Host = bc.fronts.pick()
+	}
+	resp, err := bc.transport.RoundTrip(request)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
 func (bc *BrokerChannel) SetNATType(NATType string) {
+	bc.setNAT(NATType, NATBehavior{})
+}
+
+// SetNATBehavior sets the NAT type from the behavior b of our NAT, and
+// remembers b for GetNATBehavior.
+func (bc *BrokerChannel) SetNATBehavior(b NATBehavior) {
+	bc.setNAT(b.NATType(), b)
+}
+
+func (bc *BrokerChannel) setNAT(NATType string, b NATBehavior) {
 	bc.lock.Lock()
 	bc.NATType = NATType
+	bc.natBehavior = b
 	bc.lock.Unlock()
+	metrics.setNATType(NATType)
 	log.Printf("NAT Type: %s", NATType)
 }
 
+// GetNATBehavior returns the NAT behavior last set by SetNATBehavior, or
+// the zero NATBehavior if the NAT type was set without it.
+func (bc *BrokerChannel) GetNATBehavior() NATBehavior {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	return bc.natBehavior
+}
+
+func (bc *BrokerChannel) GetNATType() string {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	return bc.NATType
+}
+
 // Implements the |Tongue| interface to catch snowflakes, using BrokerChannel.
 type WebRTCDialer struct {
 	*BrokerChannel
 	webrtcConfig *webrtc.Configuration
 	max          int
+	adaptive     bool // keep fewer than max snowflakes while demand is low
+	bridges      *BridgeBalancer
+	fallback     *WebSocketFallback
+	options      peerOptions
+	ipv6         *ipv6Preference // nil unless IPv6 is preferred
+	udp          *udpPreference  // when only TURN over TCP on port 443 last connected
+	parallel     int             // how many snowflakes Catch dials at once
+	// Picks the ICE servers of each peer, or nil for all of them.
+	selectICEServers func([]webrtc.ICEServer) []webrtc.ICEServer
 }
 
-func NewWebRTCDialer(broker *BrokerChannel, iceServers []webrtc.ICEServer, max int) *WebRTCDialer {
-	config := webrtc.Configuration{
-		ICEServers: iceServers,
+// How long to stop preferring IPv6 after an IPv6 only peer failed to connect.
+const ipv6RetryInterval = 10 * time.Minute
+
+// ipv6Preference remembers when an IPv6 only peer last failed to connect.
+type ipv6Preference struct {
+	lock     sync.Mutex
+	failedAt time.Time
+}
+
+func (p *ipv6Preference) usable() bool {
+	if p == nil {
+		return false
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return time.Since(p.failedAt) > ipv6RetryInterval
+}
+
+func (p *ipv6Preference) failed() {
+	p.lock.Lock()
+	p.failedAt = time.Now()
+	p.lock.Unlock()
+}
+
+// How long to go straight to the TURN servers over TCP on port 443 after a
+// peer only connected through them.
+const udpRetryInterval = 10 * time.Minute
+
+// udpPreference remembers when a peer last only connected through TURN over
+// TCP on port 443.
+type udpPreference struct {
+	lock     sync.Mutex
+	failedAt time.Time
+}
+
+func (p *udpPreference) usable() bool {
+	if p == nil {
+		return true
 	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return time.Since(p.failedAt) > udpRetryInterval
+}
 
-	return &WebRTCDialer{
+func (p *udpPreference) failed() {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	p.failedAt = time.Now()
+	p.lock.Unlock()
+}
+
+// NewWebRTCDialer returns a dialer catching snowflakes through broker. With
+// no options, it uses no ICE servers and keeps a single snowflake at a time.
+func NewWebRTCDialer(broker *BrokerChannel, options ...DialerOption) *WebRTCDialer {
+	w := &WebRTCDialer{
 		BrokerChannel: broker,
-		webrtcConfig:  &config,
-		max:           max,
+		webrtcConfig:  &webrtc.Configuration{},
+		max:           1,
+		udp:           new(udpPreference),
+	}
+	for _, option := range options {
+		option(w)
+	}
+	return w
+}
+
+// NewWebRTCDialerWithProxy is like NewWebRTCDialer, but the ICE agent
+// reaches TCP relay candidates through the given upstream proxy.
+//
+// Deprecated: use NewWebRTCDialer with WithICEServers, WithCapacity and
+// WithProxy.
+func NewWebRTCDialerWithProxy(broker *BrokerChannel, iceServers []webrtc.ICEServer, max int,
+	proxy *url.URL) *WebRTCDialer {
+	return NewWebRTCDialer(broker, WithICEServers(iceServers), WithCapacity(max), WithProxy(proxy))
+}
+
+// A DialerOption configures a WebRTCDialer when it is created.
+type DialerOption func(*WebRTCDialer)
+
+// WithICEServers makes the peers gather candidates with the STUN and TURN
+// servers.
+func WithICEServers(servers []webrtc.ICEServer) DialerOption {
+	return func(w *WebRTCDialer) {
+		w.webrtcConfig.ICEServers = servers
+	}
+}
+
+// WithCapacity sets how many snowflakes a session keeps at once.
+func WithCapacity(max int) DialerOption {
+	return func(w *WebRTCDialer) {
+		w.max = max
+	}
+}
+
+// WithSettingEngine makes the peers start from a copy of s, for the pion
+// settings the dialer does not otherwise expose. The settings of the dialer,
+// such as the proxy and the UDP port range, are applied on top of it.
+func WithSettingEngine(s webrtc.SettingEngine) DialerOption {
+	return func(w *WebRTCDialer) {
+		w.options.settingEngine = &s
+	}
+}
+
+// WithEventSink makes sink receive the events of the snowflakes of the
+// dialer, besides the subscribers of SubscribeEvents. It is called from the
+// goroutines catching and running the snowflakes, and must not block.
+func WithEventSink(sink func(Event)) DialerOption {
+	return func(w *WebRTCDialer) {
+		w.options.events = sink
+	}
+}
+
+// WithTuning makes the sessions over the snowflakes of the dialer tuned as t
+// says, rather than as the process-wide settings.
+func WithTuning(t *Tuning) DialerOption {
+	return func(w *WebRTCDialer) {
+		w.options.tuning = t
+	}
+}
+
+// WithPeerGroup keeps the connected snowflakes of the dialer in g too, for
+// them to be closed with those of the other dialers of the client.
+func WithPeerGroup(g *PeerGroup) DialerOption {
+	return func(w *WebRTCDialer) {
+		w.options.group = g
+	}
+}
+
+// WithProxy makes the ICE agent reach TCP relay candidates through the
+// upstream proxy, if it is not nil. UDP candidates can not be proxied and
+// are still gathered directly.
+func WithProxy(proxy *url.URL) DialerOption {
+	return func(w *WebRTCDialer) {
+		w.options.proxy = proxy
 	}
 }
 
+// Tuning returns how the sessions over the snowflakes of the dialer are
+// tuned, or nil for the process-wide settings.
+func (w *WebRTCDialer) Tuning() *Tuning {
+	return w.options.tuning
+}
+
+// SetICEServerSelector makes the dialer offer each peer the ICE servers that
+// selector picks out of those of the dialer, rather than all of them.
+// selector is called from the goroutines catching snowflakes.
+func (w *WebRTCDialer) SetICEServerSelector(selector func([]webrtc.ICEServer) []webrtc.ICEServer) {
+	w.selectICEServers = selector
+}
+
+// SetUDPPortRange makes the peers of this dialer bind their ICE UDP sockets
+// to ports between min and max, inclusive. Zero for both means any port.
+func (w *WebRTCDialer) SetUDPPortRange(min, max uint16) error {
+	if max < min {
+		return fmt.Errorf("invalid UDP port range %d-%d", min, max)
+	}
+	w.options.portMin = min
+	w.options.portMax = max
+	return nil
+}
+
+// SetInterface makes the peers of this dialer gather host candidates on the
+// network interface name only, or on all interfaces if it is empty. The
+// sockets pion opens for server reflexive and relay candidates can not be
+// bound to an interface, and still send through the routing table.
+func (w *WebRTCDialer) SetInterface(name string) error {
+	if name != "" {
+		if _, err := net.InterfaceByName(name); err != nil {
+			return err
+		}
+	}
+	w.options.iface = name
+	return nil
+}
+
 // Initialize a WebRTC Connection by signaling through the broker.
 func (w WebRTCDialer) Catch() (*WebRTCPeer, error) {
+	return w.CatchContext(context.Background())
+}
+
+// CatchContext is Catch, giving up on the broker and on ICE once ctx is
+// done.
+func (w WebRTCDialer) CatchContext(ctx context.Context) (*WebRTCPeer, error) {
+	if w.parallel > 1 {
+		return catchFirst(ctx, w.parallel, w.catchOne)
+	}
+	return w.catchOne(ctx)
+}
+
+// catchFirst runs n catches at once and returns the first snowflake to
+// connect. The others are cancelled, and closed if they connect anyway. If
+// all of them fail, the first error is returned.
+func catchFirst(ctx context.Context, n int, catch func(context.Context) (*WebRTCPeer, error)) (*WebRTCPeer, error) {
+	type result struct {
+		peer *WebRTCPeer
+		err  error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	results := make(chan result, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			peer, err := catch(ctx)
+			results <- result{peer, err}
+		}()
+	}
+	var firstErr error
+	for i := 0; i < n; i++ {
+		r := <-results
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			continue
+		}
+		cancel()
+		go func(remaining int) {
+			for ; remaining > 0; remaining-- {
+				if r := <-results; r.peer != nil {
+					r.peer.trace.debugf("WebRTC: Closing a snowflake that lost the race")
+					r.peer.Close()
+				}
+			}
+		}(n - i - 1)
+		return r.peer, nil
+	}
+	cancel()
+	return nil, firstErr
+}
+
+func (w WebRTCDialer) catchOne(ctx context.Context) (*WebRTCPeer, error) {
 	// TODO: [#25591] Fetch ICE server information from Broker.
 	// TODO: [#25596] Consider TURN servers here too.
-	return NewWebRTCPeer(w.webrtcConfig, w.BrokerChannel)
+	config := w.peerConfig()
+	relayConfig := w.tcpRelayConfig()
+	if relayConfig != nil && !w.udp.usable() {
+		return newWebRTCPeer(ctx, relayConfig, w.BrokerChannel, w.options)
+	}
+	if w.ipv6.usable() {
+		options := w.options
+		options.networkTypes = []webrtc.NetworkType{webrtc.NetworkTypeUDP6}
+		peer, err := newWebRTCPeer(ctx, config, w.BrokerChannel, options)
+		if err != errDataChannelTimeout {
+			return peer, err
+		}
+		warnf("WebRTC: IPv6 only connection failed, using IPv4 as well for %v",
+			ipv6RetryInterval)
+		w.ipv6.failed()
+	}
+	peer, err := newWebRTCPeer(ctx, config, w.BrokerChannel, w.options)
+	if err != errDataChannelTimeout || relayConfig == nil {
+		return peer, err
+	}
+	// Networks that only let HTTPS out block UDP, and TURN on other ports.
+	warnf("WebRTC: Connection failed, retrying through TURN over TCP on port 443")
+	peer, err = newWebRTCPeer(ctx, relayConfig, w.BrokerChannel, w.options)
+	if err == nil {
+		warnf("WebRTC: Only TURN over TCP on port 443 connected, using it alone for %v", udpRetryInterval)
+		w.udp.failed()
+	}
+	return peer, err
+}
+
+// tcpRelayConfig returns the configuration for a peer only relayed through
+// the TURN servers of the dialer reached over TCP on port 443, or nil if
+// there are none.
+func (w WebRTCDialer) tcpRelayConfig() *webrtc.Configuration {
+	relays := tcp443Relays(w.webrtcConfig.ICEServers)
+	if len(relays) == 0 {
+		return nil
+	}
+	config := *w.webrtcConfig
+	config.ICEServers = relays
+	config.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	return &config
+}
+
+// peerConfig returns the configuration for the next peer, with the ICE
+// servers the selector of the dialer picks. With ICEPolicyAuto, it only
+// allows TURN relays while our NAT is known to need them and any were
+// picked.
+func (w WebRTCDialer) peerConfig() *webrtc.Configuration {
+	config := *w.webrtcConfig
+	if w.selectICEServers != nil {
+		config.ICEServers = w.selectICEServers(config.ICEServers)
+	}
+	if w.options.icePolicy != ICEPolicyAuto || !w.GetNATBehavior().needsRelay() {
+		return &config
+	}
+	for _, server := range config.ICEServers {
+		for _, u := range server.URLs {
+			if strings.HasPrefix(u, "turn:") || strings.HasPrefix(u, "turns:") {
+				config.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+				return &config
+			}
+		}
+	}
+	return &config
+}
+
+// SetDataChannelReliability sets the reliability of the DataChannel of the
+// peers of this dialer.
+func (w *WebRTCDialer) SetDataChannelReliability(r DataChannelReliability) error {
+	if r.MaxRetransmits != nil && r.MaxPacketLifeTime != nil {
+		return errors.New("only one of MaxRetransmits and MaxPacketLifeTime can be set")
+	}
+	w.options.reliability = r
+	return nil
+}
+
+// SetSCTPOptions sets the send buffer and message size of the peers of this
+// dialer.
+func (w *WebRTCDialer) SetSCTPOptions(options SCTPOptions) error {
+	if options.SendBufferSize < 0 || options.MaxMessageSize < 0 {
+		return errors.New("SCTP buffer and message sizes can not be negative")
+	}
+	w.options.sctp = options
+	return nil
+}
+
+// SetStatsInterval makes the peers of this dialer log a summary of their
+// WebRTC stats every interval. Zero turns it off.
+func (w *WebRTCDialer) SetStatsInterval(interval time.Duration) {
+	w.options.statsInterval = interval
+}
+
+// SetIdleTimeout makes the peers of this dialer close themselves, to be
+// replaced, when they receive nothing for timeout. Zero means
+// SnowflakeTimeout. Sessions send a heartbeat every KeepAliveInterval, which
+// the bridge answers, so timeout should be a few times longer than that.
+func (w *WebRTCDialer) SetIdleTimeout(timeout time.Duration) {
+	w.options.idleTimeout = timeout
+}
+
+// SetQualityThresholds makes the peers of this dialer be replaced when
+// their quality falls below t.
+func (w *WebRTCDialer) SetQualityThresholds(t QualityThresholds) {
+	w.options.quality = t
+}
+
+// SetParallelDials makes Catch dial n snowflakes at once and keep the first
+// to connect, which hides proxies that the broker hands out but that turn
+// out to be unreachable.
+func (w *WebRTCDialer) SetParallelDials(n int) {
+	w.parallel = n
+}
+
+// SetPreferIPv6 makes the dialer try to connect to proxies over IPv6 only,
+// falling back to gathering IPv4 candidates too when that fails.
+func (w *WebRTCDialer) SetPreferIPv6(prefer bool) {
+	if prefer {
+		w.ipv6 = new(ipv6Preference)
+	} else {
+		w.ipv6 = nil
+	}
+}
+
+// SetICEPolicy sets which ICE candidates the peers of this dialer gather
+// and offer.
+func (w *WebRTCDialer) SetICEPolicy(policy ICEPolicy) {
+	w.options.icePolicy = policy
+	if policy == ICEPolicyRelay {
+		w.webrtcConfig.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	} else {
+		w.webrtcConfig.ICETransportPolicy = webrtc.ICETransportPolicyAll
+	}
+}
+
+// SetAdaptiveCapacity makes the capacity of the dialer a ceiling: sessions
+// keep a single snowflake for light use, and more, up to the capacity, as
+// SOCKS connections open and traffic grows.
+func (w *WebRTCDialer) SetAdaptiveCapacity(adaptive bool) {
+	w.adaptive = adaptive
+}
+
+// SetBridges makes the sessions catching snowflakes with the dialer spread
+// over the bridges of balancer, rather than all asking the broker for the
+// bridge set with SetBridgeFingerprint. nil for a single bridge.
+func (w *WebRTCDialer) SetBridges(balancer *BridgeBalancer) {
+	w.bridges = balancer
+}
+
+// Bridges returns the balancer set with SetBridges.
+func (w WebRTCDialer) Bridges() *BridgeBalancer {
+	return w.bridges
+}
+
+// SetWebSocketFallback makes the sessions catching snowflakes with the
+// dialer connect to the bridge over WebSocket as fallback says, once WebRTC
+// keeps failing. nil not to.
+func (w *WebRTCDialer) SetWebSocketFallback(fallback *WebSocketFallback) {
+	w.fallback = fallback
+}
+
+// WebSocketFallback returns the fallback set with SetWebSocketFallback.
+func (w WebRTCDialer) WebSocketFallback() *WebSocketFallback {
+	return w.fallback
 }
 
 // Returns the maximum number of snowflakes to collect
 func (w WebRTCDialer) GetMax() int {
+	if w.adaptive {
+		return demand.capacity(w.max)
+	}
+	return w.max
+}
+
+// GetCeiling returns the most snowflakes GetMax may return.
+func (w WebRTCDialer) GetCeiling() int {
 	return w.max
 }
@@ -0,0 +1,71 @@
+package lib
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// How long a retiring snowflake keeps carrying its session while a
+// replacement is caught, before it is closed anyway.
+const replacementTimeout = 30 * time.Second
+
+// SetLifetime makes the peers of this dialer be replaced once they have been
+// connected for lifetime, before the proxy is likely to go away: volunteer
+// proxies close when their browser does, or after a while of their own.
+// Zero keeps peers for as long as they work.
+func (w *WebRTCDialer) SetLifetime(lifetime time.Duration) {
+	w.options.lifetime = lifetime
+}
+
+// retire marks the peer to be replaced, for reason. The Peers it belongs to
+// catches another snowflake beyond its capacity, and closes this one once it
+// has, so that the session moves over without waiting for a rendezvous. If
+// no replacement comes in replacementTimeout, the peer is closed anyway.
+func (c *WebRTCPeer) retire(reason string) {
+	if !atomic.CompareAndSwapInt32(&c.retiring, 0, 1) {
+		return
+	}
+	c.trace.printf("WebRTC: Replacing snowflake: %s", reason)
+	time.AfterFunc(replacementTimeout, func() {
+		if !c.closed {
+			c.trace.printf("WebRTC: No replacement in %v, closing the snowflake", replacementTimeout)
+			c.Close()
+		}
+	})
+}
+
+// isRetiring tells whether the peer is to be replaced.
+func (c *WebRTCPeer) isRetiring() bool {
+	return atomic.LoadInt32(&c.retiring) != 0
+}
+
+// retireAfter retires the peer once it has been connected for lifetime.
+func (c *WebRTCPeer) retireAfter(lifetime time.Duration) {
+	time.AfterFunc(lifetime, func() {
+		if !c.closed {
+			c.retire("lifetime of " + lifetime.String() + " reached")
+		}
+	})
+}
+
+// retiring tells whether any of the snowflakes is to be replaced.
+func (p *Peers) retiring() bool {
+	for e := p.activePeers.Front(); e != nil; e = e.Next() {
+		if e.Value.(*WebRTCPeer).isRetiring() {
+			return true
+		}
+	}
+	return false
+}
+
+// replaceRetiring closes the oldest of the snowflakes to be replaced, now
+// that a replacement is waiting to be popped.
+func (p *Peers) replaceRetiring() {
+	for e := p.activePeers.Front(); e != nil; e = e.Next() {
+		if peer := e.Value.(*WebRTCPeer); peer.isRetiring() && !peer.closed {
+			peer.trace.printf("WebRTC: Handing over to the replacement snowflake")
+			peer.Close()
+			return
+		}
+	}
+}
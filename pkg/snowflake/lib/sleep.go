@@ -0,0 +1,50 @@
+package lib
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// How often to check whether the system has been asleep.
+	sleepCheckInterval = 5 * time.Second
+	// How long the system must have been asleep for it to matter.
+	sleepThreshold = 10 * time.Second
+)
+
+// WatchSleep calls onResume when the system resumes from suspend, until stop
+// is closed.
+//
+// Rather than subscribing to the power events of each system (logind, IOKit,
+// WM_POWERBROADCAST), it compares the wall clock to the monotonic clock of
+// the Go runtime, which stands still while the system is suspended on Linux,
+// macOS and Windows alike. The resume is noticed at most sleepCheckInterval
+// late.
+func WatchSleep(stop <-chan struct{}, onResume func(slept time.Duration)) {
+	ticker := time.NewTicker(sleepCheckInterval)
+	defer ticker.Stop()
+	prev := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		slept := timeAsleep(now.Round(0).Sub(prev.Round(0)), now.Sub(prev))
+		prev = now
+		if slept > sleepThreshold {
+			log.Printf("Resumed after sleeping for about %v", slept.Round(time.Second))
+			onResume(slept)
+		}
+	}
+}
+
+// timeAsleep is how much of the wall clock time elapsed was missed by the
+// monotonic clock.
+func timeAsleep(wall, monotonic time.Duration) time.Duration {
+	if wall < monotonic {
+		return 0
+	}
+	return wall - monotonic
+}
@@ -3,9 +3,10 @@ package lib
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
-	"log"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"git.torproject.org/pluggable-transports/snowflake.git/common/turbotunnel"
@@ -20,6 +21,61 @@ const (
 	DataChannelTimeout = 10 * time.Second
 )
 
+// KeepAliveInterval is how often a session sends a heartbeat through its
+// current snowflake. The heartbeat is an smux NOP frame; the bridge
+// acknowledges it at the KCP layer, so a snowflake that still carries
+// traffic always receives something in time for its idle timeout, even
+// when the session is idle.
+var KeepAliveInterval = 10 * time.Second
+
+// KCPSettings tune the KCP layer that makes the session reliable over the
+// successive snowflakes. Forward error correction is not among them: the
+// bridge uses none, and both ends must agree on it.
+type KCPSettings struct {
+	SendWindow    int           // packets in flight towards the bridge
+	ReceiveWindow int           // packets the bridge may have in flight to us
+	NoDelay       bool          // retransmit sooner, with a lower minimum timeout, for interactivity
+	Interval      time.Duration // how often KCP flushes, from 10ms to 5s
+	FastResend    int           // retransmit a packet once this many later ones are acknowledged, 0 only on timeout
+	Congestion    bool          // limit sending with a congestion window as well as with SendWindow
+}
+
+// KCP are the KCP settings of new sessions. The defaults favor throughput:
+// large windows, not limited by congestion control, which the underlying
+// DataChannel already does.
+var KCP = KCPSettings{
+	SendWindow:    65535,
+	ReceiveWindow: 65535,
+	Interval:      10 * time.Millisecond,
+}
+
+// Check tells whether s can be used.
+func (s KCPSettings) Check() error {
+	if s.SendWindow <= 0 || s.ReceiveWindow <= 0 {
+		return errors.New("KCP windows must be positive")
+	}
+	if s.Interval < 10*time.Millisecond || s.Interval > 5*time.Second {
+		return fmt.Errorf("KCP interval %v is not from 10ms to 5s", s.Interval)
+	}
+	if s.FastResend < 0 {
+		return errors.New("KCP fast resend cannot be negative")
+	}
+	return nil
+}
+
+// apply sets the settings on conn.
+func (s KCPSettings) apply(conn *kcp.UDPSession) {
+	conn.SetWindowSize(s.SendWindow, s.ReceiveWindow)
+	nodelay, nc := 0, 1
+	if s.NoDelay {
+		nodelay = 1
+	}
+	if s.Congestion {
+		nc = 0
+	}
+	conn.SetNoDelay(nodelay, int(s.Interval/time.Millisecond), s.FastResend, nc)
+}
+
 type dummyAddr struct{}
 
 func (addr dummyAddr) Network() string { return "dummy" }
@@ -27,8 +83,16 @@ func (addr dummyAddr) String() string  { return "dummy" }
 
 // newSession returns a new smux.Session and the net.PacketConn it is running
 // over. The net.PacketConn successively connects through Snowflake proxies
-// pulled from snowflakes.
-func newSession(snowflakes SnowflakeCollector) (net.PacketConn, *smux.Session, error) {
+// pulled from snowflakes, or directly to the bridge over WebSocket when they
+// fall back to it. The session is tuned as the Tongue of snowflakes says.
+func newSession(snowflakes *Peers) (net.PacketConn, *smux.Session, error) {
+	return newSessionOver(snowflakes.popConn, tuningOf(snowflakes.Tongue))
+}
+
+// newSessionOver is newSession with the snowflakes supplied by pop, which
+// blocks until one is available and returns nil when there will be no more,
+// and tuned as tuning says.
+func newSessionOver(pop func() io.ReadWriteCloser, tuning *Tuning) (net.PacketConn, *smux.Session, error) {
 	clientID := turbotunnel.NewClientID()
 
 	// We build a persistent KCP session on a sequence of ephemeral WebRTC
@@ -36,25 +100,46 @@ func newSession(snowflakes SnowflakeCollector) (net.PacketConn, *smux.Session, e
 	// WebRTC connection when the previous one dies. Inside each WebRTC
 	// connection, we use EncapsulationPacketConn to encode packets into a
 	// stream.
+	//
+	// RedialPacketConn closes for good as soon as dialContext fails, taking
+	// every stream of the session with it. So a snowflake that dies before
+	// the session has moved to it is skipped, and dialContext only fails
+	// once there are no snowflakes left.
+	var session atomic.Value // *kcp.UDPSession, once it is made
+	kcpSession := func() *kcp.UDPSession {
+		conn, _ := session.Load().(*kcp.UDPSession)
+		return conn
+	}
 	dialContext := func(ctx context.Context) (net.PacketConn, error) {
-		log.Printf("redialing on same connection")
-		// Obtain an available WebRTC remote. May block.
-		conn := snowflakes.Pop()
-		if conn == nil {
-			return nil, errors.New("handler: Received invalid Snowflake")
-		}
-		log.Println("---- Handler: snowflake assigned ----")
-		// Send the magic Turbo Tunnel token.
-		_, err := conn.Write(turbotunnel.Token[:])
-		if err != nil {
-			return nil, err
-		}
-		// Send ClientID prefix.
-		_, err = conn.Write(clientID[:])
-		if err != nil {
-			return nil, err
+		for {
+			debugf("redialing on same connection")
+			// Obtain an available WebRTC remote. May block.
+			conn := pop()
+			if conn == nil {
+				return nil, errors.New("handler: Received invalid Snowflake")
+			}
+			if err := ctx.Err(); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			var id traceID
+			if peer, ok := conn.(*WebRTCPeer); ok {
+				id = peer.trace
+				go peer.measurePath(kcpSession)
+			}
+			id.printf("---- Handler: snowflake assigned ----")
+			// Send the magic Turbo Tunnel token and the ClientID prefix.
+			_, err := conn.Write(turbotunnel.Token[:])
+			if err == nil {
+				_, err = conn.Write(clientID[:])
+			}
+			if err != nil {
+				id.warnf("WebRTC: snowflake died before the session moved to it: %v", err)
+				conn.Close()
+				continue
+			}
+			return newEncapsulationPacketConn(dummyAddr{}, dummyAddr{}, conn, tuning.padding()), nil
 		}
-		return NewEncapsulationPacketConn(dummyAddr{}, dummyAddr{}, conn), nil
 	}
 	pconn := turbotunnel.NewRedialPacketConn(dummyAddr{}, dummyAddr{}, dialContext)
 
@@ -67,22 +152,17 @@ func newSession(snowflakes SnowflakeCollector) (net.PacketConn, *smux.Session, e
 		pconn.Close()
 		return nil, nil, err
 	}
+	session.Store(conn)
 	// Permit coalescing the payloads of consecutive sends.
 	conn.SetStreamMode(true)
-	// Set the maximum send and receive window sizes to a high number
-	// Removes KCP bottlenecks: https://gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/-/issues/40026
-	conn.SetWindowSize(65535, 65535)
-	// Disable the dynamic congestion window (limit only by the
-	// maximum of local and remote static windows).
-	conn.SetNoDelay(
-		0, // default nodelay
-		0, // default interval
-		0, // default resend
-		1, // nc=1 => congestion window off
-	)
+	// By default, the maximum send and receive window sizes are high and
+	// the dynamic congestion window is off, which removes KCP bottlenecks:
+	// https://gitlab.torproject.org/tpo/anti-censorship/pluggable-transports/snowflake/-/issues/40026
+	tuning.kcp().apply(conn)
 	// On the KCP connection we overlay an smux session and stream.
 	smuxConfig := smux.DefaultConfig()
 	smuxConfig.Version = 2
+	smuxConfig.KeepAliveInterval = tuning.keepAlive()
 	smuxConfig.KeepAliveTimeout = 10 * time.Minute
 	sess, err := smux.Client(conn, smuxConfig)
 	if err != nil {
@@ -97,20 +177,38 @@ func newSession(snowflakes SnowflakeCollector) (net.PacketConn, *smux.Session, e
 // Given an accepted SOCKS connection, establish a WebRTC connection to the
 // remote peer and exchange traffic.
 func Handler(socks net.Conn, tongue Tongue) error {
+	return HandlerContext(context.Background(), socks, tongue)
+}
+
+// HandlerContext is Handler until ctx is done. Then it gives up on catching
+// snowflakes, cancelling the rendezvous in progress, and closes socks.
+func HandlerContext(ctx context.Context, socks net.Conn, tongue Tongue) error {
+	id := connTraceID(socks)
 	// Prepare to collect remote WebRTC peers.
-	snowflakes, err := NewPeers(tongue)
+	snowflakes, err := NewPeersContext(ctx, tongue)
 	if err != nil {
 		return err
 	}
+	snowflakes.trace = id
 
 	// Use a real logger to periodically output how much traffic is happening.
 	snowflakes.BytesLogger = NewBytesSyncLogger()
 
-	log.Printf("---- Handler: begin collecting snowflakes ---")
-	go connectLoop(snowflakes)
+	id.printf("---- Handler: begin collecting snowflakes ---")
+	first := newFirstCatch()
+	tuning := tuningOf(tongue)
+	go connectLoop(snowflakes, first, tuning.redialBackoff())
+	if socks, ok := socksConnector(socks); ok {
+		if err := replySocks(ctx, id, socks, first); err != nil {
+			snowflakes.End()
+			return err
+		}
+	}
+	stop := closeOnDone(ctx, socks)
+	defer stop()
 
 	// Create a new smux session
-	log.Printf("---- Handler: starting a new session ---")
+	id.printf("---- Handler: starting a new session ---")
 	pconn, sess, err := newSession(snowflakes)
 	if err != nil {
 		return err
@@ -124,31 +222,43 @@ func Handler(socks net.Conn, tongue Tongue) error {
 	defer stream.Close()
 
 	// Begin exchanging data.
-	log.Printf("---- Handler: begin stream %v ---", stream.ID())
-	copyLoop(socks, stream)
-	log.Printf("---- Handler: closed stream %v ---", stream.ID())
+	id.printf("---- Handler: begin stream %v ---", stream.ID())
+	traffic := copyLoop(id, socks, stream, tuning)
+	id.printf("---- Handler: closed stream %v: %v ---", stream.ID(), traffic)
 	snowflakes.End()
-	log.Printf("---- Handler: end collecting snowflakes ---")
+	id.printf("---- Handler: end collecting snowflakes ---")
 	pconn.Close()
 	sess.Close()
-	log.Printf("---- Handler: discarding finished session ---")
+	id.printf("---- Handler: discarding finished session ---")
 	return nil
 }
 
 // Maintain |SnowflakeCapacity| number of available WebRTC connections, to
-// transfer to the Tor SOCKS handler when needed.
-func connectLoop(snowflakes SnowflakeCollector) {
+// transfer to the Tor SOCKS handler when needed. After a failure to catch a
+// snowflake, wait as long as backoff says before the next attempt.
+// The outcome of the first attempt is set in first, if not nil.
+func connectLoop(snowflakes SnowflakeCollector, first *firstCatch, backoff Backoff) {
+	failures := 0
 	for {
 		timer := time.After(ReconnectTimeout)
 		_, err := snowflakes.Collect()
-		if err != nil {
-			log.Printf("WebRTC: %v  Retrying...", err)
+		if first != nil {
+			first.set(err)
+			first = nil
+		}
+		if err != nil && !errors.Is(err, errAtCapacity) {
+			wait := backoff.Delay(failures)
+			failures++
+			warnf("WebRTC: %v  Retrying in %v...", err, wait)
+			timer = time.After(wait)
+		} else {
+			failures = 0
 		}
 		select {
 		case <-timer:
 			continue
 		case <-snowflakes.Melted():
-			log.Println("ConnectLoop: stopped.")
+			debugf("ConnectLoop: stopped.")
 			return
 		}
 	}
@@ -156,20 +266,41 @@ func connectLoop(snowflakes SnowflakeCollector) {
 
 // Exchanges bytes between two ReadWriters.
 // (In this case, between a SOCKS connection and smux stream.)
-func copyLoop(socks, stream io.ReadWriter) {
+// Returns how many bytes were copied each way, which ConnTraffic also
+// reports while the copy is going on. The copy is held to the rate limits of
+// tuning.
+func copyLoop(id traceID, socks, stream io.ReadWriter, tuning *Tuning) Traffic {
+	upLimit, downLimit := tuning.limits()
+	t := trackConn(id)
+	defer untrackConn(t)
 	done := make(chan struct{}, 2)
 	go func() {
-		if _, err := io.Copy(socks, stream); err != nil {
-			log.Printf("copying WebRTC to SOCKS resulted in error: %v", err)
+		if _, err := io.Copy(limitWriter(countingWriter{socks, &t.down, &metrics.bytesDown}, downLimit), stream); err != nil {
+			id.printf("copying WebRTC to SOCKS resulted in error: %v", err)
 		}
 		done <- struct{}{}
 	}()
 	go func() {
-		if _, err := io.Copy(stream, socks); err != nil {
-			log.Printf("copying SOCKS to stream resulted in error: %v", err)
+		if _, err := io.Copy(limitWriter(countingWriter{stream, &t.up, &metrics.bytesUp}, upLimit), socks); err != nil {
+			id.printf("copying SOCKS to stream resulted in error: %v", err)
 		}
 		done <- struct{}{}
 	}()
 	<-done
-	log.Println("copy loop ended")
+	id.debugf("copy loop ended")
+	return t.snapshot()
+}
+
+// closeOnDone closes c once ctx is done, until the returned function is
+// called.
+func closeOnDone(ctx context.Context, c io.Closer) (stop func()) {
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-stopped:
+		}
+	}()
+	return func() { close(stopped) }
 }
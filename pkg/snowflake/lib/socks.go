@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	pt "git.torproject.org/pluggable-transports/goptlib.git"
+)
+
+// socksConnector returns the SocksConnector conn is, or was tagged from with
+// TraceConn. Handlers reply to such a connection themselves, once they know
+// whether a snowflake can carry it.
+func socksConnector(conn net.Conn) (SocksConnector, bool) {
+	if c, ok := conn.(tracedConn); ok {
+		conn = c.Conn
+	}
+	socks, ok := conn.(SocksConnector)
+	return socks, ok
+}
+
+// socksReply returns the SOCKS5 reply code telling tor why no snowflake could
+// be caught: a broker or proxy that did not answer in time, a network that
+// could not reach the broker, or a broker without proxies to give.
+func socksReply(err error) byte {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errBrokerTimeout),
+		errors.Is(err, errDataChannelTimeout),
+		errors.Is(err, context.DeadlineExceeded):
+		return pt.SocksRepTTLExpired
+	case errors.As(err, &netErr):
+		if netErr.Timeout() {
+			return pt.SocksRepTTLExpired
+		}
+		return pt.SocksRepNetworkUnreachable
+	case strings.Contains(err.Error(), BrokerError503):
+		return pt.SocksRepHostUnreachable
+	}
+	return pt.SocksRepGeneralFailure
+}
+
+// replySocks grants socks once the first attempt to catch a snowflake
+// succeeds, and otherwise rejects it with the reason for the failure, or
+// ctx being done.
+func replySocks(ctx context.Context, id traceID, socks SocksConnector, first *firstCatch) error {
+	if err := first.wait(ctx); err != nil {
+		reason := socksReply(err)
+		id.printf("SOCKS: rejecting with reply %d: %v", reason, err)
+		socks.RejectReason(reason)
+		return err
+	}
+	if err := socks.Grant(&net.TCPAddr{IP: net.IPv4zero, Port: 0}); err != nil {
+		return err
+	}
+	id.printf("SOCKS granted")
+	return nil
+}
+
+// firstCatch is the outcome of the first attempt of a connectLoop to catch a
+// snowflake, which the SOCKS replies wait for.
+type firstCatch struct {
+	done chan struct{}
+	err  error
+}
+
+func newFirstCatch() *firstCatch {
+	return &firstCatch{done: make(chan struct{})}
+}
+
+func (f *firstCatch) set(err error) {
+	f.err = err
+	close(f.done)
+}
+
+// wait blocks until the first attempt ended, and returns its error, or
+// until ctx is done.
+func (f *firstCatch) wait(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,278 @@
+// SQS rendezvous.
+//
+// The client posts its poll request to an Amazon SQS queue the broker
+// consumes, tagged with a random client ID. The broker answers on a queue
+// named after that ID, which the client long-polls for the answer. Requests
+// use the SQS query API, signed with AWS Signature Version 4.
+
+package lib
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	sqsAPIVersion = "2012-11-05"
+	// How many times to look for the response queue, one second apart,
+	// before giving up on the broker.
+	sqsQueueRetries = 10
+	// How many long polls of the response queue to do.
+	sqsReceiveRetries = 3
+	// Must stay below the ResponseHeaderTimeout of the broker transport.
+	sqsWaitTimeSeconds = 10
+)
+
+// sqsCreds are the AWS credentials used to sign SQS requests. They are
+// given to the client base64-encoded, as in upstream Snowflake bridge lines.
+type sqsCreds struct {
+	AccessKeyID string `json:"aws-access-key-id"`
+	SecretKey   string `json:"aws-secret-key"`
+}
+
+func parseSQSCreds(encoded string) (sqsCreds, error) {
+	var creds sqsCreds
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return creds, fmt.Errorf("decoding SQS credentials: %v", err)
+	}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return creds, fmt.Errorf("decoding SQS credentials: %v", err)
+	}
+	if creds.AccessKeyID == "" || creds.SecretKey == "" {
+		return creds, errors.New("incomplete SQS credentials")
+	}
+	return creds, nil
+}
+
+// sqsRendezvous exchanges offers and answers through Amazon SQS.
+type sqsRendezvous struct {
+	*BrokerChannel
+	queueURL *url.URL
+	region   string
+	creds    sqsCreds
+}
+
+// SetSQSQueue makes the BrokerChannel rendezvous through the SQS queue at
+// queueURL, using the base64-encoded JSON credentials in creds.
+func (bc *BrokerChannel) SetSQSQueue(queueURL string, creds string) error {
+	return bc.UseRendezvousMethod("sqs", map[string]string{
+		"sqsqueue": queueURL,
+		"sqscreds": creds,
+	})
+}
+
+// newSQSRendezvous reads the queue URL and credentials from the "sqsqueue"
+// and "sqscreds" options.
+func newSQSRendezvous(bc *BrokerChannel, options map[string]string) (RendezvousMethod, error) {
+	queueURL := options["sqsqueue"]
+	u, err := url.Parse(queueURL)
+	if err != nil {
+		return nil, err
+	}
+	// Queue URLs look like https://sqs.us-east-1.amazonaws.com/123/queue
+	labels := strings.Split(u.Hostname(), ".")
+	if len(labels) < 3 || labels[0] != "sqs" {
+		return nil, fmt.Errorf("can not find the AWS region in %s", queueURL)
+	}
+	c, err := parseSQSCreds(options["sqscreds"])
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Through SQS queue at:", queueURL)
+	return &sqsRendezvous{
+		BrokerChannel: bc,
+		queueURL:      u,
+		region:        labels[1],
+		creds:         c,
+	}, nil
+}
+
+func (r *sqsRendezvous) Exchange(offer []byte) ([]byte, error) {
+	return r.ExchangeContext(context.Background(), offer)
+}
+
+func (r *sqsRendezvous) ExchangeContext(ctx context.Context, offer []byte) ([]byte, error) {
+	body, err := encodeClientPollRequest(offer, r.GetNATType(), r.proxyPreferences, r.bridgeFor(ctx), r.token())
+	if err != nil {
+		return nil, err
+	}
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	clientID := hex.EncodeToString(id[:])
+
+	_, err = r.call(ctx, r.queueURL, url.Values{
+		"Action":                               {"SendMessage"},
+		"MessageBody":                          {string(body)},
+		"MessageAttribute.1.Name":              {"ClientID"},
+		"MessageAttribute.1.Value.DataType":    {"String"},
+		"MessageAttribute.1.Value.StringValue": {clientID},
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Println("SQS: offer sent, waiting for the answer queue")
+
+	responseQueue, err := r.waitForQueue(ctx, "snowflake-client-"+clientID)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < sqsReceiveRetries; i++ {
+		data, err := r.call(ctx, responseQueue, url.Values{
+			"Action":              {"ReceiveMessage"},
+			"MaxNumberOfMessages": {"1"},
+			"WaitTimeSeconds":     {fmt.Sprint(sqsWaitTimeSeconds)},
+		})
+		if err != nil {
+			return nil, err
+		}
+		var resp struct {
+			Bodies []string `xml:"ReceiveMessageResult>Message>Body"`
+		}
+		if err := xml.Unmarshal(data, &resp); err != nil {
+			return nil, err
+		}
+		if len(resp.Bodies) > 0 {
+			answer, bridge, err := decodeClientPollResponse([]byte(resp.Bodies[0]))
+			if err != nil {
+				return nil, err
+			}
+			if err := r.checkBridge(ctx, bridge); err != nil {
+				return nil, err
+			}
+			return answer, nil
+		}
+	}
+	return nil, errors.New(BrokerError503)
+}
+
+// waitForQueue returns the URL of the named queue once the broker has
+// created it.
+func (r *sqsRendezvous) waitForQueue(ctx context.Context, name string) (*url.URL, error) {
+	endpoint := &url.URL{Scheme: r.queueURL.Scheme, Host: r.queueURL.Host, Path: "/"}
+	for i := 0; i < sqsQueueRetries; i++ {
+		data, err := r.call(ctx, endpoint, url.Values{
+			"Action":    {"GetQueueUrl"},
+			"QueueName": {name},
+		})
+		if err == nil {
+			var resp struct {
+				QueueURL string `xml:"GetQueueUrlResult>QueueUrl"`
+			}
+			if err := xml.Unmarshal(data, &resp); err != nil {
+				return nil, err
+			}
+			return url.Parse(resp.QueueURL)
+		}
+		if !strings.Contains(err.Error(), "NonExistentQueue") {
+			return nil, err
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return nil, errors.New("timeout waiting for the SQS answer queue")
+}
+
+// call makes a signed SQS query API request and returns the response body.
+func (r *sqsRendezvous) call(ctx context.Context, target *url.URL, params url.Values) ([]byte, error) {
+	params.Set("Version", sqsAPIVersion)
+	body := params.Encode()
+	request, err := http.NewRequestWithContext(ctx, "POST", target.String(), strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	signSQSRequest(request, []byte(body), r.creds, r.region, time.Now())
+
+	resp, err := r.transport.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := limitedRead(resp.Body, readLimit)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var sqsErr struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		xml.Unmarshal(data, &sqsErr)
+		return nil, fmt.Errorf("SQS %s: %s %s", params.Get("Action"), sqsErr.Code, sqsErr.Message)
+	}
+	return data, nil
+}
+
+// signSQSRequest adds an AWS Signature Version 4 Authorization header.
+// https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+func signSQSRequest(req *http.Request, body []byte, creds sqsCreds, region string, now time.Time) {
+	const service = "sqs"
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	signedHeaders := "content-type;host;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		"content-type:" + req.Header.Get("Content-Type"),
+		"host:" + req.URL.Host,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		hexSHA256(body),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,58 @@
+package lib
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// logStats logs a summary of the WebRTC stats of the peer, and its quality
+// score, every interval until it is closed.
+func (c *WebRTCPeer) logStats(interval time.Duration) {
+	prev := c.counters.snapshot()
+	for {
+		<-time.After(interval)
+		if c.closed {
+			return
+		}
+		report := c.pc.GetStats()
+		cur := c.counters.snapshot()
+		q := measureQuality(prev, cur, interval, c.rtt(report))
+		q.loss = c.loss()
+		c.trace.printf("WebRTC: stats: %s; score: %v", summarizeStats(report), q)
+		prev = cur
+	}
+}
+
+// nominatedPair returns the nominated candidate pair of a stats report, and
+// whether there is one.
+func nominatedPair(report webrtc.StatsReport) (webrtc.ICECandidatePairStats, bool) {
+	for _, s := range report {
+		if pair, ok := s.(webrtc.ICECandidatePairStats); ok && pair.Nominated {
+			return pair, true
+		}
+	}
+	return webrtc.ICECandidatePairStats{}, false
+}
+
+// summarizeStats describes the traffic of the DataChannel and the nominated
+// candidate pair of a stats report. It leaves out IP addresses and ports.
+func summarizeStats(report webrtc.StatsReport) string {
+	var dc webrtc.DataChannelStats
+	for _, s := range report {
+		if s, ok := s.(webrtc.DataChannelStats); ok {
+			dc = s
+		}
+	}
+	summary := fmt.Sprintf("sent %d B, received %d B", dc.BytesSent, dc.BytesReceived)
+	pair, ok := nominatedPair(report)
+	if !ok {
+		return summary + ", no candidate pair selected"
+	}
+	local, _ := report[pair.LocalCandidateID].(webrtc.ICECandidateStats)
+	remote, _ := report[pair.RemoteCandidateID].(webrtc.ICECandidateStats)
+	return summary + fmt.Sprintf(", RTT %.0f ms, pair %s %s <-> %s, STUN retransmissions %d",
+		pair.CurrentRoundTripTime*1000, local.NetworkType,
+		local.CandidateType, remote.CandidateType, pair.RetransmissionsSent)
+}
@@ -0,0 +1,110 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Traffic is how many bytes a SOCKS connection or a snowflake has carried
+// up, towards the bridge, and down.
+type Traffic struct {
+	ID   string // The trace ID its log messages start with
+	Up   int64
+	Down int64
+}
+
+func (t Traffic) String() string {
+	return fmt.Sprintf("%d B up, %d B down", t.Up, t.Down)
+}
+
+// connTraffic counts the traffic of an open SOCKS connection.
+type connTraffic struct {
+	up, down int64 // Accessed atomically, keep first for alignment.
+	id       string
+}
+
+func (t *connTraffic) snapshot() Traffic {
+	return Traffic{
+		ID:   t.id,
+		Up:   atomic.LoadInt64(&t.up),
+		Down: atomic.LoadInt64(&t.down),
+	}
+}
+
+// countingWriter adds the bytes written through it to n and total.
+type countingWriter struct {
+	io.Writer
+	n, total *int64
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	atomic.AddInt64(w.n, int64(n))
+	atomic.AddInt64(w.total, int64(n))
+	return n, err
+}
+
+// openConns are the SOCKS connections being copied, for ConnTraffic.
+var openConns = struct {
+	sync.Mutex
+	m map[*connTraffic]struct{}
+}{m: make(map[*connTraffic]struct{})}
+
+// trackConn starts counting the traffic of a new SOCKS connection, whose
+// traffic is reported under its trace ID.
+func trackConn(id traceID) *connTraffic {
+	t := &connTraffic{id: string(id)}
+	openConns.Lock()
+	openConns.m[t] = struct{}{}
+	openConns.Unlock()
+	atomic.AddInt64(&metrics.socksConnections, 1)
+	return t
+}
+
+func untrackConn(t *connTraffic) {
+	openConns.Lock()
+	delete(openConns.m, t)
+	openConns.Unlock()
+}
+
+// openConnCount returns how many SOCKS connections are being copied.
+func openConnCount() int {
+	openConns.Lock()
+	defer openConns.Unlock()
+	return len(openConns.m)
+}
+
+// ConnTraffic returns the traffic of each open SOCKS connection so far.
+func ConnTraffic() []Traffic {
+	openConns.Lock()
+	traffic := make([]Traffic, 0, len(openConns.m))
+	for t := range openConns.m {
+		traffic = append(traffic, t.snapshot())
+	}
+	openConns.Unlock()
+	sort.Slice(traffic, func(i, j int) bool { return traffic[i].ID < traffic[j].ID })
+	return traffic
+}
+
+// PeerTraffic returns the traffic of each connected snowflake so far.
+func PeerTraffic() []Traffic {
+	livePeers.Lock()
+	traffic := make([]Traffic, 0, len(livePeers.m))
+	for c := range livePeers.m {
+		traffic = append(traffic, c.traffic())
+	}
+	livePeers.Unlock()
+	sort.Slice(traffic, func(i, j int) bool { return traffic[i].ID < traffic[j].ID })
+	return traffic
+}
+
+func (c *WebRTCPeer) traffic() Traffic {
+	return Traffic{
+		ID:   string(c.trace),
+		Up:   atomic.LoadInt64(&c.counters.bytesOut),
+		Down: atomic.LoadInt64(&c.counters.bytesIn),
+	}
+}
@@ -0,0 +1,305 @@
+package lib
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLSClientFunc performs a TLS client handshake over conn. It lets the
+// broker transport use a TLS implementation other than crypto/tls, such as
+// uTLS, to imitate the ClientHello of a browser. The returned connection
+// must negotiate http/1.1, since net/http only speaks HTTP/2 over
+// *tls.Conn.
+type TLSClientFunc func(conn net.Conn, config *tls.Config) (net.Conn, error)
+
+var (
+	clientHelloLock       sync.Mutex
+	clientHelloImitations = map[string]TLSClientFunc{}
+)
+
+// RegisterClientHelloImitation makes a TLS ClientHello imitation available
+// under name, e.g. "chrome" or "firefox", for BrokerTransportConfig.
+func RegisterClientHelloImitation(name string, f TLSClientFunc) {
+	clientHelloLock.Lock()
+	defer clientHelloLock.Unlock()
+	clientHelloImitations[name] = f
+}
+
+// BrokerTransportConfig holds the options of NewBrokerTransport.
+type BrokerTransportConfig struct {
+	// Upstream SOCKS5 or HTTP proxy, may be nil.
+	Proxy *url.URL
+	// Name of a registered ClientHello imitation to use for TLS
+	// connections, or empty for crypto/tls. Not applied to connections
+	// through Proxy, which net/http always secures with crypto/tls.
+	ClientHello string
+	// Encrypted Client Hello config list of the server, to hide its name
+	// from the network. Can not be combined with ClientHello.
+	ECHConfigList []byte
+	// Network interface to connect from, e.g. wlan0, or empty for the one
+	// the routing table picks. With Proxy, it is the proxy that is
+	// connected to from it.
+	Interface string
+	// PEM certificates of the certificate authorities to trust instead of
+	// those of the system, or nil.
+	RootCAs []byte
+	// Public keys to pin: the base64 SHA-256 hashes of their
+	// SubjectPublicKeyInfo, optionally prefixed with "sha256/" as in HPKP.
+	// One of them must be in the verified certificate chain of the server,
+	// the broker or the front domain, so that TLS interception fails
+	// instead of going unnoticed. None pins nothing.
+	Pins []string
+}
+
+// We make a copy of DefaultTransport because we want the default Dial
+// and TLSHandshakeTimeout settings. But we want to disable the default
+// ProxyFromEnvironment setting.
+func CreateBrokerTransport() http.RoundTripper {
+	return CreateBrokerTransportWithProxy(nil)
+}
+
+// CreateBrokerTransportWithProxy is like CreateBrokerTransport, but sends
+// requests through the given upstream SOCKS5 or HTTP proxy, if not nil.
+func CreateBrokerTransportWithProxy(proxyURL *url.URL) http.RoundTripper {
+	transport, _ := NewBrokerTransport(BrokerTransportConfig{Proxy: proxyURL})
+	return transport
+}
+
+// How long idle connections to the broker are kept for the next rendezvous,
+// and how many per host.
+const (
+	brokerIdleConnTimeout     = 90 * time.Second
+	brokerMaxIdleConnsPerHost = 4
+)
+
+// How many TLS sessions to keep for resumption, one per server name.
+const brokerSessionCacheSize = 32
+
+// brokerSessionCache lets the TLS connections to the broker, the fronts and
+// the AMP cache resume earlier sessions, which takes fewer round trips and
+// sends no certificates.
+var brokerSessionCache = newSessionCache()
+
+// sessionCache is a TLS session cache that ForgetBrokerSessions can empty.
+type sessionCache struct {
+	lock  sync.Mutex
+	cache tls.ClientSessionCache
+}
+
+func newSessionCache() *sessionCache {
+	return &sessionCache{cache: tls.NewLRUClientSessionCache(brokerSessionCacheSize)}
+}
+
+func (c *sessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.cache.Get(sessionKey)
+}
+
+func (c *sessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cache.Put(sessionKey, cs)
+}
+
+func (c *sessionCache) reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cache = tls.NewLRUClientSessionCache(brokerSessionCacheSize)
+}
+
+// The transports NewBrokerTransport made, by config, so that the dialers
+// rebuilt or built for SOCKS args with the same settings reuse their
+// connections.
+var brokerTransports = struct {
+	sync.Mutex
+	m map[brokerTransportKey]*http.Transport
+}{m: make(map[brokerTransportKey]*http.Transport)}
+
+type brokerTransportKey struct {
+	proxy, clientHello, echConfigList, iface, rootCAs, pins string
+}
+
+// CloseIdleBrokerConnections closes the idle connections of the broker
+// transports, as when the network changed and they are likely dead.
+func CloseIdleBrokerConnections() {
+	brokerTransports.Lock()
+	defer brokerTransports.Unlock()
+	for _, transport := range brokerTransports.m {
+		transport.CloseIdleConnections()
+	}
+}
+
+// ForgetBrokerSessions closes the idle connections of the broker transports
+// and forgets their TLS sessions, so that the broker cannot link the next
+// requests to the earlier ones, as when the client token is rotated.
+func ForgetBrokerSessions() {
+	brokerTransports.Lock()
+	defer brokerTransports.Unlock()
+	for _, transport := range brokerTransports.m {
+		transport.CloseIdleConnections()
+		if cache, ok := transport.TLSClientConfig.ClientSessionCache.(*sessionCache); ok {
+			cache.reset()
+		}
+	}
+}
+
+// NewBrokerTransport creates a transport for rendezvous requests according
+// to config. The transports for the same config are one and the same, which
+// keeps HTTP/2 and HTTP/1.1 connections alive from one rendezvous to the
+// next. TLS sessions are resumed across all of them.
+func NewBrokerTransport(config BrokerTransportConfig) (http.RoundTripper, error) {
+	key := brokerTransportKey{
+		clientHello:   config.ClientHello,
+		echConfigList: string(config.ECHConfigList),
+		iface:         config.Interface,
+		rootCAs:       string(config.RootCAs),
+		pins:          strings.Join(config.Pins, ","),
+	}
+	if config.Proxy != nil {
+		key.proxy = config.Proxy.String()
+	}
+	brokerTransports.Lock()
+	defer brokerTransports.Unlock()
+	if transport, ok := brokerTransports.m[key]; ok {
+		return transport, nil
+	}
+	transport, err := newBrokerTransport(config)
+	if err != nil {
+		return nil, err
+	}
+	brokerTransports.m[key] = transport
+	return transport, nil
+}
+
+func newBrokerTransport(config BrokerTransportConfig) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	if config.Proxy != nil {
+		transport.Proxy = http.ProxyURL(config.Proxy)
+	}
+	transport.ResponseHeaderTimeout = 15 * time.Second
+	transport.IdleConnTimeout = brokerIdleConnTimeout
+	transport.MaxIdleConnsPerHost = brokerMaxIdleConnsPerHost
+	transport.TLSClientConfig = &tls.Config{ClientSessionCache: brokerSessionCache}
+	if len(config.RootCAs) > 0 || len(config.Pins) > 0 {
+		// Resumed sessions are not verified again: only resume those
+		// verified the same way.
+		transport.TLSClientConfig.ClientSessionCache = newSessionCache()
+	}
+	if len(config.RootCAs) > 0 {
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(config.RootCAs) {
+			return nil, errors.New("no certificates in the CA bundle")
+		}
+		transport.TLSClientConfig.RootCAs = roots
+	}
+	if len(config.Pins) > 0 {
+		verify, err := pinVerifier(config.Pins)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig.VerifyPeerCertificate = verify
+	}
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if config.Interface != "" {
+		control, err := interfaceControl(config.Interface)
+		if err != nil {
+			return nil, err
+		}
+		dialer.Control = control
+		transport.DialContext = dialer.DialContext
+	}
+
+	if len(config.ECHConfigList) > 0 {
+		if config.ClientHello != "" {
+			return nil, errors.New("Encrypted Client Hello can not be used with a ClientHello imitation")
+		}
+		if err := setECHConfigList(transport, config.ECHConfigList); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.ClientHello != "" {
+		if _, err := clientHelloImitation(config.ClientHello); err != nil {
+			return nil, err
+		}
+		transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			// Looked up again, in case it was registered anew since.
+			handshake, err := clientHelloImitation(config.ClientHello)
+			if err != nil {
+				return nil, err
+			}
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig := transport.TLSClientConfig.Clone()
+			tlsConfig.ServerName = host
+			tlsConn, err := handshake(conn, tlsConfig)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		}
+	}
+	return transport, nil
+}
+
+func clientHelloImitation(name string) (TLSClientFunc, error) {
+	clientHelloLock.Lock()
+	defer clientHelloLock.Unlock()
+	handshake, ok := clientHelloImitations[name]
+	if !ok {
+		return nil, fmt.Errorf("ClientHello imitation %q is not available in this build", name)
+	}
+	return handshake, nil
+}
+
+// ErrPinMismatch is returned by the broker transport when the certificate
+// chain of the server has none of the pinned public keys.
+var ErrPinMismatch = errors.New("none of the pinned public keys is in the certificate chain")
+
+// pinVerifier returns a tls.Config.VerifyPeerCertificate function checking
+// that one of pins is in a verified chain.
+func pinVerifier(pins []string) (func([][]byte, [][]*x509.Certificate) error, error) {
+	hashes := make(map[[sha256.Size]byte]bool)
+	for _, pin := range pins {
+		b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid public key pin %q", pin)
+		}
+		var hash [sha256.Size]byte
+		copy(hash[:], b)
+		hashes[hash] = true
+	}
+	return func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+		for _, chain := range chains {
+			for _, cert := range chain {
+				if hashes[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+					return nil
+				}
+			}
+		}
+		return ErrPinMismatch
+	}, nil
+}
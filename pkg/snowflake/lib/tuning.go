@@ -0,0 +1,111 @@
+package lib
+
+import (
+	"sync"
+	"time"
+)
+
+// Tuning is how the sessions over the snowflakes of a dialer are carried and
+// paced. A client that shares the process with others gives its dialers its
+// own with WithTuning; the sessions of dialers without one follow the
+// process-wide KCP, KeepAliveInterval, RedialBackoff, ProxyCooldown,
+// SetRateLimit and SetPadding.
+type Tuning struct {
+	KCP               KCPSettings
+	KeepAliveInterval time.Duration
+	// How long to wait after failing to catch a snowflake before trying
+	// again.
+	RedialBackoff Backoff
+	// How long to skip the proxies that failed, 0 not to skip them.
+	ProxyCooldown time.Duration
+	Padding       Padding
+	// Limits on the traffic of all the connections of the client together,
+	// in bytes per second up towards the bridge and down; 0 for no limit.
+	UpLimit, DownLimit int64
+
+	once     sync.Once
+	up, down *tokenBucket
+}
+
+// DefaultTuning returns a Tuning with the process-wide settings, for a
+// client to change.
+func DefaultTuning() *Tuning {
+	return &Tuning{
+		KCP:               KCP,
+		KeepAliveInterval: KeepAliveInterval,
+		RedialBackoff:     RedialBackoff,
+		ProxyCooldown:     ProxyCooldown,
+		Padding:           padding,
+		UpLimit:           upLimit.limit(),
+		DownLimit:         downLimit.limit(),
+	}
+}
+
+// Check tells whether t can be used.
+func (t *Tuning) Check() error {
+	return t.kcp().Check()
+}
+
+// Interface for catching Snowflakes for sessions tuned otherwise than the
+// process-wide settings say.
+type TunedTongue interface {
+	Tongue
+	Tuning() *Tuning
+}
+
+// tuningOf returns the Tuning of tongue, or nil for the process-wide
+// settings.
+func tuningOf(tongue Tongue) *Tuning {
+	if tongue, ok := tongue.(TunedTongue); ok {
+		return tongue.Tuning()
+	}
+	return nil
+}
+
+func (t *Tuning) kcp() KCPSettings {
+	if t == nil {
+		return KCP
+	}
+	return t.KCP
+}
+
+func (t *Tuning) keepAlive() time.Duration {
+	if t == nil {
+		return KeepAliveInterval
+	}
+	return t.KeepAliveInterval
+}
+
+func (t *Tuning) redialBackoff() Backoff {
+	if t == nil {
+		return RedialBackoff
+	}
+	return t.RedialBackoff
+}
+
+func (t *Tuning) proxyCooldown() time.Duration {
+	if t == nil {
+		return ProxyCooldown
+	}
+	return t.ProxyCooldown
+}
+
+func (t *Tuning) padding() Padding {
+	if t == nil {
+		return padding
+	}
+	return t.Padding
+}
+
+// limits returns the buckets that the traffic is held to, up and down, nil
+// for no limit. Those of a Tuning are made on first use, and shared by all
+// the connections using it.
+func (t *Tuning) limits() (up, down *tokenBucket) {
+	if t == nil {
+		return upLimit, downLimit
+	}
+	t.once.Do(func() {
+		t.up, t.down = newTokenBucket(t.UpLimit), newTokenBucket(t.DownLimit)
+	})
+	return t.up, t.down
+}
@@ -5,6 +5,8 @@ import (
 	"errors"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"git.torproject.org/pluggable-transports/snowflake.git/common/encapsulation"
@@ -14,12 +16,19 @@ var errNotImplemented = errors.New("not implemented")
 
 // EncapsulationPacketConn implements the net.PacketConn interface over an
 // io.ReadWriteCloser stream, using the encapsulation package to represent
-// packets in a stream.
+// packets in a stream. The packets it writes are padded as SetPadding says,
+// or as the Tuning of the session.
 type EncapsulationPacketConn struct {
 	io.ReadWriteCloser
 	localAddr  net.Addr
 	remoteAddr net.Addr
-	bw         *bufio.Writer
+
+	sent      int32 // atomic: whether a packet was written since the last dummy check
+	lock      sync.Mutex
+	bw        *bufio.Writer
+	closed    chan struct{}
+	closeOnce sync.Once
+	padding   Padding
 }
 
 // NewEncapsulationPacketConn makes
@@ -27,12 +36,24 @@ func NewEncapsulationPacketConn(
 	localAddr, remoteAddr net.Addr,
 	conn io.ReadWriteCloser,
 ) *EncapsulationPacketConn {
-	return &EncapsulationPacketConn{
+	return newEncapsulationPacketConn(localAddr, remoteAddr, conn, padding)
+}
+
+// newEncapsulationPacketConn is NewEncapsulationPacketConn, padding as p says.
+func newEncapsulationPacketConn(localAddr, remoteAddr net.Addr, conn io.ReadWriteCloser,
+	p Padding) *EncapsulationPacketConn {
+	c := &EncapsulationPacketConn{
 		ReadWriteCloser: conn,
 		localAddr:       localAddr,
 		remoteAddr:      remoteAddr,
 		bw:              bufio.NewWriter(conn),
+		closed:          make(chan struct{}),
+		padding:         p,
+	}
+	if p.Idle > 0 {
+		go c.sendDummies(p)
 	}
+	return c
 }
 
 // ReadFrom reads an encapsulated packet from the stream.
@@ -47,16 +68,30 @@ func (c *EncapsulationPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
 // WriteTo writes an encapsulated packet to the stream.
 func (c *EncapsulationPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
 	// addr is ignored.
-	_, err := encapsulation.WriteData(c.bw, p)
+	c.lock.Lock()
+	n, err := encapsulation.WriteData(c.bw, p)
+	atomic.AddInt64(&metrics.encapsulatedData, int64(n))
+	if err == nil {
+		n, err = encapsulation.WritePadding(c.bw, c.padding.paddingFor(n))
+		atomic.AddInt64(&metrics.encapsulatedPadding, int64(n))
+	}
 	if err == nil {
 		err = c.bw.Flush()
 	}
+	c.lock.Unlock()
+	atomic.StoreInt32(&c.sent, 1)
 	if err != nil {
 		return 0, err
 	}
 	return len(p), nil
 }
 
+// Close closes the stream, and stops the dummy packets.
+func (c *EncapsulationPacketConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.ReadWriteCloser.Close()
+}
+
 // LocalAddr returns the localAddr value that was passed to
 // NewEncapsulationPacketConn.
 func (c *EncapsulationPacketConn) LocalAddr() net.Addr {
@@ -1,7 +1,6 @@
 package lib
 
 import (
-	"log"
 	"time"
 )
 
@@ -44,7 +43,7 @@ func (b *BytesSyncLogger) log() {
 		select {
 		case <-ticker.C:
 			if outEvents > 0 || inEvents > 0 {
-				log.Printf("Traffic Bytes (in|out): %d | %d -- (%d OnMessages, %d Sends)",
+				tracef("Traffic Bytes (in|out): %d | %d -- (%d OnMessages, %d Sends)",
 					inbound, outbound, inEvents, outEvents)
 			}
 			outbound = 0
@@ -0,0 +1,309 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/common/util"
+	"github.com/pion/webrtc/v3"
+)
+
+// How long the volunteer proxy waits before polling the broker again after
+// it had no client for us, or failed.
+const proxyPollInterval = 5 * time.Second
+
+// VolunteerProxyConfig holds the settings of a VolunteerProxy.
+type VolunteerProxyConfig struct {
+	// The WebSocket URL of the bridge to relay the clients to.
+	RelayURL string
+	// What to connect to the bridge through, such as one from
+	// NewBrokerTransport.
+	Transport http.RoundTripper
+	// How many clients to serve at once.
+	Capacity int
+	// The bytes per second of all clients together, in both directions,
+	// or zero for no limit.
+	Rate int64
+}
+
+// VolunteerProxy serves other users as a snowflake proxy does: it polls the
+// broker for the offers of clients, answers them over WebRTC, and relays the
+// DataChannel of each client to the bridge over WebSocket.
+type VolunteerProxy struct {
+	dialer    *WebRTCDialer
+	relay     *url.URL
+	transport http.RoundTripper
+	capacity  int
+	rate      *tokenBucket
+	clients   int32 // atomic
+}
+
+// NewVolunteerProxy returns a proxy that polls the broker of dialer, and
+// connects to clients with the ICE servers and network settings of dialer.
+func NewVolunteerProxy(dialer *WebRTCDialer, config VolunteerProxyConfig) (*VolunteerProxy, error) {
+	relay, err := url.Parse(config.RelayURL)
+	if err != nil {
+		return nil, err
+	}
+	if relay.Scheme != "ws" && relay.Scheme != "wss" {
+		return nil, fmt.Errorf("not a WebSocket URL: %s", config.RelayURL)
+	}
+	if config.Capacity < 1 {
+		return nil, errors.New("the volunteer proxy needs room for at least one client")
+	}
+	transport := config.Transport
+	if t, ok := transport.(*http.Transport); ok {
+		// WebSocket connections are upgraded HTTP/1.1 requests.
+		t = t.Clone()
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		transport = t
+	}
+	return &VolunteerProxy{
+		dialer:    dialer,
+		relay:     relay,
+		transport: transport,
+		capacity:  config.Capacity,
+		rate:      newTokenBucket(config.Rate),
+	}, nil
+}
+
+// Clients returns how many clients the proxy is serving.
+func (p *VolunteerProxy) Clients() int {
+	return int(atomic.LoadInt32(&p.clients))
+}
+
+// Run serves clients until ctx is done, which closes their connections.
+func (p *VolunteerProxy) Run(ctx context.Context) {
+	var clients sync.WaitGroup
+	defer clients.Wait()
+	for ctx.Err() == nil {
+		if p.Clients() < p.capacity {
+			sid, offer, err := p.poll(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Volunteer proxy: polling the broker: %v", err)
+			}
+			if offer != nil {
+				atomic.AddInt32(&p.clients, 1)
+				clients.Add(1)
+				go func() {
+					defer clients.Done()
+					defer atomic.AddInt32(&p.clients, -1)
+					p.serve(ctx, sid, offer)
+				}()
+				continue
+			}
+		}
+		select {
+		case <-time.After(proxyPollInterval):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// poll asks the broker for a client offer, and returns it along with the
+// session ID to answer it with, or a nil offer if there is none for us.
+func (p *VolunteerProxy) poll(ctx context.Context) (string, *webrtc.SessionDescription, error) {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", nil, err
+	}
+	sid := hex.EncodeToString(id[:])
+	body, err := json.Marshal(proxyPollRequest{
+		Sid:     sid,
+		Version: proxyPollVersion,
+		Type:    "standalone",
+		NAT:     p.dialer.GetNATType(),
+		// Rounded down, as other proxies do, so as not to stand out.
+		Clients: p.Clients() / 8 * 8,
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	raw, err := p.dialer.BrokerChannel.post(ctx, "proxy", body)
+	if err != nil {
+		return "", nil, err
+	}
+	var resp proxyPollResponse
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		return "", nil, err
+	}
+	if resp.Status != proxyClientMatch {
+		return "", nil, nil
+	}
+	offer, err := util.DeserializeSessionDescription(resp.Offer)
+	if err != nil {
+		return "", nil, err
+	}
+	return sid, offer, nil
+}
+
+// serve answers offer, and relays the client to the bridge once its
+// DataChannel opens.
+func (p *VolunteerProxy) serve(ctx context.Context, sid string, offer *webrtc.SessionDescription) {
+	config := *p.dialer.webrtcConfig
+	pc, err := (&WebRTCPeer{options: p.dialer.options}).newPeerConnection(&config)
+	if err != nil {
+		log.Printf("Volunteer proxy: %v", err)
+		return
+	}
+	defer pc.Close()
+	// The client may send as soon as the channel opens, before the bridge
+	// is connected: its messages wait in a pipe, which also holds the client
+	// back until they are relayed.
+	open := make(chan *webrtc.DataChannel, 1)
+	fromClient, toRelay := io.Pipe()
+	defer toRelay.Close()
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+			toRelay.Write(msg.Data)
+		})
+		dc.OnClose(func() { toRelay.Close() })
+		dc.OnOpen(func() {
+			select {
+			case open <- dc:
+			default:
+			}
+		})
+	})
+	if err := pc.SetRemoteDescription(*offer); err != nil {
+		log.Printf("Volunteer proxy: bad offer: %v", err)
+		return
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		log.Printf("Volunteer proxy: %v", err)
+		return
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		log.Printf("Volunteer proxy: %v", err)
+		return
+	}
+	select {
+	case <-gathered:
+	case <-ctx.Done():
+		return
+	}
+	if err := p.answer(ctx, sid, pc.LocalDescription()); err != nil {
+		log.Printf("Volunteer proxy: answering the client: %v", err)
+		return
+	}
+	select {
+	case dc := <-open:
+		p.relayClient(ctx, dc, fromClient)
+	case <-time.After(DataChannelTimeout):
+		log.Printf("Volunteer proxy: the client did not connect")
+	case <-ctx.Done():
+	}
+}
+
+// answer sends the broker the answer to the offer of session sid.
+func (p *VolunteerProxy) answer(ctx context.Context, sid string, answer *webrtc.SessionDescription) error {
+	sdp, err := util.SerializeSessionDescription(answer)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(proxyAnswerRequest{Version: proxyAnswerVersion, Sid: sid, Answer: sdp})
+	if err != nil {
+		return err
+	}
+	raw, err := p.dialer.BrokerChannel.post(ctx, "answer", body)
+	if err != nil {
+		return err
+	}
+	var resp proxyAnswerResponse
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		return err
+	}
+	if resp.Status != proxyAnswerOK {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// relayClient copies between the client, which sends what it reads from
+// fromClient, and a WebSocket connection to the bridge until either closes
+// or ctx is done.
+func (p *VolunteerProxy) relayClient(ctx context.Context, dc *webrtc.DataChannel, fromClient *io.PipeReader) {
+	defer dc.Close()
+	defer fromClient.Close()
+	ws, err := dialWebSocket(ctx, p.transport, p.relay, "")
+	if err != nil {
+		log.Printf("Volunteer proxy: connecting to the bridge: %v", err)
+		return
+	}
+	defer ws.Close()
+	log.Printf("Volunteer proxy: relaying a client (%d at once)", p.Clients())
+	done := make(chan struct{})
+	var once sync.Once
+	stop := func() { once.Do(func() { close(done) }) }
+	go func() {
+		io.Copy(limitWriter(ws, p.rate), fromClient)
+		stop()
+	}()
+	go func() {
+		io.Copy(limitWriter(dataChannelWriter{dc}, p.rate), ws)
+		stop()
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// dataChannelWriter sends what is written to it on a DataChannel.
+type dataChannelWriter struct {
+	dc *webrtc.DataChannel
+}
+
+func (w dataChannelWriter) Write(b []byte) (int, error) {
+	if err := w.dc.Send(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// post POSTs body to path on the broker, domain fronted as the rendezvous
+// are, and returns the response body.
+func (bc *BrokerChannel) post(ctx context.Context, path string, body []byte) ([]byte, error) {
+	u := bc.url.ResolveReference(&url.URL{Path: path})
+	request, err := http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if bc.Host != "" {
+		request.Host = bc.Host
+	}
+	var front string
+	if bc.fronts != nil {
+		front = bc.fronts.pick()
+		request.Host = request.URL.Host
+		request.URL.Host = front
+	}
+	resp, err := bc.transport.RoundTrip(request)
+	if bc.fronts != nil && ctx.Err() == nil {
+		bc.fronts.report(front, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("broker: %s", resp.Status)
+	}
+	return limitedRead(resp.Body, readLimit)
+}
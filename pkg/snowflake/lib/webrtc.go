@@ -1,15 +1,17 @@
 package lib
 
 import (
-	"crypto/rand"
-	"encoding/hex"
+	"context"
 	"errors"
 	"io"
-	"log"
+	"net"
+	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pion/webrtc/v3"
+	"golang.org/x/net/proxy"
 )
 
 // Remote WebRTC peer.
@@ -17,7 +19,11 @@ import (
 // Handles preparation of go-webrtc PeerConnection. Only ever has
 // one DataChannel.
 type WebRTCPeer struct {
+	counters peerCounters // First, to keep the atomic counters aligned
+	path     pathStats
+
 	id        string
+	trace     traceID
 	pc        *webrtc.PeerConnection
 	transport *webrtc.DataChannel
 
@@ -25,25 +31,106 @@ type WebRTCPeer struct {
 	writePipe   *io.PipeWriter
 	lastReceive time.Time
 
-	open   chan struct{} // Channel to notify when datachannel opens
-	closed bool
+	open      chan struct{} // Channel to notify when datachannel opens
+	bufferLow chan struct{} // Signaled when the send buffer drains
+	closed    bool
+	retiring  int32 // atomic: whether the peer is to be replaced; see retire
+
+	proxyAddrs  []string // public addresses of the proxy
+	connectedAt int64    // UnixNano when the DataChannel opened; atomic
+	bridge      bridgeChoice
 
 	once sync.Once // Synchronization for PeerConnection destruction
 
+	options peerOptions
+
 	BytesLogger BytesLogger
 }
 
 // Construct a WebRTC PeerConnection.
 func NewWebRTCPeer(config *webrtc.Configuration,
 	broker *BrokerChannel) (*WebRTCPeer, error) {
+	return NewWebRTCPeerWithProxy(config, broker, nil)
+}
+
+// NewWebRTCPeerWithProxy is like NewWebRTCPeer, but if proxy is not nil the
+// ICE agent dials TCP relay candidates through it. UDP candidates can not be
+// proxied and are still gathered directly.
+func NewWebRTCPeerWithProxy(config *webrtc.Configuration,
+	broker *BrokerChannel, proxy *url.URL) (*WebRTCPeer, error) {
+	return newWebRTCPeer(context.Background(), config, broker, peerOptions{proxy: proxy})
+}
+
+// peerOptions are the settings of a WebRTCPeer beyond the
+// webrtc.Configuration, which the dialer passes on to every peer.
+type peerOptions struct {
+	proxy     *url.URL // Optional upstream proxy for the ICE agent
+	icePolicy ICEPolicy
+	// Range of local UDP ports for ICE, or 0 for any port.
+	portMin, portMax uint16
+	// Network types to gather candidates for, or nil for all.
+	networkTypes []webrtc.NetworkType
+	// Where to accept ICE-TCP connections, or nil for no ICE-TCP.
+	tcpMux iceTCPMux
+	// Forwards the UDP ports from the router, or nil.
+	portMapper *portMapper
+	// Network interface to gather host candidates on, or empty for all.
+	iface       string
+	reliability DataChannelReliability
+	sctp        SCTPOptions
+	// How often to log WebRTC stats, or 0 not to.
+	statsInterval time.Duration
+	quality       QualityThresholds
+	// How long to wait for data before closing the peer, or 0 for
+	// SnowflakeTimeout.
+	idleTimeout time.Duration
+	// How long to keep the peer before replacing it, or 0 for as long as
+	// it works.
+	lifetime time.Duration
+	// The SettingEngine the options above are applied to, or nil for the
+	// default one.
+	settingEngine *webrtc.SettingEngine
+	// Receives the events of the peer, besides the subscribers, if not nil.
+	events func(Event)
+	// How the sessions over the peer are tuned, or nil for the process-wide
+	// settings.
+	tuning *Tuning
+	// Where the peer is kept while it is connected, besides livePeers, if
+	// not nil.
+	group *PeerGroup
+}
+
+// SCTPOptions tune how data is handed to the SCTP association under the
+// DataChannel. Zero values leave the pion defaults in place.
+type SCTPOptions struct {
+	// How many bytes may be queued for sending before Write blocks.
+	SendBufferSize int
+	// Writes are split into messages of at most this many bytes.
+	MaxMessageSize int
+}
+
+// DataChannelReliability sets how the snowflake DataChannel delivers
+// messages. The zero value is an ordered, fully reliable channel. The
+// turbotunnel layer retransmits what is lost, so a partially reliable
+// channel can lower latency at the cost of more retransmissions there.
+type DataChannelReliability struct {
+	Unordered bool
+	// At most one of these may be set. MaxRetransmits limits how many
+	// times a message is retransmitted, MaxPacketLifeTime for how many
+	// milliseconds.
+	MaxRetransmits    *uint16
+	MaxPacketLifeTime *uint16
+}
+
+var errDataChannelTimeout = errors.New("timeout waiting for DataChannel.OnOpen")
+
+func newWebRTCPeer(ctx context.Context, config *webrtc.Configuration,
+	broker *BrokerChannel, options peerOptions) (*WebRTCPeer, error) {
 	connection := new(WebRTCPeer)
-	{
-		var buf [8]byte
-		if _, err := rand.Read(buf[:]); err != nil {
-			panic(err)
-		}
-		connection.id = "snowflake-" + hex.EncodeToString(buf[:])
-	}
+	connection.options = options
+	connection.trace = newTraceID()
+	connection.id = "snowflake-" + string(connection.trace)
+	connection.bridge = bridgeFromContext(ctx)
 
 	// Override with something that's not NullLogger to have real logging.
 	connection.BytesLogger = &BytesNullLogger{}
@@ -51,8 +138,11 @@ func NewWebRTCPeer(config *webrtc.Configuration,
 	// Pipes remain the same even when DataChannel gets switched.
 	connection.recvPipe, connection.writePipe = io.Pipe()
 
-	err := connection.connect(config, broker)
+	err := connection.connect(ctx, config, broker)
 	if err != nil {
+		if ctx.Err() == nil {
+			connection.bridge.report(false)
+		}
 		connection.Close()
 		return nil, err
 	}
@@ -68,35 +158,80 @@ func (c *WebRTCPeer) Read(b []byte) (int, error) {
 // Writes bytes out to remote WebRTC.
 // As part of |io.ReadWriter|
 func (c *WebRTCPeer) Write(b []byte) (int, error) {
-	err := c.transport.Send(b)
-	if err != nil {
-		return 0, err
+	n := 0
+	for len(b) > 0 {
+		msg := b
+		if max := c.options.sctp.MaxMessageSize; max > 0 && len(msg) > max {
+			msg = msg[:max]
+		}
+		c.waitForSendBuffer()
+		atomic.AddInt64(&c.counters.writes, 1)
+		err := c.transport.Send(msg)
+		if err != nil {
+			atomic.AddInt64(&c.counters.writeErrors, 1)
+			return n, err
+		}
+		atomic.AddInt64(&c.counters.bytesOut, int64(len(msg)))
+		c.BytesLogger.AddOutbound(len(msg))
+		n += len(msg)
+		b = b[len(msg):]
+	}
+	return n, nil
+}
+
+// waitForSendBuffer blocks while more than SendBufferSize bytes are queued,
+// or until the peer is closed.
+func (c *WebRTCPeer) waitForSendBuffer() {
+	size := uint64(c.options.sctp.SendBufferSize)
+	if size == 0 {
+		return
+	}
+	for !c.closed && c.transport.BufferedAmount() > size {
+		select {
+		case <-c.bufferLow:
+		case <-time.After(time.Second):
+		}
 	}
-	c.BytesLogger.AddOutbound(len(b))
-	return len(b), nil
 }
 
 func (c *WebRTCPeer) Close() error {
 	c.once.Do(func() {
 		c.closed = true
+		removeLivePeer(c)
 		c.cleanup()
-		log.Printf("WebRTC: Closing")
+		c.trace.printf("WebRTC: Closing snowflake after %v", c.traffic())
 	})
 	return nil
 }
 
+// closedByProxy closes the peer after the proxy closed the connection. A
+// proxy that does so right after connecting is skipped for a while.
+func (c *WebRTCPeer) closedByProxy() {
+	connectedAt := atomic.LoadInt64(&c.connectedAt)
+	if !c.closed && connectedAt != 0 && time.Since(time.Unix(0, connectedAt)) < deadOnArrival {
+		c.trace.printf("WebRTC: Proxy closed the snowflake right after connecting")
+		failedProxies.add(c.proxyAddrs, c.options.tuning.proxyCooldown())
+		c.bridge.report(false)
+	}
+	c.Close()
+}
+
 // Prevent long-lived broken remotes.
 // Should also update the DataChannel in underlying go-webrtc's to make Closes
 // more immediate / responsive.
 func (c *WebRTCPeer) checkForStaleness() {
+	timeout := c.options.idleTimeout
+	if timeout == 0 {
+		timeout = SnowflakeTimeout
+	}
 	c.lastReceive = time.Now()
 	for {
 		if c.closed {
 			return
 		}
-		if time.Since(c.lastReceive) > SnowflakeTimeout {
-			log.Printf("WebRTC: No messages received for %v -- closing stale connection.",
-				SnowflakeTimeout)
+		if time.Since(c.lastReceive) > timeout {
+			c.trace.warnf("WebRTC: No messages received for %v -- closing stale connection.",
+				timeout)
 			c.Close()
 			return
 		}
@@ -104,19 +239,43 @@ func (c *WebRTCPeer) checkForStaleness() {
 	}
 }
 
-func (c *WebRTCPeer) connect(config *webrtc.Configuration, broker *BrokerChannel) error {
-	log.Println(c.id, " connecting...")
-	// TODO: When go-webrtc is more stable, it's possible that a new
-	// PeerConnection won't need to be re-prepared each time.
-	c.preparePeerConnection(config)
-	answer, err := broker.Negotiate(c.pc.LocalDescription())
-	if err != nil {
-		return err
+// connect gathers ICE candidates, negotiates with a proxy through broker and
+// waits for the DataChannel to open. It gives up at any step once ctx is
+// done.
+func (c *WebRTCPeer) connect(ctx context.Context, config *webrtc.Configuration, broker *BrokerChannel) error {
+	c.trace.printf("%s connecting...", c.id)
+	var answer *webrtc.SessionDescription
+	for skips := 0; ; skips++ {
+		// TODO: When go-webrtc is more stable, it's possible that a new
+		// PeerConnection won't need to be re-prepared each time.
+		if err := c.preparePeerConnection(ctx, config); err != nil {
+			return err
+		}
+		offer := c.pc.LocalDescription()
+		if c.options.icePolicy == ICEPolicyNoHost {
+			offer = &webrtc.SessionDescription{
+				Type: offer.Type,
+				SDP:  stripHostCandidates(offer.SDP),
+			}
+		}
+		var err error
+		answer, err = broker.negotiate(ctx, c.trace, offer, c.options.events)
+		if err != nil {
+			return err
+		}
+		c.proxyAddrs = proxyAddresses(answer.SDP)
+		if skips == maxCooldownSkips || !failedProxies.cooling(c.proxyAddrs) {
+			break
+		}
+		// The skipped proxy holds the ICE credentials and DTLS fingerprint
+		// of this offer, so the next proxy gets a fresh one.
+		c.trace.printf("WebRTC: Skipping a proxy that failed recently")
+		c.discardPeerConnection()
 	}
-	log.Printf("Received Answer.\n")
-	err = c.pc.SetRemoteDescription(*answer)
+	c.trace.debugf("Received Answer.")
+	err := c.pc.SetRemoteDescription(*answer)
 	if nil != err {
-		log.Println("WebRTC: Unable to SetRemoteDescription:", err)
+		c.trace.printf("WebRTC: Unable to SetRemoteDescription: %v", err)
 		return err
 	}
 
@@ -125,83 +284,210 @@ func (c *WebRTCPeer) connect(config *webrtc.Configuration, broker *BrokerChannel
 	case <-c.open:
 	case <-time.After(DataChannelTimeout):
 		c.transport.Close()
-		return errors.New("timeout waiting for DataChannel.OnOpen")
+		failedProxies.add(c.proxyAddrs, c.options.tuning.proxyCooldown())
+		return errDataChannelTimeout
+	case <-ctx.Done():
+		c.transport.Close()
+		return ctx.Err()
 	}
 
+	atomic.StoreInt64(&c.connectedAt, time.Now().UnixNano())
+	broker.recordGood(config.ICEServers)
+	addLivePeer(c)
 	go c.checkForStaleness()
+	if c.options.statsInterval > 0 {
+		go c.logStats(c.options.statsInterval)
+	}
+	if c.options.quality.enabled() {
+		go c.monitorQuality(c.options.quality)
+	}
+	if c.options.lifetime > 0 {
+		c.retireAfter(c.options.lifetime)
+	}
 	return nil
 }
 
 // preparePeerConnection creates a new WebRTC PeerConnection and returns it
-// after ICE candidate gathering is complete..
-func (c *WebRTCPeer) preparePeerConnection(config *webrtc.Configuration) error {
+// after ICE candidate gathering is complete, or once ctx is done.
+func (c *WebRTCPeer) preparePeerConnection(ctx context.Context, config *webrtc.Configuration) error {
 	var err error
-	c.pc, err = webrtc.NewPeerConnection(*config)
+	c.pc, err = c.newPeerConnection(config)
 	if err != nil {
-		log.Printf("NewPeerConnection ERROR: %s", err)
+		c.trace.printf("NewPeerConnection ERROR: %s", err)
 		return err
 	}
-	ordered := true
+	ordered := !c.options.reliability.Unordered
 	dataChannelOptions := &webrtc.DataChannelInit{
-		Ordered: &ordered,
+		Ordered:           &ordered,
+		MaxRetransmits:    c.options.reliability.MaxRetransmits,
+		MaxPacketLifeTime: c.options.reliability.MaxPacketLifeTime,
 	}
 	// We must create the data channel before creating an offer
 	// https://github.com/pion/webrtc/wiki/Release-WebRTC@v3.0.0
 	dc, err := c.pc.CreateDataChannel(c.id, dataChannelOptions)
 	if err != nil {
-		log.Printf("CreateDataChannel ERROR: %s", err)
+		c.trace.printf("CreateDataChannel ERROR: %s", err)
 		return err
 	}
 	dc.OnOpen(func() {
-		log.Println("WebRTC: DataChannel.OnOpen")
+		c.trace.debugf("WebRTC: DataChannel.OnOpen")
+		c.emit(EventDataChannelOpen)
 		close(c.open)
 	})
 	dc.OnClose(func() {
-		log.Println("WebRTC: DataChannel.OnClose")
-		c.Close()
+		c.trace.debugf("WebRTC: DataChannel.OnClose")
+		c.closedByProxy()
 	})
 	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
 		if len(msg.Data) <= 0 {
-			log.Println("0 length message---")
+			c.trace.tracef("0 length message---")
 		}
 		n, err := c.writePipe.Write(msg.Data)
+		if atomic.AddInt64(&c.counters.bytesIn, int64(n)) == int64(n) && n > 0 {
+			// The first data from the bridge.
+			c.bridge.report(true)
+		}
 		c.BytesLogger.AddInbound(n)
 		if err != nil {
 			// TODO: Maybe shouldn't actually close.
-			log.Println("Error writing to SOCKS pipe")
+			c.trace.printf("Error writing to SOCKS pipe")
 			if inerr := c.writePipe.CloseWithError(err); inerr != nil {
-				log.Printf("c.writePipe.CloseWithError returned error: %v", inerr)
+				c.trace.printf("c.writePipe.CloseWithError returned error: %v", inerr)
 			}
 		}
 		c.lastReceive = time.Now()
 	})
+	c.pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		c.trace.printf("WebRTC: ICE connection state: %s", state)
+		if state == webrtc.ICEConnectionStateConnected {
+			c.emit(EventICEConnected)
+		}
+	})
+	c.pc.SCTP().Transport().ICETransport().OnSelectedCandidatePairChange(
+		func(pair *webrtc.ICECandidatePair) {
+			c.trace.printf("WebRTC: selected candidate pair over %s (%s %s <-> %s)",
+				ipVersion(pair.Local.Address), pair.Local.Protocol,
+				pair.Local.Typ, pair.Remote.Typ)
+		})
+	c.bufferLow = make(chan struct{}, 1)
+	if size := c.options.sctp.SendBufferSize; size > 0 {
+		dc.SetBufferedAmountLowThreshold(uint64(size) / 2)
+		dc.OnBufferedAmountLow(func() {
+			select {
+			case c.bufferLow <- struct{}{}:
+			default:
+			}
+		})
+	}
 	c.transport = dc
 	c.open = make(chan struct{})
-	log.Println("WebRTC: DataChannel created.")
+	c.trace.debugf("WebRTC: DataChannel created.")
 
 	// Allow candidates to accumulate until ICEGatheringStateComplete.
 	done := webrtc.GatheringCompletePromise(c.pc)
 	offer, err := c.pc.CreateOffer(nil)
 	// TODO: Potentially timeout and retry if ICE isn't working.
 	if err != nil {
-		log.Println("Failed to prepare offer", err)
+		c.trace.printf("Failed to prepare offer: %v", err)
 		c.pc.Close()
 		return err
 	}
-	log.Println("WebRTC: Created offer")
+	c.trace.debugf("WebRTC: Created offer")
 	err = c.pc.SetLocalDescription(offer)
 	if err != nil {
-		log.Println("Failed to prepare offer", err)
+		c.trace.printf("Failed to prepare offer: %v", err)
 		c.pc.Close()
 		return err
 	}
-	log.Println("WebRTC: Set local description")
+	c.trace.debugf("WebRTC: Set local description")
 
-	<-done // Wait for ICE candidate gathering to complete.
-	log.Println("WebRTC: PeerConnection created.")
+	// Wait for ICE candidate gathering to complete.
+	select {
+	case <-done:
+	case <-ctx.Done():
+		c.pc.Close()
+		return ctx.Err()
+	}
+	c.trace.debugf("WebRTC: PeerConnection created.")
 	return nil
 }
 
+// discardPeerConnection closes the PeerConnection of an offer that is not
+// going to be answered, without closing the peer.
+func (c *WebRTCPeer) discardPeerConnection() {
+	c.transport.OnClose(func() {})
+	if err := c.pc.Close(); err != nil {
+		c.trace.printf("Error closing peerconnection...")
+	}
+	c.transport, c.pc = nil, nil
+}
+
+// newPeerConnection creates a PeerConnection with a SettingEngine
+// reflecting the options of this peer.
+func (c *WebRTCPeer) newPeerConnection(config *webrtc.Configuration) (*webrtc.PeerConnection, error) {
+	var s webrtc.SettingEngine
+	if c.options.settingEngine != nil {
+		s = *c.options.settingEngine
+	}
+	if c.options.proxy != nil {
+		dialer, err := proxy.FromURL(c.options.proxy, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+		s.SetICEProxyDialer(dialer)
+	}
+	if c.options.portMin != 0 || c.options.portMax != 0 {
+		if err := s.SetEphemeralUDPPortRange(c.options.portMin, c.options.portMax); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.options.portMapper.apply(&s); err != nil {
+		return nil, err
+	}
+	networkTypes := c.options.networkTypes
+	if c.options.tcpMux != nil {
+		s.SetICETCPMux(c.options.tcpMux)
+		networkTypes = withTCP(networkTypes)
+	}
+	if networkTypes != nil {
+		s.SetNetworkTypes(networkTypes)
+	}
+	if c.options.iface != "" {
+		iface := c.options.iface
+		s.SetInterfaceFilter(func(name string) bool {
+			return name == iface
+		})
+	}
+	api := webrtc.NewAPI(webrtc.WithSettingEngine(s))
+	return api.NewPeerConnection(*config)
+}
+
+// withTCP returns networkTypes, or the UDP ones pion uses by default if it
+// is nil, with TCP for each IP version among them.
+func withTCP(networkTypes []webrtc.NetworkType) []webrtc.NetworkType {
+	if networkTypes == nil {
+		networkTypes = []webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6}
+	}
+	types := append([]webrtc.NetworkType(nil), networkTypes...)
+	for _, t := range networkTypes {
+		switch t {
+		case webrtc.NetworkTypeUDP4:
+			types = append(types, webrtc.NetworkTypeTCP4)
+		case webrtc.NetworkTypeUDP6:
+			types = append(types, webrtc.NetworkTypeTCP6)
+		}
+	}
+	return types
+}
+
+// ipVersion returns "IPv4" or "IPv6" for the IP address addr.
+func ipVersion(addr string) string {
+	if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
 // Close all channels and transports
 func (c *WebRTCPeer) cleanup() {
 	// Close this side of the SOCKS pipe.
@@ -209,14 +495,14 @@ func (c *WebRTCPeer) cleanup() {
 		c.writePipe.Close()
 	}
 	if nil != c.transport {
-		log.Printf("WebRTC: closing DataChannel")
+		c.trace.debugf("WebRTC: closing DataChannel")
 		c.transport.Close()
 	}
 	if nil != c.pc {
-		log.Printf("WebRTC: closing PeerConnection")
+		c.trace.debugf("WebRTC: closing PeerConnection")
 		err := c.pc.Close()
 		if nil != err {
-			log.Printf("Error closing peerconnection...")
+			c.trace.printf("Error closing peerconnection...")
 		}
 	}
 }
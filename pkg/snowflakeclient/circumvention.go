@@ -0,0 +1,222 @@
+package snowflakeclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	sf "0xacab.org/leap/bitmask-vpn/pkg/snowflake/lib"
+	pt "git.torproject.org/pluggable-transports/goptlib.git"
+)
+
+// The circumvention settings API, such as the one of Tor's Moat, tells which
+// broker, fronts and ICE servers work in a country, so that they need not be
+// tuned by hand. We POST
+//
+//	{"country": "cn", "transports": ["snowflake"]}
+//
+// leaving the country out for the API to guess it from our address, and get
+// the bridge lines to use there, if any are needed:
+//
+//	{"settings": [{"bridges": {"type": "snowflake", "source": "builtin",
+//	  "bridge_strings": ["snowflake 192.0.2.3:80 2B280B23E1107BB62ABFC40DDCC8824814F80A72 url=https://broker.example/ fronts=cdn.example ice=stun:stun.example.net:3478"]}}]}
+//
+// The SOCKS args of the first snowflake bridge line then apply as if tor had
+// handed it to us.
+type settingsRequest struct {
+	Country    string   `json:"country,omitempty"`
+	Transports []string `json:"transports"`
+}
+
+type settingsResponse struct {
+	Settings []struct {
+		Bridges struct {
+			Type          string   `json:"type"`
+			BridgeStrings []string `json:"bridge_strings"`
+		} `json:"bridges"`
+	} `json:"settings"`
+	Errors []struct {
+		Code   int    `json:"code"`
+		Detail string `json:"detail"`
+	} `json:"errors"`
+}
+
+// settingsCache is what the cache file keeps of the settings.
+type settingsCache struct {
+	Fetched    time.Time `json:"fetched"`
+	Country    string    `json:"country"`
+	BridgeLine string    `json:"bridge_line"` // empty when none is needed
+}
+
+// How long cached settings are used before asking for them again. When that
+// fails, they are used however old they are.
+const settingsLifetime = 24 * time.Hour
+
+// The largest answer of the settings API to read.
+const maxSettingsSize = 64 << 10
+
+// settingsSource is where to get the circumvention settings from, as
+// DialerConfig says.
+type settingsSource struct {
+	url       string
+	front     string
+	country   string
+	cacheFile string
+	transport http.RoundTripper
+}
+
+// bridgeLine returns the snowflake bridge line of the cached settings while
+// they are fresh, or else of settings asked for anew, which are then cached.
+// It returns "" when the API says that no bridge is needed.
+func (s *settingsSource) bridgeLine() (string, error) {
+	cached, cacheErr := s.readCache()
+	if cacheErr == nil && time.Since(cached.Fetched) < settingsLifetime {
+		return cached.BridgeLine, nil
+	}
+	line, err := s.fetch()
+	if err != nil {
+		if cacheErr == nil {
+			log.Printf("Asking for circumvention settings: %v; using those of %v",
+				err, cached.Fetched.Format(time.RFC3339))
+			return cached.BridgeLine, nil
+		}
+		return "", err
+	}
+	if s.cacheFile != "" {
+		raw, _ := json.Marshal(settingsCache{Fetched: time.Now(), Country: s.country, BridgeLine: line})
+		if err := ioutil.WriteFile(s.cacheFile, raw, 0600); err != nil {
+			log.Printf("Caching circumvention settings: %v", err)
+		}
+	}
+	return line, nil
+}
+
+// readCache reads the cached settings, if they are for the same country.
+func (s *settingsSource) readCache() (*settingsCache, error) {
+	if s.cacheFile == "" {
+		return nil, errors.New("no cache")
+	}
+	raw, err := ioutil.ReadFile(s.cacheFile)
+	if err != nil {
+		return nil, err
+	}
+	var cached settingsCache
+	if err := json.Unmarshal(raw, &cached); err != nil {
+		return nil, err
+	}
+	if cached.Country != s.country {
+		return nil, fmt.Errorf("cached settings are for %q", cached.Country)
+	}
+	return &cached, nil
+}
+
+func (s *settingsSource) fetch() (string, error) {
+	body, _ := json.Marshal(settingsRequest{Country: s.country, Transports: []string{"snowflake"}})
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/vnd.api+json")
+	if s.front != "" {
+		req.Host = req.URL.Host
+		req.URL.Host = s.front
+	}
+	client := http.Client{Transport: s.transport, Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	raw, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSettingsSize))
+	if err != nil {
+		return "", err
+	}
+	var settings settingsResponse
+	if err := json.Unmarshal(raw, &settings); err != nil {
+		return "", fmt.Errorf("circumvention settings: %s: %v", resp.Status, err)
+	}
+	if len(settings.Errors) > 0 {
+		return "", fmt.Errorf("circumvention settings: %d %s", settings.Errors[0].Code, settings.Errors[0].Detail)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("circumvention settings: %s", resp.Status)
+	}
+	for _, setting := range settings.Settings {
+		if setting.Bridges.Type == "snowflake" && len(setting.Bridges.BridgeStrings) > 0 {
+			return setting.Bridges.BridgeStrings[0], nil
+		}
+	}
+	return "", nil
+}
+
+// parseBridgeLine returns the SOCKS args of a snowflake bridge line.
+func parseBridgeLine(line string) (pt.Args, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "snowflake" {
+		return nil, fmt.Errorf("not a snowflake bridge line: %q", line)
+	}
+	args := pt.Args{}
+	for _, field := range fields[2:] {
+		if i := strings.Index(field, "="); i > 0 {
+			args.Add(field[:i], field[i+1:])
+		}
+	}
+	return args, nil
+}
+
+// withCircumventionSettings returns a copy of c with the SOCKS args of the
+// bridge line from the circumvention settings API applied, if SettingsURL is
+// set. When there are no settings to be had, c is used as it is.
+func (c DialerConfig) withCircumventionSettings() DialerConfig {
+	if c.SettingsURL == "" {
+		return c
+	}
+	if _, err := url.Parse(c.SettingsURL); err != nil {
+		log.Printf("Invalid circumvention settings URL: %v", err)
+		return c
+	}
+	transport, err := sf.NewBrokerTransport(sf.BrokerTransportConfig{
+		Proxy:       c.Proxy,
+		ClientHello: c.ClientHello,
+		Interface:   c.Interface,
+	})
+	if err != nil {
+		log.Printf("Asking for circumvention settings: %v", err)
+		return c
+	}
+	source := settingsSource{
+		url:       c.SettingsURL,
+		front:     c.SettingsFront,
+		country:   strings.ToLower(c.SettingsCountry),
+		cacheFile: c.SettingsCache,
+		transport: transport,
+	}
+	line, err := source.bridgeLine()
+	if err != nil {
+		log.Printf("Asking for circumvention settings: %v; using the configured ones", err)
+		return c
+	}
+	if line == "" {
+		log.Printf("The circumvention settings need no bridge here; using the configured settings")
+		return c
+	}
+	args, err := parseBridgeLine(line)
+	if err == nil {
+		var settings DialerConfig
+		settings, _, err = c.withArgs(args)
+		if err == nil {
+			log.Printf("Using the circumvention settings")
+			return settings
+		}
+	}
+	log.Printf("Circumvention settings: %v; using the configured ones", err)
+	return c
+}
@@ -0,0 +1,100 @@
+package snowflakeclient
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const settingsBridgeLine = "snowflake 192.0.2.3:80 2B280B23E1107BB62ABFC40DDCC8824814F80A72 " +
+	"fingerprint=2B280B23E1107BB62ABFC40DDCC8824814F80A72 url=https://broker.example/ " +
+	"fronts=a.example,b.example ice=stun:stun.example.net:3478"
+
+func TestParseBridgeLine(t *testing.T) {
+	args, err := parseBridgeLine(settingsBridgeLine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url, _ := args.Get("url"); url != "https://broker.example/" {
+		t.Errorf("got url=%q", url)
+	}
+	if fronts, _ := args.Get("fronts"); fronts != "a.example,b.example" {
+		t.Errorf("got fronts=%q", fronts)
+	}
+	for _, line := range []string{"", "obfs4 192.0.2.3:80", "snowflake"} {
+		if _, err := parseBridgeLine(line); err == nil {
+			t.Errorf("%q: accepted", line)
+		}
+	}
+}
+
+func TestCircumventionSettings(t *testing.T) {
+	var request settingsRequest
+	var host string
+	fetches := 0
+	answer := `{"settings": [{"bridges": {"type": "snowflake", "source": "builtin", "bridge_strings": ["` +
+		settingsBridgeLine + `"]}}], "country": "cn"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		host = r.Host
+		json.NewDecoder(r.Body).Decode(&request)
+		w.Write([]byte(answer))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := DialerConfig{
+		BrokerURL:       "https://default.example/",
+		ICEServers:      "stun:default.example:3478",
+		SettingsURL:     "http://settings.example/moat",
+		SettingsFront:   server.Listener.Addr().String(),
+		SettingsCountry: "CN",
+		SettingsCache:   filepath.Join(dir, "settings.json"),
+	}
+	for i := 0; i < 2; i++ {
+		c := config.withCircumventionSettings()
+		if c.BrokerURL != "https://broker.example/" || c.Fronts != "a.example,b.example" ||
+			c.ICEServers != "stun:stun.example.net:3478" || c.Fingerprint != "2B280B23E1107BB62ABFC40DDCC8824814F80A72" {
+			t.Errorf("got %+v", c)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("asked %d times instead of once, then from the cache", fetches)
+	}
+	if request.Country != "cn" || len(request.Transports) != 1 || request.Transports[0] != "snowflake" {
+		t.Errorf("got request %+v", request)
+	}
+	if host != "settings.example" {
+		t.Errorf("not fronted: Host %q", host)
+	}
+
+	// Stale settings are still used when the API cannot be reached.
+	raw, _ := json.Marshal(settingsCache{Fetched: time.Now().Add(-2 * settingsLifetime), Country: "cn",
+		BridgeLine: "snowflake 192.0.2.3:80 url=https://stale.example/"})
+	ioutil.WriteFile(config.SettingsCache, raw, 0600)
+	answer = `{"errors": [{"code": 406, "detail": "unsupported"}]}`
+	if c := config.withCircumventionSettings(); c.BrokerURL != "https://stale.example/" {
+		t.Errorf("got broker %q with stale settings", c.BrokerURL)
+	}
+
+	// Neither cache nor API: the configured settings stay.
+	config.SettingsCountry = "ir"
+	if c := config.withCircumventionSettings(); c.BrokerURL != config.BrokerURL {
+		t.Errorf("got broker %q without settings", c.BrokerURL)
+	}
+
+	// No bridge needed.
+	answer = `{"settings": null, "country": "ir"}`
+	if c := config.withCircumventionSettings(); c.BrokerURL != config.BrokerURL || c.ICEServers != config.ICEServers {
+		t.Errorf("got %+v when no bridge is needed", c)
+	}
+}
@@ -0,0 +1,542 @@
+// Package snowflakeclient runs a snowflake client. It catches snowflakes
+// through the broker and carries the connections it accepts through them to
+// the bridge: SOCKS connections, as tor makes to a pluggable transport, and
+// optionally HTTP CONNECT requests and connections redirected by the
+// firewall. The snowflake-client command runs it for tor; the bitmask
+// daemon embeds it.
+package snowflakeclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	sf "0xacab.org/leap/bitmask-vpn/pkg/snowflake/lib"
+	pt "git.torproject.org/pluggable-transports/goptlib.git"
+	"git.torproject.org/pluggable-transports/snowflake.git/common/nat"
+	"github.com/pion/webrtc/v3"
+)
+
+// DefaultSocksAddr is where the SOCKS listener binds unless Config says
+// otherwise: any free port on the IPv4 loopback address.
+const DefaultSocksAddr = "127.0.0.1:0"
+
+// Config is what Start runs a client with.
+type Config struct {
+	Dialer DialerConfig
+	// How the sessions are carried and paced; nil for the process-wide
+	// settings of the lib package, such as sf.KCP.
+	Tuning *sf.Tuning
+
+	// Where to listen for SOCKS connections: an IP address and port, port
+	// 0 for any, or unix:PATH for a Unix socket. Only loopback addresses
+	// are allowed without SocksAuth. DefaultSocksAddr if empty.
+	SocksAddr string
+	// The USER:PASSWORD that SOCKS clients must log in with, given
+	// directly or in the file SocksAuthFile. See socksCredentials.
+	SocksAuth     string
+	SocksAuthFile string
+	// Limits on the SOCKS connections open at once and accepted per
+	// second; 0 for no limit.
+	MaxSocksConns   int
+	SocksAcceptRate float64
+	// Where to also accept HTTP CONNECT requests, and connections
+	// redirected by the firewall (Linux only), if not empty.
+	HTTPConnectAddr string
+	TransparentAddr string
+
+	// How many snowflakes to keep connected ahead of time.
+	Min int
+	// Whether to carry all connections over a single set of snowflakes.
+	Multiplex bool
+	// How long to keep the snowflakes that outlive the connections, those
+	// of Min and Multiplex, without any connection; 0 for ever.
+	DormantAfter time.Duration
+	// Whether to start over with new snowflakes and NAT probing when the
+	// network changes, and when the system resumes from sleep.
+	WatchNetwork bool
+	WatchSleep   bool
+	// How often to probe the NAT type again, so that the broker keeps
+	// matching us with compatible proxies when the NAT behaves differently
+	// later on; 0 to probe it only when the dialer is rebuilt.
+	NATProbeInterval time.Duration
+
+	// Whether to serve other users as a snowflake proxy while the tunnel
+	// is idle and the NAT is unrestricted: relaying up to GiveBackClients
+	// at once (1 if 0) to the bridge at GiveBackRelay
+	// (DefaultGiveBackRelay if empty), at GiveBackRate bytes per second
+	// in all (0 for no limit).
+	GiveBack        bool
+	GiveBackRelay   string
+	GiveBackClients int
+	GiveBackRate    int64
+
+	// Told how the connection changes, if not nil.
+	Events EventSink
+}
+
+// Client is a running snowflake client.
+type Client struct {
+	tongue      *dialerSwitch
+	socksTongue sf.Tongue
+	pool        *sf.PeerPool
+	shared      *sf.SharedSession
+	dormant     *dormancy
+	events      *eventRelay
+	// The connected snowflakes of the dialers of the client.
+	peers *sf.PeerGroup
+
+	socks       *socksSupervisor
+	httpConnect net.Listener
+	transparent net.Listener
+
+	reconfiguring sync.Mutex
+	// What NAT probing told about the network, a NetworkDiagnosis.
+	diagnosis atomic.Value
+	// Cancelled by Stop, to end the connections and the rendezvous in
+	// progress.
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// Start builds the dialer and starts listening, as cfg says.
+func Start(cfg Config) (*Client, error) {
+	if cfg.SocksAddr == "" {
+		cfg.SocksAddr = DefaultSocksAddr
+	}
+	var auth *socksCredentials
+	var err error
+	if cfg.SocksAuthFile != "" {
+		auth, err = loadSocksCredentials(cfg.SocksAuthFile)
+	} else if cfg.SocksAuth != "" {
+		auth, err = parseSocksCredentials(cfg.SocksAuth)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Tuning.Check(); err != nil {
+		return nil, err
+	}
+	// Only clients that log in may use a listener reachable from the network.
+	if err := checkListenAddr("SOCKS address", cfg.SocksAddr, auth != nil); err != nil {
+		return nil, err
+	}
+	if cfg.HTTPConnectAddr != "" {
+		if err := checkListenAddr("HTTP CONNECT address", cfg.HTTPConnectAddr, false); err != nil {
+			return nil, err
+		}
+	}
+
+	c := &Client{events: newEventRelay(cfg.Events)}
+	c.peers = sf.NewPeerGroup()
+	c.tongue = &dialerSwitch{scope: dialerScope{
+		events: c.events.dialerSink(),
+		peers:  c.peers,
+		tuning: cfg.Tuning,
+	}}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	if err := c.Reconfigure(cfg.Dialer); err != nil {
+		c.cancel()
+		return nil, err
+	}
+	c.socksTongue = c.tongue
+	if cfg.Min > 0 {
+		c.pool = sf.NewPeerPool(c.tongue, cfg.Min)
+		c.socksTongue = c.pool
+	}
+	if cfg.Multiplex {
+		c.shared = sf.NewSharedSession(c.socksTongue)
+	}
+	// Dormant mode only matters for the snowflakes that outlive the SOCKS
+	// connections: those of the pool and of the shared session.
+	if cfg.DormantAfter > 0 && (c.pool != nil || c.shared != nil) {
+		c.dormant = newDormancy(cfg.DormantAfter, func() {
+			if c.pool != nil {
+				c.pool.Sleep()
+			}
+			if c.shared != nil {
+				c.shared.Sleep()
+			}
+		}, func() {
+			if c.pool != nil {
+				c.pool.Wake()
+			}
+		})
+	}
+
+	ln, err := listenSocks(cfg.SocksAddr, auth)
+	if err != nil {
+		c.Stop()
+		return nil, fmt.Errorf("SOCKS listener: %v", err)
+	}
+	log.Printf("Started SOCKS listener at %v.", ln.Addr())
+	limit := newConnLimiter(cfg.MaxSocksConns, cfg.SocksAcceptRate)
+	c.socks = newSocksSupervisor("snowflake", ln, auth, func(ln *pt.SocksListener) error {
+		return socksAcceptLoop(c.ctx, ln, limit, c.tongue, c.socksTongue, c.shared, c.dormant, c.events, &c.wg)
+	})
+
+	if cfg.HTTPConnectAddr != "" {
+		c.httpConnect, err = listenLocal(cfg.HTTPConnectAddr)
+		if err != nil {
+			c.Stop()
+			return nil, fmt.Errorf("HTTP CONNECT listener: %v", err)
+		}
+		log.Printf("Started HTTP CONNECT listener at %v.", c.httpConnect.Addr())
+		go func() {
+			err := httpConnectAcceptLoop(c.ctx, c.httpConnect, c.socksTongue, c.shared, c.dormant, c.events, &c.wg)
+			log.Printf("HTTP CONNECT listener closed: %v", err)
+		}()
+	}
+	if cfg.TransparentAddr != "" {
+		c.transparent, err = listenTransparent(cfg.TransparentAddr)
+		if err != nil {
+			c.Stop()
+			return nil, fmt.Errorf("transparent listener: %v", err)
+		}
+		log.Printf("Started transparent listener at %v.", c.transparent.Addr())
+		go func() {
+			err := transparentAcceptLoop(c.ctx, c.transparent, c.socksTongue, c.shared, c.dormant, c.events, &c.wg)
+			log.Printf("Transparent listener closed: %v", err)
+		}()
+	}
+
+	if cfg.WatchNetwork {
+		go sf.WatchNetwork(c.ctx.Done(), c.StartOver)
+	}
+	if cfg.WatchSleep {
+		go sf.WatchSleep(c.ctx.Done(), func(time.Duration) { c.StartOver() })
+	}
+	if cfg.NATProbeInterval > 0 {
+		go c.reprobeNATType(cfg.NATProbeInterval)
+	}
+	if cfg.GiveBack {
+		go c.giveBack(cfg)
+	}
+	return c, nil
+}
+
+// SocksAddr returns the address of the SOCKS listener, as tor reads it in a
+// CMETHOD line.
+func (c *Client) SocksAddr() net.Addr {
+	return c.socks.addr()
+}
+
+// DialerConfig returns the settings the snowflakes are caught with.
+func (c *Client) DialerConfig() DialerConfig {
+	_, config := c.tongue.get()
+	return config
+}
+
+// NATType returns the NAT type the broker is told about.
+func (c *Client) NATType() string {
+	dialer, _ := c.tongue.get()
+	return dialer.BrokerChannel.GetNATType()
+}
+
+// NATBehavior returns how our NAT was found to map and filter UDP, if it
+// was probed successfully.
+func (c *Client) NATBehavior() sf.NATBehavior {
+	dialer, _ := c.tongue.get()
+	return dialer.BrokerChannel.GetNATBehavior()
+}
+
+// Reconfigure rebuilds the dialer with config, with its preset and the
+// circumvention settings applied if it asks for them, and probes the NAT
+// type again. Existing connections keep their sessions, but every
+// subsequent dial uses the new settings.
+func (c *Client) Reconfigure(config DialerConfig) error {
+	c.reconfiguring.Lock()
+	defer c.reconfiguring.Unlock()
+	config, err := config.withPreset()
+	if err != nil {
+		return fmt.Errorf("creating dialer: %v", err)
+	}
+	config = config.withCircumventionSettings()
+	dialer, iceServers, err := createDialer(config, c.tongue.scope)
+	if err != nil {
+		return fmt.Errorf("creating dialer: %v", err)
+	}
+	c.diagnosis.Store(NetworkUnknown)
+	if config.NATType != "" {
+		dialer.BrokerChannel.SetNATType(config.NATType)
+	} else {
+		go c.updateNATType(dialer, iceServers, config.Retry.Backoff, config.NATProbeTimeout)
+	}
+	c.tongue.set(dialer, config)
+	return nil
+}
+
+// StartOver rebuilds the dialer with the same settings, which probes the NAT
+// type again, and closes the snowflakes, so that the sessions redial, and the
+// idle connections to the broker. That is what to do when the network
+// changes or the system resumes from sleep: the connections made until then
+// are most likely dead, and the NAT type may be different.
+func (c *Client) StartOver() {
+	if err := c.Reconfigure(c.DialerConfig()); err != nil {
+		log.Printf("starting over: %v", err)
+	}
+	c.events.restart()
+	c.ClosePeers()
+	sf.CloseIdleBrokerConnections()
+}
+
+// ClosePeers closes the connected snowflakes of the client, leaving those of
+// the rest of the process. The sessions then redial through new snowflakes.
+func (c *Client) ClosePeers() {
+	c.peers.Close()
+}
+
+// Stop closes the listeners and the connections, and waits for their
+// handlers to end.
+func (c *Client) Stop() {
+	c.stopOnce.Do(func() {
+		if c.socks != nil {
+			c.socks.Close()
+		}
+		if c.httpConnect != nil {
+			c.httpConnect.Close()
+		}
+		if c.transparent != nil {
+			c.transparent.Close()
+		}
+		c.cancel()
+		if c.shared != nil {
+			c.shared.Close()
+		}
+		c.wg.Wait()
+		if c.pool != nil {
+			c.pool.Close()
+		}
+	})
+}
+
+// handleConn carries conn through snowflakes caught with tongue, or as a
+// stream of shared if it is not nil, until the handler ends or ctx is done.
+// The handlers grant the connection once they caught a snowflake, or reject
+// it with the reason they could not, which is reported to events.
+func handleConn(ctx context.Context, id string, conn net.Conn, tongue sf.Tongue, shared *sf.SharedSession,
+	events *eventRelay) {
+	var err error
+	traced := sf.TraceConn(conn, id)
+	if shared != nil {
+		err = shared.HandlerContext(ctx, traced)
+	} else {
+		err = sf.HandlerContext(ctx, traced, tongue)
+	}
+	if err != nil {
+		log.Printf("[%s] handler error: %s", id, err)
+		events.error(err)
+	}
+	log.Printf("[%s] Handler ended", id)
+}
+
+// Accept local SOCKS connections and pass them to the handler. Connections
+// whose SOCKS args override the rendezvous settings get their own dialer;
+// the others catch snowflakes with tongue, or are multiplexed over shared if
+// it is not nil. Clients are refused beyond the limits of limit. The
+// connections end once ctx is done. Returns the error that ended accepting.
+func socksAcceptLoop(ctx context.Context, ln *pt.SocksListener, limit *connLimiter,
+	dialers *dialerSwitch, tongue sf.Tongue, shared *sf.SharedSession, dormant *dormancy, events *eventRelay,
+	wg *sync.WaitGroup) error {
+	defer ln.Close()
+	for {
+		conn, err := ln.AcceptSocks()
+		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Temporary() {
+				continue
+			}
+			return err
+		}
+		id := sf.NewTraceID()
+		if err := limit.acquire(); err != nil {
+			log.Printf("[%s] SOCKS refused: %v", id, err)
+			conn.RejectReason(pt.SocksRepConnectionNotAllowed)
+			conn.Close()
+			continue
+		}
+		log.Printf("[%s] SOCKS accepted: %v", id, conn.Req)
+		dormant.begin()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer limit.release()
+			defer dormant.end()
+			defer conn.Close()
+
+			connTongue, err := dialers.forArgs(conn.Req.Args)
+			if err != nil {
+				log.Printf("[%s] SOCKS args error: %s", id, err)
+				conn.Reject()
+				return
+			}
+			connShared := shared
+			if connTongue == dialers {
+				connTongue = tongue
+			} else {
+				connShared = nil
+			}
+			handleConn(ctx, id, conn, connTongue, connShared, events)
+		}()
+	}
+}
+
+// How many more times to probe the NAT type after every STUN server failed.
+const natProbeRetries = 3
+
+// updateNATType probes the NAT type of dialer with the STUN servers. If none
+// of them is compatible with RFC 5780, or none answers, it tries again later
+// as backoff says. If none answers but the broker does, UDP is blocked, and
+// the dialer is adapted to that instead. It gives up once the client stops.
+func (c *Client) updateNATType(dialer *sf.WebRTCDialer, servers []webrtc.ICEServer, backoff sf.Backoff,
+	timeout time.Duration) {
+	broker := dialer.BrokerChannel
+	for i := 0; ; i++ {
+		err := probeNATType(c.ctx, servers, broker, timeout)
+		if err == nil {
+			if broker.GetNATBehavior().Mapping != sf.MappingUnknown {
+				c.setDiagnosis(NetworkOK)
+			}
+			return
+		}
+		if c.ctx.Err() != nil {
+			return
+		}
+		broker.SetNATType(nat.NATUnknown)
+		diagnosis := diagnose(c.ctx, err, broker)
+		c.setDiagnosis(diagnosis)
+		if diagnosis == NetworkUDPBlocked {
+			c.adaptToBlockedUDP(dialer, servers)
+			return
+		}
+		if i == natProbeRetries {
+			return
+		}
+		wait := backoff.Delay(i)
+		log.Printf("NAT probing failed: %v, retrying in %v", err, wait)
+		select {
+		case <-time.After(wait):
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// reprobeNATType probes the NAT type of the current dialer every interval
+// until the client stops. A failed probe keeps the NAT type known so far,
+// as STUN servers time out now and then without the NAT having changed.
+func (c *Client) reprobeNATType(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		dialer, config := c.tongue.get()
+		if config.NATType != "" {
+			continue
+		}
+		before := dialer.BrokerChannel.GetNATType()
+		err := probeNATType(c.ctx, ParseICEServers(config.ICEServers), dialer.BrokerChannel, config.NATProbeTimeout)
+		if err != nil {
+			log.Printf("NAT probing failed: %v, keeping NAT type %s", err, before)
+			continue
+		}
+		if c.Diagnosis() == NetworkUDPBlocked {
+			// Rebuild the dialer without the adaptations to blocked UDP.
+			log.Printf("UDP is no longer blocked")
+			if err := c.Reconfigure(config); err != nil {
+				log.Printf("reconfiguring: %v", err)
+			}
+			continue
+		}
+		if dialer.BrokerChannel.GetNATBehavior().Mapping != sf.MappingUnknown {
+			c.setDiagnosis(NetworkOK)
+		}
+		if after := dialer.BrokerChannel.GetNATType(); after != before {
+			log.Printf("NAT type changed from %s to %s", before, after)
+		}
+	}
+}
+
+// How long probeNATType waits for any STUN server to tell the NAT behavior,
+// unless told otherwise.
+const DefaultNATProbeTimeout = 30 * time.Second
+
+// probeNATType probes the NAT behavior with all STUN servers at once, and
+// sets it on broker from the first that tells it within timeout, or
+// DefaultNATProbeTimeout if it is 0, and before ctx is done. Without STUN
+// servers, there is nothing to probe.
+func probeNATType(ctx context.Context, servers []webrtc.ICEServer, broker *sf.BrokerChannel,
+	timeout time.Duration) error {
+	// NAT behavior discovery needs a STUN server; skip TURN servers. Leave
+	// out the servers that keep failing, unless all of them do.
+	var addrs, failing []string
+	for _, server := range servers {
+		if scheme, addr := splitScheme(server.URLs[0]); scheme != "stun" {
+			continue
+		} else if stunServerHealth.failing(addr) {
+			failing = append(failing, addr)
+		} else {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		addrs = failing
+	}
+	if len(addrs) == 0 {
+		return nil
+	}
+	defer logSTUNHealth()
+
+	type result struct {
+		addr     string
+		behavior sf.NATBehavior
+		err      error
+		took     time.Duration
+	}
+	if timeout == 0 {
+		timeout = DefaultNATProbeTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	results := make(chan result, len(addrs))
+	for _, addr := range addrs {
+		go func(addr string) {
+			start := time.Now()
+			behavior, err := sf.DiscoverNATBehavior(ctx, addr)
+			took := time.Since(start)
+			// Probes cut short by another server answering first tell
+			// nothing about this one.
+			if !errors.Is(err, context.Canceled) {
+				stunServerHealth.record(addr, took, err)
+			}
+			results <- result{addr, behavior, err, took}
+		}(addr)
+	}
+	var err error
+	for range addrs {
+		r := <-results
+		if r.err != nil {
+			log.Printf("NAT probing with %s failed after %v: %v", r.addr, r.took.Round(time.Millisecond), r.err)
+			// Fail with sf.ErrNoSTUNAnswer only if no server answered.
+			if err == nil || errors.Is(err, sf.ErrNoSTUNAnswer) && !errors.Is(r.err, sf.ErrNoSTUNAnswer) {
+				err = r.err
+			}
+			continue
+		}
+		log.Printf("NAT probing with %s took %v", r.addr, r.took.Round(time.Millisecond))
+		log.Printf("NAT behavior: %v", r.behavior)
+		broker.SetNATBehavior(r.behavior)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,76 @@
+package snowflakeclient
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// connLimiter bounds how many SOCKS connections are open at once, and how
+// many are accepted per second, so that a misbehaving client cannot make us
+// start handlers and catch snowflakes without end. A nil *connLimiter lets
+// every connection in.
+type connLimiter struct {
+	max  int
+	rate float64
+
+	lock   sync.Mutex
+	open   int
+	tokens float64
+	last   time.Time
+}
+
+// newConnLimiter returns a connLimiter allowing max connections at once and
+// rate new ones per second, in bursts of up to one second's worth; zero means
+// no limit. It returns nil if there is no limit at all.
+func newConnLimiter(max int, rate float64) *connLimiter {
+	if max <= 0 && rate <= 0 {
+		return nil
+	}
+	return &connLimiter{max: max, rate: rate, tokens: burst(rate), last: time.Now()}
+}
+
+// burst is how many connections may be accepted at once at rate.
+func burst(rate float64) float64 {
+	if rate < 1 {
+		return 1
+	}
+	return rate
+}
+
+// acquire lets a new connection in, or returns why it may not. A connection
+// let in must be released once it is closed.
+func (l *connLimiter) acquire() error {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.max > 0 && l.open >= l.max {
+		return fmt.Errorf("already %d connections open", l.open)
+	}
+	if l.rate > 0 {
+		now := time.Now()
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > burst(l.rate) {
+			l.tokens = burst(l.rate)
+		}
+		l.last = now
+		if l.tokens < 1 {
+			return fmt.Errorf("more than %g connections per second", l.rate)
+		}
+		l.tokens--
+	}
+	l.open++
+	return nil
+}
+
+// release is called when a connection let in by acquire is closed.
+func (l *connLimiter) release() {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.open--
+}
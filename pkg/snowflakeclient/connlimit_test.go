@@ -0,0 +1,38 @@
+package snowflakeclient
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnLimiter(t *testing.T) {
+	var none *connLimiter
+	if newConnLimiter(0, 0) != nil || none.acquire() != nil {
+		t.Error("expected no limit")
+	}
+	none.release()
+
+	l := newConnLimiter(2, 0)
+	if l.acquire() != nil || l.acquire() != nil {
+		t.Fatal("refused a connection under the limit")
+	}
+	if l.acquire() == nil {
+		t.Error("let a third connection in")
+	}
+	l.release()
+	if l.acquire() != nil {
+		t.Error("refused a connection after one was closed")
+	}
+
+	l = newConnLimiter(0, 2)
+	if l.acquire() != nil || l.acquire() != nil {
+		t.Fatal("refused the connections of a burst")
+	}
+	if l.acquire() == nil {
+		t.Error("let more than a burst in")
+	}
+	l.last = l.last.Add(-time.Second)
+	if l.acquire() != nil {
+		t.Error("refused a connection a second later")
+	}
+}
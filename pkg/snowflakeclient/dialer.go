@@ -0,0 +1,597 @@
+package snowflakeclient
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	sf "0xacab.org/leap/bitmask-vpn/pkg/snowflake/lib"
+	pt "git.torproject.org/pluggable-transports/goptlib.git"
+	"git.torproject.org/pluggable-transports/snowflake.git/common/nat"
+	"github.com/pion/webrtc/v3"
+)
+
+// DialerConfig holds the settings used to build a WebRTCDialer. They can be
+// changed while the client runs with Client.Reconfigure.
+type DialerConfig struct {
+	ICEServers         string // comma-separated list of ICE server URLs, as ParseICEServers reads them
+	ICEListURL         string // where to fetch a signed ICE server list from, replacing ICEServers unless that fails
+	ICEListKey         string // base64 Ed25519 public key the list must be signed with
+	ICEListCache       string // file to keep the list in until it expires, if not empty
+	Preset             string // settings preset for a censorship environment, such as ir; empty for none
+	PresetsFile        string // file to read the presets from instead of the built-in ones
+	SettingsURL        string // circumvention settings API, such as Moat's, to get the broker, fronts and ICE servers for the country from; empty not to
+	SettingsFront      string // front domain for SettingsURL, if any
+	SettingsCountry    string // country code to ask the settings for; empty for the API to tell from our address
+	SettingsCache      string // file to keep the settings in, if not empty
+	ClientToken        bool   // send the broker a random client token, for fair matching
+	ClientTokenFile    string // file to keep the client token in across restarts; empty to keep it for the process only
+	LastGoodFile       string // file to keep the last good rendezvous settings in, to try them first on the next start; empty not to
+	ICESelection       string // which ICE servers to offer each snowflake, ICESelectionRandomHalf if empty
+	ICECount           int    // how many servers the first-n and weighted selections offer
+	ProxyTypes         string // comma-separated proxy types to ask the broker for
+	Countries          string // comma-separated country codes to ask the broker for proxies from
+	ExcludeCountries   string // comma-separated country codes to ask the broker to avoid
+	BrokerURL          string
+	Fronts             string // comma-separated list of front domains
+	FrontsFile         string // file with more front domains, one per line
+	Rendezvous         string // comma-separated rendezvous methods to race
+	AMPCache           string
+	SQSQueue           string
+	SQSCreds           string
+	KeepLocalAddresses bool
+	ICEPolicy          string
+	PreferIPv6         bool
+	Reliability        sf.DataChannelReliability
+	SCTP               sf.SCTPOptions
+	StatsInterval      time.Duration
+	IdleTimeout        time.Duration
+	Lifetime           time.Duration // replace snowflakes connected for this long, ahead of the proxy going away; 0 not to
+	Quality            sf.QualityThresholds
+	UDPPortMin         uint // 0 for any port
+	UDPPortMax         uint
+	ICETCP             string // where to accept ICE-TCP connections from proxies, e.g. :9443; empty for no ICE-TCP
+	PortMapping        bool   // ask the router to forward the ICE UDP ports, through NAT-PMP or UPnP
+	Interface          string // network interface for the broker and ICE, e.g. wlan0; empty for any
+	Max                int
+	AdaptiveMax        bool // keep fewer than Max snowflakes while demand is low
+	ParallelDials      int
+	Proxy              *url.URL // upstream proxy, such as TOR_PT_PROXY; may be nil
+	RendezvousProxy    string   // SOCKS5 or HTTP proxy URL to reach the broker through instead, such as a working tor; empty for none
+	ClientHello        string
+	ECHConfig          string // base64 ECH config list
+	ECHResolver        string // DNS server to fetch the ECH config list from
+	BrokerKey          string // base64 Ed25519 public key broker answers must be signed with; empty for DefaultBrokerKey
+	BrokerPins         string // comma-separated sha256/BASE64 public key pins of the broker or front; empty for none
+	BrokerCAFile       string // PEM bundle of the CAs to trust for the broker instead of the system ones; empty for the system ones
+	Retry              sf.RetryPolicy
+	NATProbeTimeout    time.Duration // 0 for DefaultNATProbeTimeout
+	NATType            string        // tell the broker this NAT type instead of probing it, if not empty
+	Fingerprint        string        // of the bridge to ask the broker for; empty for its default
+	Bridges            string        // comma-separated fingerprints of bridges to spread sessions over, overriding Fingerprint
+	WebSocketURL       string        // ws or wss URL of the bridge to fall back to when WebRTC keeps failing; empty not to
+	WebSocketFront     string        // front domain for WebSocketURL, if any
+	WebSocketAfter     int           // how many failures in a row before falling back, 0 for DefaultWebSocketAfter
+}
+
+// withArgs returns a copy of c with the rendezvous SOCKS args of a bridge
+// line applied, and whether any of them changed it. Tor passes all the args
+// of the bridge line, so args that repeat the settings change nothing.
+func (c DialerConfig) withArgs(args pt.Args) (DialerConfig, bool, error) {
+	changed := false
+	set := func(field *string, name string) {
+		if value, ok := args.Get(name); ok && value != *field {
+			*field = value
+			changed = true
+		}
+	}
+	set(&c.BrokerURL, "url")
+	set(&c.Fronts, "front")
+	set(&c.Fronts, "fronts")
+	set(&c.AMPCache, "ampcache")
+	set(&c.SQSQueue, "sqsqueue")
+	set(&c.SQSCreds, "sqscreds")
+	if ice, ok := args.Get("ice"); ok && ice != c.ICEServers {
+		c.ICEServers = ice
+		c.ICEListURL = ""
+		changed = true
+	}
+	if max, ok := args.Get("max"); ok {
+		n, err := strconv.Atoi(max)
+		if err != nil || n < 1 {
+			return c, false, fmt.Errorf("invalid max=%q", max)
+		}
+		if n != c.Max {
+			c.Max = n
+			changed = true
+		}
+	}
+	// Bridge lines carry the fingerprint of their bridge, which only needs
+	// a dialer of its own when it is another bridge.
+	if fingerprint, ok := args.Get("fingerprint"); ok && !strings.EqualFold(fingerprint, c.Fingerprint) {
+		c.Fingerprint = fingerprint
+		c.Bridges = ""
+		changed = true
+	}
+	return c, changed, nil
+}
+
+// frontDomains returns the front domains given with -fronts and those read
+// from -fronts-file. Blank lines and lines starting with # in the file are
+// ignored.
+func (c DialerConfig) frontDomains() ([]string, error) {
+	var fronts []string
+	for _, front := range strings.Split(c.Fronts, ",") {
+		if front = strings.TrimSpace(front); front != "" {
+			fronts = append(fronts, front)
+		}
+	}
+	if c.FrontsFile == "" {
+		return fronts, nil
+	}
+	data, err := ioutil.ReadFile(c.FrontsFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			fronts = append(fronts, line)
+		}
+	}
+	return fronts, nil
+}
+
+// proxyPreferences returns the proxies to ask the broker for.
+func (c DialerConfig) proxyPreferences() sf.ProxyPreferences {
+	return sf.ProxyPreferences{
+		Types:            splitList(c.ProxyTypes, strings.ToLower),
+		Countries:        splitList(c.Countries, strings.ToUpper),
+		ExcludeCountries: splitList(c.ExcludeCountries, strings.ToUpper),
+	}
+}
+
+// splitList splits a comma-separated list, leaving out empty items and
+// normalizing the others with norm.
+func splitList(s string, norm func(string) string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, norm(item))
+		}
+	}
+	return list
+}
+
+// rendezvousMethods returns the names of the rendezvous methods to use.
+// Unless they are given explicitly, the AMP cache and SQS are used when
+// configured, and raced if both are, and the broker is contacted directly
+// otherwise.
+func (c DialerConfig) rendezvousMethods() []string {
+	var methods []string
+	for _, name := range strings.Split(c.Rendezvous, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			methods = append(methods, name)
+		}
+	}
+	if len(methods) > 0 {
+		return methods
+	}
+	if c.AMPCache != "" {
+		methods = append(methods, "ampcache")
+	}
+	if c.SQSQueue != "" {
+		methods = append(methods, "sqs")
+	}
+	if len(methods) == 0 {
+		methods = append(methods, "http")
+	}
+	return methods
+}
+
+// rendezvousProxy parses RendezvousProxy.
+func (c DialerConfig) rendezvousProxy() (*url.URL, error) {
+	proxyURL, err := url.Parse(c.RendezvousProxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rendezvous proxy: %v", err)
+	}
+	if err := sf.CheckProxyProtocolSupport(proxyURL); err != nil {
+		return nil, fmt.Errorf("rendezvous proxy: %v", err)
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("rendezvous proxy %q has no address", c.RendezvousProxy)
+	}
+	return proxyURL, nil
+}
+
+// DefaultBrokerKey is the base64 Ed25519 public key broker answers must be
+// signed with when DialerConfig.BrokerKey is empty. Builds for a broker that
+// signs its answers set it with
+// -ldflags "-X 0xacab.org/leap/bitmask-vpn/pkg/snowflakeclient.DefaultBrokerKey=...".
+var DefaultBrokerKey string
+
+// brokerKey decodes BrokerKey, or else DefaultBrokerKey. It returns nil if
+// both are empty: answers are then not signed.
+func (c DialerConfig) brokerKey() (ed25519.PublicKey, error) {
+	encoded := c.BrokerKey
+	if encoded == "" {
+		encoded = DefaultBrokerKey
+	}
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid broker key %q", encoded)
+	}
+	return key, nil
+}
+
+// brokerTrust reads the CA bundle of BrokerCAFile, if any, and splits
+// BrokerPins.
+func (c DialerConfig) brokerTrust() ([]byte, []string, error) {
+	var rootCAs []byte
+	if c.BrokerCAFile != "" {
+		var err error
+		rootCAs, err = ioutil.ReadFile(c.BrokerCAFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("broker CA bundle: %v", err)
+		}
+	}
+	var pins []string
+	for _, pin := range strings.Split(c.BrokerPins, ",") {
+		if pin = strings.TrimSpace(pin); pin != "" {
+			pins = append(pins, pin)
+		}
+	}
+	return rootCAs, pins, nil
+}
+
+// echConfigList returns the ECH config list to use for the broker, either
+// given directly or fetched from the HTTPS DNS record of the broker host.
+func (c DialerConfig) echConfigList() ([]byte, error) {
+	if c.ECHConfig != "" {
+		return base64.StdEncoding.DecodeString(c.ECHConfig)
+	}
+	if c.ECHResolver == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(c.BrokerURL)
+	if err != nil {
+		return nil, err
+	}
+	list, err := sf.FetchECHConfigList(u.Hostname(), c.ECHResolver)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Using ECH config list of %s from DNS", u.Hostname())
+	return list, nil
+}
+
+// iceServers returns the ICE servers from the signed list, if there is one
+// and it can be had, or else the configured ones.
+func (c DialerConfig) iceServers() ([]webrtc.ICEServer, error) {
+	if c.ICEListURL == "" {
+		return ParseICEServers(c.ICEServers), nil
+	}
+	key, err := base64.StdEncoding.DecodeString(c.ICEListKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid ICE server list key %q", c.ICEListKey)
+	}
+	transport, err := sf.NewBrokerTransport(sf.BrokerTransportConfig{
+		Proxy:       c.Proxy,
+		ClientHello: c.ClientHello,
+		Interface:   c.Interface,
+	})
+	if err != nil {
+		return nil, err
+	}
+	source := iceListSource{url: c.ICEListURL, key: key, cacheFile: c.ICEListCache, transport: transport}
+	servers, err := source.servers()
+	if err != nil {
+		log.Printf("Getting the ICE server list: %v; using the configured ICE servers", err)
+		return ParseICEServers(c.ICEServers), nil
+	}
+	return ParseICEServers(servers), nil
+}
+
+// dialerScope is what the dialers of a client share.
+type dialerScope struct {
+	events func(sf.Event) // where the events of their snowflakes also go, if not nil
+	peers  *sf.PeerGroup  // where their connected snowflakes are kept
+	tuning *sf.Tuning     // how their sessions are tuned, nil for the process-wide settings
+}
+
+// createDialer builds a WebRTCDialer, and the BrokerChannel it rendezvous
+// through, from the given settings, in scope. It also returns the ICE
+// servers the dialer picks the servers of each snowflake from.
+func createDialer(c DialerConfig, scope dialerScope) (*sf.WebRTCDialer, []webrtc.ICEServer, error) {
+	icePolicy, err := sf.ParseICEPolicy(c.ICEPolicy)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch c.NATType {
+	case "", nat.NATUnknown, nat.NATRestricted, nat.NATUnrestricted:
+	default:
+		return nil, nil, fmt.Errorf("unknown NAT type %q", c.NATType)
+	}
+	iceServers, err := c.iceServers()
+	if err != nil {
+		return nil, nil, err
+	}
+	selectICEServers, err := iceServerSelector(c.ICESelection, c.ICECount)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Printf("Using ICE servers:")
+	for _, server := range iceServers {
+		log.Printf("url: %v", strings.Join(server.URLs, " "))
+	}
+
+	echConfigList, err := c.echConfigList()
+	if err != nil {
+		return nil, nil, err
+	}
+	transportConfig := sf.BrokerTransportConfig{
+		Proxy:         c.Proxy,
+		ClientHello:   c.ClientHello,
+		ECHConfigList: echConfigList,
+		Interface:     c.Interface,
+	}
+	transport, err := sf.NewBrokerTransport(transportConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The pins and the CA bundle are for the broker, not for the bridge
+	// that the WebSocket fallback connects to.
+	brokerConfig := transportConfig
+	brokerConfig.RootCAs, brokerConfig.Pins, err = c.brokerTrust()
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.RendezvousProxy != "" {
+		proxyURL, err := c.rendezvousProxy()
+		if err != nil {
+			return nil, nil, err
+		}
+		// The proxy, such as tor on the loopback address, finds its own
+		// way to the broker.
+		brokerConfig.Proxy = proxyURL
+		brokerConfig.Interface = ""
+		log.Printf("Rendezvous through the proxy %s://%s", proxyURL.Scheme, proxyURL.Host)
+	}
+	brokerTransport, err := sf.NewBrokerTransport(brokerConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	fronts, err := c.frontDomains()
+	if err != nil {
+		return nil, nil, err
+	}
+	// Use potentially domain-fronting broker to rendezvous.
+	broker, err := sf.NewBrokerChannel(
+		c.BrokerURL, "", brokerTransport, c.KeepLocalAddresses)
+	if err != nil {
+		return nil, nil, err
+	}
+	broker.SetFronts(fronts)
+	broker.SetRetryPolicy(c.Retry)
+	if err := broker.SetBridgeFingerprint(c.Fingerprint); err != nil {
+		return nil, nil, err
+	}
+	answerKey, err := c.brokerKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	broker.SetAnswerKey(answerKey)
+	if c.ClientToken {
+		broker.SetClientToken(clientTokenFor(c.ClientTokenFile).get)
+	}
+	prefs := c.proxyPreferences()
+	if err := prefs.Check(); err != nil {
+		return nil, nil, err
+	}
+	broker.SetProxyPreferences(prefs)
+	var bridges *sf.BridgeBalancer
+	if fingerprints := splitList(c.Bridges, strings.ToUpper); len(fingerprints) > 0 {
+		bridges, err = sf.NewBridgeBalancer(fingerprints)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	methods := c.rendezvousMethods()
+	err = broker.UseRendezvousMethods(methods, map[string]string{
+		"ampcache": c.AMPCache,
+		"sqsqueue": c.SQSQueue,
+		"sqscreds": c.SQSCreds,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	events := scope.events
+	var lastGood *lastGoodStore
+	if c.LastGoodFile != "" {
+		lastGood = &lastGoodStore{file: c.LastGoodFile}
+		sink := events
+		events = func(e sf.Event) {
+			if sink != nil {
+				sink(e)
+			}
+			if e.Type == sf.EventPeerConnected {
+				lastGood.save(broker.LastGood())
+			}
+		}
+	}
+
+	dialer := sf.NewWebRTCDialer(broker, sf.WithICEServers(iceServers), sf.WithCapacity(c.Max),
+		sf.WithProxy(c.Proxy), sf.WithEventSink(events), sf.WithPeerGroup(scope.peers), sf.WithTuning(scope.tuning))
+	dialer.SetICEPolicy(icePolicy)
+	dialer.SetICEServerSelector(selectICEServers)
+	if lastGood != nil {
+		if good, err := lastGood.load(); err == nil {
+			preferLastGood(dialer, good, c.BrokerURL, c.NATType, selectICEServers)
+		}
+	}
+	dialer.SetAdaptiveCapacity(c.AdaptiveMax)
+	dialer.SetBridges(bridges)
+	if c.WebSocketURL != "" {
+		after := c.WebSocketAfter
+		if after == 0 {
+			after = DefaultWebSocketAfter
+		}
+		fallback, err := sf.NewWebSocketFallback(c.WebSocketURL, c.WebSocketFront, transport, after)
+		if err != nil {
+			return nil, nil, err
+		}
+		dialer.SetWebSocketFallback(fallback)
+	}
+	dialer.SetPreferIPv6(c.PreferIPv6)
+	dialer.SetParallelDials(c.ParallelDials)
+	dialer.SetStatsInterval(c.StatsInterval)
+	dialer.SetIdleTimeout(c.IdleTimeout)
+	dialer.SetLifetime(c.Lifetime)
+	dialer.SetQualityThresholds(c.Quality)
+	if err := dialer.SetDataChannelReliability(c.Reliability); err != nil {
+		return nil, nil, err
+	}
+	if err := dialer.SetSCTPOptions(c.SCTP); err != nil {
+		return nil, nil, err
+	}
+	if err := dialer.SetInterface(c.Interface); err != nil {
+		return nil, nil, err
+	}
+	if err := dialer.SetICETCP(c.ICETCP); err != nil {
+		return nil, nil, err
+	}
+	if c.UDPPortMin > 65535 || c.UDPPortMax > 65535 {
+		return nil, nil, fmt.Errorf("invalid UDP port range %d-%d", c.UDPPortMin, c.UDPPortMax)
+	}
+	if c.UDPPortMin != 0 || c.UDPPortMax != 0 {
+		err := dialer.SetUDPPortRange(uint16(c.UDPPortMin), uint16(c.UDPPortMax))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := dialer.SetPortMapping(c.PortMapping); err != nil {
+		return nil, nil, err
+	}
+	return dialer, iceServers, nil
+}
+
+// How many snowflakes in a row must fail to be caught before falling back to
+// WebSocket, unless told otherwise.
+const DefaultWebSocketAfter = 3
+
+// How many dialers built from SOCKS args dialerSwitch keeps for reuse.
+const maxArgsDialers = 8
+
+// dialerSwitch is the |Tongue| handed to the SOCKS accept loop. It allows
+// the underlying WebRTCDialer to be replaced on reload.
+type dialerSwitch struct {
+	lock   sync.RWMutex
+	dialer *sf.WebRTCDialer
+	config DialerConfig
+	// What the dialers built from it share.
+	scope dialerScope
+
+	argsLock sync.Mutex
+	// The dialers built by forArgs from the settings of argsBase.
+	argsBase *sf.WebRTCDialer
+	byArgs   map[DialerConfig]*sf.WebRTCDialer
+}
+
+func (d *dialerSwitch) get() (*sf.WebRTCDialer, DialerConfig) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.dialer, d.config
+}
+
+func (d *dialerSwitch) set(dialer *sf.WebRTCDialer, config DialerConfig) {
+	d.lock.Lock()
+	d.dialer = dialer
+	d.config = config
+	d.lock.Unlock()
+}
+
+// forArgs returns the |Tongue| to use for a SOCKS connection. Without any
+// rendezvous args that is the shared dialer; otherwise it is a dialer built
+// from the current settings with the args applied, once for each set of
+// args, keeping up to maxArgsDialers of them until the settings change. It
+// takes the NAT type of the shared dialer, as probed so far.
+func (d *dialerSwitch) forArgs(args pt.Args) (sf.Tongue, error) {
+	dialer, config := d.get()
+	config, changed, err := config.withArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	if !changed {
+		return d, nil
+	}
+	d.argsLock.Lock()
+	defer d.argsLock.Unlock()
+	if d.argsBase != dialer {
+		d.argsBase = dialer
+		d.byArgs = make(map[DialerConfig]*sf.WebRTCDialer)
+	}
+	connDialer := d.byArgs[config]
+	if connDialer == nil {
+		log.Printf("Using rendezvous settings from SOCKS args")
+		connDialer, _, err = createDialer(config, d.scope)
+		if err != nil {
+			return nil, err
+		}
+		if len(d.byArgs) >= maxArgsDialers {
+			// The connections using the one dropped keep it.
+			for evicted := range d.byArgs {
+				delete(d.byArgs, evicted)
+				break
+			}
+		}
+		d.byArgs[config] = connDialer
+	}
+	connDialer.SetNATType(dialer.GetNATType())
+	return connDialer, nil
+}
+
+func (d *dialerSwitch) Catch() (*sf.WebRTCPeer, error) {
+	dialer, _ := d.get()
+	return dialer.Catch()
+}
+
+func (d *dialerSwitch) CatchContext(ctx context.Context) (*sf.WebRTCPeer, error) {
+	dialer, _ := d.get()
+	return dialer.CatchContext(ctx)
+}
+
+func (d *dialerSwitch) GetMax() int {
+	dialer, _ := d.get()
+	return dialer.GetMax()
+}
+
+func (d *dialerSwitch) GetCeiling() int {
+	dialer, _ := d.get()
+	return dialer.GetCeiling()
+}
+
+func (d *dialerSwitch) Bridges() *sf.BridgeBalancer {
+	dialer, _ := d.get()
+	return dialer.Bridges()
+}
+
+func (d *dialerSwitch) WebSocketFallback() *sf.WebSocketFallback {
+	dialer, _ := d.get()
+	return dialer.WebSocketFallback()
+}
+
+func (d *dialerSwitch) Tuning() *sf.Tuning {
+	return d.scope.tuning
+}
@@ -0,0 +1,79 @@
+package snowflakeclient
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// dormancy puts the snowflakes kept ahead of time to sleep once there have
+// been no SOCKS connections for a while, and wakes them up on the next one.
+// A nil *dormancy does nothing.
+type dormancy struct {
+	after time.Duration
+	sleep func()
+	wake  func()
+
+	lock    sync.Mutex
+	active  int
+	dormant bool
+	timer   *time.Timer
+	// Counts the idle periods, so that a timer firing late for an
+	// earlier one is ignored.
+	idle int
+}
+
+// newDormancy returns a dormancy calling sleep after an idle period of after,
+// starting now, and wake when a connection comes after that.
+func newDormancy(after time.Duration, sleep, wake func()) *dormancy {
+	d := &dormancy{after: after, sleep: sleep, wake: wake}
+	d.lock.Lock()
+	d.startIdle()
+	d.lock.Unlock()
+	return d
+}
+
+// begin is called when a SOCKS connection is accepted.
+func (d *dormancy) begin() {
+	if d == nil {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.active++
+	d.idle++
+	d.timer.Stop()
+	if d.dormant {
+		d.dormant = false
+		log.Println("Waking up from dormant mode")
+		d.wake()
+	}
+}
+
+// end is called when a SOCKS connection is closed.
+func (d *dormancy) end() {
+	if d == nil {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.active--
+	if d.active == 0 {
+		d.startIdle()
+	}
+}
+
+// startIdle starts an idle period. d.lock must be held.
+func (d *dormancy) startIdle() {
+	idle := d.idle
+	d.timer = time.AfterFunc(d.after, func() {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		if d.idle != idle || d.active > 0 || d.dormant {
+			return
+		}
+		d.dormant = true
+		log.Printf("No SOCKS connections for %v, going dormant", d.after)
+		d.sleep()
+	})
+}
@@ -0,0 +1,45 @@
+package snowflakeclient
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDormancy(t *testing.T) {
+	sleeps := make(chan struct{}, 10)
+	wakes := make(chan struct{}, 10)
+	d := newDormancy(50*time.Millisecond,
+		func() { sleeps <- struct{}{} },
+		func() { wakes <- struct{}{} })
+
+	select {
+	case <-sleeps:
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not go dormant without connections")
+	}
+
+	d.begin()
+	select {
+	case <-wakes:
+	default:
+		t.Fatal("did not wake up on a connection")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if len(sleeps) != 0 {
+		t.Fatal("went dormant with an active connection")
+	}
+
+	d.end()
+	select {
+	case <-sleeps:
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not go dormant after the last connection")
+	}
+	if len(wakes) != 0 {
+		t.Fatal("woke up without a connection")
+	}
+
+	var off *dormancy
+	off.begin()
+	off.end()
+}
@@ -0,0 +1,89 @@
+package snowflakeclient
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	sf "0xacab.org/leap/bitmask-vpn/pkg/snowflake/lib"
+)
+
+// EventSink is told how the connection of a client changes, for an
+// application to show without reading the log. The methods are called one at
+// a time, from the goroutines of the client, and must return quickly.
+type EventSink interface {
+	// A rendezvous with the broker started to catch the snowflake id.
+	OnRendezvousStarted(id string)
+	// The snowflake id connected, and can carry traffic.
+	OnPeerConnected(id string)
+	// The connected snowflake id was closed.
+	OnPeerLost(id string)
+	// The first snowflake connected since the client started, or started
+	// over: connections can go through from now on.
+	OnBootstrapped()
+	// A connection could not be carried, e.g. because no snowflake could
+	// be caught for it.
+	OnError(err error)
+}
+
+// eventRelay passes the events of the snowflakes of a client to its
+// EventSink. A nil *eventRelay drops them.
+type eventRelay struct {
+	lock         sync.Mutex
+	sink         EventSink
+	bootstrapped bool
+}
+
+// newEventRelay returns a relay to sink, or nil if sink is nil.
+func newEventRelay(sink EventSink) *eventRelay {
+	if sink == nil {
+		return nil
+	}
+	return &eventRelay{sink: sink}
+}
+
+// dialerSink returns the function to give the dialers with
+// sf.WithEventSink, or nil if r is nil.
+func (r *eventRelay) dialerSink() func(sf.Event) {
+	if r == nil {
+		return nil
+	}
+	return r.event
+}
+
+func (r *eventRelay) event(e sf.Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	switch e.Type {
+	case sf.EventBrokerContacted:
+		r.sink.OnRendezvousStarted(e.ID)
+	case sf.EventPeerConnected:
+		r.sink.OnPeerConnected(e.ID)
+		if !r.bootstrapped {
+			r.bootstrapped = true
+			r.sink.OnBootstrapped()
+		}
+	case sf.EventPeerDisconnected:
+		r.sink.OnPeerLost(e.ID)
+	}
+}
+
+// error reports err, unless it is from the client being stopped.
+func (r *eventRelay) error(err error) {
+	if r == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.sink.OnError(err)
+}
+
+// restart makes the next snowflake to connect bootstrap the client again.
+func (r *eventRelay) restart() {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.bootstrapped = false
+}
@@ -0,0 +1,57 @@
+package snowflakeclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	sf "0xacab.org/leap/bitmask-vpn/pkg/snowflake/lib"
+)
+
+// recordingSink records the calls made to it.
+type recordingSink []string
+
+func (s *recordingSink) OnRendezvousStarted(id string) { *s = append(*s, "rendezvous "+id) }
+func (s *recordingSink) OnPeerConnected(id string)     { *s = append(*s, "connected "+id) }
+func (s *recordingSink) OnPeerLost(id string)          { *s = append(*s, "lost "+id) }
+func (s *recordingSink) OnBootstrapped()               { *s = append(*s, "bootstrapped") }
+func (s *recordingSink) OnError(err error)             { *s = append(*s, fmt.Sprint("error ", err)) }
+
+func TestEventRelay(t *testing.T) {
+	if newEventRelay(nil).dialerSink() != nil {
+		t.Error("a relay without a sink gave the dialers a sink")
+	}
+	newEventRelay(nil).error(errors.New("dropped"))
+
+	var sink recordingSink
+	r := newEventRelay(&sink)
+	for _, e := range []sf.Event{
+		{Type: sf.EventBrokerContacted, ID: "a"},
+		{Type: sf.EventOfferSent, ID: "a"},
+		{Type: sf.EventPeerConnected, ID: "a"},
+		{Type: sf.EventPeerConnected, ID: "b"},
+		{Type: sf.EventPeerDisconnected, ID: "a"},
+	} {
+		r.dialerSink()(e)
+	}
+	r.error(context.Canceled)
+	r.error(errors.New("no proxies"))
+	r.restart()
+	r.dialerSink()(sf.Event{Type: sf.EventPeerConnected, ID: "c"})
+
+	expected := recordingSink{
+		"rendezvous a",
+		"connected a",
+		"bootstrapped",
+		"connected b",
+		"lost a",
+		"error no proxies",
+		"connected c",
+		"bootstrapped",
+	}
+	if !reflect.DeepEqual(sink, expected) {
+		t.Errorf("got calls %q, expected %q", sink, expected)
+	}
+}
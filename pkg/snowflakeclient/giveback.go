@@ -0,0 +1,153 @@
+package snowflakeclient
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	sf "0xacab.org/leap/bitmask-vpn/pkg/snowflake/lib"
+	"git.torproject.org/pluggable-transports/snowflake.git/common/nat"
+)
+
+// DefaultGiveBackRelay is the bridge that the volunteer proxy relays the
+// clients it serves to, unless Config says otherwise.
+const DefaultGiveBackRelay = "wss://snowflake.torproject.net/"
+
+// How often giving back is reconsidered, and how many bytes the SOCKS
+// connections may carry in that time for the tunnel to count as idle.
+const (
+	giveBackInterval  = time.Minute
+	giveBackIdleBytes = 64 << 10
+)
+
+// giveBack runs a volunteer proxy while the tunnel is idle and the NAT lets
+// any proxy reach us, which is when other users can reach us too, and stops
+// it as soon as either no longer holds.
+type giveBack struct {
+	// The traffic of the SOCKS connections, sf.ConnTraffic.
+	traffic func() []sf.Traffic
+	// Whether the NAT is fit to serve others.
+	unrestricted func() bool
+	// Runs the volunteer proxy until ctx is done.
+	serve func(ctx context.Context)
+
+	lock sync.Mutex
+	// How many bytes each SOCKS connection had carried at the last check.
+	last   map[string]int64
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// moved returns how many bytes the SOCKS connections carried since the
+// last call.
+func (g *giveBack) moved() int64 {
+	var n int64
+	now := make(map[string]int64)
+	for _, t := range g.traffic() {
+		now[t.ID] = t.Up + t.Down
+		n += now[t.ID] - g.last[t.ID]
+	}
+	g.last = now
+	return n
+}
+
+// check starts or stops the volunteer proxy as the traffic since the last
+// check and the NAT type tell.
+func (g *giveBack) check() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	idle := g.moved() < giveBackIdleBytes
+	if idle && g.unrestricted() {
+		if g.cancel == nil {
+			log.Printf("Volunteer proxy: the tunnel is idle, serving other users")
+			var ctx context.Context
+			ctx, g.cancel = context.WithCancel(context.Background())
+			g.done = make(chan struct{})
+			go func(done chan struct{}) {
+				defer close(done)
+				g.serve(ctx)
+			}(g.done)
+		}
+		return
+	}
+	if g.cancel != nil {
+		log.Printf("Volunteer proxy: stopping, the tunnel is in use or the NAT is restricted")
+		g.stopLocked()
+	}
+}
+
+// stop stops the volunteer proxy, if it runs, and waits for it to end.
+func (g *giveBack) stop() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.stopLocked()
+}
+
+func (g *giveBack) stopLocked() {
+	if g.cancel == nil {
+		return
+	}
+	g.cancel()
+	<-g.done
+	g.cancel = nil
+}
+
+// giveBack serves other users as cfg says while the client is idle, until
+// the client is stopped.
+func (c *Client) giveBack(cfg Config) {
+	g := &giveBack{
+		traffic: sf.ConnTraffic,
+		unrestricted: func() bool {
+			return c.NATType() == nat.NATUnrestricted
+		},
+		serve: func(ctx context.Context) {
+			c.runVolunteerProxy(ctx, cfg)
+		},
+	}
+	defer g.stop()
+	ticker := time.NewTicker(giveBackInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			g.check()
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// runVolunteerProxy runs a volunteer proxy with the broker and network
+// settings of the current dialer until ctx is done.
+func (c *Client) runVolunteerProxy(ctx context.Context, cfg Config) {
+	dialer, config := c.tongue.get()
+	// The bridge is reached as the broker is, without its pins.
+	transport, err := sf.NewBrokerTransport(sf.BrokerTransportConfig{
+		Proxy:     config.Proxy,
+		Interface: config.Interface,
+	})
+	if err != nil {
+		log.Printf("Volunteer proxy: %v", err)
+		return
+	}
+	relay := cfg.GiveBackRelay
+	if relay == "" {
+		relay = DefaultGiveBackRelay
+	}
+	clients := cfg.GiveBackClients
+	if clients == 0 {
+		clients = 1
+	}
+	proxy, err := sf.NewVolunteerProxy(dialer, sf.VolunteerProxyConfig{
+		RelayURL:  relay,
+		Transport: transport,
+		Capacity:  clients,
+		Rate:      cfg.GiveBackRate,
+	})
+	if err != nil {
+		log.Printf("Volunteer proxy: %v", err)
+		return
+	}
+	proxy.Run(ctx)
+}
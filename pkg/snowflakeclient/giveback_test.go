@@ -0,0 +1,64 @@
+package snowflakeclient
+
+import (
+	"context"
+	"testing"
+
+	sf "0xacab.org/leap/bitmask-vpn/pkg/snowflake/lib"
+)
+
+func TestGiveBack(t *testing.T) {
+	var traffic []sf.Traffic
+	unrestricted := true
+	running := make(chan bool, 1)
+	g := &giveBack{
+		traffic:      func() []sf.Traffic { return traffic },
+		unrestricted: func() bool { return unrestricted },
+		serve: func(ctx context.Context) {
+			running <- true
+			<-ctx.Done()
+			running <- false
+		},
+	}
+	expect := func(want bool) {
+		t.Helper()
+		if got := <-running; got != want {
+			t.Fatalf("running: got %v, want %v", got, want)
+		}
+	}
+
+	// Busy: a connection moved a lot since it opened.
+	traffic = []sf.Traffic{{ID: "a", Up: giveBackIdleBytes, Down: 1}}
+	g.check()
+	if g.cancel != nil {
+		t.Fatal("serving while busy")
+	}
+
+	// Idle: it moved little since the last check.
+	traffic = []sf.Traffic{{ID: "a", Up: giveBackIdleBytes + 10, Down: 1}}
+	g.check()
+	expect(true)
+	g.check()
+	if len(running) != 0 {
+		t.Fatal("served twice")
+	}
+
+	// A new connection moving a lot stops it.
+	traffic = append(traffic, sf.Traffic{ID: "b", Down: giveBackIdleBytes})
+	g.check()
+	expect(false)
+
+	// So does a restricted NAT.
+	g.check()
+	expect(true)
+	unrestricted = false
+	g.check()
+	expect(false)
+
+	unrestricted = true
+	g.check()
+	expect(true)
+	g.stop()
+	expect(false)
+	g.stop()
+}
@@ -0,0 +1,117 @@
+package snowflakeclient
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	sf "0xacab.org/leap/bitmask-vpn/pkg/snowflake/lib"
+	pt "git.torproject.org/pluggable-transports/goptlib.git"
+)
+
+// How long a client has to send its CONNECT request, as goptlib gives SOCKS
+// clients for their handshake.
+const httpConnectRequestTimeout = 5 * time.Second
+
+// httpConnectAcceptLoop accepts HTTP CONNECT requests on ln and tunnels them
+// through snowflakes caught with tongue, or multiplexed over shared if it is
+// not nil, the way socksAcceptLoop does SOCKS connections. As with SOCKS, the
+// requested host is not used: the tunnel leads to the bridge. Returns the
+// error that ended accepting.
+func httpConnectAcceptLoop(ctx context.Context, ln net.Listener, tongue sf.Tongue, shared *sf.SharedSession,
+	dormant *dormancy, events *eventRelay, wg *sync.WaitGroup) error {
+	defer ln.Close()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Temporary() {
+				continue
+			}
+			return err
+		}
+		id := sf.NewTraceID()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer c.Close()
+
+			conn, err := readHTTPConnect(c)
+			if err != nil {
+				log.Printf("[%s] HTTP CONNECT error: %s", id, err)
+				return
+			}
+			log.Printf("[%s] HTTP CONNECT accepted: %s", id, conn.target)
+			dormant.begin()
+			defer dormant.end()
+			handleConn(ctx, id, conn, tongue, shared, events)
+		}()
+	}
+}
+
+// httpConnectConn is a connection that sent a CONNECT request. Like a
+// *pt.SocksConn, it is granted or rejected by the handler, which answers the
+// request.
+type httpConnectConn struct {
+	net.Conn
+	// Holds what the client sent after its request.
+	r      *bufio.Reader
+	target string
+}
+
+// readHTTPConnect reads the request on c, and answers it if it is not a
+// CONNECT request.
+func readHTTPConnect(c net.Conn) (*httpConnectConn, error) {
+	if err := c.SetDeadline(time.Now().Add(httpConnectRequestTimeout)); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(c)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	if req.Method != http.MethodConnect {
+		writeHTTPStatus(c, http.StatusMethodNotAllowed, "Allow: CONNECT\r\n")
+		return nil, fmt.Errorf("unsupported method %s", req.Method)
+	}
+	if err := c.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return &httpConnectConn{Conn: c, r: r, target: req.Host}, nil
+}
+
+func (c *httpConnectConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Grant tells the client that the tunnel is open.
+func (c *httpConnectConn) Grant(*net.TCPAddr) error {
+	_, err := fmt.Fprintf(c.Conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return err
+}
+
+func (c *httpConnectConn) Reject() error {
+	return c.RejectReason(pt.SocksRepGeneralFailure)
+}
+
+// RejectReason answers with the HTTP status closest to the SOCKS5 reply
+// code reason.
+func (c *httpConnectConn) RejectReason(reason byte) error {
+	status := http.StatusBadGateway
+	if reason == pt.SocksRepTTLExpired {
+		status = http.StatusGatewayTimeout
+	}
+	return writeHTTPStatus(c.Conn, status, "")
+}
+
+// writeHTTPStatus writes an empty response with status and the header lines
+// in header.
+func writeHTTPStatus(c net.Conn, status int, header string) error {
+	_, err := fmt.Fprintf(c, "HTTP/1.1 %d %s\r\n%sContent-Length: 0\r\nConnection: close\r\n\r\n",
+		status, http.StatusText(status), header)
+	return err
+}
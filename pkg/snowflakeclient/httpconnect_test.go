@@ -0,0 +1,59 @@
+package snowflakeclient
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	pt "git.torproject.org/pluggable-transports/goptlib.git"
+)
+
+func TestHTTPConnect(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go io.WriteString(client, "CONNECT bridge.example:443 HTTP/1.1\r\nHost: bridge.example:443\r\n\r\nhello")
+	conn, err := readHTTPConnect(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.target != "bridge.example:443" {
+		t.Errorf("target %q", conn.target)
+	}
+	// What the client sent after the request is not lost.
+	hello := make([]byte, 5)
+	if _, err := io.ReadFull(conn, hello); err != nil || string(hello) != "hello" {
+		t.Errorf("read %q, %v", hello, err)
+	}
+
+	responses := bufio.NewReader(client)
+	go conn.Grant(nil)
+	resp, err := http.ReadResponse(responses, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("unexpected response to Grant %v, %v", resp, err)
+	}
+	go conn.RejectReason(pt.SocksRepTTLExpired)
+	resp, err = http.ReadResponse(responses, nil)
+	if err != nil || resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("unexpected response to RejectReason %v, %v", resp, err)
+	}
+}
+
+func TestHTTPConnectOtherMethods(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go io.WriteString(client, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	errs := make(chan error, 1)
+	go func() {
+		_, err := readHTTPConnect(server)
+		errs <- err
+	}()
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil || resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "CONNECT" {
+		t.Errorf("unexpected response %v, %v", resp, err)
+	}
+	if err := <-errs; err == nil {
+		t.Error("expected an error for a GET request")
+	}
+}
@@ -0,0 +1,148 @@
+package snowflakeclient
+
+import (
+	"fmt"
+	"math/rand"
+	neturl "net/url"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// ParseICEServers parses s, a comma-separated list of ICE server URLs. TURN
+// servers may carry their credentials in the URL, as in
+// turn:user:password@host:port, with any ':' or '@' in the user name or
+// password percent-encoded.
+func ParseICEServers(s string) []webrtc.ICEServer {
+	var servers []webrtc.ICEServer
+	s = strings.TrimSpace(s)
+	if len(s) == 0 {
+		return nil
+	}
+	urls := strings.Split(s, ",")
+	for _, url := range urls {
+		url = strings.TrimSpace(url)
+		server := webrtc.ICEServer{
+			URLs: []string{url},
+		}
+		if scheme, rest := splitScheme(url); scheme == "turn" || scheme == "turns" {
+			if at := strings.LastIndex(rest, "@"); at >= 0 {
+				username, credential := splitCredentials(rest[:at])
+				server.URLs = []string{scheme + ":" + rest[at+1:]}
+				server.Username = username
+				server.Credential = credential
+				server.CredentialType = webrtc.ICECredentialTypePassword
+			}
+		}
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+// splitScheme splits an ICE server URL like stun:host:port at the first ':'.
+func splitScheme(url string) (scheme, rest string) {
+	i := strings.Index(url, ":")
+	if i < 0 {
+		return "", url
+	}
+	return strings.ToLower(url[:i]), url[i+1:]
+}
+
+// splitCredentials splits user:password and undoes their percent-encoding.
+// Invalid escapes are left as they are.
+func splitCredentials(userinfo string) (username, credential string) {
+	username = userinfo
+	if i := strings.Index(userinfo, ":"); i >= 0 {
+		username, credential = userinfo[:i], userinfo[i+1:]
+	}
+	if u, err := neturl.PathUnescape(username); err == nil {
+		username = u
+	}
+	if c, err := neturl.PathUnescape(credential); err == nil {
+		credential = c
+	}
+	return username, credential
+}
+
+// How to pick the ICE servers offered to each snowflake out of the
+// configured ones.
+const (
+	// All of them.
+	ICESelectionAll = "all"
+	// A random half of them, leaving out the failing STUN servers first.
+	ICESelectionRandomHalf = "random-half"
+	// The first ones, in the configured order.
+	ICESelectionFirstN = "first-n"
+	// Random ones, favoring the STUN servers that answered.
+	ICESelectionWeighted = "weighted"
+)
+
+// iceServerSelector returns the function picking the ICE servers of each
+// snowflake as selection says. count is how many the first-n and weighted
+// selections pick; 0 means half for weighted.
+func iceServerSelector(selection string, count int) (func([]webrtc.ICEServer) []webrtc.ICEServer, error) {
+	if count < 0 {
+		return nil, fmt.Errorf("invalid ICE server count %d", count)
+	}
+	switch selection {
+	case ICESelectionAll:
+		return nil, nil
+	case "", ICESelectionRandomHalf:
+		return selectRandomHalf, nil
+	case ICESelectionFirstN:
+		if count == 0 {
+			return nil, fmt.Errorf("the %s ICE server selection needs a count", selection)
+		}
+		return func(servers []webrtc.ICEServer) []webrtc.ICEServer {
+			if len(servers) > count {
+				servers = servers[:count]
+			}
+			return servers
+		}, nil
+	case ICESelectionWeighted:
+		return func(servers []webrtc.ICEServer) []webrtc.ICEServer {
+			return selectWeighted(servers, count)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown ICE server selection %q", selection)
+	}
+}
+
+// selectRandomHalf chooses a random subset of servers from inputs.
+func selectRandomHalf(servers []webrtc.ICEServer) []webrtc.ICEServer {
+	shuffled := append([]webrtc.ICEServer(nil), servers...)
+	rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	// leaving out the STUN servers that keep failing first
+	shuffled = stunServerHealth.order(shuffled)
+	if len(shuffled) > 2 {
+		shuffled = shuffled[:(len(shuffled)+1)/2]
+	}
+	return shuffled
+}
+
+// selectWeighted picks count servers, or half of them if count is 0, at
+// random with the weights of stunServerHealth.
+func selectWeighted(servers []webrtc.ICEServer, count int) []webrtc.ICEServer {
+	if count == 0 {
+		count = (len(servers) + 1) / 2
+	}
+	left := append([]webrtc.ICEServer(nil), servers...)
+	var picked []webrtc.ICEServer
+	for len(picked) < count && len(left) > 0 {
+		total := 0
+		for _, server := range left {
+			total += stunServerHealth.weight(server)
+		}
+		n := rand.Intn(total)
+		for i, server := range left {
+			if n -= stunServerHealth.weight(server); n < 0 {
+				picked = append(picked, server)
+				left = append(left[:i], left[i+1:]...)
+				break
+			}
+		}
+	}
+	return picked
+}
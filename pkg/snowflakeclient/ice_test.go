@@ -0,0 +1,77 @@
+package snowflakeclient
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestParseIceServers(t *testing.T) {
+	servers := ParseICEServers(" stun:stun.example.net:3478 , turn:alice:s%40cret@turn.example.net:3478?transport=tcp,turns:turn.example.net:5349")
+	expected := []webrtc.ICEServer{
+		{URLs: []string{"stun:stun.example.net:3478"}},
+		{
+			URLs:           []string{"turn:turn.example.net:3478?transport=tcp"},
+			Username:       "alice",
+			Credential:     "s@cret",
+			CredentialType: webrtc.ICECredentialTypePassword,
+		},
+		{URLs: []string{"turns:turn.example.net:5349"}},
+	}
+	if !reflect.DeepEqual(servers, expected) {
+		t.Errorf("got %+v, expected %+v", servers, expected)
+	}
+	if servers := ParseICEServers(" "); servers != nil {
+		t.Errorf("got %+v for an empty list", servers)
+	}
+}
+
+func TestICEServerSelector(t *testing.T) {
+	servers := ParseICEServers("stun:a.example.net:3478,stun:b.example.net:3478,stun:c.example.net:3478,turn:d.example.net:3478")
+
+	if selector, err := iceServerSelector(ICESelectionAll, 0); err != nil || selector != nil {
+		t.Errorf("all selection: %v", err)
+	}
+	selector, err := iceServerSelector(ICESelectionFirstN, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if picked := selector(servers); !reflect.DeepEqual(picked, servers[:2]) {
+		t.Errorf("first-n picked %v", picked)
+	}
+	for _, selection := range []string{"", ICESelectionRandomHalf, ICESelectionWeighted} {
+		selector, err := iceServerSelector(selection, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		picked := selector(servers)
+		if len(picked) != 2 {
+			t.Errorf("%q selection picked %v, expected half", selection, picked)
+		}
+		seen := make(map[string]bool)
+		for _, server := range picked {
+			if seen[server.URLs[0]] {
+				t.Errorf("%q selection picked %v twice", selection, server.URLs)
+			}
+			seen[server.URLs[0]] = true
+		}
+	}
+	selector, _ = iceServerSelector(ICESelectionWeighted, 10)
+	if picked := selector(servers); len(picked) != len(servers) {
+		t.Errorf("weighted selection picked %d of %d servers", len(picked), len(servers))
+	}
+
+	for _, bad := range []struct {
+		selection string
+		count     int
+	}{
+		{"fastest", 0},
+		{ICESelectionFirstN, 0},
+		{ICESelectionWeighted, -1},
+	} {
+		if _, err := iceServerSelector(bad.selection, bad.count); err == nil {
+			t.Errorf("accepted %q with count %d", bad.selection, bad.count)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package snowflakeclient
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// An ICE server list is a JSON document signed by the operator, so that the
+// servers can be changed for every client without a new release:
+//
+//	{"payload": "<base64 payload>", "signature": "<base64 Ed25519 signature of the payload>"}
+//
+// where the payload is itself JSON, with the servers as -ice takes them:
+//
+//	{"ice_servers": ["stun:stun.example.net:3478", "turn:user:password@turn.example.net:3478"],
+//	 "expires": "2026-12-01T00:00:00Z"}
+type signedICEList struct {
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+type iceListPayload struct {
+	ICEServers []string  `json:"ice_servers"`
+	Expires    time.Time `json:"expires"`
+}
+
+// The largest ICE server list to read.
+const maxICEListSize = 64 << 10
+
+// iceListSource is where to get the ICE server list from, as DialerConfig
+// says.
+type iceListSource struct {
+	url       string
+	key       ed25519.PublicKey
+	cacheFile string
+	transport http.RoundTripper
+}
+
+// servers returns the ICE servers of the cached list while it has not
+// expired, or else of a list fetched anew, which is then cached.
+func (s *iceListSource) servers() (string, error) {
+	if s.cacheFile != "" {
+		if raw, err := ioutil.ReadFile(s.cacheFile); err == nil {
+			if list, err := s.verify(raw); err == nil {
+				return strings.Join(list.ICEServers, ","), nil
+			}
+		}
+	}
+	raw, err := s.fetch()
+	if err != nil {
+		return "", err
+	}
+	list, err := s.verify(raw)
+	if err != nil {
+		return "", err
+	}
+	if s.cacheFile != "" {
+		if err := ioutil.WriteFile(s.cacheFile, raw, 0600); err != nil {
+			return "", fmt.Errorf("caching ICE server list: %v", err)
+		}
+	}
+	return strings.Join(list.ICEServers, ","), nil
+}
+
+func (s *iceListSource) fetch() ([]byte, error) {
+	client := http.Client{Transport: s.transport, Timeout: 30 * time.Second}
+	resp, err := client.Get(s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching ICE server list: %s", resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxICEListSize))
+}
+
+// verify checks the signature and the expiry of the list raw.
+func (s *iceListSource) verify(raw []byte) (*iceListPayload, error) {
+	var signed signedICEList
+	if err := json.Unmarshal(raw, &signed); err != nil {
+		return nil, err
+	}
+	payload, err := base64.StdEncoding.DecodeString(signed.Payload)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.StdEncoding.DecodeString(signed.Signature)
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(s.key, payload, signature) {
+		return nil, errors.New("bad signature on ICE server list")
+	}
+	var list iceListPayload
+	if err := json.Unmarshal(payload, &list); err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(list.Expires) {
+		return nil, fmt.Errorf("ICE server list expired at %v", list.Expires)
+	}
+	if len(list.ICEServers) == 0 {
+		return nil, errors.New("empty ICE server list")
+	}
+	return &list, nil
+}
@@ -0,0 +1,96 @@
+package snowflakeclient
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func signICEList(t *testing.T, key ed25519.PrivateKey, servers []string, expires time.Time) []byte {
+	payload, _ := json.Marshal(iceListPayload{ICEServers: servers, Expires: expires})
+	raw, err := json.Marshal(signedICEList{
+		Payload:   base64.StdEncoding.EncodeToString(payload),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestICEList(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	servers := []string{"stun:stun.example.net:3478", "turn:user:pass@turn.example.net:3478"}
+	list := signICEList(t, private, servers, time.Now().Add(time.Hour))
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write(list)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "icelist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source := iceListSource{
+		url:       server.URL,
+		key:       public,
+		cacheFile: filepath.Join(dir, "ice.json"),
+		transport: http.DefaultTransport,
+	}
+	for i := 0; i < 2; i++ {
+		got, err := source.servers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "stun:stun.example.net:3478,turn:user:pass@turn.example.net:3478" {
+			t.Errorf("got servers %q", got)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("fetched the list %d times, expected once and then the cache", fetches)
+	}
+
+	// An expired cache is fetched anew.
+	ioutil.WriteFile(source.cacheFile, signICEList(t, private, servers, time.Now().Add(-time.Hour)), 0600)
+	if _, err := source.servers(); err != nil || fetches != 2 {
+		t.Errorf("expired cache: %v, %d fetches", err, fetches)
+	}
+
+	for name, raw := range map[string][]byte{
+		"wrong key": signICEList(t, other, servers, time.Now().Add(time.Hour)),
+		"expired":   signICEList(t, private, servers, time.Now().Add(-time.Hour)),
+		"empty":     signICEList(t, private, nil, time.Now().Add(time.Hour)),
+		"garbage":   []byte("stun:stun.example.net:3478"),
+	} {
+		if _, err := source.verify(raw); err == nil {
+			t.Errorf("%s list was accepted", name)
+		}
+	}
+
+	// Without the list, the configured servers are used.
+	config := DialerConfig{
+		ICEServers: "stun:fallback.example.net:3478",
+		ICEListURL: "http://127.0.0.1:1/ice.json",
+		ICEListKey: base64.StdEncoding.EncodeToString(public),
+	}
+	got, err := config.iceServers()
+	if err != nil || len(got) != 1 || got[0].URLs[0] != "stun:fallback.example.net:3478" {
+		t.Errorf("got %v, %v, expected the fallback", got, err)
+	}
+	config.ICEListKey = "c2hvcnQ="
+	if _, err := config.iceServers(); err == nil {
+		t.Error("accepted a short key")
+	}
+}
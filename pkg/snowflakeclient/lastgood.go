@@ -0,0 +1,103 @@
+package snowflakeclient
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	sf "0xacab.org/leap/bitmask-vpn/pkg/snowflake/lib"
+	"git.torproject.org/pluggable-transports/snowflake.git/common/nat"
+	"github.com/pion/webrtc/v3"
+)
+
+// lastGoodStore keeps what the last snowflake to connect went through in a
+// file, such as one in tor's pt state dir, for the next start to try first.
+type lastGoodStore struct {
+	file  string
+	lock  sync.Mutex
+	saved *sf.LastGood
+}
+
+func (s *lastGoodStore) load() (*sf.LastGood, error) {
+	raw, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		return nil, err
+	}
+	var good sf.LastGood
+	if err := json.Unmarshal(raw, &good); err != nil {
+		return nil, err
+	}
+	return &good, nil
+}
+
+// save writes good to the file, unless it is what was last saved.
+func (s *lastGoodStore) save(good *sf.LastGood) {
+	if good == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if reflect.DeepEqual(good, s.saved) {
+		return
+	}
+	raw, _ := json.Marshal(good)
+	if err := ioutil.WriteFile(s.file, raw, 0600); err != nil {
+		log.Printf("Saving the last good rendezvous settings: %v", err)
+		return
+	}
+	s.saved = good
+}
+
+// preferLastGood makes dialer try what last connected first, if that was
+// through the same broker: the front domain, the ICE servers for the first
+// snowflake, and the NAT type until it is probed, unless natType is set.
+// selector is the ICE server selector of dialer.
+func preferLastGood(dialer *sf.WebRTCDialer, good *sf.LastGood, brokerURL, natType string,
+	selector func([]webrtc.ICEServer) []webrtc.ICEServer) {
+	if good.BrokerURL != brokerURL {
+		return
+	}
+	log.Printf("Trying the last good rendezvous settings first")
+	if good.Front != "" {
+		dialer.BrokerChannel.PreferFront(good.Front)
+	}
+	if len(good.ICEServers) > 0 {
+		dialer.SetICEServerSelector(preferICEServers(good.ICEServers, selector))
+	}
+	if natType == "" && good.NATType != "" && good.NATType != nat.NATUnknown {
+		dialer.BrokerChannel.SetNATType(good.NATType)
+	}
+}
+
+// preferICEServers returns an ICE server selector that picks the servers
+// with urls for the first snowflake, and leaves the others to selector.
+func preferICEServers(urls []string, selector func([]webrtc.ICEServer) []webrtc.ICEServer) func([]webrtc.ICEServer) []webrtc.ICEServer {
+	wanted := make(map[string]bool)
+	for _, u := range urls {
+		wanted[u] = true
+	}
+	var used int32
+	return func(servers []webrtc.ICEServer) []webrtc.ICEServer {
+		if atomic.CompareAndSwapInt32(&used, 0, 1) {
+			var preferred []webrtc.ICEServer
+			for _, server := range servers {
+				for _, u := range server.URLs {
+					if wanted[u] {
+						preferred = append(preferred, server)
+						break
+					}
+				}
+			}
+			if len(preferred) > 0 {
+				return preferred
+			}
+		}
+		if selector == nil {
+			return servers
+		}
+		return selector(servers)
+	}
+}
@@ -0,0 +1,69 @@
+package snowflakeclient
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	sf "0xacab.org/leap/bitmask-vpn/pkg/snowflake/lib"
+	"git.torproject.org/pluggable-transports/snowflake.git/common/nat"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestLastGoodStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lastgood")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &lastGoodStore{file: filepath.Join(dir, "last-good.json")}
+	if _, err := store.load(); err == nil {
+		t.Errorf("loaded a missing file")
+	}
+	good := &sf.LastGood{
+		BrokerURL:  "https://broker.example/",
+		Front:      "a.example",
+		ICEServers: []string{"stun:stun.example.net:3478"},
+		NATType:    nat.NATRestricted,
+	}
+	store.save(good)
+	loaded, err := store.load()
+	if err != nil || !reflect.DeepEqual(loaded, good) {
+		t.Errorf("got %+v %v", loaded, err)
+	}
+}
+
+func TestPreferICEServers(t *testing.T) {
+	servers := ParseICEServers("stun:a.example:3478,stun:b.example:3478,stun:c.example:3478")
+	selector := func(servers []webrtc.ICEServer) []webrtc.ICEServer { return servers[:1] }
+	prefer := preferICEServers([]string{"stun:c.example:3478", "stun:gone.example:3478"}, selector)
+	if got := prefer(servers); !reflect.DeepEqual(got, servers[2:]) {
+		t.Errorf("first snowflake got %+v", got)
+	}
+	if got := prefer(servers); !reflect.DeepEqual(got, servers[:1]) {
+		t.Errorf("next snowflake got %+v", got)
+	}
+	if got := preferICEServers(nil, nil)(servers); !reflect.DeepEqual(got, servers) {
+		t.Errorf("got %+v without a selector", got)
+	}
+}
+
+func TestPreferLastGood(t *testing.T) {
+	good := &sf.LastGood{BrokerURL: "https://broker.example/", NATType: nat.NATRestricted}
+	for _, test := range []struct {
+		brokerURL, natType, expected string
+	}{
+		{"https://broker.example/", "", nat.NATRestricted},
+		{"https://other.example/", "", nat.NATUnknown},
+		{"https://broker.example/", nat.NATUnrestricted, nat.NATUnknown},
+	} {
+		broker, _ := sf.NewBrokerChannel(test.brokerURL, "", sf.CreateBrokerTransport(), false)
+		dialer := sf.NewWebRTCDialer(broker)
+		preferLastGood(dialer, good, test.brokerURL, test.natType, nil)
+		if got := broker.GetNATType(); got != test.expected {
+			t.Errorf("%+v: got NAT type %s", test, got)
+		}
+	}
+}
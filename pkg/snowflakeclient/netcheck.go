@@ -0,0 +1,108 @@
+package snowflakeclient
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	sf "0xacab.org/leap/bitmask-vpn/pkg/snowflake/lib"
+	"github.com/pion/webrtc/v3"
+)
+
+// NetworkDiagnosis is what NAT probing tells about the network.
+type NetworkDiagnosis string
+
+const (
+	// Not probed yet, or nothing to probe with.
+	NetworkUnknown NetworkDiagnosis = "unknown"
+	// A STUN server answered over UDP.
+	NetworkOK NetworkDiagnosis = "ok"
+	// No STUN server answered, but the broker did over HTTPS: UDP is
+	// blocked, and WebRTC with it unless relayed over TCP.
+	NetworkUDPBlocked NetworkDiagnosis = "udp-blocked"
+	// Neither the STUN servers nor the broker answered.
+	NetworkOffline NetworkDiagnosis = "offline"
+)
+
+// How long diagnose waits for the broker to answer.
+const brokerCheckTimeout = 30 * time.Second
+
+// diagnose tells what probeErr, the error of probeNATType, says about the
+// network. When no STUN server answered, whether the broker does tells
+// blocked UDP from no network at all.
+func diagnose(ctx context.Context, probeErr error, broker *sf.BrokerChannel) NetworkDiagnosis {
+	if !errors.Is(probeErr, sf.ErrNoSTUNAnswer) {
+		return NetworkOK
+	}
+	ctx, cancel := context.WithTimeout(ctx, brokerCheckTimeout)
+	defer cancel()
+	if err := broker.CheckReachable(ctx); err != nil {
+		log.Printf("The broker does not answer either: %v", err)
+		return NetworkOffline
+	}
+	return NetworkUDPBlocked
+}
+
+// tcpTURNServers returns the TURN servers out of servers that are reached
+// over TCP or TLS: the turns: ones, and the turn: ones with transport=tcp.
+func tcpTURNServers(servers []webrtc.ICEServer) []webrtc.ICEServer {
+	var tcp []webrtc.ICEServer
+	for _, server := range servers {
+		scheme, rest := splitScheme(server.URLs[0])
+		if scheme == "turns" || scheme == "turn" && strings.Contains(strings.ToLower(rest), "transport=tcp") {
+			tcp = append(tcp, server)
+		}
+	}
+	return tcp
+}
+
+// Diagnosis returns what NAT probing told about the network.
+func (c *Client) Diagnosis() NetworkDiagnosis {
+	if d, ok := c.diagnosis.Load().(NetworkDiagnosis); ok {
+		return d
+	}
+	return NetworkUnknown
+}
+
+func (c *Client) setDiagnosis(d NetworkDiagnosis) {
+	if c.Diagnosis() != d {
+		log.Printf("Network diagnosis: %s", d)
+	}
+	c.diagnosis.Store(d)
+}
+
+// adaptToBlockedUDP makes the snowflakes of dialer, the current one, get
+// through without UDP: by relaying WebRTC through the TURN servers out of
+// iceServers that are reached over TCP or TLS, or else by falling back to
+// WebSocket. The dialer is rebuilt with the same settings for that, so that
+// StartOver and Reconfigure try UDP again.
+func (c *Client) adaptToBlockedUDP(dialer *sf.WebRTCDialer, iceServers []webrtc.ICEServer) {
+	if len(tcpTURNServers(iceServers)) > 0 {
+		c.reconfiguring.Lock()
+		defer c.reconfiguring.Unlock()
+		current, config := c.tongue.get()
+		if current != dialer {
+			// Reconfigured in the meantime, which probes again.
+			return
+		}
+		relayed, _, err := createDialer(config, c.tongue.scope)
+		if err == nil {
+			relayed.SetICEPolicy(sf.ICEPolicyRelay)
+			relayed.SetICEServerSelector(tcpTURNServers)
+			relayed.BrokerChannel.SetNATType(dialer.BrokerChannel.GetNATType())
+			c.tongue.set(relayed, config)
+			log.Printf("UDP is blocked: relaying WebRTC through the TURN servers reached over TCP or TLS")
+			return
+		}
+		log.Printf("UDP is blocked, but relaying over TCP failed: %v", err)
+	}
+	if fallback := dialer.WebSocketFallback(); fallback != nil {
+		log.Printf("UDP is blocked: connecting to the bridge over WebSocket")
+		fallback.Activate()
+		return
+	}
+	log.Printf("UDP is blocked, and WebRTC with it: add TURN servers over TCP or TLS " +
+		"(turns: or transport=tcp) to the ICE servers, or a WebSocket fallback")
+}
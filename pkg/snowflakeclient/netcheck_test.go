@@ -0,0 +1,51 @@
+package snowflakeclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	sf "0xacab.org/leap/bitmask-vpn/pkg/snowflake/lib"
+)
+
+func TestTCPTURNServers(t *testing.T) {
+	servers := ParseICEServers("stun:stun.example.net:3478,turn:turn.example.net:3478," +
+		"turn:alice:secret@turn.example.net:3478?transport=tcp,turns:turn.example.net:5349")
+	expected := servers[2:]
+	if tcp := tcpTURNServers(servers); !reflect.DeepEqual(tcp, expected) {
+		t.Errorf("got %+v, expected %+v", tcp, expected)
+	}
+	if tcp := tcpTURNServers(servers[:2]); tcp != nil {
+		t.Errorf("got %+v without TCP TURN servers", tcp)
+	}
+}
+
+func TestDiagnose(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	reachable, _ := sf.NewBrokerChannel(server.URL, "", sf.CreateBrokerTransport(), false)
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	ln.Close()
+	unreachable, _ := sf.NewBrokerChannel("http://"+ln.Addr().String()+"/", "", sf.CreateBrokerTransport(), false)
+
+	noAnswer := fmt.Errorf("%w: timed out", sf.ErrNoSTUNAnswer)
+	for _, test := range []struct {
+		err      error
+		broker   *sf.BrokerChannel
+		expected NetworkDiagnosis
+	}{
+		{sf.ErrNATDiscoveryUnsupported, unreachable, NetworkOK},
+		{errors.New("no such host"), unreachable, NetworkOK},
+		{noAnswer, reachable, NetworkUDPBlocked},
+		{noAnswer, unreachable, NetworkOffline},
+	} {
+		if d := diagnose(context.Background(), test.err, test.broker); d != test.expected {
+			t.Errorf("%v: got %s, expected %s", test.err, d, test.expected)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package snowflakeclient
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	sf "0xacab.org/leap/bitmask-vpn/pkg/snowflake/lib"
+	pt "git.torproject.org/pluggable-transports/goptlib.git"
+)
+
+// builtinPresets are the settings presets that come with the client, in the
+// format of DialerConfig.PresetsFile: one preset per line, its name followed
+// by key=value settings. The keys are the SOCKS args of snowflake bridge
+// lines (url, fronts, ampcache, ice, ...) and ice-policy. Blank lines and
+// lines starting with # are ignored.
+//
+// They follow the snowflake settings that Tor publishes as built in, and
+// are to be kept in step with them.
+const builtinPresets = `
+# Iran: the broker is domain fronted through CDN77. STUN servers that are
+# not blocked there, and no host candidates in the offer.
+ir url=https://1098762253.rsc.cdn77.org/ fronts=www.cdn77.com,www.phpmyadmin.net ice=stun:stun.antisip.com:3478,stun:stun.bluesip.net:3478,stun:stun.dus.net:3478,stun:stun.epygi.com:3478,stun:stun.sonetel.com:3478,stun:stun.uls.co.za:3478,stun:stun.voipgate.com:3478,stun:stun.voys.nl:3478 ice-policy=no-host
+
+# Russia: as in Iran.
+ru url=https://1098762253.rsc.cdn77.org/ fronts=www.cdn77.com,www.phpmyadmin.net ice=stun:stun.antisip.com:3478,stun:stun.bluesip.net:3478,stun:stun.dus.net:3478,stun:stun.epygi.com:3478,stun:stun.sonetel.com:3478,stun:stun.uls.co.za:3478,stun:stun.voipgate.com:3478,stun:stun.voys.nl:3478 ice-policy=no-host
+
+# China: Google is blocked, so neither its STUN servers nor the AMP cache
+# are of use.
+cn url=https://1098762253.rsc.cdn77.org/ fronts=www.cdn77.com,www.phpmyadmin.net ice=stun:stun.antisip.com:3478,stun:stun.epygi.com:3478,stun:stun.sonetel.com:3478,stun:stun.uls.co.za:3478,stun:stun.voipgate.com:3478,stun:stun.voys.nl:3478
+`
+
+// parsePresets reads settings presets by name.
+func parsePresets(r io.Reader) (map[string]pt.Args, error) {
+	presets := make(map[string]pt.Args)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64<<10)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		args := pt.Args{}
+		for _, field := range fields[1:] {
+			i := strings.Index(field, "=")
+			if i <= 0 {
+				return nil, fmt.Errorf("preset %s: %q is not key=value", fields[0], field)
+			}
+			args.Add(field[:i], field[i+1:])
+		}
+		presets[strings.ToLower(fields[0])] = args
+	}
+	return presets, scanner.Err()
+}
+
+// withPreset returns a copy of c with the settings of the preset named
+// Preset applied, from PresetsFile or else the built-in ones.
+func (c DialerConfig) withPreset() (DialerConfig, error) {
+	if c.Preset == "" {
+		return c, nil
+	}
+	var presets map[string]pt.Args
+	var err error
+	if c.PresetsFile != "" {
+		var f *os.File
+		f, err = os.Open(c.PresetsFile)
+		if err != nil {
+			return c, err
+		}
+		defer f.Close()
+		presets, err = parsePresets(f)
+	} else {
+		presets, err = parsePresets(strings.NewReader(builtinPresets))
+	}
+	if err != nil {
+		return c, err
+	}
+	args, ok := presets[strings.ToLower(c.Preset)]
+	if !ok {
+		return c, fmt.Errorf("no settings preset %q", c.Preset)
+	}
+	if policy, ok := args.Get("ice-policy"); ok {
+		if _, err := sf.ParseICEPolicy(policy); err != nil {
+			return c, fmt.Errorf("preset %s: %v", c.Preset, err)
+		}
+		c.ICEPolicy = policy
+	}
+	c, _, err = c.withArgs(args)
+	return c, err
+}
@@ -0,0 +1,59 @@
+package snowflakeclient
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuiltinPresets(t *testing.T) {
+	presets, err := parsePresets(strings.NewReader(builtinPresets))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"ir", "ru", "cn"} {
+		if _, ok := presets[name]; !ok {
+			t.Errorf("no %s preset", name)
+		}
+		c, err := DialerConfig{Preset: name}.withPreset()
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if c.BrokerURL == "" || c.Fronts == "" || c.ICEServers == "" {
+			t.Errorf("%s: got %+v", name, c)
+		}
+	}
+}
+
+func TestPreset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "presets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "presets")
+	ioutil.WriteFile(path, []byte("# presets\n\nXX url=https://broker.example/ ice-policy=relay max=2\n"), 0600)
+
+	base := DialerConfig{BrokerURL: "https://default.example/", ICEPolicy: "all", Max: 1, PresetsFile: path}
+	if c, err := base.withPreset(); err != nil || c != base {
+		t.Errorf("no preset changed the config: %+v %v", c, err)
+	}
+	base.Preset = "xx"
+	c, err := base.withPreset()
+	if err != nil || c.BrokerURL != "https://broker.example/" || c.ICEPolicy != "relay" || c.Max != 2 {
+		t.Errorf("got %+v %v", c, err)
+	}
+	base.Preset = "yy"
+	if _, err := base.withPreset(); err == nil {
+		t.Errorf("an unknown preset was accepted")
+	}
+
+	for _, presets := range []string{"xx url", "xx ice-policy=none"} {
+		ioutil.WriteFile(path, []byte(presets), 0600)
+		if _, err := (DialerConfig{Preset: "xx", PresetsFile: path}).withPreset(); err == nil {
+			t.Errorf("%q: accepted", presets)
+		}
+	}
+}
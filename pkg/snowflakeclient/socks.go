@@ -0,0 +1,393 @@
+package snowflakeclient
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pt "git.torproject.org/pluggable-transports/goptlib.git"
+)
+
+// How long to wait before binding a dead SOCKS listener again, at first and
+// at most.
+const (
+	socksRebindDelay    = time.Second
+	socksRebindMaxDelay = time.Minute
+)
+
+// How long a SOCKS client has to log in.
+const socksLoginTimeout = 5 * time.Second
+
+// SOCKS5 authentication methods, and the versions of SOCKS and of RFC 1929
+// username and password authentication.
+const (
+	socksVersion            = 0x05
+	socksAuthNone           = 0x00
+	socksAuthPassword       = 0x02
+	socksAuthNoneAcceptable = 0xff
+	socksPasswordVersion    = 0x01
+)
+
+// A listening address with this prefix is the path of a Unix socket, as tor
+// writes the address of a pluggable transport listening on one.
+const socksUnixPrefix = "unix:"
+
+// checkListenAddr checks that the address described as name is the path
+// of a Unix socket, or an IP address and port to listen at. Unless wide, the
+// address must be a loopback one, such as 127.0.0.1 or another 127.0.0.0/8
+// alias, so that the listener is not reachable from the network.
+func checkListenAddr(name, addr string, wide bool) error {
+	if strings.HasPrefix(addr, socksUnixPrefix) {
+		if addr == socksUnixPrefix {
+			return fmt.Errorf("invalid %s %q: no socket path", name, addr)
+		}
+		return nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err == nil {
+		_, err = strconv.ParseUint(port, 10, 16)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %v", name, addr, err)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("invalid %s %q: not an IP address", name, addr)
+	}
+	if !ip.IsLoopback() && !wide {
+		return fmt.Errorf("%s %q is not a loopback address", name, addr)
+	}
+	return nil
+}
+
+// socksCredentials are the username and password that SOCKS clients must
+// log in with, as RFC 1929 says. goptlib parses the username and password
+// put together as pluggable transport args, so the login is checked before
+// goptlib sees it, and clients that log in cannot pass args. A nil
+// *socksCredentials lets every client in.
+type socksCredentials struct {
+	user, password string
+}
+
+// parseSocksCredentials parses credentials of the form USER:PASSWORD.
+func parseSocksCredentials(s string) (*socksCredentials, error) {
+	i := strings.Index(s, ":")
+	if i < 1 || i == len(s)-1 {
+		return nil, errors.New("SOCKS credentials must be of the form USER:PASSWORD")
+	}
+	return &socksCredentials{user: s[:i], password: s[i+1:]}, nil
+}
+
+// loadSocksCredentials reads credentials of the form USER:PASSWORD from the
+// first line of the file at path that is neither empty nor a # comment.
+func loadSocksCredentials(path string) (*socksCredentials, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			return parseSocksCredentials(line)
+		}
+	}
+	return nil, fmt.Errorf("no SOCKS credentials in %s", path)
+}
+
+// match returns whether user and password are the credentials.
+func (c *socksCredentials) match(user, password string) bool {
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(c.user))
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(c.password))
+	return userOK&passwordOK == 1
+}
+
+// login makes the SOCKS5 client on conn log in with the credentials. It
+// returns conn as goptlib is to read it: as though the client had asked for
+// no authentication.
+func (c *socksCredentials) login(conn net.Conn) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(socksLoginTimeout))
+	r := bufio.NewReader(conn)
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	if head[0] != socksVersion {
+		return nil, fmt.Errorf("SOCKS version %d", head[0])
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return nil, err
+	}
+	if bytes.IndexByte(methods, socksAuthPassword) < 0 {
+		conn.Write([]byte{socksVersion, socksAuthNoneAcceptable})
+		return nil, errors.New("no username and password offered")
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksAuthPassword}); err != nil {
+		return nil, err
+	}
+	if version, err := r.ReadByte(); err != nil {
+		return nil, err
+	} else if version != socksPasswordVersion {
+		return nil, fmt.Errorf("username and password version %d", version)
+	}
+	user, err := readSocksString(r)
+	if err != nil {
+		return nil, err
+	}
+	password, err := readSocksString(r)
+	if err != nil {
+		return nil, err
+	}
+	if !c.match(user, password) {
+		conn.Write([]byte{socksPasswordVersion, 1})
+		return nil, errors.New("wrong username or password")
+	}
+	if _, err := conn.Write([]byte{socksPasswordVersion, 0}); err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return &socksLoginConn{
+		Conn: conn,
+		r:    io.MultiReader(bytes.NewReader([]byte{socksVersion, 1, socksAuthNone}), r),
+		skip: 2,
+	}, nil
+}
+
+// readSocksString reads a string preceded by its length in a byte.
+func readSocksString(r *bufio.Reader) (string, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// socksLoginConn is a connection whose client logged in, as goptlib is to
+// read it. The reads start with a method selection asking for no
+// authentication, and the first skip bytes written, goptlib's answer to it,
+// are dropped.
+type socksLoginConn struct {
+	net.Conn
+	r    io.Reader
+	skip int
+}
+
+func (c *socksLoginConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func (c *socksLoginConn) Write(b []byte) (int, error) {
+	if c.skip == 0 {
+		return c.Conn.Write(b)
+	}
+	n := len(b)
+	if n > c.skip {
+		n = c.skip
+	}
+	c.skip -= n
+	m, err := c.Conn.Write(b[n:])
+	return n + m, err
+}
+
+// socksLoginListener accepts only the SOCKS clients that log in with auth.
+type socksLoginListener struct {
+	net.Listener
+	auth *socksCredentials
+}
+
+// Accept returns the next connection whose client logged in, closing the
+// others.
+func (ln *socksLoginListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := ln.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		loggedIn, err := ln.auth.login(conn)
+		if err == nil {
+			return loggedIn, nil
+		}
+		log.Printf("SOCKS login from %v failed: %v", conn.RemoteAddr(), err)
+		conn.Close()
+	}
+}
+
+// listenLocal listens at an address checked with checkListenAddr. A Unix
+// socket is only accessible to the user.
+func listenLocal(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, socksUnixPrefix) {
+		return ListenUnix(strings.TrimPrefix(addr, socksUnixPrefix))
+	}
+	return net.Listen("tcp", addr)
+}
+
+// ListenUnix listens on a Unix socket at path that only the user may connect
+// to, replacing the socket a previous run left behind.
+func ListenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// listenSocks listens for SOCKS connections at an address checked with
+// checkListenAddr, from clients that log in with auth if it is not nil.
+func listenSocks(addr string, auth *socksCredentials) (*pt.SocksListener, error) {
+	ln, err := listenLocal(addr)
+	if err != nil {
+		return nil, err
+	}
+	if auth != nil {
+		ln = &socksLoginListener{ln, auth}
+	}
+	return pt.NewSocksListener(ln), nil
+}
+
+// socksMethodAddr returns the address of ln to give tor in a CMETHOD line.
+func socksMethodAddr(ln net.Listener) net.Addr {
+	if addr, ok := ln.Addr().(*net.UnixAddr); ok {
+		return unixMethodAddr{addr}
+	}
+	return ln.Addr()
+}
+
+// unixMethodAddr is a Unix socket address written the way tor reads it.
+type unixMethodAddr struct{ *net.UnixAddr }
+
+func (addr unixMethodAddr) String() string { return socksUnixPrefix + addr.Name }
+
+// socksSupervisor keeps the SOCKS listener of a transport method open. When
+// serve returns because the listener died, it binds a new one on the same
+// address, or on any port if a TCP address is taken, and serves it again.
+type socksSupervisor struct {
+	method string
+	serve  func(*pt.SocksListener) error
+	// Binds a listener; listenSocks, unless testing.
+	listen func(addr string) (*pt.SocksListener, error)
+
+	lock   sync.Mutex
+	ln     *pt.SocksListener
+	closed bool
+	done   chan struct{}
+}
+
+// newSocksSupervisor starts serving ln with serve. The listeners bound in
+// its place take clients that log in with auth, like ln.
+func newSocksSupervisor(method string, ln *pt.SocksListener, auth *socksCredentials,
+	serve func(*pt.SocksListener) error) *socksSupervisor {
+	s := &socksSupervisor{
+		method: method,
+		serve:  serve,
+		listen: func(addr string) (*pt.SocksListener, error) {
+			return listenSocks(addr, auth)
+		},
+		ln:   ln,
+		done: make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *socksSupervisor) run() {
+	ln := s.ln
+	for {
+		err := s.serve(ln)
+		addr := socksMethodAddr(ln)
+		if s.isClosed() {
+			return
+		}
+		log.Printf("SOCKS listener at %v died: %v", addr, err)
+		ln = s.rebind(addr)
+		if ln == nil {
+			return
+		}
+		if socksMethodAddr(ln).String() != addr.String() {
+			// tor only reads the CMETHOD lines before CMETHODS DONE, so
+			// it keeps connecting to the old port until it restarts us.
+			msg := fmt.Sprintf("SOCKS listener for %s moved from %v to %v; restart tor to use it",
+				s.method, addr, ln.Addr())
+			log.Print(msg)
+			pt.Log(pt.LogSeverityWarning, msg)
+		} else {
+			log.Printf("Restarted SOCKS listener at %v.", ln.Addr())
+		}
+	}
+}
+
+// rebind binds a listener in place of the dead one at addr, retrying with
+// a growing delay until it succeeds. It returns nil if s was closed first.
+func (s *socksSupervisor) rebind(addr net.Addr) *pt.SocksListener {
+	delay := socksRebindDelay
+	for {
+		ln, err := s.listen(addr.String())
+		if tcpAddr, ok := addr.(*net.TCPAddr); ok && err != nil {
+			log.Printf("SOCKS listener: binding %v again: %v", addr, err)
+			ln, err = s.listen(net.JoinHostPort(tcpAddr.IP.String(), "0"))
+		}
+		if err == nil {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			if s.closed {
+				ln.Close()
+				return nil
+			}
+			s.ln = ln
+			return ln
+		}
+		log.Printf("SOCKS listener: %v; retrying in %v", err, delay)
+		select {
+		case <-time.After(delay):
+		case <-s.done:
+			return nil
+		}
+		if delay *= 2; delay > socksRebindMaxDelay {
+			delay = socksRebindMaxDelay
+		}
+	}
+}
+
+// addr returns the address of the current listener, as tor reads it.
+func (s *socksSupervisor) addr() net.Addr {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return socksMethodAddr(s.ln)
+}
+
+func (s *socksSupervisor) isClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closed
+}
+
+// Close closes the listener for good.
+func (s *socksSupervisor) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	return s.ln.Close()
+}
@@ -0,0 +1,246 @@
+package snowflakeclient
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pt "git.torproject.org/pluggable-transports/goptlib.git"
+)
+
+func TestSocksSupervisor(t *testing.T) {
+	ln, err := pt.ListenSocks("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	served := make(chan *pt.SocksListener)
+	s := newSocksSupervisor("snowflake", ln, nil, func(ln *pt.SocksListener) error {
+		served <- ln
+		_, err := ln.AcceptSocks()
+		return err
+	})
+
+	// The listener dying outside of Close gets it bound again on its port.
+	first := <-served
+	first.Close()
+	var second *pt.SocksListener
+	select {
+	case second = <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the listener was not bound again")
+	}
+	if second == first || second.Addr().(*net.TCPAddr).Port != port {
+		t.Errorf("rebound at %v, expected port %d", second.Addr(), port)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ln := <-served:
+		t.Errorf("served %v after Close", ln.Addr())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSocksSupervisorRebind(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}
+	var tried []string
+	s := &socksSupervisor{
+		listen: func(addr string) (*pt.SocksListener, error) {
+			tried = append(tried, addr)
+			if len(tried) < 3 {
+				return nil, errors.New("address already in use")
+			}
+			return pt.ListenSocks("tcp", "127.0.0.1:0")
+		},
+		done: make(chan struct{}),
+	}
+	ln := s.rebind(addr)
+	if ln == nil {
+		t.Fatal("no listener")
+	}
+	defer ln.Close()
+	expected := []string{"127.0.0.1:1080", "127.0.0.1:0", "127.0.0.1:1080"}
+	if len(tried) != 3 || tried[0] != expected[0] || tried[1] != expected[1] || tried[2] != expected[2] {
+		t.Errorf("tried %v, expected %v", tried, expected)
+	}
+}
+
+func TestCheckListenAddr(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:0", "127.0.0.1:9150", "127.0.0.2:9150", "[::1]:9150", "unix:/run/snowflake/socks"} {
+		if err := checkListenAddr("SOCKS address", addr, false); err != nil {
+			t.Errorf("%q: %v", addr, err)
+		}
+	}
+	for _, addr := range []string{"127.0.0.1", "0.0.0.0:9150", "192.168.1.2:9150", "localhost:9150", "127.0.0.1:70000", ":9150", "unix:"} {
+		if err := checkListenAddr("SOCKS address", addr, false); err == nil {
+			t.Errorf("%q: expected an error", addr)
+		}
+	}
+	// Other addresses are allowed when clients must log in.
+	for _, addr := range []string{"0.0.0.0:9150", "192.168.1.2:9150", "[::]:9150"} {
+		if err := checkListenAddr("SOCKS address", addr, true); err != nil {
+			t.Errorf("%q: %v", addr, err)
+		}
+	}
+	if err := checkListenAddr("SOCKS address", "localhost:9150", true); err == nil {
+		t.Error("expected an error for a host name")
+	}
+}
+
+func TestUnixSocksListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "socks.sock")
+	ln, err := listenSocks("unix:"+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("socket mode %v, %v", fi.Mode(), err)
+	}
+	if addr := socksMethodAddr(ln).String(); addr != "unix:"+path {
+		t.Errorf("CMETHOD address %q", addr)
+	}
+
+	// A SOCKS5 handshake over the socket gets to AcceptSocks.
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := ln.AcceptSocks()
+		if err == nil {
+			conn.Reject()
+		}
+		accepted <- err
+	}()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{5, 1, 0})
+	io.ReadFull(conn, make([]byte, 2))
+	conn.Write([]byte{5, 1, 0, 1, 192, 0, 2, 1, 0, 80})
+	if err := <-accepted; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSocksCredentials(t *testing.T) {
+	for _, bad := range []string{"", "alice", ":secret", "alice:"} {
+		if _, err := parseSocksCredentials(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+
+	f, err := ioutil.TempFile("", "socks-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# SOCKS login\n\nalice:s3cr:et\n")
+	f.Close()
+	auth, err := loadSocksCredentials(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *auth != (socksCredentials{"alice", "s3cr:et"}) {
+		t.Errorf("loaded %+v", auth)
+	}
+
+	if !auth.match("alice", "s3cr:et") {
+		t.Error("the right credentials were refused")
+	}
+	for _, login := range [][2]string{{"alice", ""}, {"alice", "secret"}, {"bob", "s3cr:et"}} {
+		if auth.match(login[0], login[1]) {
+			t.Errorf("%q was allowed", login)
+		}
+	}
+}
+
+func TestSocksLogin(t *testing.T) {
+	ln, err := listenSocks("127.0.0.1:0", &socksCredentials{"alice", "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan *pt.SocksConn)
+	go func() {
+		defer close(accepted)
+		for {
+			conn, err := ln.AcceptSocks()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	// login dials the listener and logs in as a standard SOCKS5 client
+	// would, returning the status the listener answered with.
+	login := func(user, password string) (net.Conn, byte) {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte{5, 1, 2})
+		reply := make([]byte, 2)
+		if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 2 {
+			t.Fatalf("method selection %v, %v", reply, err)
+		}
+		msg := append([]byte{1, byte(len(user))}, user...)
+		msg = append(append(msg, byte(len(password))), password...)
+		conn.Write(msg)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatal(err)
+		}
+		return conn, reply[1]
+	}
+
+	conn, status := login("alice", "wrong")
+	conn.Close()
+	if status == 0 {
+		t.Error("a wrong password was accepted")
+	}
+
+	conn, status = login("alice", "secret")
+	defer conn.Close()
+	if status != 0 {
+		t.Fatalf("the right credentials were refused with status %d", status)
+	}
+	conn.Write([]byte{5, 1, 0, 1, 192, 0, 2, 1, 0, 80})
+	socks := <-accepted
+	if socks == nil {
+		t.Fatal("the listener closed")
+	}
+	if socks.Req.Target != "192.0.2.1:80" || len(socks.Req.Args) != 0 {
+		t.Errorf("request %+v", socks.Req)
+	}
+	socks.Grant(nil)
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[0] != 5 || reply[1] != 0 {
+		t.Errorf("reply %v, %v", reply, err)
+	}
+	socks.Close()
+
+	// A client offering no username and password is turned away.
+	conn, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{5, 1, 0})
+	if _, err := io.ReadFull(conn, reply[:2]); err != nil || reply[1] != 0xff {
+		t.Errorf("method selection %v, %v", reply[:2], err)
+	}
+}
@@ -0,0 +1,138 @@
+package snowflakeclient
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	sf "0xacab.org/leap/bitmask-vpn/pkg/snowflake/lib"
+	"github.com/pion/webrtc/v3"
+)
+
+// After how many failures in a row a STUN server counts as failing.
+const stunFailureThreshold = 3
+
+// stunHealth keeps how the STUN servers fared when probing the NAT type, for
+// as long as the process runs. Failing servers are probed and offered to
+// ICE after the others.
+type stunHealth struct {
+	lock    sync.Mutex
+	servers map[string]*stunStats
+}
+
+// stunStats are the results of probing with one STUN server.
+type stunStats struct {
+	successes int
+	failures  int
+	// Failures since the last success.
+	failuresInRow int
+	// How long the last successful probe took.
+	latency time.Duration
+}
+
+var stunServerHealth = newSTUNHealth()
+
+func newSTUNHealth() *stunHealth {
+	return &stunHealth{servers: make(map[string]*stunStats)}
+}
+
+// record counts a probe with the server at addr that took took and ended
+// with err. A server that answers but does not support NAT discovery still
+// works for ICE, so that is a success.
+func (h *stunHealth) record(addr string, took time.Duration, err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	stats, ok := h.servers[addr]
+	if !ok {
+		stats = new(stunStats)
+		h.servers[addr] = stats
+	}
+	if err != nil && !errors.Is(err, sf.ErrNATDiscoveryUnsupported) {
+		stats.failures++
+		stats.failuresInRow++
+		return
+	}
+	stats.successes++
+	stats.failuresInRow = 0
+	stats.latency = took
+}
+
+func (h *stunHealth) failing(addr string) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	stats, ok := h.servers[addr]
+	return ok && stats.failuresInRow >= stunFailureThreshold
+}
+
+// order moves the failing STUN servers after the others, keeping the order
+// of the servers otherwise. TURN servers are not tracked and stay where
+// they are among the working servers.
+func (h *stunHealth) order(servers []webrtc.ICEServer) []webrtc.ICEServer {
+	ordered := append([]webrtc.ICEServer(nil), servers...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return !h.serverFailing(ordered[i]) && h.serverFailing(ordered[j])
+	})
+	return ordered
+}
+
+func (h *stunHealth) serverFailing(server webrtc.ICEServer) bool {
+	scheme, addr := splitScheme(server.URLs[0])
+	return scheme == "stun" && h.failing(addr)
+}
+
+// weight is how likely the weighted ICE server selection is to pick server:
+// most for STUN servers that answered, least for failing ones.
+func (h *stunHealth) weight(server webrtc.ICEServer) int {
+	scheme, addr := splitScheme(server.URLs[0])
+	if scheme != "stun" {
+		return 2
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	stats, ok := h.servers[addr]
+	switch {
+	case !ok:
+		return 2
+	case stats.failuresInRow >= stunFailureThreshold:
+		return 1
+	case stats.successes > 0:
+		return 4
+	default:
+		return 2
+	}
+}
+
+// String lists the STUN servers that answered, with how long they last
+// took, and those that are failing.
+func (h *stunHealth) String() string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var usable, failing []string
+	for addr, stats := range h.servers {
+		if stats.failuresInRow >= stunFailureThreshold {
+			failing = append(failing, fmt.Sprintf("%s (%d/%d failed)",
+				addr, stats.failures, stats.failures+stats.successes))
+		} else if stats.successes > 0 {
+			usable = append(usable, fmt.Sprintf("%s (%v)", addr, stats.latency.Round(time.Millisecond)))
+		}
+	}
+	sort.Strings(usable)
+	sort.Strings(failing)
+	return fmt.Sprintf("usable: %s; failing: %s", listOrNone(usable), listOrNone(failing))
+}
+
+func listOrNone(list []string) string {
+	if len(list) == 0 {
+		return "none"
+	}
+	return strings.Join(list, ", ")
+}
+
+// logSTUNHealth logs which STUN servers work on this network.
+func logSTUNHealth() {
+	log.Printf("STUN servers %v", stunServerHealth)
+}
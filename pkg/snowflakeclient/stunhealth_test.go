@@ -0,0 +1,52 @@
+package snowflakeclient
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	sf "0xacab.org/leap/bitmask-vpn/pkg/snowflake/lib"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestSTUNHealth(t *testing.T) {
+	h := newSTUNHealth()
+	timeout := errors.New("timed out")
+	for i := 0; i < stunFailureThreshold; i++ {
+		h.record("dead.example.net:3478", time.Second, timeout)
+		h.record("flaky.example.net:3478", time.Second, timeout)
+	}
+	h.record("flaky.example.net:3478", 40*time.Millisecond, nil)
+	h.record("plain.example.net:3478", 20*time.Millisecond, fmt.Errorf("probing: %w", sf.ErrNATDiscoveryUnsupported))
+
+	if !h.failing("dead.example.net:3478") {
+		t.Error("a server that never answered is not failing")
+	}
+	if h.failing("flaky.example.net:3478") || h.failing("plain.example.net:3478") {
+		t.Error("a server that answered is failing")
+	}
+	if h.failing("unknown.example.net:3478") {
+		t.Error("a server never probed is failing")
+	}
+
+	servers := []webrtc.ICEServer{
+		{URLs: []string{"stun:dead.example.net:3478"}},
+		{URLs: []string{"turn:dead.example.net:3478"}},
+		{URLs: []string{"stun:flaky.example.net:3478"}},
+	}
+	ordered := h.order(servers)
+	expected := []webrtc.ICEServer{servers[1], servers[2], servers[0]}
+	if !reflect.DeepEqual(ordered, expected) {
+		t.Errorf("got order %v, expected %v", ordered, expected)
+	}
+	if servers[0].URLs[0] != "stun:dead.example.net:3478" {
+		t.Error("order changed its argument")
+	}
+
+	summary := "usable: flaky.example.net:3478 (40ms), plain.example.net:3478 (20ms); failing: dead.example.net:3478 (3/3 failed)"
+	if h.String() != summary {
+		t.Errorf("got %q, expected %q", h.String(), summary)
+	}
+}
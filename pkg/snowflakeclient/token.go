@@ -0,0 +1,106 @@
+package snowflakeclient
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+
+	sf "0xacab.org/leap/bitmask-vpn/pkg/snowflake/lib"
+)
+
+// The client token is a random identifier that the broker can tell this
+// client by across rendezvous and restarts, to match clients fairly and to
+// resist abuse, without learning anything else about it. Rotating it sheds
+// an identity that a censor may have tied to this client.
+type clientToken struct {
+	lock  sync.Mutex
+	file  string // where it is kept, or "" to keep it for the process only
+	token string
+}
+
+// The size of client tokens, in bytes before hex encoding.
+const clientTokenSize = 16
+
+// The client tokens by file, shared by the dialers as they are rebuilt, so
+// that a rotation reaches them all.
+var clientTokens = struct {
+	sync.Mutex
+	m map[string]*clientToken
+}{m: make(map[string]*clientToken)}
+
+// clientTokenFor returns the client token kept in file.
+func clientTokenFor(file string) *clientToken {
+	clientTokens.Lock()
+	defer clientTokens.Unlock()
+	t, ok := clientTokens.m[file]
+	if !ok {
+		t = &clientToken{file: file}
+		clientTokens.m[file] = t
+	}
+	return t
+}
+
+// get returns the token, reading it from the file, or making one up and
+// saving it, the first time.
+func (t *clientToken) get() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.token != "" {
+		return t.token
+	}
+	if t.file != "" {
+		if raw, err := ioutil.ReadFile(t.file); err == nil {
+			token := strings.TrimSpace(string(raw))
+			if b, err := hex.DecodeString(token); err == nil && len(b) == clientTokenSize {
+				t.token = token
+				return t.token
+			}
+		}
+	}
+	if err := t.renew(); err != nil {
+		log.Printf("Saving the client token: %v", err)
+	}
+	return t.token
+}
+
+// rotate replaces the token with a new one.
+func (t *clientToken) rotate() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.renew()
+}
+
+// renew makes up a new token and saves it. t.lock must be held.
+func (t *clientToken) renew() error {
+	b := make([]byte, clientTokenSize)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	t.token = hex.EncodeToString(b)
+	if t.file == "" {
+		return nil
+	}
+	return ioutil.WriteFile(t.file, []byte(t.token+"\n"), 0600)
+}
+
+// RotateClientToken replaces the client token with a new one, which the
+// next rendezvous of every dialer sends the broker instead. It then starts
+// over, and forgets the TLS sessions with the broker, so that nothing links
+// the new token to the old one.
+func (c *Client) RotateClientToken() error {
+	_, config := c.tongue.get()
+	if !config.ClientToken {
+		return errors.New("no client token is sent")
+	}
+	if err := clientTokenFor(config.ClientTokenFile).rotate(); err != nil {
+		return err
+	}
+	log.Printf("Rotated the client token")
+	c.StartOver()
+	sf.ForgetBrokerSessions()
+	return nil
+}
@@ -0,0 +1,52 @@
+package snowflakeclient
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestClientToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "token")
+
+	token := clientTokenFor(file)
+	if clientTokenFor(file) != token {
+		t.Errorf("the token of a file is not shared")
+	}
+	first := token.get()
+	if len(first) != 2*clientTokenSize || token.get() != first {
+		t.Errorf("got tokens %q and %q", first, token.get())
+	}
+	raw, _ := ioutil.ReadFile(file)
+	if strings.TrimSpace(string(raw)) != first {
+		t.Errorf("saved %q instead of %q", raw, first)
+	}
+	if (&clientToken{file: file}).get() != first {
+		t.Errorf("the saved token is not read back")
+	}
+
+	if err := token.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if token.get() == first {
+		t.Errorf("the token was not rotated")
+	}
+	if (&clientToken{file: file}).get() != token.get() {
+		t.Errorf("the rotated token is not saved")
+	}
+
+	ioutil.WriteFile(file, []byte("not a token"), 0600)
+	if got := (&clientToken{file: file}).get(); len(got) != 2*clientTokenSize {
+		t.Errorf("got %q from a bad file", got)
+	}
+	if got := clientTokenFor("").get(); len(got) != 2*clientTokenSize {
+		t.Errorf("got %q without a file", got)
+	}
+}
@@ -0,0 +1,44 @@
+package snowflakeclient
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+
+	sf "0xacab.org/leap/bitmask-vpn/pkg/snowflake/lib"
+)
+
+// transparentAcceptLoop accepts the TCP connections the firewall redirects to
+// ln and carries them through snowflakes caught with tongue, or multiplexed
+// over shared if it is not nil. The original destination is only logged: like
+// SOCKS connections, they all lead to the bridge. Returns the error that ended
+// accepting.
+func transparentAcceptLoop(ctx context.Context, ln net.Listener, tongue sf.Tongue, shared *sf.SharedSession,
+	dormant *dormancy, events *eventRelay, wg *sync.WaitGroup) error {
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Temporary() {
+				continue
+			}
+			return err
+		}
+		id := sf.NewTraceID()
+		dst, err := originalDst(conn)
+		if err != nil {
+			log.Printf("[%s] Transparent connection: no original destination: %v", id, err)
+			dst = conn.LocalAddr()
+		}
+		log.Printf("[%s] Transparent connection to %v", id, dst)
+		dormant.begin()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer dormant.end()
+			defer conn.Close()
+			handleConn(ctx, id, conn, tongue, shared, events)
+		}()
+	}
+}
@@ -0,0 +1,91 @@
+package snowflakeclient
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// The getsockopt option of netfilter that returns the destination a
+// connection had before it was REDIRECTed, for IPv4 and IPv6 alike.
+const soOriginalDst = 80
+
+// listenTransparent listens at addr for the TCP connections that the firewall
+// redirects to it with REDIRECT or TPROXY. TPROXY needs IP_TRANSPARENT on the
+// listener, and so CAP_NET_ADMIN; without it, only REDIRECT works.
+func listenTransparent(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			level, opt := unix.SOL_IP, unix.IP_TRANSPARENT
+			if network == "tcp6" {
+				level, opt = unix.SOL_IPV6, unix.IPV6_TRANSPARENT
+			}
+			err = unix.SetsockoptInt(int(fd), level, opt, 1)
+		}); cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			log.Printf("Transparent listener: TPROXY unavailable, only REDIRECT will work: %v", err)
+		}
+		return nil
+	}}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// originalDst returns the destination of a connection accepted by a
+// transparent listener. That is the local address of a TPROXY connection,
+// which netfilter does not rewrite, and what SO_ORIGINAL_DST gives for a
+// REDIRECTed one.
+func originalDst(conn net.Conn) (net.Addr, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("not a TCP connection")
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	local := conn.LocalAddr().(*net.TCPAddr)
+	var dst *net.TCPAddr
+	cerr := raw.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			// A struct sockaddr_in fits in an IPv6Mreq.
+			var mreq *unix.IPv6Mreq
+			mreq, err = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, soOriginalDst)
+			if err == nil {
+				sa := mreq.Multiaddr
+				dst = &net.TCPAddr{
+					IP:   net.IPv4(sa[4], sa[5], sa[6], sa[7]),
+					Port: int(binary.BigEndian.Uint16(sa[2:4])),
+				}
+			}
+			return
+		}
+		// And a struct sockaddr_in6 in an IPv6MTUInfo.
+		var info *unix.IPv6MTUInfo
+		info, err = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, soOriginalDst)
+		if err == nil {
+			// The port is in network byte order.
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			dst = &net.TCPAddr{
+				IP:   net.IP(append([]byte(nil), info.Addr.Addr[:]...)),
+				Port: int(binary.BigEndian.Uint16(port[:])),
+			}
+		}
+	})
+	if cerr != nil {
+		return nil, cerr
+	}
+	if errors.Is(err, unix.ENOENT) {
+		// Not REDIRECTed: either TPROXY, or a direct connection.
+		return local, nil
+	}
+	return dst, err
+}
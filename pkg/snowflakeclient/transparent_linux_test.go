@@ -0,0 +1,35 @@
+package snowflakeclient
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTransparentListener(t *testing.T) {
+	ln, err := listenTransparent("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn := <-accepted
+	if conn == nil {
+		t.Fatal("no connection accepted")
+	}
+	defer conn.Close()
+
+	// A connection that was not redirected went where it was headed.
+	dst, err := originalDst(conn)
+	if err != nil || dst.String() != ln.Addr().String() {
+		t.Errorf("original destination %v, %v; expected %v", dst, err, ln.Addr())
+	}
+}
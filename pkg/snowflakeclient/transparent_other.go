@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package snowflakeclient
+
+import (
+	"errors"
+	"net"
+)
+
+func listenTransparent(addr string) (net.Listener, error) {
+	return nil, errors.New("transparent proxying is only supported on Linux")
+}
+
+func originalDst(conn net.Conn) (net.Addr, error) {
+	return conn.LocalAddr(), nil
+}
@@ -0,0 +1,118 @@
+// Package snowflakemobile runs the snowflake client inside a mobile app. It
+// wraps pkg/snowflakeclient with the simple types gomobile can bind, so that
+// the Android and iOS apps link the transport instead of running a separate
+// process:
+//
+//	gomobile bind -target=android ./pkg/snowflakemobile
+//
+// The app starts a client, points its tunnel at the SOCKS address, and
+// stops the client when it is done.
+package snowflakemobile
+
+import (
+	sf "0xacab.org/leap/bitmask-vpn/pkg/snowflake/lib"
+	"0xacab.org/leap/bitmask-vpn/pkg/snowflakeclient"
+)
+
+// Config is what a client is started with. Lists are comma-separated, as
+// for the flags of snowflake-client.
+type Config struct {
+	BrokerURL  string
+	Fronts     string
+	ICEServers string
+	AMPCache   string
+	// How many snowflakes to keep at once.
+	Max int
+	// Where to listen for SOCKS connections; any free loopback port if
+	// empty.
+	SocksAddr string
+	// How many snowflakes to keep connected ahead of time.
+	Min int
+	// Whether to carry all connections over a single set of snowflakes.
+	Multiplex bool
+}
+
+// NewConfig returns a Config with the defaults of snowflake-client, for the
+// app to fill in the broker and the ICE servers.
+func NewConfig() *Config {
+	return &Config{Max: 1}
+}
+
+// EventListener is told how the connection changes. The methods are called
+// from the goroutines of the client and must return quickly.
+type EventListener interface {
+	// A rendezvous with the broker started to catch the snowflake id.
+	OnRendezvousStarted(id string)
+	// The snowflake id connected, and can carry traffic.
+	OnPeerConnected(id string)
+	// The connected snowflake id was closed.
+	OnPeerLost(id string)
+	// The first snowflake connected: traffic can go through.
+	OnBootstrapped()
+	// A connection could not be carried.
+	OnError(message string)
+}
+
+// listenerSink adapts an EventListener to a snowflakeclient.EventSink.
+type listenerSink struct {
+	EventListener
+}
+
+func (s listenerSink) OnError(err error) {
+	s.EventListener.OnError(err.Error())
+}
+
+// Client is a running snowflake client.
+type Client struct {
+	client *snowflakeclient.Client
+}
+
+// Start starts a client with config, telling listener, if not nil, how the
+// connection changes.
+func Start(config *Config, listener EventListener) (*Client, error) {
+	cfg := snowflakeclient.Config{
+		Dialer: snowflakeclient.DialerConfig{
+			BrokerURL:     config.BrokerURL,
+			Fronts:        config.Fronts,
+			ICEServers:    config.ICEServers,
+			AMPCache:      config.AMPCache,
+			Max:           config.Max,
+			ParallelDials: 1,
+			IdleTimeout:   sf.SnowflakeTimeout,
+			Retry:         sf.RetryPolicy{Backoff: sf.DefaultBackoff},
+		},
+		SocksAddr: config.SocksAddr,
+		Min:       config.Min,
+		Multiplex: config.Multiplex,
+	}
+	if listener != nil {
+		cfg.Events = listenerSink{listener}
+	}
+	client, err := snowflakeclient.Start(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{client}, nil
+}
+
+// SocksAddr returns the address the client accepts SOCKS connections at, as
+// host:port.
+func (c *Client) SocksAddr() string {
+	return c.client.SocksAddr().String()
+}
+
+// NATType returns the NAT type the broker is told about.
+func (c *Client) NATType() string {
+	return c.client.NATType()
+}
+
+// StartOver catches new snowflakes and probes the NAT type again. The app
+// calls it when the device changes networks.
+func (c *Client) StartOver() {
+	c.client.StartOver()
+}
+
+// Stop closes the connections and stops the client.
+func (c *Client) Stop() {
+	c.client.Stop()
+}
@@ -0,0 +1,37 @@
+package snowflakemobile
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+type errorListener struct {
+	EventListener
+	message string
+}
+
+func (l *errorListener) OnError(message string) {
+	l.message = message
+}
+
+func TestStart(t *testing.T) {
+	config := NewConfig()
+	config.BrokerURL = "https://broker.example/"
+	client, err := Start(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	if addr := client.SocksAddr(); !strings.HasPrefix(addr, "127.0.0.1:") {
+		t.Errorf("SOCKS address %q is not a loopback one", addr)
+	}
+}
+
+func TestListenerSink(t *testing.T) {
+	l := &errorListener{}
+	listenerSink{l}.OnError(errors.New("no proxies"))
+	if l.message != "no proxies" {
+		t.Errorf("got error message %q", l.message)
+	}
+}